@@ -2,6 +2,7 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -24,6 +25,8 @@ var (
 	p, q  float32
 	out   string
 	debug bool
+	iface string
+	bind  string
 )
 
 var rootCmd = &cobra.Command{
@@ -50,6 +53,10 @@ var rootCmd = &cobra.Command{
 		if s {
 			log.Printf("start file server for dir %v\n", files[0])
 			server := rftp.NewServer()
+			if err := bindConn(server.Conn); err != nil {
+				log.Printf("Can not bind: %s", err)
+				return
+			}
 			if p != -1 || q != -1 {
 				lossSim := rftp.NewMarkovLossSimulator(p, q)
 				server.Conn.LossSim(lossSim)
@@ -76,16 +83,17 @@ var rootCmd = &cobra.Command{
 		hs := fmt.Sprintf("%v:%v", host, t)
 		log.Printf("running client request to host '%v' for files %v\n", hs, files)
 
-		var client rftp.Client
+		conn := rftp.NewUDPConnection()
+		if err := bindConn(conn); err != nil {
+			log.Printf("Can not bind: %s", err)
+			return
+		}
 		if p != -1 || q != -1 {
 			lossSim := rftp.NewMarkovLossSimulator(p, q)
-			conn := rftp.NewUDPConnection()
 			conn.LossSim(lossSim)
-			client = rftp.Client{Conn: conn}
 			rand.Seed(time.Now().UTC().UnixNano())
-		} else {
-			client = rftp.Client{Conn: rftp.NewUDPConnection()}
 		}
+		client := rftp.Client{Conn: conn}
 
 		reqs, err := client.Request(hs, files)
 		if err != nil {
@@ -136,6 +144,20 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+// bindConn binds conn to the interface or address given by flags.
+func bindConn(conn interface {
+	BindAddr(string) error
+	BindInterface(string) error
+}) error {
+	if iface != "" {
+		return conn.BindInterface(iface)
+	}
+	if bind != "" {
+		return conn.BindAddr(bind)
+	}
+	return nil
+}
+
 type progressReader struct {
 	req  *rftp.FileResponse
 	done int64
@@ -192,13 +214,17 @@ func directoryHandler(dirname string) (rftp.FileHandler, error) {
 		return nil, err
 	}
 
-	return func(name string) (*io.SectionReader, error) {
+	return func(ctx context.Context, name string) (*io.SectionReader, error) {
 		for _, f := range files {
 			if f.path == name {
 				file, err := os.Open(filepath.Join(dirname, f.path))
 				if err != nil {
 					return nil, err
 				}
+				go func() {
+					<-ctx.Done()
+					file.Close()
+				}()
 				if !debug {
 					fmt.Printf("handling file: %v, size: %v\n", file.Name(), byteCountIEC(f.info.Size()))
 				}
@@ -244,6 +270,10 @@ only one is specified, assume p=q; if neither is specified assume no loss`)
 		`specify the directory in which the requested files are going to be stored;
 set to '-' to redirect file content to stdout`)
 	rootCmd.Flags().BoolVarP(&debug, "v", "v", false, "print debug output")
+	rootCmd.Flags().StringVarP(&iface, "interface", "i", "",
+		"bind to the first IPv4 address of the given network interface")
+	rootCmd.Flags().StringVarP(&bind, "bind", "b", "",
+		"bind to the given local address")
 
 	rootCmd.Flags().SortFlags = false
 	rootCmd.PersistentFlags().SortFlags = false
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/hendrikcech/rft/rftp"
+	"github.com/spf13/cobra"
+)
+
+var regionSize int
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify <host> <file>",
+	Short: "Verify a downloaded file and fetch only its corrupted regions again",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		host := args[0]
+		name := args[1]
+
+		if !debug {
+			log.SetOutput(ioutil.Discard)
+		}
+
+		path := filepath.Join(out, name)
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			fmt.Printf("Can't open %s: %s\n", path, err)
+			return
+		}
+		defer f.Close()
+
+		conn := rftp.NewUDPConnection()
+		if err := bindConn(conn); err != nil {
+			fmt.Printf("Can not bind: %s\n", err)
+			return
+		}
+		client := rftp.Client{Conn: conn, RegionSize: regionSize}
+
+		hs := fmt.Sprintf("%v:%v", host, t)
+		res, err := client.Repair(hs, name, f)
+		if err != nil {
+			fmt.Printf("err: %v\n", err)
+			return
+		}
+		if err := f.Truncate(int64(res.Size)); err != nil {
+			fmt.Printf("Can't truncate %s: %s\n", path, err)
+			return
+		}
+		fmt.Printf("%v of %v regions fetched again\n", len(res.Refetched), res.Regions)
+	},
+}
+
+func init() {
+	verifyCmd.Flags().IntVarP(&t, "port", "t", 2020, "specify the port number to use")
+	verifyCmd.Flags().StringVarP(&out, "out", "o", ".",
+		"specify the directory in which the file to verify is stored")
+	verifyCmd.Flags().IntVar(&regionSize, "region-size", 1<<20,
+		"size of the compared regions in bytes, a multiple of the chunk size")
+	verifyCmd.Flags().BoolVarP(&debug, "v", "v", false, "print debug output")
+	verifyCmd.Flags().StringVarP(&iface, "interface", "i", "",
+		"bind to the first IPv4 address of the given network interface")
+	verifyCmd.Flags().StringVarP(&bind, "bind", "b", "",
+		"bind to the given local address")
+	rootCmd.AddCommand(verifyCmd)
+}
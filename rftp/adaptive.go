@@ -0,0 +1,100 @@
+package rftp
+
+import "time"
+
+const (
+	// adaptiveMinChunks is the number of chunks, which must have been sent
+	// since the last change, before the chunk size is adapted again.
+	adaptiveMinChunks = 32
+
+	// adaptiveRTTs is the number of RTTs, which must have passed since the
+	// last change, so that the loss of the current size was observed.
+	adaptiveRTTs = 4
+
+	// The chunk size is halved above adaptiveShrinkLoss and doubled below
+	// adaptiveGrowLoss, both in retransmissions per sent chunk.
+	adaptiveShrinkLoss = 0.05
+	adaptiveGrowLoss   = 0.01
+)
+
+// AdaptiveChunkSize configures chunk sizes, which adapt to the loss observed on
+// a connection. Lost small chunks cost less to resend, while large chunks
+// carry less overhead on clean paths. The size only changes between files and
+// is announced in the metadata of each file.
+type AdaptiveChunkSize struct {
+	// Min and Max bound the chunk size in bytes. Max defaults to the largest
+	// chunk size clients may request, see Server.MaxChunkSize, and is reduced
+	// to it.
+	Min int
+	Max int
+}
+
+// chunkSizer adapts the chunk size of a connection.
+type chunkSizer struct {
+	min, max int
+	size     int
+	now      func() time.Time
+
+	// sent and resent are the chunks sent and resent before the last change.
+	sent    int
+	resent  int
+	changed time.Time
+}
+
+// newChunkSizer returns a sizer, which starts at size and stays within the
+// bounds of a and below max, the negotiated maximum chunk size.
+func newChunkSizer(a *AdaptiveChunkSize, size, max int) *chunkSizer {
+	s := &chunkSizer{min: a.Min, max: a.Max, now: time.Now}
+	if s.min < minChunkSize {
+		s.min = minChunkSize
+	}
+	if s.max <= 0 || s.max > max {
+		s.max = max
+	}
+	s.size = s.clamp(size)
+	return s
+}
+
+func (s *chunkSizer) clamp(size int) int {
+	if size < s.min {
+		return s.min
+	}
+	if size > s.max {
+		return s.max
+	}
+	return size
+}
+
+// adapt returns the chunk size for the next file given the total number of
+// sent and resent chunks and the mean RTT of the connection.
+func (s *chunkSizer) adapt(sent, resent int, rtt time.Duration) int {
+	if rtt <= 0 {
+		rtt = defaultRTT
+	}
+	now := s.now()
+	window := sent - s.sent
+	if window < adaptiveMinChunks || now.Sub(s.changed) < adaptiveRTTs*rtt {
+		return s.size
+	}
+	loss := float64(resent-s.resent) / float64(window)
+	switch {
+	case loss > adaptiveShrinkLoss:
+		s.size = s.clamp(s.size / 2)
+	case loss < adaptiveGrowLoss:
+		s.size = s.clamp(s.size * 2)
+	}
+	s.sent = sent
+	s.resent = resent
+	s.changed = now
+	return s.size
+}
+
+// nextChunkSize returns the chunk size for the next file of the connection.
+func (c *clientConnection) nextChunkSize() int {
+	if c.chunkSizer == nil {
+		return c.chunkSize
+	}
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.chunkSizer.adapt(c.state.chunksSent, c.state.retransmissions, c.state.rtts.stats().Mean)
+}
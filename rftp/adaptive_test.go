@@ -0,0 +1,61 @@
+package rftp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveChunkSize(t *testing.T) {
+	now := time.Now()
+	c := &clientConnection{
+		chunkSize:  1024,
+		chunkSizer: newChunkSizer(&AdaptiveChunkSize{Min: 256, Max: 4096}, 1024, maxChunkSize),
+	}
+	c.chunkSizer.now = func() time.Time { return now }
+
+	// send and resend chunks at the given loss rate for one adaptation window
+	send := func(chunks int, loss float64) int {
+		c.state.chunksSent += chunks
+		c.state.retransmissions += int(float64(chunks) * loss)
+		now = now.Add(adaptiveRTTs * defaultRTT)
+		return c.nextChunkSize()
+	}
+
+	if size := c.nextChunkSize(); size != 1024 {
+		t.Fatalf("started at %v bytes, want 1024", size)
+	}
+	for _, step := range []struct {
+		loss float64
+		want int
+	}{
+		{0.2, 512},
+		{0.2, 256},
+		{0.2, 256},
+		{0.03, 256},
+		{0, 512},
+		{0, 1024},
+		{0, 2048},
+		{0, 4096},
+		{0, 4096},
+	} {
+		if size := send(100, step.loss); size != step.want {
+			t.Fatalf("got %v bytes at %v loss, want %v", size, step.loss, step.want)
+		}
+	}
+
+	// too few chunks don't tell the loss rate
+	if size := send(10, 0.5); size != 4096 {
+		t.Errorf("adapted to %v bytes after 10 chunks", size)
+	}
+}
+
+func TestAdaptiveChunkSizeDefaultMax(t *testing.T) {
+	s := NewServer()
+	s.MaxChunkSize = 2048
+	for _, a := range []AdaptiveChunkSize{{}, {Max: 8192}} {
+		sizer := newChunkSizer(&a, 1024, s.chunkSizeLimit())
+		if sizer.max != 2048 {
+			t.Errorf("max %v grows to %v bytes, want the negotiated 2048", a.Max, sizer.max)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package rftp
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// AllowlistFileHandler passes only the names matching an allowed pattern to
+// inner. Other names are denied with os.ErrPermission, which clients receive
+// as access denied, so the served files are exactly the listed ones. Patterns
+// have the syntax of path.Match, a pattern without metacharacters allows its
+// name only. Malformed patterns match no name. Names, which aren't clean or
+// contain a ".." element, are denied before matching, so that wildcards can't
+// reach outside the listed directories.
+func AllowlistFileHandler(inner FileHandler, allowed []string) FileHandler {
+	patterns := append([]string{}, allowed...)
+	return func(ctx context.Context, name string) (*io.SectionReader, error) {
+		if path.Clean(name) != name || hasDotDot(name) {
+			return nil, os.ErrPermission
+		}
+		for _, p := range patterns {
+			if ok, err := path.Match(p, name); ok && err == nil {
+				return inner(ctx, name)
+			}
+		}
+		return nil, os.ErrPermission
+	}
+}
+
+// hasDotDot reports whether the slash-separated name has a ".." element.
+func hasDotDot(name string) bool {
+	for _, e := range strings.Split(name, "/") {
+		if e == ".." {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package rftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAllowlistFileHandler(t *testing.T) {
+	files := map[string][]byte{
+		"public":           testData(2000),
+		"logs/today":       testData(300),
+		"secret":           testData(10),
+		"logs/nested/deep": testData(10),
+	}
+	s := NewServer()
+	s.SetFileHandler(AllowlistFileHandler(bytesHandler(files), []string{"public", "logs/*"}))
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	names := []string{"public", "logs/today", "secret", "logs/nested/deep"}
+	rs, err := c.Request(addr, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names[:2] {
+		got, err := ioutil.ReadAll(rs[i])
+		if err != nil || rs[i].Err != nil || !bytes.Equal(got, files[name]) {
+			t.Errorf("%v: received %v of %v bytes: %v, %v", name, len(got), len(files[name]), err, rs[i].Err)
+		}
+	}
+	for i, name := range names[2:] {
+		r := rs[i+2]
+		ioutil.ReadAll(r)
+		if r.Err == nil || !strings.Contains(r.Err.Error(), accessDenied.String()) {
+			t.Errorf("%v: got error %v, want status %v", name, r.Err, accessDenied)
+		}
+	}
+}
+
+func TestAllowlistDeniesTraversal(t *testing.T) {
+	var passed []string
+	inner := func(_ context.Context, name string) (*io.SectionReader, error) {
+		passed = append(passed, name)
+		return io.NewSectionReader(bytes.NewReader(nil), 0, 0), nil
+	}
+	h := AllowlistFileHandler(inner, []string{"logs/*", "*"})
+	for _, name := range []string{"..", "logs/..", "logs/../secret", "./public", "logs//today", "/public"} {
+		if _, err := h(context.Background(), name); !errors.Is(err, os.ErrPermission) {
+			t.Errorf("%q: got error %v, want %v", name, err, os.ErrPermission)
+		}
+	}
+	if _, err := h(context.Background(), "logs/today"); err != nil {
+		t.Errorf("clean name denied: %v", err)
+	}
+	if len(passed) != 1 || passed[0] != "logs/today" {
+		t.Errorf("passed %q to the inner handler, want only the clean name", passed)
+	}
+}
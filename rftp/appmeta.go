@@ -0,0 +1,43 @@
+package rftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// maxAppMetadataSize is the maximum size of application metadata in bytes. It
+// is carried in a single option.
+const maxAppMetadataSize = math.MaxUint8
+
+type appMetadataKey struct{}
+
+// appMetadata holds the application metadata set by a FileHandler.
+type appMetadata struct {
+	value []byte
+}
+
+// withAppMetadata returns a context for a FileHandler call, in which
+// SetAppMetadata stores to the returned holder.
+func withAppMetadata(ctx context.Context) (context.Context, *appMetadata) {
+	am := &appMetadata{}
+	return context.WithValue(ctx, appMetadataKey{}, am), am
+}
+
+// SetAppMetadata attaches md, e.g. a content type, to the file opened by the
+// FileHandler, which was called with ctx. The client receives it with the
+// file's metadata, see FileResponse.AppMetadata, the protocol doesn't
+// interpret it. It fails, if md is larger than 255 bytes or ctx doesn't belong
+// to a FileHandler call.
+func SetAppMetadata(ctx context.Context, md []byte) error {
+	am, ok := ctx.Value(appMetadataKey{}).(*appMetadata)
+	if !ok {
+		return errors.New("context doesn't belong to a file handler call")
+	}
+	if len(md) > maxAppMetadataSize {
+		return fmt.Errorf("application metadata too large: %d bytes", len(md))
+	}
+	am.value = append([]byte{}, md...)
+	return nil
+}
@@ -0,0 +1,43 @@
+package rftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestAppMetadata(t *testing.T) {
+	files := bytesHandler(map[string][]byte{"file": testData(3000)})
+	s := NewServer()
+	s.SetFileHandler(func(ctx context.Context, name string) (*io.SectionReader, error) {
+		if err := SetAppMetadata(ctx, []byte("text/plain; v2")); err != nil {
+			t.Error(err)
+		}
+		return files(ctx, name)
+	})
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	rs, err := c.Request(addr, []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(rs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got := rs[0].AppMetadata(); !bytes.Equal(got, []byte("text/plain; v2")) {
+		t.Errorf("got application metadata %q", got)
+	}
+}
+
+func TestSetAppMetadataErrors(t *testing.T) {
+	if err := SetAppMetadata(context.Background(), []byte("x")); err == nil {
+		t.Error("set application metadata outside of a file handler call")
+	}
+	ctx, _ := withAppMetadata(context.Background())
+	if err := SetAppMetadata(ctx, make([]byte, maxAppMetadataSize+1)); err == nil {
+		t.Error("set oversized application metadata")
+	}
+}
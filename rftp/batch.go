@@ -0,0 +1,160 @@
+package rftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	// maxBatchSize is the maximum size in bytes of the body of a metadata
+	// batch, so that batches fit into a datagram on common paths.
+	maxBatchSize = 1200
+
+	// metadataBatchDelay is the longest time metadata waits for more metadata
+	// to be sent in the same batch.
+	metadataBatchDelay = 5 * time.Millisecond
+)
+
+// metadataBatch is the body of a metadata message with optionMetadataBatch,
+// which carries the metadata of several files. Each entry is a complete
+// metadata message prefixed by its length as uint16.
+type metadataBatch struct {
+	entries [][]byte
+}
+
+func (b metadataBatch) MarshalBinary() ([]byte, error) {
+	bs := []byte{}
+	for _, e := range b.entries {
+		if len(e) > math.MaxUint16 {
+			return nil, fmt.Errorf("batch entry too long: %d bytes", len(e))
+		}
+		bs = append(bs, 0, 0)
+		binary.BigEndian.PutUint16(bs[len(bs)-2:], uint16(len(e)))
+		bs = append(bs, e...)
+	}
+	return bs, nil
+}
+
+func (b *metadataBatch) UnmarshalBinary(data []byte) error {
+	b.entries = nil
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return errors.New("truncated batch entry length")
+		}
+		n := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if len(data) < n {
+			return fmt.Errorf("batch entry of %d bytes truncated to %d bytes", n, len(data))
+		}
+		b.entries = append(b.entries, data[:n])
+		data = data[n:]
+	}
+	return nil
+}
+
+// size returns the encoded size of b.
+func (b *metadataBatch) size() int {
+	n := 0
+	for _, e := range b.entries {
+		n += 2 + len(e)
+	}
+	return n
+}
+
+// metadataBatcher collects metadata of a connection, which is sent in
+// batches.
+type metadataBatcher struct {
+	c     *clientConnection
+	batch metadataBatch
+	// flush fires once the first metadata of the batch waited for
+	// metadataBatchDelay, nil while the batch is empty.
+	flush <-chan time.Time
+}
+
+// add appends md to the batch and sends the batch, if it's full or md belongs
+// to the last requested file. It reports whether a datagram was sent.
+func (b *metadataBatcher) add(md *serverMetaData, lastAck uint8) (bool, error) {
+	b.c.cacheLock.Lock()
+	b.c.metadataCache[md.fileIndex] = md
+	b.c.cacheLock.Unlock()
+
+	entry, err := marshalMsg(lastAck, *md, md.options...)
+	if err != nil {
+		return false, err
+	}
+	if 2+len(entry) > maxBatchSize {
+		// too large for any batch
+		if err := b.send(lastAck); err != nil {
+			return true, err
+		}
+		return true, b.c.sendMetadata(md, lastAck)
+	}
+	sent := false
+	if b.batch.size()+2+len(entry) > maxBatchSize {
+		sent = true
+		if err := b.send(lastAck); err != nil {
+			return sent, err
+		}
+	}
+	b.batch.entries = append(b.batch.entries, entry)
+	if b.flush == nil {
+		b.flush = b.c.clock().NewTimer(metadataBatchDelay).C()
+	}
+	if int(md.fileIndex) == len(b.c.req.files)-1 {
+		return true, b.send(lastAck)
+	}
+	return sent, nil
+}
+
+// send sends the collected metadata, if any.
+func (b *metadataBatcher) send(lastAck uint8) error {
+	if len(b.batch.entries) == 0 {
+		return nil
+	}
+	log.Printf("sending batch of %v metadata\n", len(b.batch.entries))
+	err := sendAckTo(b.c.socket, lastAck, b.batch, option{otype: optionMetadataBatch})
+	b.batch.entries = nil
+	b.flush = nil
+	return err
+}
+
+// handleMetadataBatch handles the metadata of a batch one at a time.
+func (c *Client) handleMetadataBatch(w io.Writer, p *packet) {
+	b := metadataBatch{}
+	if err := b.UnmarshalBinary(p.data); err != nil {
+		log.Printf("failed to parse metadata batch: %v\n", err)
+		if c.Strict {
+			c.violation(w, p.remoteAddr, p.data, err)
+		}
+		return
+	}
+	for _, e := range b.entries {
+		h := &msgHeader{}
+		err := h.UnmarshalBinary(e)
+		if err == nil && h.msgType != msgServerMetadata {
+			err = fmt.Errorf("unexpected message type %d in metadata batch", h.msgType)
+		}
+		if _, ok := findOption(h.options, optionMetadataBatch); err == nil && ok {
+			err = errors.New("nested metadata batch")
+		}
+		if err != nil {
+			log.Printf("dropped metadata batch entry: %v\n", err)
+			if c.Strict {
+				c.violation(w, p.remoteAddr, p.data, err)
+				return
+			}
+			continue
+		}
+		c.handleMetadata(w, &packet{
+			os:         h.options,
+			data:       e[h.hdrLen:],
+			ackNum:     p.ackNum,
+			remoteAddr: p.remoteAddr,
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package rftp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestMetadataBatch(t *testing.T) {
+	const n = 10
+	files := map[string][]byte{}
+	names := make([]string, n)
+	fds := make([]fileDescriptor, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("file%v", i)
+		files[names[i]] = testData(100 + i)
+		fds[i] = fileDescriptor{0, names[i]}
+	}
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(files))
+	addr := startServer(t, s)
+
+	t.Run("datagrams", func(t *testing.T) {
+		conn := dialServer(t, addr)
+		defer conn.Close()
+		if err := sendTo(conn, clientRequest{files: fds}, option{otype: optionMetadataBatch}); err != nil {
+			t.Fatal(err)
+		}
+
+		received := map[uint16]bool{}
+		datagrams := 0
+		for len(received) < n {
+			b := metadataBatch{}
+			if err := b.UnmarshalBinary(readMsg(t, conn, msgServerMetadata)); err != nil {
+				t.Fatal(err)
+			}
+			datagrams++
+			for _, e := range b.entries {
+				h := &msgHeader{}
+				if err := h.UnmarshalBinary(e); err != nil {
+					t.Fatal(err)
+				}
+				md := serverMetaData{}
+				if err := md.UnmarshalBinary(e[h.hdrLen:]); err != nil {
+					t.Fatal(err)
+				}
+				received[md.fileIndex] = true
+			}
+		}
+		if datagrams >= n {
+			t.Errorf("metadata of %v files arrived in %v datagrams", n, datagrams)
+		}
+	})
+
+	t.Run("client", func(t *testing.T) {
+		c := Client{Conn: NewUDPConnection(), BatchMetadata: true}
+		rs, err := c.Request(addr, names)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i, r := range rs {
+				got, err := ioutil.ReadAll(r)
+				if err != nil || len(got) != len(files[names[i]]) {
+					t.Errorf("received %v bytes of %v: %v", len(got), names[i], err)
+				}
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("transfer didn't complete")
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package rftp
+
+import "io"
+
+// defaultReadBlockSize is the size of reads from files of known size, if
+// Server.ReadBlockSize isn't set.
+const defaultReadBlockSize = 64 * 1024
+
+// blockReader reads src in blocks of a fixed size and serves the reads of
+// chunks from the last block. Disk reads stay large, while chunks may be
+// small. Reads must be sequential to benefit, others refill the block.
+type blockReader struct {
+	src *io.SectionReader
+	// Blocks are never read beyond size. Section readers turn short reads
+	// at their end into io.EOF.
+	size  int64
+	block []byte
+	// start is the offset of the block in src, -1 before the first read.
+	start int64
+	// n is the number of valid bytes in block and err the error of the read
+	// which filled it.
+	n   int
+	err error
+}
+
+func newBlockReader(src *io.SectionReader, size int) *blockReader {
+	return &blockReader{src: src, size: src.Size(), block: make([]byte, size), start: -1}
+}
+
+func (b *blockReader) ReadAt(p []byte, off int64) (int, error) {
+	if b.start < 0 || off < b.start || off > b.start+int64(b.n) ||
+		(off == b.start+int64(b.n) && b.err == nil) {
+		if off >= b.size {
+			return 0, io.EOF
+		}
+		block := b.block
+		if rest := b.size - off; rest < int64(len(block)) {
+			block = block[:rest]
+		}
+		b.n, b.err = readChunk(b.src, block, off)
+		b.start = off
+	}
+	n := copy(p, b.block[off-b.start:b.n])
+	if n < len(p) && b.err != nil {
+		return n, b.err
+	}
+	return n, nil
+}
+
+// readBlocks wraps src of a file of known size in a blockReader, unless its
+// chunks are at least as large as a block.
+func (c *clientConnection) readBlocks(src *io.SectionReader, chunkSize int) io.ReaderAt {
+	size := c.readBlockSize
+	if size <= 0 {
+		size = defaultReadBlockSize
+	}
+	if size <= chunkSize {
+		return src
+	}
+	return newBlockReader(src, size)
+}
@@ -0,0 +1,86 @@
+package rftp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// countingReaderAt counts the reads from r.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.r.ReadAt(p, off)
+}
+
+// readChunks reads r in chunks of chunkSize like a connection does.
+func readChunks(r io.ReaderAt, chunkSize int) ([]byte, error) {
+	got := []byte{}
+	for off := int64(0); ; off += int64(chunkSize) {
+		buf := make([]byte, chunkSize)
+		n, err := readChunk(r, buf, off)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			return got, nil
+		} else if err != nil {
+			return got, err
+		}
+	}
+}
+
+func TestBlockReader(t *testing.T) {
+	data := testData(10*1024 + 100)
+	src := &countingReaderAt{r: bytes.NewReader(data)}
+	r := newBlockReader(io.NewSectionReader(src, 0, int64(len(data))), 4096)
+
+	got, err := readChunks(r, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("read %v bytes differing from the source", len(got))
+	}
+	if src.reads != 3 {
+		t.Errorf("got %v reads from the source, want 3", src.reads)
+	}
+}
+
+// BenchmarkReadBlocks compares the reads from a file, i.e. syscalls, with
+// chunks read directly and sliced from blocks.
+func BenchmarkReadBlocks(b *testing.B) {
+	f, err := ioutil.TempFile("", "rftp")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	const size = 4 * 1024 * 1024
+	if _, err := f.Write(testData(size)); err != nil {
+		b.Fatal(err)
+	}
+
+	for name, blockSize := range map[string]int{"coupled": 0, "decoupled": 1024 * 1024} {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(size)
+			reads := 0
+			for i := 0; i < b.N; i++ {
+				src := &countingReaderAt{r: f}
+				var r io.ReaderAt = io.NewSectionReader(src, 0, size)
+				if blockSize > 0 {
+					r = newBlockReader(io.NewSectionReader(src, 0, size), blockSize)
+				}
+				if _, err := readChunks(r, defaultChunkSize); err != nil {
+					b.Fatal(err)
+				}
+				reads += src.reads
+			}
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
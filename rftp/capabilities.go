@@ -0,0 +1,205 @@
+package rftp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"time"
+)
+
+// protocolVersion is the version sent in the header of all messages.
+const protocolVersion = 1
+
+// Feature is an optional protocol feature.
+type Feature uint32
+
+const (
+	// FeatureEstimate is the support of estimate requests, see
+	// Client.Estimate.
+	FeatureEstimate Feature = 1 << iota
+	// FeatureGzip is the support of compressed transfers, see Client.Gzip.
+	FeatureGzip
+	// FeatureChunkSize is the support of requested chunk sizes, see
+	// Client.ChunkSize.
+	FeatureChunkSize
+	// FeatureOffset is the support of requested offsets, see
+	// Client.RequestFrom.
+	FeatureOffset
+	// FeatureNackOnly is the support of selective repeat, see
+	// Client.NackOnly.
+	FeatureNackOnly
+	// FeatureConnectionID is the support of connection IDs, see
+	// Client.ConnectionID.
+	FeatureConnectionID
+	// FeatureProfile is the support of transfer profiles, see Client.Profile.
+	FeatureProfile
+	// FeatureMetadataBatch is the support of batched metadata, see
+	// Client.BatchMetadata.
+	FeatureMetadataBatch
+	// FeatureRanges is the support of a chunk range per file, see
+	// Client.Recover.
+	FeatureRanges
+	// FeatureRegions is the support of region checksums and transfers of
+	// single regions, see Client.Repair.
+	FeatureRegions
+	// FeatureChecksums is the support of checksum algorithms per file, see
+	// FileRequest.Checksum.
+	FeatureChecksums
+	// FeatureByHash is the support of files requested by content, see
+	// FileRequest.Hash.
+	FeatureByHash
+	// FeatureReceipts is the support of delivery receipts, see
+	// Client.Receipts.
+	FeatureReceipts
+	// FeatureResumeTokens is the support of resume tokens, see
+	// Client.OnResumeToken. Servers only issue tokens, if they have a key.
+	FeatureResumeTokens
+	// FeatureTreeHash is the support of ChecksumTreeMD5, see
+	// FileRequest.Checksum.
+	FeatureTreeHash
+	// FeatureProbe is the support of bandwidth probes, see
+	// Client.ProbeBandwidth.
+	FeatureProbe
+)
+
+// serverFeatures are the features supported by Server.
+const serverFeatures = FeatureEstimate | FeatureGzip | FeatureChunkSize | FeatureOffset |
+	FeatureNackOnly | FeatureConnectionID | FeatureProfile |
+	FeatureMetadataBatch | FeatureRegions | FeatureRanges | FeatureChecksums |
+	FeatureByHash | FeatureReceipts | FeatureResumeTokens | FeatureTreeHash |
+	FeatureProbe
+
+// capabilitiesSize is the size of encoded Capabilities.
+const capabilitiesSize = 8
+
+// Capabilities describes the protocol version and the features of a server.
+type Capabilities struct {
+	Version  uint8
+	Features Feature
+	// MaxChunkSize is the largest chunk size in bytes, which clients may
+	// request.
+	MaxChunkSize int
+	// ChecksumSize is the size of the server's checksums in bytes. Clients
+	// must use a hash of the same size.
+	ChecksumSize int
+}
+
+// Supports reports whether all features f are supported.
+func (c *Capabilities) Supports(f Feature) bool {
+	return c.Features&f == f
+}
+
+// option encodes c as version, features, max. chunk size and checksum size.
+func (c *Capabilities) option() option {
+	value := make([]byte, capabilitiesSize)
+	value[0] = c.Version
+	binary.BigEndian.PutUint32(value[1:5], uint32(c.Features))
+	binary.BigEndian.PutUint16(value[5:7], uint16(c.MaxChunkSize))
+	value[7] = uint8(c.ChecksumSize)
+	return option{otype: optionCapabilities, value: value}
+}
+
+func parseCapabilities(o option) (*Capabilities, error) {
+	if len(o.value) < capabilitiesSize {
+		return nil, fmt.Errorf("capabilities too short: %v bytes", len(o.value))
+	}
+	return &Capabilities{
+		Version:      o.value[0],
+		Features:     Feature(binary.BigEndian.Uint32(o.value[1:5])),
+		MaxChunkSize: int(binary.BigEndian.Uint16(o.value[5:7])),
+		ChecksumSize: int(o.value[7]),
+	}, nil
+}
+
+// capabilities returns the capabilities of s.
+func (s *Server) capabilities() *Capabilities {
+	return &Capabilities{
+		Version:      protocolVersion,
+		Features:     serverFeatures,
+		MaxChunkSize: s.chunkSizeLimit(),
+		ChecksumSize: s.NewHash().Size(),
+	}
+}
+
+// Capabilities asks the server at host for its protocol version and features
+// without transferring files. Servers, which don't support the query, don't
+// respond.
+func (c *Client) Capabilities(ctx context.Context, host string) (*Capabilities, error) {
+	if err := c.Conn.connectTo(host); err != nil {
+		return nil, err
+	}
+
+	results := make(chan *Capabilities, 1)
+	c.Conn.handle(msgServerMetadata, handlerFunc(func(_ io.Writer, p *packet) {
+		o, ok := findOption(p.os, optionCapabilities)
+		if !ok {
+			return
+		}
+		caps, err := parseCapabilities(o)
+		if err != nil {
+			log.Printf("failed to parse capabilities: %v\n", err)
+			return
+		}
+		select {
+		case results <- caps:
+		default:
+		}
+	}))
+	go c.Conn.receive()
+	defer c.Conn.cclose(c.closeTimeout())
+
+	for try := 1; try <= 3; try++ {
+		err := c.Conn.send(clientRequest{}, option{otype: optionCapabilities})
+		if err != nil {
+			return nil, err
+		}
+		timeout := c.clock().NewTimer(time.Duration(math.Pow(2, float64(try))) * time.Second)
+		select {
+		case caps := <-results:
+			timeout.Stop()
+			return caps, nil
+		case <-ctx.Done():
+			timeout.Stop()
+			return nil, ctx.Err()
+		case <-timeout.C():
+		}
+	}
+	return nil, fmt.Errorf("capabilities request timed out %v times, aborting", 3)
+}
+
+// Negotiate turns off the options of c, which the server doesn't support, and
+// reduces the chunk size to the server's maximum. It fails, if the client
+// can't talk to the server at all.
+func (c *Client) Negotiate(caps *Capabilities) error {
+	if caps.Version != protocolVersion {
+		return fmt.Errorf("unsupported protocol version %v", caps.Version)
+	}
+	if caps.ChecksumSize != c.newHash().Size() {
+		return errors.New("checksum size doesn't match the server's")
+	}
+	if !caps.Supports(FeatureGzip) {
+		c.Gzip = false
+	}
+	if !caps.Supports(FeatureNackOnly) {
+		c.NackOnly = false
+	}
+	if !caps.Supports(FeatureConnectionID) {
+		c.ConnectionID = false
+	}
+	if !caps.Supports(FeatureProfile) {
+		c.Profile = ""
+	}
+	if !caps.Supports(FeatureMetadataBatch) {
+		c.BatchMetadata = false
+	}
+	if !caps.Supports(FeatureChunkSize) {
+		c.ChunkSize = 0
+	} else if c.ChunkSize > caps.MaxChunkSize {
+		c.ChunkSize = caps.MaxChunkSize
+	}
+	return nil
+}
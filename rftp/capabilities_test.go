@@ -0,0 +1,94 @@
+package rftp
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestCapabilitiesNegotiation(t *testing.T) {
+	data := bytes.Repeat([]byte("negotiated "), 1000)
+	s := NewServer()
+	s.MaxChunkSize = 512
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection(), Gzip: true, ChunkSize: 4096}
+	caps, err := c.Capabilities(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Capabilities{Version: 1, Features: serverFeatures, MaxChunkSize: 512, ChecksumSize: 16}
+	if *caps != want {
+		t.Fatalf("got capabilities %+v, want %+v", *caps, want)
+	}
+	if err := c.Negotiate(caps); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Gzip || c.ChunkSize != 512 {
+		t.Errorf("negotiated gzip %v and chunk size %v, want true and 512", c.Gzip, c.ChunkSize)
+	}
+
+	c.Conn = NewUDPConnection()
+	rs, err := c.Request(addr, []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) || rs[0].Err != nil {
+		t.Errorf("received %v of %v bytes: %v", len(got), len(data), rs[0].Err)
+	}
+}
+
+func TestNegotiateWithLimitedServer(t *testing.T) {
+	server := fakeServer(t)
+	defer server.Close()
+
+	c := Client{Conn: NewUDPConnection(), Gzip: true, NackOnly: true, ConnectionID: true, ChunkSize: 2048}
+	type result struct {
+		caps *Capabilities
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		caps, err := c.Capabilities(context.Background(), server.LocalAddr().String())
+		results <- result{caps, err}
+	}()
+
+	h, _, client := readFrom(t, server, msgClientRequest, time.Second)
+	if client == nil {
+		t.Fatal("no request received")
+	}
+	if _, ok := findOption(h.options, optionCapabilities); !ok {
+		t.Fatal("request doesn't ask for capabilities")
+	}
+	// an older server without selective repeat and connection IDs
+	caps := &Capabilities{Version: 1, Features: FeatureGzip | FeatureChunkSize, MaxChunkSize: 1024, ChecksumSize: 16}
+	w := responseWriter(func(bs []byte) (int, error) {
+		return server.WriteToUDP(bs, client)
+	})
+	if err := sendTo(w, serverMetaData{}, caps.option()); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-results
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if err := c.Negotiate(r.caps); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Gzip || c.NackOnly || c.ConnectionID || c.ChunkSize != 1024 {
+		t.Errorf("negotiated %+v, want gzip and a chunk size of 1024 only", c)
+	}
+
+	r.caps.ChecksumSize = 32
+	if err := c.Negotiate(r.caps); err == nil {
+		t.Error("negotiated with a mismatching checksum size")
+	}
+}
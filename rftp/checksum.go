@@ -0,0 +1,97 @@
+package rftp
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+)
+
+// ChecksumAlgorithm identifies the hash, by which a single file of a request
+// is verified, see FileRequest.Checksum.
+type ChecksumAlgorithm uint8
+
+const (
+	// ChecksumDefault is the hash of the server's NewHash and the client's
+	// NewHash, which must match.
+	ChecksumDefault ChecksumAlgorithm = iota
+	// ChecksumMD5 is MD5.
+	ChecksumMD5
+	// ChecksumSHA256 is SHA-256, for files, which must not be corrupted
+	// unnoticed.
+	ChecksumSHA256
+	// ChecksumCRC32 is CRC-32 with the IEEE polynomial, which is fast to
+	// compute for large files, but only detects accidental corruption.
+	ChecksumCRC32
+	// ChecksumTreeMD5 is an MD5 tree hash: the MD5 of the concatenated MD5
+	// digests of consecutive 1 MiB leaves of the file. The leaves are hashed in
+	// parallel, so that hashing very large files doesn't slow down reading them
+	// on multicore machines. Its digests differ from flat MD5 of the same file.
+	// Servers must support FeatureTreeHash.
+	ChecksumTreeMD5
+)
+
+func (a ChecksumAlgorithm) String() string {
+	switch a {
+	case ChecksumDefault:
+		return "default"
+	case ChecksumMD5:
+		return "md5"
+	case ChecksumSHA256:
+		return "sha256"
+	case ChecksumCRC32:
+		return "crc32"
+	case ChecksumTreeMD5:
+		return "md5-tree"
+	}
+	return fmt.Sprintf("unknown checksum algorithm %d", uint8(a))
+}
+
+// hash returns a new hash of a or def, if a is ChecksumDefault.
+func (a ChecksumAlgorithm) hash(def func() hash.Hash) (hash.Hash, error) {
+	switch a {
+	case ChecksumDefault:
+		return def(), nil
+	case ChecksumMD5:
+		return md5.New(), nil
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumCRC32:
+		return crc32.NewIEEE(), nil
+	case ChecksumTreeMD5:
+		return newTreeHash(md5.New, treeLeafSize), nil
+	}
+	return nil, fmt.Errorf("unknown checksum algorithm %d", uint8(a))
+}
+
+// checksumsOption returns the option selecting the checksum algorithms of the
+// files of a request, one byte per file in order.
+func checksumsOption(algs []ChecksumAlgorithm) option {
+	value := make([]byte, len(algs))
+	for i, a := range algs {
+		value[i] = uint8(a)
+	}
+	return option{otype: optionChecksums, value: value}
+}
+
+// checksums returns the checksum algorithms, which the options os of a
+// request of files files select. Without the option, all files use
+// ChecksumDefault.
+func checksums(os []option, files int) ([]ChecksumAlgorithm, error) {
+	algs := make([]ChecksumAlgorithm, files)
+	o, ok := findOption(os, optionChecksums)
+	if !ok {
+		return algs, nil
+	}
+	if len(o.value) != files {
+		return nil, fmt.Errorf("got %d checksum algorithms for %d files", len(o.value), files)
+	}
+	for i, v := range o.value {
+		algs[i] = ChecksumAlgorithm(v)
+		if _, err := algs[i].hash(md5.New); err != nil {
+			return nil, err
+		}
+	}
+	return algs, nil
+}
@@ -0,0 +1,56 @@
+package rftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestChecksumPerFile(t *testing.T) {
+	large, small := testData(50*1024+3), testData(300)
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"large": large, "small": small}))
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	rs, err := c.RequestFrom(addr, []FileRequest{
+		{Name: "large", Checksum: ChecksumCRC32},
+		{Name: "small", Checksum: ChecksumSHA256},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		data []byte
+		size int
+	}{{large, 4}, {small, 32}} {
+		got, err := ioutil.ReadAll(rs[i])
+		if err != nil || rs[i].Err != nil || !bytes.Equal(got, tc.data) {
+			t.Errorf("file %v: received %v of %v bytes: %v, %v", i, len(got), len(tc.data), err, rs[i].Err)
+		}
+		if n := len(rs[i].checksum); n != tc.size {
+			t.Errorf("file %v: got %v byte checksum, want %v bytes", i, n, tc.size)
+		}
+	}
+}
+
+func TestUnknownChecksumRejected(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10)}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}},
+		checksumsOption([]ChecksumAlgorithm{99}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := closeConnection{}
+	if err := cl.UnmarshalBinary(readMsg(t, conn, msgClose)); err != nil {
+		t.Fatal(err)
+	}
+	if cl.reason != unknownRequest {
+		t.Errorf("got close reason %v, want %v", cl.reason, unknownRequest)
+	}
+}
@@ -1,11 +1,20 @@
 package rftp
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"math"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,23 +27,243 @@ func Request(host string, files []string) ([]*FileResponse, error) {
 }
 
 type Client struct {
+	// dropped counts messages for files, which weren't requested. It's the
+	// first field to be aligned for atomic access.
+	dropped uint64
+
 	Conn connection
 	rtt  time.Duration
 
+	// NewHash returns the hash used to verify received files. It must match
+	// the server's hash. Defaults to MD5.
+	NewHash func() hash.Hash
+
+	// Strict makes the client close the connection with any packet that
+	// violates the protocol instead of dropping it. Meant for debugging.
+	Strict bool
+
+	// IgnoreMisdirected makes the client drop messages, which only clients
+	// send, instead of aborting with unknownRequest. The client receives them,
+	// if it's pointed at another client or itself.
+	IgnoreMisdirected bool
+
+	// Receipts makes the client confirm each file to the server, once it was
+	// read until io.EOF and its checksum matched, e.g. for auditing, see
+	// Server.OnReceipt. Receipts aren't retransmitted, they are a best effort
+	// signal. The connection is only closed after all files were read until
+	// their end. Servers without FeatureReceipts ignore them.
+	Receipts bool
+
+	// OnResumeToken makes the client ask the server for resume tokens and is
+	// called with each token it issues. A token resumes the transfer of the
+	// requested files at the chunks acknowledged when it was issued, see
+	// ResumeWithToken. Servers without a Server.ResumeTokenKey issue none.
+	OnResumeToken func(token []byte)
+
+	// OnFileComplete is called as soon as a file was received completely and
+	// its checksum matched, independently of the other files of the request,
+	// e.g. to process it before the rest arrived. Files are received through
+	// their FileResponse, so a file completes once it was read until io.EOF.
+	OnFileComplete func(index uint16, name string, checksum []byte)
+
+	// OnProgress is called whenever the frontier of a file advances.
+	OnProgress func(Progress)
+
+	// MaxNackBacklog is the number of missing chunks per file, which the
+	// client tracks and requests again. Once it's reached, further gaps are
+	// only detected after earlier ones are filled, and the client halves its
+	// advertised receive window to slow the server down. Defaults to 4096,
+	// negative values disable the limit.
+	MaxNackBacklog int
+
+	// NackTimeout is the time after which missing chunks, which were requested
+	// but didn't arrive, are requested again, since the ack requesting them may
+	// have been lost. Defaults to twice the RTT, at least 100ms and at most
+	// 500ms.
+	NackTimeout time.Duration
+
+	// MaxNacks is the number of times a missing chunk is requested, before the
+	// client gives up and closes the connection. The file fails with an error
+	// wrapping ErrGaveUp then. 0 means no limit.
+	MaxNacks int
+
+	// ChunkSize is the preferred chunk size in bytes. The server may reduce
+	// it. 0 uses the server's default, see Server.ChunkSize. The metadata of
+	// each file announces the chunk size used.
+	ChunkSize int
+
+	// Gzip requests the files gzip compressed as a whole. This compresses
+	// better than compressing single chunks, but requested offsets are
+	// ignored and files are always transferred from their start.
+	Gzip bool
+
+	// NackOnly requests selective repeat: Acks only request missing chunks
+	// instead of acknowledging received ones. This saves retransmissions on
+	// lossy links with long RTTs. The end of the transfer is confirmed by
+	// closing the connection. Servers, which don't support it, close the
+	// connection.
+	NackOnly bool
+
+	// ConnectionID makes the client identify its connection by a random ID
+	// instead of its address. Transfers survive address changes, e.g. by NAT
+	// rebinding, and clients behind one address don't collide.
+	ConnectionID bool
+
+	// Rand is the source of connection IDs. Defaults to crypto/rand.Reader,
+	// which tests may replace by a seeded source to make IDs reproducible.
+	Rand io.Reader
+
+	// Profile requests the congestion control and priority settings of the
+	// transfer, see Profile. Servers fall back to ProfileBulk for unknown
+	// profiles. Empty uses the server's default.
+	Profile Profile
+
+	// BatchMetadata lets the server send the metadata of several files in one
+	// datagram, which saves packets for many small files. The server must
+	// support FeatureMetadataBatch, see Negotiate.
+	BatchMetadata bool
+
+	// RegionSize is the size in bytes of the regions compared by Repair. It
+	// must be a multiple of the chunk size. Defaults to 1 MiB.
+	RegionSize int
+
+	// VerifyOffsets makes the client abort with protocolViolation, if the
+	// server sends a payload beyond the chunks announced by the file's
+	// metadata. Meant for tests and staging.
+	VerifyOffsets bool
+
+	// Preallocate makes Download reserve the size of each file in its writer
+	// before the first chunk is written, once the metadata announced it. This
+	// avoids fragmentation and fails early, if the disk is full. Files are
+	// allocated on disk, other writers with a Truncate method like *os.File
+	// are truncated. Content arriving before the size is held back, up to
+	// 1 MiB. Files, whose size is unknown until then, aren't preallocated.
+	Preallocate bool
+
+	// CloseTimeout is the time the client waits for in-flight packets to be
+	// handled when closing the connection. Defaults to one second.
+	CloseTimeout time.Duration
+
+	// Version is the protocol version the client prefers and advertises in
+	// its requests. If the server doesn't support it, the client downgrades
+	// to the newest older version the server supports and requests again.
+	// Defaults to the version of this package.
+	Version uint8
+
 	responses []*FileResponse
 	ack       chan uint8
 	err       chan struct{}
 	closeMsg  chan struct{}
 	done      chan uint16
 	stopAck   chan struct{}
+	closeOnce *sync.Once
+	closed    *closeState
 	start     time.Time
+	// clk is the source of time, the real clock if nil.
+	clk clock
+
+	// id is the connection ID of the current request, if ConnectionID is set.
+	id []byte
+	// version is the protocol version of the current request, see Version.
+	// downgraded is set, once the server rejected the request for its
+	// version and version was downgraded. Both are only written before the
+	// first response arrives.
+	version    uint8
+	downgraded bool
+	// token is the resume token presented by the current request, see
+	// ResumeWithToken.
+	token []byte
+	// limits are the numbers of chunks requested of all files or of each
+	// file, nil means no limit.
+	limits []uint64
+	// checksums are the checksum algorithms of the requested files, if any
+	// isn't ChecksumDefault.
+	checksums []ChecksumAlgorithm
+	// digests are the digests of the files requested by hash, if any is.
+	digests [][]byte
 }
 
 func (c *Client) Request(host string, files []string) ([]*FileResponse, error) {
+	fs := make([]FileRequest, len(files))
+	for i, f := range files {
+		fs[i] = FileRequest{Name: f}
+	}
+	return c.RequestFrom(host, fs)
+}
+
+// idSource returns the source of connection IDs.
+func (c *Client) idSource() io.Reader {
+	if c.Rand != nil {
+		return c.Rand
+	}
+	return rand.Reader
+}
+
+// clock returns the source of time of the client.
+func (c *Client) clock() clock {
+	return orRealClock(c.clk)
+}
 
+// RequestFrom requests files starting at the given chunk offsets. The server
+// may start a transfer before the requested offset, see
+// FileResponse.Offset. A request must name at least one file, servers close
+// connections requesting no files with unknownRequest.
+func (c *Client) RequestFrom(host string, files []FileRequest) ([]*FileResponse, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no files in request")
+	}
 	if len(files) > 65536 {
 		return nil, errors.New("too many files in request, use max. 65536 files per request")
 	}
+	c.version = c.Version
+	if c.version == 0 {
+		c.version = protocolVersion
+	}
+	if c.version > 0x0F {
+		return nil, fmt.Errorf("protocol version %d exceeds 4 bits", c.version)
+	}
+	c.downgraded = false
+
+	hashes := make([]hash.Hash, len(files))
+	c.checksums = nil
+	c.digests = nil
+	for i, f := range files {
+		h, err := f.Checksum.hash(c.newHash)
+		if err != nil {
+			return nil, fmt.Errorf("file %v: %w", f.Name, err)
+		}
+		hashes[i] = h
+		if f.Checksum != ChecksumDefault && c.checksums == nil {
+			c.checksums = make([]ChecksumAlgorithm, len(files))
+		}
+		if f.ChunkSums != nil && (f.Offset != 0 || c.Gzip) {
+			return nil, fmt.Errorf("file %d: chunk checksums require offset 0 and no gzip", i)
+		}
+		if f.Hash == nil {
+			continue
+		}
+		if len(f.Hash) != h.Size() {
+			return nil, fmt.Errorf("file %d: got %d byte hash, expected %d bytes for %v",
+				i, len(f.Hash), h.Size(), f.Checksum)
+		}
+		if f.Offset != 0 {
+			return nil, fmt.Errorf("file %d: files requested by hash start at offset 0", i)
+		}
+		if c.digests == nil {
+			c.digests = make([][]byte, len(files))
+		}
+		c.digests[i] = f.Hash
+	}
+	if c.checksums != nil || c.digests != nil {
+		if len(files) > math.MaxUint8 {
+			return nil, errors.New("checksum algorithms and hashes can be selected for max. 255 files per request")
+		}
+	}
+	if c.checksums != nil {
+		for i, f := range files {
+			c.checksums[i] = f.Checksum
+		}
+	}
 
 	fs := make([]fileDescriptor, len(files))
 	c.responses = make([]*FileResponse, len(files))
@@ -43,16 +272,62 @@ func (c *Client) Request(host string, files []string) ([]*FileResponse, error) {
 	c.closeMsg = make(chan struct{})
 	c.done = make(chan uint16, len(fs))
 	c.stopAck = make(chan struct{})
+	c.closeOnce = &sync.Once{}
+	c.closed = &closeState{}
+	c.id = nil
+	if c.ConnectionID {
+		c.id = make([]byte, connectionIDSize)
+		if _, err := io.ReadFull(c.idSource(), c.id); err != nil {
+			return nil, err
+		}
+	}
 
 	for i, f := range files {
-		fs[i] = fileDescriptor{0, f}
-		c.responses[i] = newFileResponse(f, uint16(i))
+		name := f.Name
+		if f.Hash != nil {
+			name = hex.EncodeToString(f.Hash)
+		}
+		fs[i] = fileDescriptor{f.Offset, name}
+		c.responses[i] = newFileResponse(name, uint16(i), hashes[i])
+		c.responses[i].digest = f.Hash
+		c.responses[i].chunkSums = f.ChunkSums
+		c.responses[i].chunkHash = c.newHash
+		c.responses[i].onProgress = c.OnProgress
+		c.responses[i].onComplete = c.OnFileComplete
+		c.responses[i].clk = c.clk
+		if c.MaxNackBacklog != 0 {
+			c.responses[i].maxBacklog = c.MaxNackBacklog
+		}
+		c.responses[i].maxNacks = c.MaxNacks
+		if c.Gzip {
+			c.responses[i].inflate()
+		}
+		if c.Receipts {
+			c.responses[i].onVerified = c.sendReceipt
+		}
+		if c.VerifyOffsets {
+			c.responses[i].limit = c.limit(i)
+			c.responses[i].onViolation = func(err error) {
+				log.Printf("offset verification failed: %v\n", err)
+				c.abort(protocolViolation, err)
+			}
+		}
 		go c.responses[i].write(c.done)
 	}
 
 	c.Conn.handle(msgServerMetadata, handlerFunc(c.handleMetadata))
 	c.Conn.handle(msgServerPayload, handlerFunc(c.handleServerPayload))
 	c.Conn.handle(msgClose, handlerFunc(c.handleClose))
+	c.Conn.handle(msgResumeToken, handlerFunc(c.handleResumeToken))
+	if !c.IgnoreMisdirected {
+		c.Conn.handle(msgClientRequest, c.misdirected(msgClientRequest))
+		c.Conn.handle(msgClientAck, c.misdirected(msgClientAck))
+		c.Conn.handle(msgReceipt, c.misdirected(msgReceipt))
+	}
+	c.Conn.handleUnsupported(c.unsupported)
+	if c.Strict {
+		c.Conn.handleViolation(c.violation)
+	}
 
 	if err := c.sendRequest(host, fs); err != nil {
 		return nil, err
@@ -61,16 +336,199 @@ func (c *Client) Request(host string, files []string) ([]*FileResponse, error) {
 	return c.responses, nil
 }
 
+// Estimate is the result of a dry-run request.
+type Estimate struct {
+	// Files is the number of files matched by the requested names.
+	Files int
+	// Size is the total size of all matched files in bytes.
+	Size uint64
+	// Checksums holds per requested name the checksum of the file, if the
+	// name matches a single file, whose checksum the server cached, see
+	// Server.Preload. Other entries are nil.
+	Checksums [][]byte
+}
+
+// Estimate asks the server for the number and total size of the files
+// matched by names, e.g. glob patterns, without transferring them.
+func (c *Client) Estimate(host string, names []string) (*Estimate, error) {
+	if len(names) > 65536 {
+		return nil, errors.New("too many files in request, use max. 65536 files per request")
+	}
+	if err := c.Conn.connectTo(host); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		index uint16
+		files int
+		size  uint64
+		sum   []byte
+	}
+	// Retries and duplicated packets may yield more results than names, so the
+	// handler must not block once Estimate returned.
+	results := make(chan result, len(names))
+	done := make(chan struct{})
+	c.Conn.handle(msgServerMetadata, handlerFunc(func(_ io.Writer, p *packet) {
+		md := serverMetaData{}
+		if err := md.UnmarshalBinary(p.data); err != nil {
+			log.Printf("failed to parse estimate: %v\n", err)
+			return
+		}
+		r := result{index: md.fileIndex, size: md.size}
+		if o, ok := findOption(p.os, optionFileCount); ok && len(o.value) == 4 {
+			r.files = int(binary.BigEndian.Uint32(o.value))
+		}
+		if _, ok := findOption(p.os, optionEstimate); ok {
+			r.sum = md.checkSum
+		}
+		select {
+		case results <- r:
+		case <-done:
+		}
+	}))
+	go c.Conn.receive()
+	defer c.Conn.cclose(c.closeTimeout())
+	// runs before cclose, which waits for the handler
+	defer close(done)
+
+	fs := make([]fileDescriptor, len(names))
+	for i, name := range names {
+		fs[i] = fileDescriptor{0, name}
+	}
+	received := map[uint16]result{}
+	for try := 1; try <= 3; try++ {
+		err := c.Conn.send(clientRequest{files: fs}, option{otype: optionEstimate})
+		if err != nil {
+			return nil, err
+		}
+		timeout := c.clock().NewTimer(time.Duration(math.Pow(2, float64(try))) * time.Second)
+	wait:
+		for len(received) < len(names) {
+			select {
+			case r := <-results:
+				if int(r.index) < len(names) {
+					received[r.index] = r
+				}
+			case <-timeout.C():
+				break wait
+			}
+		}
+		timeout.Stop()
+		if len(received) == len(names) {
+			e := &Estimate{Checksums: make([][]byte, len(names))}
+			for _, r := range received {
+				e.Files += r.files
+				e.Size += r.size
+				e.Checksums[r.index] = r.sum
+			}
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("estimate request timed out %v times, aborting", 3)
+}
+
+func (c *Client) closeTimeout() time.Duration {
+	if c.CloseTimeout > 0 {
+		return c.CloseTimeout
+	}
+	return defaultCloseTimeout
+}
+
+// withID appends the connection ID option to os, if the client uses one.
+func (c *Client) withID(os ...option) []option {
+	if c.id == nil {
+		return os
+	}
+	return append(os, option{otype: optionConnectionID, value: c.id})
+}
+
+func (c *Client) newHash() hash.Hash {
+	if c.NewHash != nil {
+		return c.NewHash()
+	}
+	return md5.New()
+}
+
+// limit returns the number of chunks requested of file index, 0 if all.
+// Compressed files aren't limited.
+func (c *Client) limit(index int) uint64 {
+	switch {
+	case c.Gzip || c.limits == nil:
+		return 0
+	case len(c.limits) == 1:
+		return c.limits[0]
+	case index < len(c.limits):
+		return c.limits[index]
+	}
+	return 0
+}
+
+// requestedChunkSize returns the chunk size of the request, 0 to leave it to
+// the server. Limits and chunk checksums count chunks of the default size, if
+// ChunkSize isn't set, so the request must not leave it to the server then.
+func (c *Client) requestedChunkSize() int {
+	size := c.ChunkSize
+	if size <= 0 {
+		if c.limits == nil && !c.hasChunkSums() {
+			return 0
+		}
+		size = defaultChunkSize
+	}
+	if size > maxChunkSize {
+		size = maxChunkSize
+	}
+	return size
+}
+
+// hasChunkSums returns whether any file of the request is verified by chunk
+// checksums.
+func (c *Client) hasChunkSums() bool {
+	for _, r := range c.responses {
+		if r.chunkSums != nil {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Client) sendRequest(host string, fs []fileDescriptor) error {
 	for i := 1; i <= 10; i++ {
 		if err := c.Conn.connectTo(host); err != nil {
 			return err
 		}
-		c.start = time.Now()
-		if err := c.Conn.send(clientRequest{
+		c.start = c.clock().Now()
+		os := []option{}
+		if c.Gzip {
+			os = append(os, option{otype: optionGzip})
+		}
+		if c.NackOnly {
+			os = append(os, option{otype: optionNackOnly})
+		}
+		if c.BatchMetadata {
+			os = append(os, option{otype: optionMetadataBatch})
+		}
+		if c.Profile != "" {
+			os = append(os, profileOption(c.Profile))
+		}
+		if c.limits != nil {
+			os = append(os, limitOptions(c.limits)...)
+		}
+		if c.checksums != nil {
+			os = append(os, checksumsOption(c.checksums))
+		}
+		if c.digests != nil {
+			os = append(os, byHashOption(c.digests))
+		}
+		if c.token != nil || c.OnResumeToken != nil {
+			os = append(os, resumeTokenOptions(c.token)...)
+		}
+		if size := c.requestedChunkSize(); size > 0 {
+			os = append(os, chunkSizeOption(size))
+		}
+		if err := c.Conn.send(versioned{c.version, clientRequest{
 			maxTransmissionRate: 0,
 			files:               fs,
-		}); err != nil {
+		}}, c.withID(os...)...); err != nil {
 			return err
 		}
 
@@ -86,6 +544,12 @@ func (c *Client) sendRequest(host string, fs []fileDescriptor) error {
 			c.Conn.cclose(0 * time.Second)
 			continue
 		}
+		if c.downgraded {
+			log.Printf("server rejected the protocol version, requesting again with version %v\n", c.version)
+			c.downgraded = false
+			c.Conn.cclose(0 * time.Second)
+			continue
+		}
 
 		go c.sendAcks(c.Conn)
 		go c.waitForCloseConnection()
@@ -100,56 +564,148 @@ func (c *Client) waitForCloseConnection() {
 	for {
 		select {
 		case i := <-c.done:
-			fr := c.responses[i]
-			if fr.Err != nil {
-				log.Printf("Transfer of file %v aborted: %s", i, fr.Err)
+			if err := c.responses[i].err(); err != nil {
+				log.Printf("Transfer of file %v aborted: %s", i, err)
 			}
 			done++
 			if done == len(c.responses) {
+				c.closeWith(donwloadFinished, false)
+				// tell the server, so that it doesn't wait for acks to time out
+				if err := c.Conn.send(closeConnection{reason: donwloadFinished}, c.withID()...); err != nil {
+					log.Printf("failed to send close: %v\n", err)
+				}
 				c.closeConnection()
 			}
 
 		case <-c.closeMsg:
 			c.closeConnection()
 		case <-c.err:
+			c.closeWith(timeout, false)
 			c.closeConnection()
 		}
 	}
 }
 
+// closeConnection stops the transfer of all files. Only the first call has an
+// effect.
 func (c *Client) closeConnection() {
-	c.stopAck <- struct{}{}
-	for _, r := range c.responses {
-		log.Printf("send abort to file writer: %v\n", r.index)
-		r.cc <- struct{}{}
+	c.closeWith(applicationClosed, false)
+	c.closeOnce.Do(func() {
+		close(c.stopAck)
+		for _, r := range c.responses {
+			log.Printf("send abort to file writer: %v\n", r.index)
+			close(r.cc)
+		}
+		c.Conn.cclose(c.closeTimeout())
+	})
+}
+
+// Open requests the file name from host and returns a reader, which delivers
+// the file's content in order as it is received. Read returns the transfer's
+// error instead of io.EOF, if the transfer fails or the checksum doesn't match.
+// Closing the reader or canceling ctx cancels the transfer.
+//
+// Streaming trades early access for deferred verification: the content is
+// delivered before the checksum of the whole file can be verified. Consumers,
+// which act on the content before the end of the stream, must check the error
+// of the final Read or of Close, which returns an error wrapping ErrChecksum,
+// if the content read didn't match the checksum.
+func (c *Client) Open(ctx context.Context, host, name string) (io.ReadCloser, error) {
+	type result struct {
+		rs  []*FileResponse
+		err error
+	}
+	requested := make(chan result, 1)
+	go func() {
+		rs, err := c.Request(host, []string{name})
+		requested <- result{rs, err}
+	}()
+
+	var r result
+	select {
+	case r = <-requested:
+	case <-ctx.Done():
+		go func() {
+			if r := <-requested; r.err == nil {
+				c.closeConnection()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+	if r.err != nil {
+		return nil, r.err
 	}
-	c.Conn.cclose(1 * time.Second)
+
+	f := &openFile{c: c, fr: r.rs[0], closed: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.closeConnection()
+		case <-f.closed:
+		}
+	}()
+	return f, nil
+}
+
+// openFile is the reader returned by Open.
+type openFile struct {
+	c      *Client
+	fr     *FileResponse
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (f *openFile) Read(p []byte) (int, error) {
+	n, err := f.fr.Read(p)
+	if err == io.EOF {
+		if ferr := f.fr.err(); ferr != nil {
+			return n, ferr
+		}
+	}
+	return n, err
+}
+
+// Close cancels the transfer, if it's still running. It returns the
+// verification error, if the stream was read to its end and the content didn't
+// match the checksum.
+func (f *openFile) Close() error {
+	f.once.Do(func() {
+		close(f.closed)
+		f.fr.preader.Close()
+		f.c.closeConnection()
+	})
+	if err := f.fr.err(); errors.Is(err, ErrChecksum) {
+		return err
+	}
+	return nil
 }
 
 func (c *Client) waitForFirstResponse(try int) error {
 	exp := math.Pow(2, float64(try))
 	timeoutTime := time.Duration(exp) * time.Second // TODO Set initial timeout with expo backoff
-	timeout := time.NewTimer(timeoutTime)
+	timeout := c.clock().NewTimer(timeoutTime)
 	select {
-	case <-timeout.C:
+	case <-timeout.C():
 		return fmt.Errorf("%v. try timed out after %v", try, timeoutTime)
 	case <-c.ack:
-		c.rtt = time.Since(c.start)
+		c.rtt = c.clock().Now().Sub(c.start)
 		return nil
 	}
 }
 
+// sendAcks sends one ack per interval, which consolidates the state of all
+// files of the request.
 func (c *Client) sendAcks(conn connection) {
-	timeout := time.NewTimer(500 * time.Millisecond)
+	timeout := c.clock().NewTimer(500 * time.Millisecond)
 	ackNumWaitingMap := map[uint8]bool{}
 	ackSendTimeMap := map[uint8]time.Time{}
 	nextAckNum := uint8(1)
-	lastPing := time.Now()
+	lastPing := c.clock().Now()
 
 	for {
 		select {
-		case <-timeout.C:
-			if time.Since(lastPing) > 3*time.Second+3*c.rtt {
+		case <-timeout.C():
+			if c.clock().Now().Sub(lastPing) > 3*time.Second+3*c.rtt {
 				log.Println("connection timed out")
 				c.err <- struct{}{}
 				continue
@@ -159,39 +715,49 @@ func (c *Client) sendAcks(conn connection) {
 			status := metaDataReceived
 			maxTransmission := 1
 			res := []*resendEntry{}
+			gaveUp := false
 			for i, r := range c.responses {
 				if len(res) > 3 {
 					break
 				}
 				index := uint16(i)
-				rd := r.getResendEntries(140)
+				rd := r.getResendEntries(140, c.nackTimeout())
+				gaveUp = gaveUp || rd.gaveUp
 				maxTransmission += rd.bufferSize
 				if rd.res != nil {
 					res = append(res, rd.res...)
 				}
 				if index == maxFile {
-					maxOff = rd.head
+					maxOff = rd.frontier
 				}
 				if index > maxFile && rd.started {
 					maxFile = index
-					maxOff = rd.head
+					maxOff = rd.frontier
 					if !rd.metadata {
 						status = metaDataMissing
 					}
 				}
 			}
+			if gaveUp {
+				log.Println("gave up requesting missing chunks")
+				c.err <- struct{}{}
+				continue
+			}
+			if c.NackOnly {
+				// missing metadata is requested by resend entries of length 0
+				maxFile, maxOff, status = 0, 0, metaDataReceived
+			}
 			ack := clientAck{
-				ackNumber:           nextAckNum,
 				maxTransmissionRate: uint32(maxTransmission),
 				fileIndex:           maxFile,
 				offset:              maxOff,
 				resendEntries:       res,
 				status:              status,
 			}
-			ackSendTimeMap[nextAckNum] = time.Now()
+			ackSendTimeMap[nextAckNum] = c.clock().Now()
 			ackNumWaitingMap[nextAckNum] = true
 			log.Printf("sending ack at timeout: %v: %v\n", c.rtt, &ack)
-			c.Conn.send(ack)
+			c.Conn.sendAck(nextAckNum, ack, c.withID()...)
 
 			nextAckNum++
 			// avoid 0 as it can't be distinguished from not set
@@ -199,22 +765,22 @@ func (c *Client) sendAcks(conn connection) {
 				nextAckNum++
 			}
 			if c.rtt > 500*time.Millisecond {
-				timeout = time.NewTimer(500 * time.Millisecond)
+				timeout = c.clock().NewTimer(500 * time.Millisecond)
 			} else if c.rtt < 10*time.Millisecond {
-				timeout = time.NewTimer(5 * time.Millisecond)
+				timeout = c.clock().NewTimer(5 * time.Millisecond)
 			} else {
-				timeout = time.NewTimer(c.rtt)
+				timeout = c.clock().NewTimer(c.rtt)
 			}
 
 		case ackNum := <-c.ack:
 			if waiting, ok := ackNumWaitingMap[ackNum]; ok && waiting {
 				if sent, ok := ackSendTimeMap[ackNum]; ok {
-					c.rtt = time.Since(sent)
+					c.rtt = c.clock().Now().Sub(sent)
 					ackNumWaitingMap[ackNum] = false
 					log.Printf("got new rtt: %v\n", c.rtt)
 				}
 			}
-			lastPing = time.Now()
+			lastPing = c.clock().Now()
 
 		case <-c.stopAck:
 			log.Println("leaving ack writer")
@@ -223,36 +789,218 @@ func (c *Client) sendAcks(conn connection) {
 	}
 }
 
-func (c *Client) handleMetadata(_ io.Writer, p *packet) {
+// nackTimeout returns the time after which missing chunks are requested again,
+// see NackTimeout.
+func (c *Client) nackTimeout() time.Duration {
+	if c.NackTimeout > 0 {
+		return c.NackTimeout
+	}
+	t := 2 * c.rtt
+	if t < minNackTimeout {
+		t = minNackTimeout
+	} else if t > maxNackTimeout {
+		t = maxNackTimeout
+	}
+	return t
+}
+
+func (c *Client) handleMetadata(w io.Writer, p *packet) {
+	if _, ok := findOption(p.os, optionMetadataBatch); ok {
+		c.handleMetadataBatch(w, p)
+		return
+	}
 	smd := serverMetaData{}
 	err := smd.UnmarshalBinary(p.data)
+	smd.options = p.os
 	if err != nil {
-		// TODO: what now? Rerequest metadata.
-		// Maybe log something or cancel the whole thing?
+		if c.Strict {
+			c.violation(w, p.remoteAddr, p.data, err)
+			return
+		}
+		// The metadata is requested again by the next ack.
+		log.Printf("dropping malformed metadata from %v: %v\n", p.remoteAddr, err)
+		return
+	}
+	if !c.knownFile(smd.fileIndex) {
+		return
 	}
 	c.ack <- p.ackNum
 	log.Printf("handling metadata for file %v\n", smd.fileIndex)
 	c.responses[smd.fileIndex].mc <- &smd
 }
 
-func (c *Client) handleServerPayload(_ io.Writer, p *packet) {
+func (c *Client) handleServerPayload(w io.Writer, p *packet) {
 	pl := serverPayload{}
 	err := pl.UnmarshalBinary(p.data)
 	if err != nil {
-		// TODO: what now? Rerequest payload
-		// Maybe log something or cancel the whole thing?
+		if c.Strict {
+			c.violation(w, p.remoteAddr, p.data, err)
+			return
+		}
+		// The chunk is requested again, once it's missing.
+		log.Printf("dropping malformed payload from %v: %v\n", p.remoteAddr, err)
+		return
+	}
+	if !c.knownFile(pl.fileIndex) {
+		return
+	}
+	if c.VerifyOffsets {
+		if err := c.responses[pl.fileIndex].verifyOffset(pl.offset); err != nil {
+			log.Printf("offset verification failed: %v\n", err)
+			c.abort(protocolViolation, err)
+			return
+		}
 	}
 	c.ack <- p.ackNum
 	log.Printf("handling payload %v for file %v\n", pl.offset, pl.fileIndex)
 	c.responses[pl.fileIndex].pc <- &pl
 }
 
-func (c *Client) handleClose(_ io.Writer, p *packet) {
+func (c *Client) handleClose(w io.Writer, p *packet) {
 	cl := closeConnection{}
 	err := cl.UnmarshalBinary(p.data)
 	if err != nil {
-		// TODO: what now? Just drop everything?
+		if c.Strict {
+			c.violation(w, p.remoteAddr, p.data, err)
+			return
+		}
+		// Without a reason, it's not certain that the server closed at all.
+		log.Printf("dropping malformed close from %v: %v\n", p.remoteAddr, err)
+		return
+	}
+	if cl.reason == unsupportedVersion && c.downgrade(p.os) {
+		// The request is repeated in the older version instead.
+		c.ack <- p.ackNum
+		return
+	}
+	if !c.closeWith(cl.reason, true) {
+		// Both ends closed at the same time, the client's reason stands and
+		// it's closing already.
+		log.Printf("server closed the connection too: %s\n", cl.reason)
+		return
+	}
+	if o, ok := findOption(p.os, optionReason); ok {
+		log.Printf("server closed connection: %s: %s\n", cl.reason, o.value)
 	}
 	c.ack <- p.ackNum
 	c.closeMsg <- struct{}{}
 }
+
+// downgrade lowers the protocol version of the request to the newest of the
+// versions supported by the server carried by os, which is older than the
+// current one. It reports whether there is one.
+func (c *Client) downgrade(os []option) bool {
+	o, ok := findOption(os, optionVersions)
+	if !ok {
+		return false
+	}
+	newest := uint8(0)
+	for _, v := range o.value {
+		if v < c.version && v > newest {
+			newest = v
+		}
+	}
+	if newest == 0 {
+		return false
+	}
+	c.version, c.downgraded = newest, true
+	return true
+}
+
+// ProtocolVersion returns the protocol version of the last request, after the
+// client downgraded it, if the server didn't support Version.
+func (c *Client) ProtocolVersion() uint8 {
+	return c.version
+}
+
+// violation closes the connection in strict mode after the server sent a
+// packet that violates the protocol.
+func (c *Client) violation(_ io.Writer, addr *net.UDPAddr, packet []byte, err error) {
+	log.Printf("protocol violation by %v: %v, packet: %x\n", addr, err, packet)
+	c.abort(protocolViolation, err)
+}
+
+// misdirected returns a handler, which aborts the transfer after receiving a
+// message of msgType, which only clients send. The peer is a client or the
+// client itself.
+func (c *Client) misdirected(msgType uint8) handlerFunc {
+	return func(_ io.Writer, p *packet) {
+		err := fmt.Errorf("received client message type %d from %v, is the peer a client?",
+			msgType, p.remoteAddr)
+		log.Println(err)
+		c.abort(unknownRequest, err)
+	}
+}
+
+// unsupported closes the connection after the server sent a critical option,
+// which the client doesn't understand.
+func (c *Client) unsupported(_ io.Writer, addr *net.UDPAddr, packet []byte, err error) {
+	log.Printf("unsupported packet from %v: %v, packet: %x\n", addr, err, packet)
+	c.abort(unsupportedVersion, err)
+}
+
+// knownFile reports whether index refers to a requested file. Messages for
+// other files are dropped and counted, in strict mode they close the
+// connection.
+func (c *Client) knownFile(index uint16) bool {
+	if int(index) < len(c.responses) {
+		return true
+	}
+	atomic.AddUint64(&c.dropped, 1)
+	err := fmt.Errorf("received message for unknown file %v", index)
+	log.Println(err)
+	if c.Strict {
+		c.abort(unknownRequest, err)
+	}
+	return false
+}
+
+// DroppedMessages returns the number of messages dropped, because they
+// referred to a file, which wasn't requested.
+func (c *Client) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// abort tells the server why the connection is closed and closes it.
+func (c *Client) abort(reason CloseConnectionReason, err error) {
+	c.closeWith(reason, false)
+	if err := c.Conn.send(closeConnection{reason: reason}, c.withID(reasonOption(err))...); err != nil {
+		log.Printf("failed to send close: %v\n", err)
+	}
+	go func() {
+		c.closeMsg <- struct{}{}
+	}()
+}
+
+// closeState is the reason a client's connection was closed for.
+type closeState struct {
+	lock     sync.Mutex
+	reason   CloseConnectionReason
+	byServer bool
+	set      bool
+}
+
+// closeWith records the reason the connection is closed for and reports
+// whether it's the first. Ends record their own reason before sending their
+// close, so that a close of the peer crossing it doesn't replace it.
+func (c *Client) closeWith(reason CloseConnectionReason, byServer bool) bool {
+	c.closed.lock.Lock()
+	defer c.closed.lock.Unlock()
+	if c.closed.set {
+		return false
+	}
+	c.closed.reason, c.closed.byServer, c.closed.set = reason, byServer, true
+	return true
+}
+
+// CloseReason returns the reason the connection of the last request was closed
+// for and whether the server closed it. If both ends closed at the same time,
+// each keeps its own reason. The reason is 0 while the connection is open.
+func (c *Client) CloseReason() (CloseConnectionReason, bool) {
+	if c.closed == nil {
+		return noReason, false
+	}
+	c.closed.lock.Lock()
+	defer c.closed.lock.Unlock()
+	return c.closed.reason, c.closed.byServer
+}
@@ -0,0 +1,577 @@
+package rftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeServer listens on a loopback socket and lets tests answer requests by
+// hand.
+func fakeServer(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readFrom reads the next message of type msgType sent to conn and returns
+// its header, body and sender.
+func readFrom(t *testing.T, conn *net.UDPConn, msgType uint8, timeout time.Duration) (*msgHeader, []byte, *net.UDPAddr) {
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, nil, nil
+		}
+		h := &msgHeader{}
+		if err := h.UnmarshalBinary(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if h.msgType == msgType {
+			return h, append([]byte{}, buf[h.hdrLen:n]...), addr
+		}
+	}
+}
+
+func TestAcksConsolidateFiles(t *testing.T) {
+	server := fakeServer(t)
+	defer server.Close()
+
+	c := Client{Conn: NewUDPConnection()}
+	requested := make(chan error, 1)
+	go func() {
+		_, err := c.Request(server.LocalAddr().String(), []string{"a", "b", "c"})
+		requested <- err
+	}()
+	_, _, client := readFrom(t, server, msgClientRequest, time.Second)
+	if client == nil {
+		t.Fatal("no request received")
+	}
+
+	// chunk 0 of every file is missing
+	w := responseWriter(func(bs []byte) (int, error) {
+		return server.WriteToUDP(bs, client)
+	})
+	for i := uint16(0); i < 3; i++ {
+		sendTo(w, serverMetaData{fileIndex: i, size: 2 * 1024, checkSum: make([]byte, 16)})
+		sendTo(w, serverPayload{fileIndex: i, offset: 1, data: make([]byte, 1024)})
+	}
+	if err := <-requested; err != nil {
+		t.Fatal(err)
+	}
+
+	// Chunks are re-requested every 500ms, so at least the second request
+	// covers all files in a single ack.
+	for files := map[uint16]bool{}; len(files) < 3; {
+		_, body, _ := readFrom(t, server, msgClientAck, time.Second)
+		if body == nil {
+			t.Fatal("no single ack requested the missing chunks of all files")
+		}
+		ack := &clientAck{}
+		if err := ack.UnmarshalBinary(body); err != nil {
+			t.Fatal(err)
+		}
+		files = map[uint16]bool{}
+		for _, re := range ack.resendEntries {
+			if re.offset == 0 && re.length == 1 {
+				files[re.fileIndex] = true
+			}
+		}
+	}
+
+	// the shortest ack interval is 5ms, one ack per file would triple this
+	window := 100 * time.Millisecond
+	acks := 0
+	deadline := time.Now().Add(window)
+	for time.Now().Before(deadline) {
+		if _, body, _ := readFrom(t, server, msgClientAck, time.Until(deadline)); body != nil {
+			acks++
+		}
+	}
+	if max := int(window/(5*time.Millisecond)) + 2; acks > max {
+		t.Errorf("received %v acks in %v, want at most %v", acks, window, max)
+	}
+}
+
+func TestClientBindAddr(t *testing.T) {
+	data := testData(3000)
+	from := make(chan net.Addr, 1)
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	s.OnRequest = func(addr net.Addr, _ []FileRequest) error {
+		from <- addr
+		return nil
+	}
+	addr := startServer(t, s)
+
+	conn := NewUDPConnection()
+	if err := conn.BindAddr("127.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	c := Client{Conn: conn}
+	rs, err := c.Request(addr, []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) || rs[0].Err != nil {
+		t.Errorf("transfer failed: %v", rs[0].Err)
+	}
+	if a := (<-from).(*net.UDPAddr); !a.IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Errorf("request sent from %v, want 127.0.0.2", a)
+	}
+}
+
+func TestBindInterface(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loopback string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+		}
+	}
+	if loopback == "" {
+		t.Skip("no loopback interface")
+	}
+
+	c := NewUDPConnection()
+	if err := c.BindInterface(loopback); err != nil {
+		t.Fatal(err)
+	}
+	cancel, err := c.listen(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	if a := c.addr().(*net.UDPAddr); !a.IP.IsLoopback() {
+		t.Errorf("listening on %v, want loopback address", a)
+	}
+
+	if err := NewUDPConnection().BindInterface("does-not-exist"); err == nil {
+		t.Error("bound to interface, which doesn't exist")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	data := testData(20*1024 + 17)
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	r, err := c.Open(context.Background(), addr, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("received %v bytes differing from source", len(got))
+	}
+}
+
+func TestOpenCancel(t *testing.T) {
+	// the stream never ends, so only the cancellation ends the transfer
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		for {
+			if _, err := pw.Write(testData(1024)); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	s := NewServer()
+	s.SetFileHandler(func(context.Context, string) (*io.SectionReader, error) {
+		return NewStreamReader(pr), nil
+	})
+	addr := startServer(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := Client{Conn: NewUDPConnection()}
+	r, err := c.Open(ctx, addr, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.ReadFull(r, make([]byte, 2048)); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	read := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(r)
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Error("read canceled transfer without error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("read did not return after cancellation")
+	}
+}
+
+func TestOpenChecksumMismatch(t *testing.T) {
+	data := testData(20*1024 + 17)
+	s := NewServer()
+	// both checksums are 32 bytes long, so only the verification fails
+	s.NewHash = sha256.New
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection(), NewHash: sha512.New512_256}
+	r, err := c.Open(context.Background(), addr, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if !bytes.Equal(got, data) {
+		t.Errorf("received %v bytes differing from source", len(got))
+	}
+	if !errors.Is(err, ErrChecksum) {
+		t.Errorf("final read returned %v, want %v", err, ErrChecksum)
+	}
+	if err := r.Close(); !errors.Is(err, ErrChecksum) {
+		t.Errorf("close returned %v, want %v", err, ErrChecksum)
+	}
+}
+
+func TestPayloadForUnknownFile(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			server := fakeServer(t)
+			defer server.Close()
+
+			c := Client{Conn: NewUDPConnection(), Strict: strict}
+			requested := make(chan []*FileResponse, 1)
+			go func() {
+				rs, err := c.Request(server.LocalAddr().String(), []string{"file"})
+				if err != nil {
+					t.Error(err)
+				}
+				requested <- rs
+			}()
+			_, _, client := readFrom(t, server, msgClientRequest, time.Second)
+			if client == nil {
+				t.Fatal("no request received")
+			}
+			w := responseWriter(func(bs []byte) (int, error) {
+				return server.WriteToUDP(bs, client)
+			})
+
+			data := testData(1000)
+			sendTo(w, serverPayload{fileIndex: 0, offset: 0, data: data})
+			rs := <-requested
+			sendTo(w, serverPayload{fileIndex: 5, offset: 0, data: testData(1024)})
+
+			if strict {
+				h, body, _ := readFrom(t, server, msgClose, time.Second)
+				if h == nil {
+					t.Fatal("connection not closed")
+				}
+				cl := closeConnection{}
+				if err := cl.UnmarshalBinary(body); err != nil {
+					t.Fatal(err)
+				}
+				if cl.reason != unknownRequest {
+					t.Errorf("got close reason %v, want %v", cl.reason, unknownRequest)
+				}
+				return
+			}
+
+			sum := md5.Sum(data)
+			sendTo(w, serverMetaData{fileIndex: 0, size: uint64(len(data)), checkSum: sum[:]})
+			got, err := ioutil.ReadAll(rs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) || rs[0].Err != nil {
+				t.Errorf("transfer corrupted: %v", rs[0].Err)
+			}
+			// packets are handled concurrently, so the drop may be counted later
+			deadline := time.Now().Add(time.Second)
+			for c.DroppedMessages() == 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := c.DroppedMessages(); n != 1 {
+				t.Errorf("dropped %v messages, want 1", n)
+			}
+		})
+	}
+}
+
+func TestNackBacklogBoundedUnderLoss(t *testing.T) {
+	const backlog = 8
+	data := testData(100 * 1024)
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	conn := NewUDPConnection()
+	conn.LossSim(NewSeededMarkovLossSimulator(0.5, 0.3, rand.NewSource(1)))
+	c := Client{Conn: conn, MaxNackBacklog: backlog}
+	rs, err := c.Request(addr, []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	peak := make(chan int)
+	go func() {
+		max := 0
+		for {
+			select {
+			case <-stop:
+				peak <- max
+				return
+			case <-time.After(time.Millisecond):
+			}
+			if b := rs[0].backlog(); b > max {
+				max = b
+			}
+		}
+	}()
+	got, err := ioutil.ReadAll(rs[0])
+	close(stop)
+	if err != nil || !bytes.Equal(got, data) || rs[0].Err != nil {
+		t.Errorf("received %v of %v bytes: %v, %v", len(got), len(data), err, rs[0].Err)
+	}
+	if max := <-peak; max == 0 || max > backlog {
+		t.Errorf("tracked up to %v missing chunks, want at most %v", max, backlog)
+	}
+}
+
+func TestClientDowngradesVersion(t *testing.T) {
+	data := testData(3000)
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection(), Version: 2}
+	rs, err := c.Request(addr, []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rs[0])
+	if err != nil || rs[0].Err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("received %v of %v bytes: %v, %v", len(got), len(data), err, rs[0].Err)
+	}
+	if v := c.ProtocolVersion(); v != protocolVersion {
+		t.Errorf("requested with version %v, want %v", v, protocolVersion)
+	}
+}
+
+func TestClientWithoutCommonVersion(t *testing.T) {
+	s := NewServer()
+	s.SupportedVersions = []uint8{2}
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10)}))
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	rs, err := c.Request(addr, []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(rs[0])
+	if reason, byServer := c.CloseReason(); reason != unsupportedVersion || !byServer {
+		t.Errorf("closed with %v, by server %v, want %v by server", reason, byServer, unsupportedVersion)
+	}
+}
+
+// gatedReaderAt blocks reads until gate is closed.
+type gatedReaderAt struct {
+	gate <-chan struct{}
+	data []byte
+}
+
+func (r *gatedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	<-r.gate
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+func TestOnFileComplete(t *testing.T) {
+	files := map[string][]byte{"small": testData(2 * 1024), "large": testData(300 * 1024)}
+	// the large file stalls until the small one completed
+	release := make(chan struct{})
+	s := NewServer()
+	s.SetFileHandler(func(ctx context.Context, name string) (*io.SectionReader, error) {
+		data := files[name]
+		if name == "small" {
+			return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), nil
+		}
+		return io.NewSectionReader(&gatedReaderAt{gate: release, data: data}, 0, int64(len(data))), nil
+	})
+	addr := startServer(t, s)
+
+	type completion struct {
+		index uint16
+		name  string
+		sum   []byte
+	}
+	completions := make(chan completion, len(files))
+	c := Client{Conn: NewUDPConnection()}
+	c.OnFileComplete = func(index uint16, name string, sum []byte) {
+		completions <- completion{index, name, sum}
+	}
+	rs, err := c.Request(addr, []string{"small", "large"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rs {
+		go ioutil.ReadAll(r)
+	}
+	for i, want := range []completion{{0, "small", nil}, {1, "large", nil}} {
+		select {
+		case got := <-completions:
+			sum := md5.Sum(files[want.name])
+			if got.index != want.index || got.name != want.name || !bytes.Equal(got.sum, sum[:]) {
+				t.Errorf("completion %v: got file %v (%v) with checksum %x, want %v (%v) with %x",
+					i, got.index, got.name, got.sum, want.index, want.name, sum)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %v completions, want %v", i, len(files))
+		}
+		if i == 0 {
+			close(release)
+		}
+	}
+}
+
+func TestMalformedServerMessagesDropped(t *testing.T) {
+	c := Client{Conn: NewUDPConnection()}
+	c.ack = make(chan uint8, 64)
+	fr := newFileResponse("file", 0, md5.New())
+	// buffered, so that delivered messages can be counted
+	fr.mc = make(chan *serverMetaData, 64)
+	fr.pc = make(chan *serverPayload, 64)
+	c.responses = []*FileResponse{fr}
+
+	md, err := serverMetaData{fileIndex: 0, size: 2048, checkSum: make([]byte, md5Size)}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl, err := serverPayload{fileIndex: 0, offset: 1, data: make([]byte, 1024)}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(md); i++ {
+		c.handleMetadata(nil, &packet{ackNum: 1, data: md[:i]})
+	}
+	for i := 0; i < 9; i++ {
+		c.handleServerPayload(nil, &packet{ackNum: 2, data: pl[:i]})
+	}
+	if len(fr.mc) != 0 || len(fr.pc) != 0 || len(c.ack) != 0 {
+		t.Errorf("delivered %v metadata and %v payloads and acked %v truncated messages",
+			len(fr.mc), len(fr.pc), len(c.ack))
+	}
+
+	// complete messages are still delivered
+	c.handleMetadata(nil, &packet{ackNum: 1, data: md})
+	c.handleServerPayload(nil, &packet{ackNum: 2, data: pl})
+	if len(fr.mc) != 1 || len(fr.pc) != 1 || len(c.ack) != 2 {
+		t.Errorf("delivered %v metadata and %v payloads and acked %v messages, want 1, 1 and 2",
+			len(fr.mc), len(fr.pc), len(c.ack))
+	}
+}
+
+func TestEstimateIgnoresDuplicates(t *testing.T) {
+	server := fakeServer(t)
+	defer server.Close()
+
+	c := Client{Conn: NewUDPConnection(), CloseTimeout: time.Minute}
+	estimated := make(chan error, 1)
+	go func() {
+		_, err := c.Estimate(server.LocalAddr().String(), []string{"a"})
+		estimated <- err
+	}()
+	_, _, client := readFrom(t, server, msgClientRequest, time.Second)
+	if client == nil {
+		t.Fatal("no request received")
+	}
+
+	// duplicates outnumber the requested names
+	w := responseWriter(func(bs []byte) (int, error) {
+		return server.WriteToUDP(bs, client)
+	})
+	for i := 0; i < 5; i++ {
+		sendTo(w, serverMetaData{fileIndex: 0, size: 1024, checkSum: make([]byte, 16)}, option{otype: optionEstimate})
+	}
+	select {
+	case err := <-estimated:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("estimate blocked by duplicate results")
+	}
+}
+
+func TestMalformedCloseDropped(t *testing.T) {
+	server := fakeServer(t)
+	defer server.Close()
+
+	data := testData(1024)
+	c := Client{Conn: NewUDPConnection()}
+	requested := make(chan []*FileResponse, 1)
+	go func() {
+		rs, err := c.Request(server.LocalAddr().String(), []string{"file"})
+		if err != nil {
+			t.Error(err)
+		}
+		requested <- rs
+	}()
+	_, _, client := readFrom(t, server, msgClientRequest, time.Second)
+	if client == nil {
+		t.Fatal("no request received")
+	}
+
+	// the close lacks a byte of its reason
+	bs, err := marshalMsg(0, closeConnection{reason: applicationClosed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.WriteToUDP(bs[:len(bs)-1], client); err != nil {
+		t.Fatal(err)
+	}
+	w := responseWriter(func(bs []byte) (int, error) {
+		return server.WriteToUDP(bs, client)
+	})
+	sum := md5.Sum(data)
+	sendTo(w, serverPayload{fileIndex: 0, offset: 0, data: data})
+	sendTo(w, serverMetaData{fileIndex: 0, size: uint64(len(data)), checkSum: sum[:]})
+
+	rs := <-requested
+	got, err := ioutil.ReadAll(rs[0])
+	if err != nil || !bytes.Equal(got, data) || rs[0].err() != nil {
+		t.Fatalf("received %v of %v bytes: %v, %v", len(got), len(data), err, rs[0].err())
+	}
+	if reason, byServer := c.CloseReason(); byServer {
+		t.Errorf("closed by the server with %v", reason)
+	}
+}
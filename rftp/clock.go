@@ -0,0 +1,71 @@
+package rftp
+
+import "time"
+
+// clock is the source of time of servers and clients. Tests replace it by a
+// virtual clock, which only advances when they advance it, so that transfers
+// over a simulated network are reproducible.
+type clock interface {
+	Now() time.Time
+	// NewTimer, AfterFunc and NewTicker behave like their counterparts in
+	// package time.
+	NewTimer(d time.Duration) timer
+	AfterFunc(d time.Duration, f func()) timer
+	NewTicker(d time.Duration) ticker
+}
+
+// timer is a timer of a clock. C is nil for timers created by AfterFunc.
+type timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// ticker is a ticker of a clock.
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the clock of package time.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// orRealClock returns c or, if it is nil, the real clock.
+func orRealClock(c clock) clock {
+	if c == nil {
+		return realClock{}
+	}
+	return c
+}
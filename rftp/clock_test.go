@@ -0,0 +1,251 @@
+package rftp
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// virtualClock is a clock, whose time only advances when advance is called.
+// Timers due at the same time fire in the order they were set.
+type virtualClock struct {
+	// running counts the AfterFunc callbacks, which haven't returned yet, and
+	// ops the uses of the clock and its timers. Both are accessed atomically.
+	running int64
+	ops     uint64
+
+	lock   sync.Mutex
+	now    time.Time
+	timers virtualTimers
+	seq    uint64
+}
+
+func newVirtualClock() *virtualClock {
+	return &virtualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+var _ clock = (*virtualClock)(nil)
+
+func (c *virtualClock) Now() time.Time {
+	atomic.AddUint64(&c.ops, 1)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *virtualClock) NewTimer(d time.Duration) timer {
+	return c.set(&virtualTimer{c: make(chan time.Time, 1)}, d)
+}
+
+func (c *virtualClock) AfterFunc(d time.Duration, f func()) timer {
+	return c.set(&virtualTimer{f: f}, d)
+}
+
+func (c *virtualClock) NewTicker(d time.Duration) ticker {
+	return virtualTicker{c.set(&virtualTimer{c: make(chan time.Time, 1), period: d}, d)}
+}
+
+// afterInline calls f after d from advance itself instead of a new goroutine.
+func (c *virtualClock) afterInline(d time.Duration, f func()) {
+	c.set(&virtualTimer{f: f, inline: true}, d)
+}
+
+func (c *virtualClock) set(t *virtualTimer, d time.Duration) *virtualTimer {
+	atomic.AddUint64(&c.ops, 1)
+	t.clock = c
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.schedule(t, d)
+	return t
+}
+
+// schedule adds t to the timers to fire after d. c.lock must be held.
+func (c *virtualClock) schedule(t *virtualTimer, d time.Duration) {
+	t.when = c.now.Add(d)
+	t.seq = c.seq
+	c.seq++
+	heap.Push(&c.timers, t)
+}
+
+// unschedule removes t from the timers and reports whether it was scheduled.
+// c.lock must be held.
+func (c *virtualClock) unschedule(t *virtualTimer) bool {
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&c.timers, t.index)
+	return true
+}
+
+// advance moves the time to the next deadline and fires the timer due first.
+// Timers due at the same time fire one per call, so that the caller can wait
+// for the reactions to each before firing the next. It reports false, if no
+// timer is set.
+func (c *virtualClock) advance() bool {
+	c.lock.Lock()
+	if len(c.timers) == 0 {
+		c.lock.Unlock()
+		return false
+	}
+	t := heap.Pop(&c.timers).(*virtualTimer)
+	if t.when.After(c.now) {
+		c.now = t.when
+	}
+	if t.period > 0 {
+		c.schedule(t, t.period)
+	}
+	now := c.now
+	c.lock.Unlock()
+
+	switch {
+	case t.c != nil:
+		// like the channels of package time, ticks are dropped for slow
+		// receivers
+		select {
+		case t.c <- now:
+		default:
+		}
+	case t.inline:
+		t.f()
+	default:
+		atomic.AddInt64(&c.running, 1)
+		go func() {
+			defer atomic.AddInt64(&c.running, -1)
+			t.f()
+		}()
+	}
+	return true
+}
+
+// busy reports whether AfterFunc callbacks are running.
+func (c *virtualClock) busy() bool {
+	return atomic.LoadInt64(&c.running) > 0
+}
+
+// activity returns the number of uses of the clock and its timers so far.
+// Goroutines reacting to a timer use the clock again, until they wait.
+func (c *virtualClock) activity() uint64 {
+	return atomic.LoadUint64(&c.ops)
+}
+
+// virtualTimer is a timer or ticker of a virtualClock.
+type virtualTimer struct {
+	clock  *virtualClock
+	when   time.Time
+	seq    uint64
+	period time.Duration
+	c      chan time.Time
+	f      func()
+	inline bool
+	// index is the timer's position in the heap, -1 if it isn't scheduled.
+	index int
+}
+
+func (t *virtualTimer) C() <-chan time.Time {
+	atomic.AddUint64(&t.clock.ops, 1)
+	return t.c
+}
+
+func (t *virtualTimer) Stop() bool {
+	atomic.AddUint64(&t.clock.ops, 1)
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	return t.clock.unschedule(t)
+}
+
+func (t *virtualTimer) Reset(d time.Duration) bool {
+	atomic.AddUint64(&t.clock.ops, 1)
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	active := t.clock.unschedule(t)
+	t.clock.schedule(t, d)
+	return active
+}
+
+type virtualTicker struct {
+	*virtualTimer
+}
+
+func (t virtualTicker) Stop() {
+	t.virtualTimer.Stop()
+}
+
+// virtualTimers is a heap of timers ordered by their deadline and the order
+// they were set in.
+type virtualTimers []*virtualTimer
+
+func (ts virtualTimers) Len() int {
+	return len(ts)
+}
+
+func (ts virtualTimers) Less(i, j int) bool {
+	if ts[i].when.Equal(ts[j].when) {
+		return ts[i].seq < ts[j].seq
+	}
+	return ts[i].when.Before(ts[j].when)
+}
+
+func (ts virtualTimers) Swap(i, j int) {
+	ts[i], ts[j] = ts[j], ts[i]
+	ts[i].index = i
+	ts[j].index = j
+}
+
+func (ts *virtualTimers) Push(x interface{}) {
+	t := x.(*virtualTimer)
+	t.index = len(*ts)
+	*ts = append(*ts, t)
+}
+
+func (ts *virtualTimers) Pop() interface{} {
+	old := *ts
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*ts = old[:len(old)-1]
+	return t
+}
+
+func TestVirtualClockFiresInOrder(t *testing.T) {
+	c := newVirtualClock()
+	start := c.Now()
+	var fired []int
+	c.afterInline(2*time.Second, func() { fired = append(fired, 3) })
+	c.afterInline(time.Second, func() { fired = append(fired, 1) })
+	c.afterInline(time.Second, func() { fired = append(fired, 2) })
+	stopped := c.NewTimer(time.Second)
+	stopped.Stop()
+	ticker := c.NewTicker(time.Second)
+
+	for i := 0; i < 3; i++ {
+		if !c.advance() {
+			t.Fatal("no timer fired")
+		}
+	}
+	if got := c.Now().Sub(start); got != time.Second {
+		t.Errorf("advanced by %v, want 1s", got)
+	}
+	select {
+	case <-stopped.C():
+		t.Error("stopped timer fired")
+	case <-ticker.C():
+	default:
+		t.Error("ticker didn't tick")
+	}
+	c.advance()
+	c.advance()
+	if len(fired) != 3 || fired[0] != 1 || fired[1] != 2 || fired[2] != 3 {
+		t.Errorf("fired %v, want [1 2 3]", fired)
+	}
+	select {
+	case <-ticker.C():
+	default:
+		t.Error("ticker didn't tick again")
+	}
+	ticker.Stop()
+	if c.advance() {
+		t.Error("timers left after stopping the ticker")
+	}
+}
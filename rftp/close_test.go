@@ -0,0 +1,177 @@
+package rftp
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// closeGate holds back closes of the peer until release is closed and reports
+// each close on arrived and once it was handled on handled.
+type closeGate struct {
+	connection
+	release chan struct{}
+	arrived chan struct{}
+	handled chan struct{}
+}
+
+func newCloseGate() *closeGate {
+	return &closeGate{
+		connection: NewUDPConnection(),
+		release:    make(chan struct{}),
+		arrived:    make(chan struct{}, 10),
+		handled:    make(chan struct{}, 10),
+	}
+}
+
+func (c *closeGate) handle(msgType uint8, h packetHandler) {
+	if msgType != msgClose {
+		c.connection.handle(msgType, h)
+		return
+	}
+	c.connection.handle(msgType, handlerFunc(func(w io.Writer, p *packet) {
+		c.arrived <- struct{}{}
+		<-c.release
+		h.handle(w, p)
+		c.handled <- struct{}{}
+	}))
+}
+
+func waitFor(t *testing.T, c chan struct{}, event string) {
+	t.Helper()
+	select {
+	case <-c:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("close of the peer wasn't %v", event)
+	}
+}
+
+func TestSimultaneousClose(t *testing.T) {
+	summaries := make(chan TransferSummary, 2)
+	sconn := newCloseGate()
+	s := NewServer()
+	s.Conn = sconn
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(4 * 1024 * 1024)}))
+	s.OnComplete = func(summary TransferSummary) { summaries <- summary }
+	addr := startServer(t, s)
+
+	cconn := newCloseGate()
+	c := Client{Conn: cconn}
+	rs, err := c.RequestFrom(addr, []FileRequest{{Name: "file"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := s.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("got %v connections, want 1", len(conns))
+	}
+
+	// both ends close before either handles the close of the other
+	if err := s.CloseConnection(conns[0], "server closing"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, cconn.arrived, "received")
+	c.abort(donwloadFinished, errors.New("client closing"))
+	waitFor(t, sconn.arrived, "received")
+	close(sconn.release)
+	close(cconn.release)
+	waitFor(t, sconn.handled, "handled")
+	waitFor(t, cconn.handled, "handled")
+
+	select {
+	case summary := <-summaries:
+		if summary.Reason != applicationClosed {
+			t.Errorf("server recorded %v, want its own reason %v", summary.Reason, applicationClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server didn't complete the connection")
+	}
+	if n := len(s.Connections()); n != 0 {
+		t.Errorf("server has %v connections after the close", n)
+	}
+	if reason, byServer := c.CloseReason(); reason != donwloadFinished || byServer {
+		t.Errorf("client recorded %v, by server %v, want its own reason %v", reason, byServer, donwloadFinished)
+	}
+	if _, err := ioutil.ReadAll(rs[0]); err != nil || rs[0].err() == nil {
+		t.Errorf("got %v, %v reading the closed file, want a canceled file", err, rs[0].err())
+	}
+	select {
+	case summary := <-summaries:
+		t.Errorf("server completed the connection twice: %v", summary)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCloseByServerIsRecorded(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(4 * 1024 * 1024)}))
+	addr := startServer(t, s)
+
+	cconn := newCloseGate()
+	close(cconn.release)
+	c := Client{Conn: cconn}
+	if _, err := c.RequestFrom(addr, []FileRequest{{Name: "file"}}); err != nil {
+		t.Fatal(err)
+	}
+	if reason, _ := c.CloseReason(); reason != noReason {
+		t.Errorf("got reason %v of an open connection", reason)
+	}
+	if err := s.CloseConnection(s.Connections()[0], "bye"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, cconn.handled, "handled")
+	if reason, byServer := c.CloseReason(); reason != applicationClosed || !byServer {
+		t.Errorf("client recorded %v, by server %v, want %v by server", reason, byServer, applicationClosed)
+	}
+}
+
+func TestCloseOfReconnectedClient(t *testing.T) {
+	summaries := make(chan TransferSummary, 2)
+	s := NewServer()
+	s.ConnectionKey = func(addr *net.UDPAddr) string { return addr.IP.String() }
+	s.CloseTimeout = time.Minute
+	s.OnComplete = func(summary TransferSummary) { summaries <- summary }
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(100 * 1024)}))
+	addr := startServer(t, s)
+
+	// the first connection closes and is kept for the close timeout
+	first := dialServer(t, addr)
+	defer first.Close()
+	if err := sendTo(first, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, first, msgServerMetadata)
+	if err := sendTo(first, closeConnection{reason: donwloadFinished}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-summaries:
+	case <-time.After(2 * time.Second):
+		t.Fatal("first connection not closed")
+	}
+
+	// the client reconnects from another port and closes the new connection
+	second := dialServer(t, addr)
+	defer second.Close()
+	if err := sendTo(second, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, second, msgServerMetadata)
+	if err := sendTo(second, closeConnection{reason: applicationClosed}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case summary := <-summaries:
+		if summary.Reason != applicationClosed {
+			t.Errorf("second connection closed with %v, want %v", summary.Reason, applicationClosed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("close of the second connection ignored")
+	}
+	if n := len(s.Connections()); n != 0 {
+		t.Errorf("server has %v connections after the close", n)
+	}
+}
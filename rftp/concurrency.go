@@ -0,0 +1,75 @@
+package rftp
+
+// startFile waits until the file at index can be transferred without
+// exceeding the limit of files in transfer. It returns false, if the
+// connection closes first.
+func (c *clientConnection) startFile(index uint16, closeChan <-chan struct{}) bool {
+	for {
+		c.stateLock.Lock()
+		if c.maxFiles <= 0 || len(c.state.active) < c.maxFiles {
+			c.state.active[index] = struct{}{}
+			c.stateLock.Unlock()
+			return true
+		}
+		c.stateLock.Unlock()
+
+		select {
+		case <-c.fileDone:
+		case <-closeChan:
+			return false
+		}
+	}
+}
+
+// emitted records that all n chunks of the file at index were queued. n is
+// the exact number of chunks, also of compressed files and streams.
+func (c *clientConnection) emitted(index uint16, n uint64) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.state.emitted[index] = n
+	c.chunks[index] = n
+}
+
+// finishFile ends the transfer of the file at index, which has no payloads
+// left to acknowledge.
+func (c *clientConnection) finishFile(index uint16) {
+	c.stateLock.Lock()
+	delete(c.state.active, index)
+	c.stateLock.Unlock()
+	c.signalFileDone()
+}
+
+// finishAcked ends the transfer of all files, whose chunks were acknowledged
+// and for which ack requests neither resends nor metadata.
+func (c *clientConnection) finishAcked(ack *clientAck) {
+	requested := map[uint16]struct{}{}
+	if ack.status == metaDataMissing {
+		requested[ack.fileIndex] = struct{}{}
+	}
+	for _, re := range ack.resendEntries {
+		requested[re.fileIndex] = struct{}{}
+	}
+
+	finished := false
+	c.stateLock.Lock()
+	for f := range c.state.active {
+		n, ok := c.state.emitted[f]
+		if _, r := requested[f]; !ok || r || c.state.frontier[f] < n {
+			continue
+		}
+		delete(c.state.active, f)
+		finished = true
+	}
+	c.stateLock.Unlock()
+
+	if finished {
+		c.signalFileDone()
+	}
+}
+
+func (c *clientConnection) signalFileDone() {
+	select {
+	case c.fileDone <- struct{}{}:
+	default:
+	}
+}
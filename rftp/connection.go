@@ -1,12 +1,16 @@
 package rftp
 
 import (
+	"context"
 	"encoding"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -15,6 +19,8 @@ type packet struct {
 	data       []byte
 	ackNum     uint8
 	remoteAddr *net.UDPAddr
+	// version is the protocol version of the packet's header.
+	version uint8
 }
 
 type handlerFunc func(io.Writer, *packet)
@@ -27,25 +33,53 @@ type packetHandler interface {
 	handle(io.Writer, *packet)
 }
 
+// violationHandler is called with packets that violate the protocol, i.e.,
+// that can't be parsed, carry unknown options or have an unexpected type.
+type violationHandler func(w io.Writer, addr *net.UDPAddr, packet []byte, err error)
+
 type connection interface {
 	addr() net.Addr
 	handle(msgType uint8, h packetHandler)
+	handleViolation(h violationHandler)
+	handleUnsupported(h violationHandler)
 	receive() error
+	// receiveContext works like receive, but returns nil once ctx is done.
+	receiveContext(ctx context.Context) error
 	listen(host string) (func(), error)
 	connectTo(host string) error
-	send(msg encoding.BinaryMarshaler) error
+	send(msg encoding.BinaryMarshaler, os ...option) error
+	sendAck(ackNum uint8, msg encoding.BinaryMarshaler, os ...option) error
 	cclose(time.Duration) error
 	LossSim(LossSimulator)
+	BindAddr(host string) error
+	BindInterface(name string) error
 }
 
 type udpConnection struct {
 	lossSim    LossSimulator
 	socket     *net.UDPConn
 	handlers   map[uint8]packetHandler
+	violation  violationHandler
 	bufferSize int
 
-	closed  chan struct{}
+	// unsupported is called with packets carrying unknown critical options.
+	unsupported violationHandler
+
+	// maxOptions is the number of options headers of received packets may
+	// carry, defaultMaxOptions if 0.
+	maxOptions int
+
+	// local is the address to listen on or to send from, if set.
+	local *net.UDPAddr
+
+	// lock guards socket, closing, closed and closeOnce, which are replaced
+	// with every new socket.
+	lock    sync.Mutex
 	closing bool
+	// closed is closed once receive stopped reading the socket. closeOnce
+	// closes it, since receive may run several times or not at all.
+	closed    chan struct{}
+	closeOnce *sync.Once
 }
 
 var _ connection = (*udpConnection)(nil)
@@ -60,12 +94,19 @@ func NewUDPConnection() *udpConnection {
 	return &udpConnection{
 		lossSim:    &NoopLossSimulator{},
 		handlers:   make(map[uint8]packetHandler),
-		bufferSize: 2048,
+		bufferSize: 65535, // the maximum size of a UDP datagram
 		closed:     make(chan struct{}),
+		closeOnce:  &sync.Once{},
 	}
 }
 
+// defaultCloseTimeout is the time cclose waits for in-flight packets to be
+// handled, if no other timeout is configured.
+const defaultCloseTimeout = 1 * time.Second
+
 func (c *udpConnection) addr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	return c.socket.LocalAddr()
 }
 
@@ -73,16 +114,38 @@ func (c *udpConnection) handle(msgType uint8, h packetHandler) {
 	c.handlers[msgType] = h
 }
 
+// handleViolation registers h to be called with packets that violate the
+// protocol. By default, these packets are logged and dropped.
+func (c *udpConnection) handleViolation(h violationHandler) {
+	c.violation = h
+}
+
+// handleUnsupported registers h to be called with packets, which carry a
+// critical option of unknown type. By default, these packets are logged and
+// dropped.
+func (c *udpConnection) handleUnsupported(h violationHandler) {
+	c.unsupported = h
+}
+
+// cclose closes the socket and waits up to deadline for receive to finish
+// handling in-flight packets. Closing a closed connection is a no-op, as is
+// closing a connection, which was never opened.
 func (c *udpConnection) cclose(deadline time.Duration) error {
-	timeout := time.NewTimer(deadline)
-	if c.closing {
-		return fmt.Errorf("connection already closed")
+	c.lock.Lock()
+	if c.closing || c.socket == nil {
+		c.lock.Unlock()
+		return nil
 	}
 	c.closing = true
-	err := c.socket.Close()
+	socket, closed := c.socket, c.closed
+	c.lock.Unlock()
+
+	err := socket.Close()
 	log.Printf("closed connection with err: %v\n", err)
+	timeout := time.NewTimer(deadline)
+	defer timeout.Stop()
 	select {
-	case <-c.closed:
+	case <-closed:
 		log.Println("closed connection")
 	case <-timeout.C:
 		log.Println("timeout while closing connection")
@@ -90,20 +153,60 @@ func (c *udpConnection) cclose(deadline time.Duration) error {
 	return err
 }
 
+// receivePollInterval is the read deadline used by receiveContext to notice
+// the cancellation of its context.
+const receivePollInterval = 100 * time.Millisecond
+
 func (c *udpConnection) receive() error {
+	return c.receiveContext(context.Background())
+}
+
+// receiveContext works like receive, but additionally returns nil once ctx is
+// done. If ctx can be canceled, the socket is read with deadlines of
+// receivePollInterval to notice the cancellation.
+func (c *udpConnection) receiveContext(ctx context.Context) error {
 	var wg sync.WaitGroup
+	done := ctx.Done()
+	// A new socket may be opened after cclose, so remember the one read here.
+	c.lock.Lock()
+	socket, closed, closeOnce := c.socket, c.closed, c.closeOnce
+	c.lock.Unlock()
+	defer closeOnce.Do(func() { close(closed) })
+	buf := make([]byte, c.bufferSize)
 
 	for {
-		msg := make([]byte, c.bufferSize)
-		n, addr, err := c.socket.ReadFromUDP(msg)
+		if done != nil {
+			select {
+			case <-done:
+				wg.Wait()
+				return nil
+			default:
+			}
+			if err := socket.SetReadDeadline(time.Now().Add(receivePollInterval)); err != nil {
+				return err
+			}
+		}
+
+		n, addr, err := socket.ReadFromUDP(buf)
 		if err != nil {
-			if c.closing {
+			c.lock.Lock()
+			closing := c.closing || socket != c.socket
+			c.lock.Unlock()
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && done != nil && !closing {
+				continue
+			}
+			if closing {
 				log.Println("finishing connection close")
 				wg.Wait()
-				c.closed <- struct{}{}
 				log.Println("finished connection close")
 				return nil
 			}
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				// The peer isn't listening for the moment, e.g. a restarting
+				// server, which may resume the connection.
+				log.Printf("peer refused a packet: %v\n", err)
+				continue
+			}
 			log.Printf("discarded packet due to error: %v", err)
 			log.Println("closing due to crashed connection")
 			return err
@@ -112,28 +215,56 @@ func (c *udpConnection) receive() error {
 		if c.lossSim.shouldDrop() {
 			continue
 		}
+		// buf is reused, handlers get their own copy of the packet
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
 
-		header := &msgHeader{}
-		if err := header.UnmarshalBinary(msg); err != nil {
+		rw := udpResponseWriter{socket: socket, addr: addr}
+
+		header := &msgHeader{maxOptions: c.maxOptions}
+		if err := header.UnmarshalBinary(msg[:n]); err != nil {
+			if c.violation != nil {
+				c.violation(rw, addr, msg[:n], err)
+				continue
+			}
 			// Some wisdom: "Be conservative in what you do, be liberal in what you
 			// accept from others."
 			log.Printf("error while unmarshalling packet header: %v\n", err)
 			continue
 		}
-
-		rw := responseWriter(func(bs []byte) (int, error) {
-			return c.socket.WriteTo(bs, addr)
-		})
+		if critical, err := checkOptions(header.options); critical {
+			if c.unsupported != nil {
+				c.unsupported(rw, addr, msg[:n], err)
+			} else {
+				log.Printf("dropped packet from %v: %v\n", addr, err)
+			}
+			continue
+		} else if err != nil && c.violation != nil {
+			c.violation(rw, addr, msg[:n], err)
+			continue
+		}
 		p := &packet{
 			os:         header.options,
 			data:       msg[header.hdrLen:n],
 			remoteAddr: addr,
 			ackNum:     header.ackNum,
+			version:    header.version,
 		}
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			defer func() {
+				// A single bad packet must not take down all other connections.
+				if r := recover(); r != nil {
+					log.Printf("recovered from panic while handling message type %d from %v: %v, packet: %x\n",
+						header.msgType, addr, r, msg[:n])
+				}
+			}()
 			if handler, ok := c.handlers[header.msgType]; !ok {
+				if c.violation != nil {
+					c.violation(rw, addr, msg[:n], fmt.Errorf("unexpected message type %d", header.msgType))
+					return
+				}
 				log.Printf("no handler for message type %d\n", header.msgType)
 			} else {
 				handler.handle(rw, p)
@@ -142,17 +273,58 @@ func (c *udpConnection) receive() error {
 	}
 }
 
+// BindAddr sets the local address to listen on or to send requests from. host
+// may omit the port, then the port passed to listen or an ephemeral port is
+// used.
+func (c *udpConnection) BindAddr(host string) error {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "0")
+	}
+	addr, err := net.ResolveUDPAddr("udp4", host)
+	if err != nil {
+		return err
+	}
+	c.local = addr
+	return nil
+}
+
+// BindInterface binds the connection to the first IPv4 address of the network
+// interface called name.
+func (c *udpConnection) BindInterface(name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			c.local = &net.UDPAddr{IP: ipnet.IP.To4()}
+			return nil
+		}
+	}
+	return fmt.Errorf("interface %v has no IPv4 address", name)
+}
+
 func (c *udpConnection) listen(host string) (func(), error) {
 	addr, err := net.ResolveUDPAddr("udp4", host)
 	if err != nil {
 		return nil, err
 	}
+	if c.local != nil {
+		addr.IP = c.local.IP
+		if c.local.Port != 0 {
+			addr.Port = c.local.Port
+		}
+	}
 
 	conn, err := net.ListenUDP("udp4", addr)
 	if err != nil {
 		return nil, err
 	}
-	c.socket = conn
+	c.reset(conn)
 
 	return func() {
 		conn.Close()
@@ -165,60 +337,139 @@ func (c *udpConnection) connectTo(host string) error {
 		return err
 	}
 
-	conn, err := net.DialUDP("udp", nil, addr)
+	conn, err := net.DialUDP("udp", c.local, addr)
 
 	if err != nil {
 		return err
 	}
 
-	c.socket = conn
+	c.reset(conn)
 	return nil
 }
 
-func (c udpConnection) send(msg encoding.BinaryMarshaler) error {
-	return sendTo(c.socket, msg)
+// reset prepares the connection to be closed again after a new socket was
+// opened.
+func (c *udpConnection) reset(socket *net.UDPConn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.socket = socket
+	c.closing = false
+	c.closed = make(chan struct{})
+	c.closeOnce = &sync.Once{}
+}
+
+// conn returns the current socket.
+func (c *udpConnection) conn() *net.UDPConn {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.socket
+}
+
+func (c *udpConnection) send(msg encoding.BinaryMarshaler, os ...option) error {
+	return sendTo(c.conn(), msg, os...)
+}
+
+func (c *udpConnection) sendAck(ackNum uint8, msg encoding.BinaryMarshaler, os ...option) error {
+	return sendAckTo(c.conn(), ackNum, msg, os...)
 }
 
 func (c *udpConnection) LossSim(lossSim LossSimulator) {
 	c.lossSim = lossSim
 }
 
-func sendTo(writer io.Writer, msg encoding.BinaryMarshaler) error {
+// MaxOptions sets the number of options, which headers of received packets
+// may carry. Packets with more are protocol violations. Defaults to 64, at
+// most 255 options fit into a header.
+func (c *udpConnection) MaxOptions(n int) {
+	c.maxOptions = n
+}
+
+// sendTo writes msg with an ack number of 0 to writer.
+func sendTo(writer io.Writer, msg encoding.BinaryMarshaler, os ...option) error {
+	return sendAckTo(writer, 0, msg, os...)
+}
+
+// sendAckTo writes msg with ackNum to writer. The header is the only place,
+// which carries the ack number: Acks are numbered by the client and all
+// messages of the server echo the number of the last received ack.
+func sendAckTo(writer io.Writer, ackNum uint8, msg encoding.BinaryMarshaler, os ...option) error {
+	bs, err := marshalMsg(ackNum, msg, os...)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(bs)
+	return err
+}
+
+// versioned is msg sent with the header version of another protocol version
+// than protocolVersion, e.g. by a client advertising its preferred version.
+type versioned struct {
+	version uint8
+	msg     encoding.BinaryMarshaler
+}
+
+func (v versioned) MarshalBinary() ([]byte, error) {
+	return v.msg.MarshalBinary()
+}
+
+// marshalMsg encodes msg with its header.
+func marshalMsg(ackNum uint8, msg encoding.BinaryMarshaler, os ...option) ([]byte, error) {
+	if len(os) > math.MaxUint8 {
+		return nil, fmt.Errorf("too many options: %d", len(os))
+	}
+	if v, ok := msg.(versioned); ok {
+		if v.version > 0x0F {
+			return nil, fmt.Errorf("protocol version %d exceeds 4 bits", v.version)
+		}
+		bs, err := marshalMsg(ackNum, v.msg, os...)
+		if err != nil {
+			return nil, err
+		}
+		bs[0] = v.version<<4 | bs[0]&0x0F
+		return bs, nil
+	}
 	header := msgHeader{
-		version:   1,
-		optionLen: 0,
+		version:   protocolVersion,
+		ackNum:    ackNum,
+		optionLen: uint8(len(os)),
+		options:   os,
 	}
 
 	switch v := msg.(type) {
+	case serverPayload:
+		header.msgType = msgServerPayload
+		// payloads are marshaled into a single buffer on the send path
+		bs := header.AppendBinary(make([]byte, 0, header.size()+9+len(v.data)))
+		return v.AppendBinary(bs), nil
+	case *serverPayload:
+		return marshalMsg(ackNum, *v, os...)
 	case clientRequest:
 		header.msgType = msgClientRequest
 	case clientAck:
 		header.msgType = msgClientAck
-		header.ackNum = v.ackNumber
-	case serverMetaData:
+	case serverMetaData, metadataBatch:
 		header.msgType = msgServerMetadata
-	case serverPayload:
-		log.Printf("sending payload: file %v at offset %v\n", v.fileIndex, v.offset)
-		header.msgType = msgServerPayload
-		header.ackNum = v.ackNumber
 	case closeConnection:
 		header.msgType = msgClose
+	case clientReceipt:
+		header.msgType = msgReceipt
+	case resumeTokenMsg:
+		header.msgType = msgResumeToken
+	case probeMsg:
+		header.msgType = msgProbe
 	default:
-		return fmt.Errorf("unknown msg type %T", v)
+		return nil, fmt.Errorf("unknown msg type %T", v)
 	}
 
 	hs, err := header.MarshalBinary()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	bs, err := msg.MarshalBinary()
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	_, err = writer.Write(append(hs, bs...))
-
-	return err
+	return append(hs, bs...), nil
 }
 
 var testConnectionAddr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
@@ -250,6 +501,10 @@ func (c *testConnection) handle(msgType uint8, h packetHandler) {
 }
 
 func (c *testConnection) receive() error {
+	return c.receiveContext(context.Background())
+}
+
+func (c *testConnection) receiveContext(ctx context.Context) error {
 	rw := responseWriter(func(bs []byte) (n int, err error) {
 		n = len(bs)
 		header := &msgHeader{}
@@ -270,6 +525,12 @@ func (c *testConnection) receive() error {
 			msg = &clientAck{}
 		case msgClose:
 			msg = &closeConnection{}
+		case msgReceipt:
+			msg = &clientReceipt{}
+		case msgResumeToken:
+			msg = &resumeTokenMsg{}
+		case msgProbe:
+			msg = &probeMsg{}
 		default:
 			return n, nil
 		}
@@ -286,6 +547,8 @@ func (c *testConnection) receive() error {
 		select {
 		case <-c.cancel:
 			return nil
+		case <-ctx.Done():
+			return nil
 		case msg := <-c.recvChan:
 			header := &msgHeader{}
 			if err := header.UnmarshalBinary(msg); err != nil {
@@ -295,7 +558,9 @@ func (c *testConnection) receive() error {
 			p := &packet{
 				os:         header.options,
 				data:       msg[header.hdrLen:],
+				ackNum:     header.ackNum,
 				remoteAddr: testConnectionAddr, // TODO: make configurable
+				version:    header.version,
 			}
 			go c.handlers[header.msgType].handle(rw, p)
 		}
@@ -308,11 +573,22 @@ func (c *testConnection) listen(host string) (func(), error) {
 	}, nil
 }
 
+func (c *testConnection) handleViolation(h violationHandler) {
+}
+
+func (c *testConnection) handleUnsupported(h violationHandler) {
+}
+
 func (c testConnection) connectTo(host string) error {
 	return nil
 }
 
-func (c testConnection) send(msg encoding.BinaryMarshaler) error {
+func (c testConnection) send(msg encoding.BinaryMarshaler, os ...option) error {
+	c.sentChan <- msg
+	return nil
+}
+
+func (c testConnection) sendAck(ackNum uint8, msg encoding.BinaryMarshaler, os ...option) error {
 	c.sentChan <- msg
 	return nil
 }
@@ -323,3 +599,11 @@ func (c testConnection) cclose(timeout time.Duration) error {
 
 func (c testConnection) LossSim(lossSim LossSimulator) {
 }
+
+func (c testConnection) BindAddr(host string) error {
+	return nil
+}
+
+func (c testConnection) BindInterface(name string) error {
+	return nil
+}
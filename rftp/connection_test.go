@@ -0,0 +1,192 @@
+package rftp
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReceiveRecoversFromHandlerPanic(t *testing.T) {
+	c := NewUDPConnection()
+	handled := make(chan struct{}, 1)
+	c.handle(msgClientRequest, handlerFunc(func(io.Writer, *packet) {
+		panic("bad packet")
+	}))
+	c.handle(msgClientAck, handlerFunc(func(io.Writer, *packet) {
+		handled <- struct{}{}
+	}))
+	cancel, err := c.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	received := make(chan error, 1)
+	go func() {
+		received <- c.receive()
+	}()
+
+	conn, err := net.DialUDP("udp4", nil, c.addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendTo(conn, clientAck{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-handled:
+	case err := <-received:
+		t.Fatalf("receive returned after handler panic: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("packet after panic was not handled")
+	}
+}
+
+func TestReceiveContextCancel(t *testing.T) {
+	c := NewUDPConnection()
+	cancel, err := c.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	received := make(chan error, 1)
+	go func() {
+		received <- c.receiveContext(ctx)
+	}()
+
+	// an idle socket keeps hitting the read deadline, which must not end receive
+	select {
+	case err := <-received:
+		t.Fatalf("receive returned before cancellation: %v", err)
+	case <-time.After(3 * receivePollInterval):
+	}
+
+	cancelCtx()
+	select {
+	case err := <-received:
+		if err != nil {
+			t.Errorf("receive returned %v after cancellation, want nil", err)
+		}
+	case <-time.After(3 * receivePollInterval):
+		t.Fatal("receive did not return after cancellation")
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	c := NewUDPConnection()
+	if _, err := c.listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan error, 1)
+	go func() {
+		received <- c.receive()
+	}()
+
+	if err := c.cclose(time.Second); err != nil {
+		t.Fatalf("first close: %v", err)
+	}
+	if err := <-received; err != nil {
+		t.Errorf("receive returned %v after close, want nil", err)
+	}
+
+	start := time.Now()
+	if err := c.cclose(time.Second); err != nil {
+		t.Errorf("second close returned %v, want nil", err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("second close blocked for %v", d)
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	c := NewUDPConnection()
+	if _, err := c.listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// without receive, nobody confirms the close
+	start := time.Now()
+	if err := c.cclose(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > time.Second {
+		t.Errorf("close returned after %v, want 50ms", d)
+	}
+}
+
+func TestRapidOpenClose(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c := NewUDPConnection()
+		// closing a connection, which was never opened
+		c.cclose(time.Second)
+		for i := 0; i < 100; i++ {
+			if err := c.connectTo("127.0.0.1:9"); err != nil {
+				t.Error(err)
+				return
+			}
+			// receive may run several times or not at all
+			for j := 0; j < i%3; j++ {
+				go c.receive()
+			}
+			var wg sync.WaitGroup
+			for j := 0; j < 2; j++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					c.cclose(10 * time.Millisecond)
+				}()
+			}
+			wg.Wait()
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("opening and closing connections deadlocked")
+	}
+}
+
+func TestAckNumberOnlyInHeader(t *testing.T) {
+	tests := map[string]encoding.BinaryMarshaler{
+		"payload":  serverPayload{fileIndex: 1, offset: 2, data: []byte("data")},
+		"metadata": serverMetaData{fileIndex: 1, size: 2, checkSum: make([]byte, 16)},
+		"ack":      clientAck{fileIndex: 1, offset: 2, resendEntries: []*resendEntry{{1, 1, 1}}},
+	}
+	for name, msg := range tests {
+		t.Run(name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			if err := sendAckTo(buf, 42, msg); err != nil {
+				t.Fatal(err)
+			}
+			h := &msgHeader{}
+			if err := h.UnmarshalBinary(buf.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			if h.ackNum != 42 {
+				t.Errorf("got ack number %v, want 42", h.ackNum)
+			}
+
+			// the body is independent of the ack number
+			body, err := msg.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes()[h.hdrLen:], body) {
+				t.Errorf("got body %x, want %x", buf.Bytes()[h.hdrLen:], body)
+			}
+		})
+	}
+}
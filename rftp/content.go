@@ -0,0 +1,53 @@
+package rftp
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// HashHandler opens the content, whose checksum by alg is digest, for files
+// requested by hash, see FileRequest.Hash. It returns a nil reader, if it
+// doesn't know the content. ChecksumDefault stands for the server's NewHash.
+type HashHandler func(ctx context.Context, alg ChecksumAlgorithm, digest []byte) (*io.SectionReader, error)
+
+// byHashOption returns the option marking the files of a request, which are
+// requested by hash, one byte per file in order. The names of marked files are
+// their hex-encoded digests, the algorithm is selected by optionChecksums.
+func byHashOption(digests [][]byte) option {
+	value := make([]byte, len(digests))
+	for i, d := range digests {
+		if d != nil {
+			value[i] = 1
+		}
+	}
+	return option{otype: optionByHash, value: value}
+}
+
+// digests returns per file of a request the requested digest, or nil for
+// files requested by name.
+func digests(os []option, files []fileDescriptor) ([][]byte, error) {
+	o, ok := findOption(os, optionByHash)
+	if !ok {
+		return nil, nil
+	}
+	if len(o.value) != len(files) {
+		return nil, fmt.Errorf("got %d hash markers for %d files", len(o.value), len(files))
+	}
+	ds := make([][]byte, len(files))
+	for i, v := range o.value {
+		switch v {
+		case 0:
+		case 1:
+			d, err := hex.DecodeString(files[i].fileName)
+			if err != nil || len(d) == 0 {
+				return nil, fmt.Errorf("invalid digest %q of file %d", files[i].fileName, i)
+			}
+			ds[i] = d
+		default:
+			return nil, fmt.Errorf("invalid hash marker %d of file %d", v, i)
+		}
+	}
+	return ds, nil
+}
@@ -0,0 +1,72 @@
+package rftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestRequestByHash(t *testing.T) {
+	content, other, named := testData(20*1024+5), testData(700), testData(100)
+	sum := sha256.Sum256(content)
+	// the server claims to hold wrong under the digest of other content
+	wrong := sha256.Sum256([]byte("wrong"))
+	unknown := sha256.Sum256([]byte("unknown"))
+	store := map[[sha256.Size]byte][]byte{sum: content, wrong: other}
+
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"named": named}))
+	s.HashHandler = func(_ context.Context, alg ChecksumAlgorithm, digest []byte) (*io.SectionReader, error) {
+		if alg != ChecksumSHA256 {
+			t.Errorf("got algorithm %v, want %v", alg, ChecksumSHA256)
+		}
+		var key [sha256.Size]byte
+		copy(key[:], digest)
+		data, ok := store[key]
+		if !ok {
+			return nil, nil
+		}
+		return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), nil
+	}
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	rs, err := c.RequestFrom(addr, []FileRequest{
+		{Hash: sum[:], Checksum: ChecksumSHA256},
+		{Name: "named"},
+		{Hash: wrong[:], Checksum: ChecksumSHA256},
+		{Hash: unknown[:], Checksum: ChecksumSHA256},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the errors are read by err, since the client's goroutines may still
+	// set them
+	for i, data := range [][]byte{content, named} {
+		got, err := ioutil.ReadAll(rs[i])
+		if err != nil || rs[i].err() != nil || !bytes.Equal(got, data) {
+			t.Errorf("file %v: received %v of %v bytes: %v, %v", i, len(got), len(data), err, rs[i].err())
+		}
+		if i == 0 && sha256.Sum256(got) != sum {
+			t.Error("received content doesn't match the requested digest")
+		}
+	}
+	if _, err := ioutil.ReadAll(rs[2]); !errors.Is(rs[2].err(), ErrChecksum) {
+		t.Errorf("got error %v, %v for a wrong digest, want %v", err, rs[2].err(), ErrChecksum)
+	}
+	if _, err := ioutil.ReadAll(rs[3]); rs[3].err() == nil {
+		t.Errorf("got no error for an unknown digest: %v", err)
+	}
+}
+
+func TestRequestByHashSizeMismatch(t *testing.T) {
+	c := Client{Conn: NewUDPConnection()}
+	_, err := c.RequestFrom("127.0.0.1:1", []FileRequest{{Hash: []byte{1, 2, 3}, Checksum: ChecksumSHA256}})
+	if err == nil {
+		t.Error("requested a 3 byte SHA-256 digest")
+	}
+}
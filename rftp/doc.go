@@ -1,2 +1,9 @@
 // Package rftp implements the RFT-Protocol
+//
+// Only the loss simulation and connection IDs draw random numbers. The loss
+// simulation uses the global source of math/rand, unless a source is passed to
+// NewSeededMarkovLossSimulator to make simulations reproducible. Clients draw
+// connection IDs, see Client.ConnectionID, from Client.Rand, which defaults to
+// crypto/rand, so that they can't be guessed to take over connections. Apart
+// from that, the protocol is deterministic.
 package rftp
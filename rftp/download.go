@@ -0,0 +1,201 @@
+package rftp
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// DownloadFile is a file to download and the writer, which stores it.
+type DownloadFile struct {
+	FileRequest
+	// W receives the file's content at offsets relative to the start of the
+	// transfer, see FileResponse.Offset.
+	W io.WriterAt
+}
+
+// DownloadResult describes the state of the files of a download, also of an
+// aborted one.
+type DownloadResult struct {
+	Files []DownloadedFile
+}
+
+// DownloadedFile is the state of a single file of a download.
+type DownloadedFile struct {
+	Name string
+	// Offset is the chunk, at which the transfer started.
+	Offset uint64
+	// Written is the number of bytes written to W. They form a contiguous
+	// prefix of the transfer.
+	Written int64
+	// Frontier is the number of complete chunks in W. A later download
+	// resumes the file by requesting it from Offset+Frontier with the same
+	// chunk size. Bytes beyond the frontier may be incomplete.
+	Frontier uint64
+	// Complete is set, if the file was received completely and verified.
+	Complete bool
+	// Err is the error of the file's transfer, if it failed.
+	Err error
+}
+
+// Download requests files from host and writes them to their writers. It
+// returns once all files are complete, or, if ctx is canceled, with the
+// partial result and ctx.Err(). Otherwise, the error is the error of the first
+// failed file. A failing writer aborts the whole download.
+func (c *Client) Download(ctx context.Context, host string, files []DownloadFile) (*DownloadResult, error) {
+	reqs := make([]FileRequest, len(files))
+	result := &DownloadResult{Files: make([]DownloadedFile, len(files))}
+	for i, f := range files {
+		reqs[i] = f.FileRequest
+		result.Files[i].Name = f.Name
+	}
+
+	type requested struct {
+		rs  []*FileResponse
+		err error
+	}
+	ready := make(chan requested, 1)
+	go func() {
+		rs, err := c.RequestFrom(host, reqs)
+		ready <- requested{rs, err}
+	}()
+	var r requested
+	select {
+	case r = <-ready:
+	case <-ctx.Done():
+		go func() {
+			if r := <-ready; r.err == nil {
+				c.closeConnection()
+			}
+		}()
+		return result, ctx.Err()
+	}
+	if r.err != nil {
+		return result, r.err
+	}
+
+	var wg sync.WaitGroup
+	for i := range files {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result.Files[i] = c.download(r.rs[i], files[i].W)
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		c.closeConnection()
+		<-done
+		return result, ctx.Err()
+	}
+	for _, f := range result.Files {
+		if f.Err != nil {
+			return result, f.Err
+		}
+	}
+	return result, nil
+}
+
+// maxPreallocatePending is the content in bytes Download holds back, while it
+// waits for the size of a file to preallocate it.
+const maxPreallocatePending = 1 << 20
+
+// download copies fr to w in order, until fr ends.
+func (c *Client) download(fr *FileResponse, w io.WriterAt) DownloadedFile {
+	df := DownloadedFile{Name: fr.Name}
+	buf := make([]byte, 32*1024)
+	// pending holds the content read before the metadata announced the
+	// size, which may arrive after the first chunks, see Preallocate.
+	var pending []byte
+	allocated := !c.Preallocate
+	for {
+		n, err := fr.Read(buf)
+		p := buf[:n]
+		if !allocated {
+			size, ok := fr.announcedSize()
+			if !ok && err == nil && len(pending)+n <= maxPreallocatePending {
+				pending = append(pending, p...)
+				continue
+			}
+			// the size is known, or won't be known before the content was
+			// written
+			allocated = true
+			if ok {
+				if aerr := preallocate(w, int64(size)); aerr != nil {
+					df.Err = aerr
+					c.closeConnection()
+					break
+				}
+			}
+			p = append(pending, p...)
+			pending = nil
+		}
+		if len(p) > 0 {
+			m, werr := w.WriteAt(p, df.Written)
+			df.Written += int64(m)
+			if werr != nil {
+				df.Err = werr
+				c.closeConnection()
+				break
+			}
+		}
+		if err == io.EOF {
+			df.Err = fr.err()
+			df.Complete = df.Err == nil
+			break
+		} else if err != nil {
+			df.Err = err
+			break
+		}
+	}
+	// A download, which stopped early, must not leave the writer of fr
+	// blocked on the pipe, while it holds the lock.
+	fr.preader.Close()
+
+	fr.lock.Lock()
+	chunkSize := fr.chunkSize
+	df.Offset = fr.offset
+	fr.lock.Unlock()
+	if chunkSize == 0 {
+		chunkSize = defaultChunkSize
+		if c.ChunkSize > 0 {
+			chunkSize = uint64(c.ChunkSize)
+		}
+	}
+	df.Frontier = uint64(df.Written) / chunkSize
+	if df.Complete && uint64(df.Written)%chunkSize > 0 {
+		df.Frontier++
+	}
+	return df
+}
+
+// teeWriterAt writes to several writers.
+type teeWriterAt []io.WriterAt
+
+// TeeWriterAt returns a writer, which duplicates each write to all ws at the
+// same offset, e.g. to store a download and feed a verifier in one pass. A
+// write fails with the error of the first writer, which fails, so that the
+// download fails, too.
+func TeeWriterAt(ws ...io.WriterAt) io.WriterAt {
+	return teeWriterAt(append([]io.WriterAt{}, ws...))
+}
+
+func (t teeWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	for _, w := range t {
+		n, err := w.WriteAt(p, off)
+		if err != nil {
+			return n, err
+		}
+		if n != len(p) {
+			return n, io.ErrShortWrite
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,146 @@
+package rftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memWriterAt stores writes in memory.
+type memWriterAt struct {
+	lock sync.Mutex
+	data []byte
+}
+
+func (m *memWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if end := int(off) + len(p); end > len(m.data) {
+		m.data = append(m.data, make([]byte, end-len(m.data))...)
+	}
+	copy(m.data[off:], p)
+	return len(p), nil
+}
+
+func (m *memWriterAt) ReadAt(p []byte, off int64) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memWriterAt) len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.data)
+}
+
+func TestDownloadCanceled(t *testing.T) {
+	const stall = 50 * 1024
+	data := testData(100 * 1024)
+	s := NewServer()
+	s.SetFileHandler(func(ctx context.Context, name string) (*io.SectionReader, error) {
+		r := &stallingReaderAt{ctx: ctx, data: data, stall: stall}
+		return io.NewSectionReader(r, 0, int64(len(data))), nil
+	})
+	s.ReadBlockSize = 1024
+	addr := startServer(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &memWriterAt{}
+	go func() {
+		// cancel once the transfer stalls
+		for w.len() < stall {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+	}()
+
+	c := Client{Conn: NewUDPConnection()}
+	res, err := c.Download(ctx, addr, []DownloadFile{{FileRequest{Name: "file"}, w}})
+	if err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	f := res.Files[0]
+	if f.Complete {
+		t.Error("canceled file reported as complete")
+	}
+	if f.Written != int64(w.len()) || !bytes.Equal(w.data, data[:f.Written]) {
+		t.Errorf("reported %v bytes written, but %v bytes differing from the file are", f.Written, w.len())
+	}
+	if f.Frontier != stall/1024 {
+		t.Errorf("got frontier %v, want %v", f.Frontier, stall/1024)
+	}
+}
+
+func TestDownloadComplete(t *testing.T) {
+	data := testData(10*1024 + 100)
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	w := &memWriterAt{}
+	c := Client{Conn: NewUDPConnection()}
+	res, err := c.Download(context.Background(), addr, []DownloadFile{{FileRequest{Name: "file"}, w}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := res.Files[0]; !f.Complete || f.Frontier != 11 || !bytes.Equal(w.data, data) {
+		t.Errorf("got %+v, want the complete file of 11 chunks", f)
+	}
+}
+
+// failingWriterAt fails all writes at or beyond limit.
+type failingWriterAt struct {
+	limit int64
+}
+
+var errSinkFull = errors.New("sink full")
+
+func (w failingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > w.limit {
+		return 0, errSinkFull
+	}
+	return len(p), nil
+}
+
+func TestDownloadTee(t *testing.T) {
+	data := testData(100*1024 + 100)
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	disk, verifier := &memWriterAt{}, &memWriterAt{}
+	c := Client{Conn: NewUDPConnection()}
+	w := TeeWriterAt(disk, verifier)
+	res, err := c.Download(context.Background(), addr, []DownloadFile{{FileRequest{Name: "file"}, w}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Files[0].Complete {
+		t.Errorf("got %+v, want the complete file", res.Files[0])
+	}
+	for i, sink := range []*memWriterAt{disk, verifier} {
+		if !bytes.Equal(sink.data, data) {
+			t.Errorf("sink %v received %v bytes differing from source", i, len(sink.data))
+		}
+	}
+
+	// a failing sink fails the download
+	failing := Client{Conn: NewUDPConnection()}
+	w = TeeWriterAt(&memWriterAt{}, failingWriterAt{limit: 50 * 1024})
+	res, err = failing.Download(context.Background(), addr, []DownloadFile{{FileRequest{Name: "file"}, w}})
+	if !errors.Is(err, errSinkFull) || res.Files[0].Complete {
+		t.Errorf("got %v, %+v, want the sink's error", err, res.Files[0])
+	}
+}
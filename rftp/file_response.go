@@ -2,8 +2,10 @@ package rftp
 
 import (
 	"bytes"
+	"compress/gzip"
 	"container/heap"
-	"crypto/md5"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
@@ -13,6 +15,27 @@ import (
 	"time"
 )
 
+// ErrChecksum is the error of a file, whose received content doesn't match the
+// checksum sent by the server.
+var ErrChecksum = errors.New("Checksum validation failed")
+
+// ErrGaveUp is the error of a file, whose missing chunk was requested
+// Client.MaxNacks times without arriving.
+var ErrGaveUp = errors.New("gave up requesting a missing chunk")
+
+const (
+	// defaultNackBacklog is the number of missing chunks per file tracked for
+	// retransmission, unless Client.MaxNackBacklog is set.
+	defaultNackBacklog = 4096
+	// minBacklogWindow is the receive window, below which it isn't halved
+	// while the backlog is full, so that the transfer doesn't stall.
+	minBacklogWindow = 16
+	// minNackTimeout and maxNackTimeout bound the RTT based time after which
+	// missing chunks are requested again, unless Client.NackTimeout is set.
+	minNackTimeout = 100 * time.Millisecond
+	maxNackTimeout = 500 * time.Millisecond
+)
+
 type FileResponse struct {
 	index uint16
 	Name  string
@@ -20,30 +43,131 @@ type FileResponse struct {
 	mc chan *serverMetaData
 	pc chan *serverPayload
 	cc chan struct{}
+	// sized is closed, once the metadata set size. Unlike metadata, it can be
+	// checked without the lock, which is held while writing to pwriter.
+	sized chan struct{}
 
 	preader       *io.PipeReader
 	pwriter       *io.PipeWriter
 	buffer        *chunkQueue
 	maxBufferSize int
+	// maxBacklog is the maximum number of missing chunks in resendEntries.
+	maxBacklog    int
 	resendEntries map[uint64]struct{}
 	rerequested   map[uint64]time.Time
-	outOfOrder    map[uint64]struct{}
-	head          uint64
-	metadata      bool
-	lock          sync.Mutex
-	hasher        hash.Hash
-
-	size     uint64
-	chunks   uint64
-	checksum [16]byte
-	Err      error
+	// nacks counts the requests of each missing chunk, at most maxNacks, if
+	// it's not 0.
+	nacks      map[uint64]int
+	maxNacks   int
+	outOfOrder map[uint64]struct{}
+	head       uint64
+	metadata   bool
+	lock       sync.Mutex
+	hasher     hash.Hash
+	onProgress func(Progress)
+	// received measures the rate of new chunks for progress reports.
+	received rateMeter
+	// clk is the source of time, the real clock if nil.
+	clk clock
+
+	size      uint64
+	wireSize  uint64
+	chunkSize uint64
+	chunks    uint64
+	offset    uint64
+	canonical string
+	// appMetadata is the application metadata sent by the server.
+	appMetadata []byte
+	checksum    []byte
+	// digest is the requested checksum, if the file is requested by hash.
+	digest []byte
+	// chunkSums verify each chunk on arrival by chunkHash, if set.
+	chunkSums *RegionChecksums
+	chunkHash func() hash.Hash
+	// onVerified is called once with the checksum of the content read, when
+	// the reader reached its end, and the error of the file, if set. The file
+	// is finished then instead of once it was written.
+	onVerified func(index uint16, sum []byte, err error)
+	// onComplete is called once with the canonical name and the checksum of
+	// the file, when the reader reached its end and the file was verified.
+	onComplete func(index uint16, name string, sum []byte)
+	// limit is the number of chunks requested, 0 if all.
+	limit uint64
+	// early is one beyond the largest offset verified before the metadata
+	// arrived.
+	early uint64
+	// onViolation is called, if offsets are verified and the metadata
+	// announces fewer chunks than payloads received before it.
+	onViolation  func(error)
+	verifiedOnce sync.Once
+	Err          error
+}
+
+// clock returns the source of time of the file.
+func (f *FileResponse) clock() clock {
+	return orRealClock(f.clk)
 }
 
 func (f *FileResponse) Size() uint64 {
 	return f.size
 }
 
-func newFileResponse(name string, index uint16) *FileResponse {
+// Offset returns the chunk of the file, at which the transfer started. All
+// offsets and the size of the response are relative to it. It is 0 until the
+// metadata arrived.
+func (f *FileResponse) Offset() uint64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.offset
+}
+
+// CanonicalName returns the name of the file the server served for the
+// requested name. It is the requested name, unless the server rewrote it, or
+// until the metadata arrived.
+func (f *FileResponse) CanonicalName() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.canonical != "" {
+		return f.canonical
+	}
+	return f.Name
+}
+
+// AppMetadata returns the application metadata the server attached to the
+// file, see SetAppMetadata. It is nil, if there is none, or until the metadata
+// arrived.
+func (f *FileResponse) AppMetadata() []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.appMetadata
+}
+
+// Progress describes the state of a file transfer.
+type Progress struct {
+	Index uint16
+	Name  string
+	// Frontier is the offset of the first chunk that has not been received
+	// yet. All chunks below it have been received.
+	Frontier uint64
+	// Size is the size of the file in bytes, 0 until the metadata arrived.
+	Size uint64
+	// Rate is the rate in bytes per second, at which new chunks arrived over
+	// the last second.
+	Rate uint64
+	// ETA is the time left until the file is complete at Rate, 0 until the
+	// metadata arrived or while nothing arrives.
+	ETA time.Duration
+}
+
+// Frontier returns the offset of the first chunk that has not been received
+// yet.
+func (f *FileResponse) Frontier() uint64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.buffer.Frontier(f.head)
+}
+
+func newFileResponse(name string, index uint16, hasher hash.Hash) *FileResponse {
 	r, w := io.Pipe()
 
 	return &FileResponse{
@@ -54,13 +178,17 @@ func newFileResponse(name string, index uint16) *FileResponse {
 		pc: make(chan *serverPayload, 1024*1024),
 		cc: make(chan struct{}),
 
+		sized: make(chan struct{}),
+
 		preader:       r,
 		pwriter:       w,
 		buffer:        newChunkQueue(index),
 		maxBufferSize: 10 * 1024,
+		maxBacklog:    defaultNackBacklog,
 		resendEntries: make(map[uint64]struct{}),
 		rerequested:   make(map[uint64]time.Time),
-		hasher:        md5.New(),
+		nacks:         make(map[uint64]int),
+		hasher:        hasher,
 
 		outOfOrder: make(map[uint64]struct{}),
 	}
@@ -70,13 +198,20 @@ func (f *FileResponse) Read(p []byte) (n int, err error) {
 	n, readErr := f.preader.Read(p)
 	_, hashErr := f.hasher.Write(p[:n])
 	if readErr == io.EOF {
-		if !bytes.Equal(f.checksum[:], f.hasher.Sum(nil)[:16]) {
-			f.lock.Lock()
-			if f.Err == nil {
-				f.Err = fmt.Errorf("Checksum validation failed")
-			}
-			f.lock.Unlock()
+		sum := f.hasher.Sum(nil)
+		f.lock.Lock()
+		if f.Err == nil && len(f.checksum) != f.hasher.Size() {
+			f.Err = fmt.Errorf("%w: got %d byte checksum, expected %d bytes",
+				ErrChecksum, len(f.checksum), f.hasher.Size())
+		} else if f.Err == nil && !bytes.Equal(f.checksum, sum) {
+			f.Err = ErrChecksum
+		} else if f.Err == nil && f.digest != nil && !bytes.Equal(f.digest, sum) {
+			f.Err = fmt.Errorf("%w: content doesn't match the requested hash", ErrChecksum)
 		}
+		f.lock.Unlock()
+	}
+	if readErr != nil {
+		f.verifiedOnce.Do(func() { f.verified(readErr) })
 	}
 	if readErr != nil {
 		err = readErr
@@ -86,18 +221,58 @@ func (f *FileResponse) Read(p []byte) (n int, err error) {
 	return
 }
 
+// verified reports the end of the reader with readErr to onComplete, if the
+// file is complete and verified, and to onVerified.
+func (f *FileResponse) verified(readErr error) {
+	ferr := f.err()
+	if ferr == nil && readErr != io.EOF {
+		ferr = readErr
+	}
+	sum := f.hasher.Sum(nil)
+	if ferr == nil && f.onComplete != nil {
+		f.onComplete(f.index, f.CanonicalName(), sum)
+	}
+	if f.onVerified != nil {
+		f.onVerified(f.index, sum, ferr)
+	}
+}
+
+func (f *FileResponse) err() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.Err
+}
+
 type resendData struct {
 	started    bool
 	metadata   bool
-	head       uint64
+	frontier   uint64
 	res        []*resendEntry
 	bufferSize int
+	// gaveUp is set, if a missing chunk was requested maxNacks times.
+	gaveUp bool
 }
 
-func (f *FileResponse) getResendEntries(max int) *resendData {
+// getResendEntries returns the missing chunks, which weren't requested within
+// timeout, e.g. because the ack requesting them was lost.
+func (f *FileResponse) getResendEntries(max int, timeout time.Duration) *resendData {
 	f.lock.Lock()
 	defer f.lock.Unlock()
 	res := []*resendEntry{}
+	if f.metadata {
+		// The metadata follows the last payload, so chunks missing at the end of
+		// the file are lost.
+		missing := 0
+	gaps:
+		for _, g := range f.buffer.Gaps(f.head) {
+			for i := uint64(0); i < uint64(g.length); i++ {
+				if missing > max || !f.missing(g.offset+i) {
+					break gaps
+				}
+				missing++
+			}
+		}
+	}
 	// TODO: make sort faster? keep it sorted? Check loss of precision when
 	// converting uint64 to int?
 	entries := make([]int, len(f.resendEntries))
@@ -107,14 +282,24 @@ func (f *FileResponse) getResendEntries(max int) *resendData {
 		i++
 	}
 	sort.Ints(entries)
+	gaveUp := false
 	for _, offset := range entries {
 		if len(res) > max {
 			break
 		}
 		if _, ok := f.outOfOrder[uint64(offset)]; !ok {
-			if t, ok := f.rerequested[uint64(offset)]; !ok || time.Since(t) > 500*time.Millisecond {
+			if t, ok := f.rerequested[uint64(offset)]; !ok || f.clock().Now().Sub(t) > timeout {
+				if f.maxNacks > 0 && f.nacks[uint64(offset)] >= f.maxNacks {
+					if f.Err == nil {
+						f.Err = fmt.Errorf("%w: chunk %v of file %v requested %v times",
+							ErrGaveUp, offset, f.index, f.nacks[uint64(offset)])
+					}
+					gaveUp = true
+					break
+				}
+				f.nacks[uint64(offset)]++
 				log.Printf("re-requesting file %v at offset %v\n", f.index, offset)
-				f.rerequested[uint64(offset)] = time.Now()
+				f.rerequested[uint64(offset)] = f.clock().Now()
 				res = append(res, &resendEntry{
 					fileIndex: f.index,
 					offset:    uint64(offset),
@@ -125,8 +310,8 @@ func (f *FileResponse) getResendEntries(max int) *resendData {
 	}
 
 	if !f.metadata {
-		if t, ok := f.rerequested[uint64(f.head)]; !ok || time.Since(t) > 500*time.Millisecond {
-			f.rerequested[uint64(f.head)] = time.Now()
+		if t, ok := f.rerequested[uint64(f.head)]; !ok || f.clock().Now().Sub(t) > timeout {
+			f.rerequested[uint64(f.head)] = f.clock().Now()
 			res = append(res, &resendEntry{
 				fileIndex: f.index,
 				offset:    f.head,
@@ -160,13 +345,53 @@ func (f *FileResponse) getResendEntries(max int) *resendData {
 	return &resendData{
 		started:    (f.head > 0) || f.buffer.Len() > 0,
 		metadata:   f.metadata,
-		head:       f.head,
+		frontier:   f.buffer.Frontier(f.head),
 		res:        res,
 		bufferSize: f.getMaxTransmissionRate(),
+		gaveUp:     gaveUp,
 	}
 }
 
+// missing adds the missing chunk offset to the resend entries and reports
+// whether the backlog had room for it. Chunks beyond the backlog are detected
+// again once earlier gaps are filled. f.lock must be held.
+func (f *FileResponse) missing(offset uint64) bool {
+	if _, ok := f.resendEntries[offset]; ok {
+		return true
+	}
+	if _, ok := f.outOfOrder[offset]; ok {
+		// received already
+		return true
+	}
+	if f.maxBacklog > 0 && len(f.resendEntries) >= f.maxBacklog {
+		return false
+	}
+	f.resendEntries[offset] = struct{}{}
+	return true
+}
+
+// backlog returns the number of missing chunks tracked for retransmission.
+func (f *FileResponse) backlog() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.resendEntries)
+}
+
 func (f *FileResponse) getMaxTransmissionRate() int {
+	free := f.freeBuffer()
+	if f.maxBacklog > 0 && len(f.resendEntries) >= f.maxBacklog {
+		// Gaps arrive faster than they are filled. Halve the window to slow
+		// the server down instead of accumulating more gaps.
+		if half := free / 2; half >= minBacklogWindow {
+			free = half
+		}
+	}
+	return free
+}
+
+// freeBuffer returns the number of chunks the client is willing to receive
+// out of order.
+func (f *FileResponse) freeBuffer() int {
 	if f.maxBufferSize > f.buffer.Len() {
 		return f.maxBufferSize - f.buffer.Len()
 	} else {
@@ -180,11 +405,17 @@ func (f *FileResponse) getMaxTransmissionRate() int {
 func (f *FileResponse) write(done chan<- uint16) {
 	log.Printf("Start processing file %v\n", f.index)
 	defer func() {
-		done <- f.index
+		if f.onVerified == nil {
+			done <- f.index
+		}
 		f.pwriter.Close()
 		log.Printf("Finished processing file %v\n", f.index)
 	}()
 	for {
+		// Only this goroutine moves the head, so it's read without the lock.
+		// Buffered chunks are beyond the head, once the buffer was drained, so
+		// the frontier only moves with it.
+		head := f.head
 		select {
 		case metadata := <-f.mc:
 			log.Printf("metadata: %v\n", metadata)
@@ -196,28 +427,69 @@ func (f *FileResponse) write(done chan<- uint16) {
 				return
 			}
 			f.size = metadata.size
-			f.chunks = f.size / 1024
-			if f.size%1024 > 0 {
+			f.wireSize = metadata.size
+			if o, ok := findOption(metadata.options, optionGzip); ok && len(o.value) == 8 {
+				f.size = binary.BigEndian.Uint64(o.value)
+			}
+			f.chunkSize = defaultChunkSize
+			if size, ok := chunkSize(metadata.options); ok && size > 0 {
+				f.chunkSize = uint64(size)
+			}
+			if o, ok := findOption(metadata.options, optionOffset); ok && len(o.value) == 8 {
+				f.offset = binary.BigEndian.Uint64(o.value)
+			}
+			if o, ok := findOption(metadata.options, optionName); ok {
+				f.canonical = string(o.value)
+			}
+			if o, ok := findOption(metadata.options, optionAppMetadata); ok {
+				f.appMetadata = append([]byte{}, o.value...)
+			}
+			f.chunks = f.wireSize / f.chunkSize
+			if f.wireSize%f.chunkSize > 0 {
 				f.chunks++
 			}
+			f.buffer.max = f.chunks
+			if err := f.verifyEarly(); err != nil && f.onViolation != nil {
+				f.Err = err
+				f.lock.Unlock()
+				f.onViolation(err)
+				return
+			}
 			log.Printf("fileresponse received metadata: size: %v\n", f.chunks)
 			f.checksum = metadata.checkSum
+			if !f.metadata {
+				close(f.sized)
+			}
 			f.metadata = true
 			f.lock.Unlock()
 
 		case payload := <-f.pc:
 			log.Printf("fileresponse received payload %v\n", payload.offset)
+			if !f.checkLength(payload) {
+				// dropped, it's requested again
+				break
+			}
+			if ok, err := f.verifyChunk(payload); err != nil {
+				f.lock.Lock()
+				f.Err = err
+				f.lock.Unlock()
+				return
+			} else if !ok {
+				break
+			}
 			if payload.offset == f.head {
 				if f.metadata && payload.offset == f.chunks-1 {
 					log.Printf("writing last chunk")
-					lastSize := f.size - (f.chunks-1)*1024
+					lastSize := f.wireSize - (f.chunks-1)*f.chunkSize
 					f.pwriter.Write(payload.data[:lastSize])
 				} else {
 					f.pwriter.Write(payload.data)
 				}
 				f.lock.Lock()
 				delete(f.resendEntries, f.head)
+				delete(f.nacks, f.head)
 				f.head++
+				f.received.add(f.clock().Now(), uint64(len(payload.data)))
 				f.lock.Unlock()
 			} else if payload.offset > f.head {
 				if payload.offset > f.head {
@@ -225,8 +497,13 @@ func (f *FileResponse) write(done chan<- uint16) {
 					if _, ok := f.outOfOrder[payload.offset]; !ok {
 						heap.Push(f.buffer, payload)
 						f.outOfOrder[payload.offset] = struct{}{}
+						delete(f.resendEntries, payload.offset)
+						delete(f.nacks, payload.offset)
+						f.received.add(f.clock().Now(), uint64(len(payload.data)))
 						for i := f.head; i < payload.offset; i++ {
-							f.resendEntries[i] = struct{}{}
+							if !f.missing(i) {
+								break
+							}
 						}
 					}
 					f.lock.Unlock()
@@ -236,10 +513,18 @@ func (f *FileResponse) write(done chan<- uint16) {
 
 		case <-f.cc:
 			f.drainBuffer()
-			f.Err = fmt.Errorf("Write canceled")
+			f.lock.Lock()
+			if f.Err == nil {
+				f.Err = fmt.Errorf("Write canceled")
+			}
+			f.lock.Unlock()
 			return
 		}
 
+		if f.onProgress != nil && f.head != head {
+			f.onProgress(f.progress())
+		}
+
 		log.Printf("file %v at head %v and buffer size %v\n", f.index, f.head, f.buffer.Len())
 		if f.metadata && f.head >= f.chunks && f.buffer.Len() == 0 {
 			return
@@ -247,6 +532,42 @@ func (f *FileResponse) write(done chan<- uint16) {
 	}
 }
 
+func (f *FileResponse) progress() Progress {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	p := Progress{
+		Index:    f.index,
+		Name:     f.Name,
+		Frontier: f.buffer.Frontier(f.head),
+		Size:     f.size,
+		Rate:     f.received.rate(f.clock().Now()),
+	}
+	if f.metadata && p.Rate > 0 {
+		remaining := uint64(0)
+		if done := p.Frontier * f.chunkSize; done < f.wireSize {
+			remaining = f.wireSize - done
+		}
+		p.ETA = time.Duration(float64(remaining) / float64(p.Rate) * float64(time.Second))
+	}
+	return p
+}
+
+// inflate makes f decompress the received chunks, which form a gzip stream,
+// before passing them to the reader.
+func (f *FileResponse) inflate() {
+	out := f.pwriter
+	r, w := io.Pipe()
+	f.pwriter = w
+	go func() {
+		zr, err := gzip.NewReader(r)
+		if err == nil {
+			_, err = io.Copy(out, zr)
+		}
+		r.CloseWithError(err)
+		out.CloseWithError(err)
+	}()
+}
+
 func (f *FileResponse) drainBuffer() {
 	f.lock.Lock()
 	defer f.lock.Unlock()
@@ -254,10 +575,15 @@ func (f *FileResponse) drainBuffer() {
 	log.Printf("buffer top: %v, head: %v\n", top, f.head)
 	for top <= f.head && f.buffer.Len() > 0 {
 		payload := heap.Pop(f.buffer).(*serverPayload)
-		if top == f.head {
+		if top == f.head && !f.validLength(payload) {
+			// buffered before the metadata announced the chunk size
+			log.Printf("dropping chunk %v of file %v with %v bytes\n", payload.offset, f.index, len(payload.data))
+			delete(f.outOfOrder, payload.offset)
+			f.missing(payload.offset)
+		} else if top == f.head {
 			if f.metadata && payload.offset == f.chunks-1 {
 				log.Printf("writing last chunk")
-				lastSize := f.size - (f.chunks-1)*1024
+				lastSize := f.wireSize - (f.chunks-1)*f.chunkSize
 				f.pwriter.Write(payload.data[:lastSize])
 			} else {
 				f.pwriter.Write(payload.data)
@@ -268,3 +594,33 @@ func (f *FileResponse) drainBuffer() {
 		top = f.buffer.Top()
 	}
 }
+
+// checkLength reports whether payload has the length of its chunk. Other
+// payloads are requested again.
+func (f *FileResponse) checkLength(payload *serverPayload) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.validLength(payload) {
+		return true
+	}
+	log.Printf("dropping chunk %v of file %v with %v bytes\n", payload.offset, f.index, len(payload.data))
+	if _, ok := f.outOfOrder[payload.offset]; !ok && payload.offset >= f.head {
+		delete(f.rerequested, payload.offset)
+		f.missing(payload.offset)
+	}
+	return false
+}
+
+// validLength reports whether payload has the length of its chunk. Until the
+// metadata arrived, the chunk size and the last chunk aren't known, so only
+// empty payloads are invalid then. f.lock must be held.
+func (f *FileResponse) validLength(payload *serverPayload) bool {
+	n := uint64(len(payload.data))
+	if !f.metadata {
+		return n > 0
+	}
+	if f.chunks > 0 && payload.offset == f.chunks-1 {
+		return n == f.wireSize-(f.chunks-1)*f.chunkSize
+	}
+	return n == f.chunkSize
+}
@@ -0,0 +1,124 @@
+package rftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestFrontierAdvancesOverContiguousChunks(t *testing.T) {
+	progress := make(chan Progress, 10)
+	f := newFileResponse("file", 0, md5.New())
+	f.onProgress = func(p Progress) {
+		progress <- p
+	}
+	done := make(chan uint16, 1)
+	go f.write(done)
+	go ioutil.ReadAll(f)
+
+	for _, o := range []uint64{2, 3, 0, 5, 1, 4} {
+		f.pc <- &serverPayload{offset: o, data: make([]byte, 1024)}
+	}
+	for _, want := range []uint64{1, 4, 6} {
+		select {
+		case p := <-progress:
+			if p.Frontier != want {
+				t.Errorf("got frontier %v, want %v", p.Frontier, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("frontier did not advance to %v", want)
+		}
+	}
+	if got := f.Frontier(); got != 6 {
+		t.Errorf("got frontier %v, want 6", got)
+	}
+}
+
+func TestProgressReportsRate(t *testing.T) {
+	const (
+		chunks   = 200
+		interval = 10 * time.Millisecond
+		want     = 1024 * uint64(time.Second/interval)
+	)
+	clk := newVirtualClock()
+	progress := make(chan Progress, 1)
+	f := newFileResponse("file", 0, md5.New())
+	f.clk = clk
+	f.onProgress = func(p Progress) {
+		progress <- p
+	}
+	done := make(chan uint16, 1)
+	go f.write(done)
+	go ioutil.ReadAll(f)
+
+	// one chunk per interval for 1.5s
+	f.mc <- &serverMetaData{size: chunks * 1024}
+	var last Progress
+	for o := uint64(0); o < 150; o++ {
+		clk.afterInline(interval, func() {})
+		clk.advance()
+		f.pc <- &serverPayload{offset: o, data: make([]byte, 1024)}
+		last = <-progress
+	}
+	close(f.cc)
+	<-done
+
+	if last.Rate < want*8/10 || last.Rate > want*12/10 {
+		t.Errorf("got rate %v, want %v", last.Rate, want)
+	}
+	eta := time.Duration(chunks-last.Frontier) * interval
+	if last.ETA < eta*8/10 || last.ETA > eta*12/10 {
+		t.Errorf("got ETA %v, want %v", last.ETA, eta)
+	}
+}
+
+func TestPayloadsOfWrongLengthDropped(t *testing.T) {
+	data := testData(2*1024 + 100)
+	sum := md5.Sum(data)
+	f := newFileResponse("file", 0, md5.New())
+	done := make(chan uint16, 1)
+	go f.write(done)
+	received := make(chan []byte, 1)
+	go func() {
+		got, _ := ioutil.ReadAll(f)
+		received <- got
+	}()
+
+	f.mc <- &serverMetaData{size: uint64(len(data)), checkSum: sum[:]}
+	// Payloads alias the receive buffer, whose capacity holds stale bytes of
+	// earlier datagrams.
+	stale := bytes.Repeat([]byte{0xff}, 1024)
+	for _, p := range []*serverPayload{
+		{offset: 0, data: stale[:1000]},
+		{offset: 2, data: []byte{}},
+		{offset: 2, data: stale[:50]},
+		{offset: 1, data: data[1024:2048]},
+		{offset: 2, data: data[2048:]},
+		{offset: 0, data: data[:1024]},
+	} {
+		f.pc <- p
+	}
+
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, data) || f.err() != nil {
+			t.Errorf("received %v bytes differing from the %v source bytes: %v", len(got), len(data), f.err())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("file not complete")
+	}
+}
+
+func TestRateMeterSlides(t *testing.T) {
+	m := rateMeter{}
+	start := time.Now()
+	m.add(start, 1000)
+	if r := m.rate(start.Add(time.Second / 2)); r != 2000 {
+		t.Errorf("got rate %v after half a second, want 2000", r)
+	}
+	if r := m.rate(start.Add(2 * time.Second)); r != 0 {
+		t.Errorf("got rate %v after the window passed, want 0", r)
+	}
+}
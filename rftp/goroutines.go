@@ -0,0 +1,46 @@
+package rftp
+
+import "sync/atomic"
+
+// goroutineTracker counts the running goroutines of connections and logs when
+// they start and stop, so that goroutines leaked by a close, which didn't
+// propagate, show up.
+type goroutineTracker struct {
+	running int32
+	logger  Logger
+}
+
+// run runs f in a new goroutine of the connection to peer. Connections created
+// by tests have no tracker and just start f.
+func (g *goroutineTracker) run(peer interface{}, name string, f func()) {
+	if g == nil {
+		go f()
+		return
+	}
+	atomic.AddInt32(&g.running, 1)
+	g.debugf("goroutine %v of connection to %v started\n", name, peer)
+	go func() {
+		defer func() {
+			atomic.AddInt32(&g.running, -1)
+			g.debugf("goroutine %v of connection to %v stopped\n", name, peer)
+		}()
+		f()
+	}()
+}
+
+func (g *goroutineTracker) debugf(format string, v ...interface{}) {
+	if g.logger != nil {
+		g.logger.Debugf(format, v...)
+	}
+}
+
+// goFunc runs f in a new goroutine, which is counted by Server.Goroutines.
+func (c *clientConnection) goFunc(name string, f func()) {
+	c.goroutines.run(c.peer.address(), name, f)
+}
+
+// Goroutines returns the number of goroutines running for connections. It
+// drops to zero once all connections are closed, unless goroutines leak.
+func (s *Server) Goroutines() int {
+	return int(atomic.LoadInt32(&s.goroutines.running))
+}
@@ -0,0 +1,39 @@
+package rftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestConnectionGoroutinesStop(t *testing.T) {
+	data := testData(20 * 1024)
+	s := NewServer()
+	s.MaxTransferDuration = time.Minute
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data, "empty": {}}))
+	addr := startServer(t, s)
+
+	for i := 0; i < 5; i++ {
+		c := Client{Conn: NewUDPConnection()}
+		rs, err := c.Request(addr, []string{"file", "empty"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(rs[0])
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("received %v bytes differing from source: %v", len(got), err)
+		}
+		if _, err := ioutil.ReadAll(rs[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Goroutines() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v goroutines running after all transfers completed", s.Goroutines())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
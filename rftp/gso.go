@@ -0,0 +1,132 @@
+package rftp
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+)
+
+const (
+	// maxGSOSegments is the maximum number of datagrams of a single segmented
+	// write, UDP_MAX_SEGMENTS of the kernel.
+	maxGSOSegments = 64
+	// maxGSOBytes is the maximum size of a segmented write, the size of a
+	// single IPv4 UDP datagram.
+	maxGSOBytes = 65507
+)
+
+var errGSOUnsupported = errors.New("UDP generic segmentation offload is not supported")
+
+// segmentWriter writes b as datagrams of size bytes, the last may be shorter,
+// with a single syscall.
+type segmentWriter interface {
+	writeSegments(b []byte, size int) (int, error)
+}
+
+// udpResponseWriter writes to addr over socket.
+type udpResponseWriter struct {
+	socket *net.UDPConn
+	addr   *net.UDPAddr
+}
+
+func (w udpResponseWriter) Write(bs []byte) (int, error) {
+	return w.socket.WriteTo(bs, w.addr)
+}
+
+func (w udpResponseWriter) writeSegments(b []byte, size int) (int, error) {
+	return writeSegments(w.socket, w.addr, b, size)
+}
+
+func (p *peer) writeSegments(b []byte, size int) (int, error) {
+	p.lock.Lock()
+	w := p.w
+	p.lock.Unlock()
+	if sw, ok := w.(segmentWriter); ok {
+		return sw.writeSegments(b, size)
+	}
+	return 0, errGSOUnsupported
+}
+
+// gsoBatch collects payloads of equal size, which are written with a single
+// syscall by generic segmentation offload, see Server.GSO. Only the last
+// payload of a batch may be shorter.
+type gsoBatch struct {
+	w        io.Writer
+	buf      []byte
+	size     int
+	segments int
+	short    bool
+	// disabled is set, once a segmented write failed. All further payloads
+	// are written one by one.
+	disabled bool
+}
+
+func newGSOBatch(w io.Writer) *gsoBatch {
+	return &gsoBatch{w: w, buf: make([]byte, 0, maxGSOBytes)}
+}
+
+// open reports whether further payloads may join the batch.
+func (b *gsoBatch) open() bool {
+	return !b.disabled && !b.short && b.segments < maxGSOSegments &&
+		len(b.buf)+b.size <= maxGSOBytes
+}
+
+// add appends the payload p with ackNum to the batch. It flushes the batch
+// first, if p can't join it.
+func (b *gsoBatch) add(ackNum uint8, p *serverPayload) error {
+	header := msgHeader{version: protocolVersion, msgType: msgServerPayload, ackNum: ackNum}
+	size := header.size() + 9 + len(p.data)
+	if b.disabled {
+		return sendAckTo(b.w, ackNum, p)
+	}
+	var err error
+	if b.segments > 0 && (!b.open() || size > b.size || len(b.buf)+size > maxGSOBytes) {
+		err = b.flush()
+	}
+	if b.segments == 0 {
+		b.size = size
+	} else if size < b.size {
+		b.short = true
+	}
+	b.buf = p.AppendBinary(header.AppendBinary(b.buf))
+	b.segments++
+	return err
+}
+
+// flush writes the batch. If the segmented write fails, segmentation offload
+// is disabled and the payloads are written one by one.
+func (b *gsoBatch) flush() error {
+	defer func() {
+		b.buf = b.buf[:0]
+		b.segments = 0
+		b.short = false
+	}()
+	switch {
+	case b.segments == 0:
+		return nil
+	case b.segments == 1:
+		_, err := b.w.Write(b.buf)
+		return err
+	}
+	sw, ok := b.w.(segmentWriter)
+	if ok {
+		_, err := sw.writeSegments(b.buf, b.size)
+		if err == nil {
+			return nil
+		}
+		log.Printf("disabling segmentation offload: %v\n", err)
+	}
+	b.disabled = true
+	var err error
+	for off := 0; off < len(b.buf); off += b.size {
+		end := off + b.size
+		if end > len(b.buf) {
+			end = len(b.buf)
+		}
+		if _, werr := b.w.Write(b.buf[off:end]); werr != nil {
+			err = werr
+		}
+	}
+	return err
+}
@@ -0,0 +1,23 @@
+package rftp
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// udpSegment is UDP_SEGMENT of linux/udp.h, which the syscall package lacks.
+const udpSegment = 103
+
+// writeSegments writes b to addr as datagrams of size bytes with a single
+// sendmsg, which the kernel segments.
+func writeSegments(conn *net.UDPConn, addr *net.UDPAddr, b []byte, size int) (int, error) {
+	oob := make([]byte, syscall.CmsgSpace(2))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.IPPROTO_UDP // SOL_UDP
+	h.Type = udpSegment
+	h.SetLen(syscall.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = uint16(size)
+	n, _, err := conn.WriteMsgUDP(b, oob, addr)
+	return n, err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package rftp
+
+import "net"
+
+func writeSegments(conn *net.UDPConn, addr *net.UDPAddr, b []byte, size int) (int, error) {
+	return 0, errGSOUnsupported
+}
@@ -0,0 +1,212 @@
+package rftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// datagramWriter records each write as a datagram.
+type datagramWriter struct {
+	datagrams [][]byte
+}
+
+func (w *datagramWriter) Write(b []byte) (int, error) {
+	w.datagrams = append(w.datagrams, append([]byte{}, b...))
+	return len(b), nil
+}
+
+// segmentingWriter splits segmented writes into datagrams like the kernel and
+// records their sizes.
+type segmentingWriter struct {
+	datagramWriter
+	segments []int
+}
+
+func (w *segmentingWriter) writeSegments(b []byte, size int) (int, error) {
+	w.segments = append(w.segments, len(b))
+	for off := 0; off < len(b); off += size {
+		end := off + size
+		if end > len(b) {
+			end = len(b)
+		}
+		w.Write(b[off:end])
+	}
+	return len(b), nil
+}
+
+func gsoPayloads(sizes ...int) []*serverPayload {
+	ps := []*serverPayload{}
+	for i, size := range sizes {
+		ps = append(ps, &serverPayload{fileIndex: 1, offset: uint64(i), data: testData(size)})
+	}
+	return ps
+}
+
+func checkDatagrams(t *testing.T, got [][]byte, ps []*serverPayload) {
+	t.Helper()
+	if len(got) != len(ps) {
+		t.Fatalf("got %v datagrams, want %v", len(got), len(ps))
+	}
+	for i, p := range ps {
+		want, err := marshalMsg(3, p)
+		checkErr(t, err)
+		if !bytes.Equal(got[i], want) {
+			t.Errorf("datagram %v differs from the payload written alone", i)
+		}
+	}
+}
+
+func TestGSOBatch(t *testing.T) {
+	w := &segmentingWriter{}
+	b := newGSOBatch(w)
+	// the shorter payload ends the batch, the larger one starts a new one
+	ps := gsoPayloads(1000, 1000, 1000, 500, 1000)
+	for _, p := range ps {
+		checkErr(t, b.add(3, p))
+	}
+	checkErr(t, b.flush())
+	checkDatagrams(t, w.datagrams, ps)
+	if want := []int{3*1012 + 512}; len(w.segments) != 1 || w.segments[0] != want[0] {
+		t.Errorf("got segmented writes of %v bytes, want %v", w.segments, want)
+	}
+}
+
+func TestGSOBatchLimits(t *testing.T) {
+	w := &segmentingWriter{}
+	b := newGSOBatch(w)
+	ps := gsoPayloads(make([]int, maxGSOSegments+1)...)
+	for _, p := range ps {
+		checkErr(t, b.add(3, p))
+	}
+	checkErr(t, b.flush())
+	checkDatagrams(t, w.datagrams, ps)
+	if len(w.segments) != 1 {
+		t.Errorf("got %v segmented writes, want 1 and a single datagram", len(w.segments))
+	}
+
+	w = &segmentingWriter{}
+	b = newGSOBatch(w)
+	ps = gsoPayloads(40000, 40000)
+	for _, p := range ps {
+		checkErr(t, b.add(3, p))
+	}
+	checkErr(t, b.flush())
+	checkDatagrams(t, w.datagrams, ps)
+	if len(w.segments) != 0 {
+		t.Errorf("got segmented writes %v exceeding the size of a datagram", w.segments)
+	}
+}
+
+func TestGSOBatchFallback(t *testing.T) {
+	w := &datagramWriter{}
+	b := newGSOBatch(w)
+	ps := gsoPayloads(1000, 1000, 1000)
+	for _, p := range ps[:2] {
+		checkErr(t, b.add(3, p))
+	}
+	checkErr(t, b.flush())
+	if !b.disabled {
+		t.Error("segmentation offload wasn't disabled for a writer without it")
+	}
+	checkErr(t, b.add(3, ps[2]))
+	checkDatagrams(t, w.datagrams, ps)
+}
+
+func TestGSOTransfer(t *testing.T) {
+	data := testData(200*1024 + 7)
+	s := NewServer()
+	s.GSO = true
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	rs, err := c.Request(addr, []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rs[0])
+	if err != nil || rs[0].Err != nil || !bytes.Equal(got, data) {
+		t.Errorf("received %v of %v bytes: %v, %v", len(got), len(data), err, rs[0].Err)
+	}
+}
+
+// BenchmarkGSO compares writing a batch of payloads to a socket one by one
+// with a single segmented write. It's skipped, if the kernel doesn't support
+// segmentation offload.
+func BenchmarkGSO(b *testing.B) {
+	receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer receiver.Close()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			if _, _, err := receiver.ReadFromUDP(buf); err != nil {
+				return
+			}
+		}
+	}()
+	sender, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sender.Close()
+	w := udpResponseWriter{socket: sender, addr: receiver.LocalAddr().(*net.UDPAddr)}
+	if _, err := w.writeSegments(make([]byte, 20), 10); err != nil {
+		b.Skipf("no segmentation offload: %v", err)
+	}
+
+	ps := gsoPayloads(make([]int, 32)...)
+	for i := range ps {
+		ps[i].data = testData(defaultChunkSize)
+	}
+	for _, gso := range []bool{false, true} {
+		name := "single"
+		if gso {
+			name = "gso"
+		}
+		b.Run(name, func(b *testing.B) {
+			counter := &countingWriter{w: w}
+			b.SetBytes(int64(len(ps) * defaultChunkSize))
+			for i := 0; i < b.N; i++ {
+				if !gso {
+					for _, p := range ps {
+						if err := sendAckTo(counter, 0, p); err != nil {
+							b.Fatal(err)
+						}
+					}
+					continue
+				}
+				batch := newGSOBatch(counter)
+				for _, p := range ps {
+					if err := batch.add(0, p); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := batch.flush(); err != nil || batch.disabled {
+					b.Fatalf("segmented write failed: %v", err)
+				}
+			}
+			b.ReportMetric(float64(counter.syscalls)/float64(b.N), "syscalls/op")
+		})
+	}
+}
+
+// countingWriter counts the writes to the socket.
+type countingWriter struct {
+	w        udpResponseWriter
+	syscalls int
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	c.syscalls++
+	return c.w.Write(b)
+}
+
+func (c *countingWriter) writeSegments(b []byte, size int) (int, error) {
+	c.syscalls++
+	return c.w.writeSegments(b, size)
+}
@@ -0,0 +1,107 @@
+package rftp
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Logger receives log output of the protocol implementation.
+type Logger interface {
+	// Debugf logs detailed events, e.g. about single packets.
+	Debugf(format string, v ...interface{})
+	// Infof logs events an operator may be interested in.
+	Infof(format string, v ...interface{})
+}
+
+// stdLogger writes all levels to the standard logger of package log.
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+func (stdLogger) Infof(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// rateLimitedLogger passes at most limit Debug lines per second to the wrapped
+// Logger and drops the others. Info lines are never dropped.
+type rateLimitedLogger struct {
+	Logger
+	limit int
+	now   func() time.Time
+
+	lock    sync.Mutex
+	window  time.Time
+	count   int
+	dropped int
+}
+
+// NewRateLimitedLogger wraps l so that at most limit Debug lines per second
+// are logged. The number of dropped lines is reported with the first line of
+// the next second. A limit of 0 disables rate limiting.
+func NewRateLimitedLogger(l Logger, limit int) Logger {
+	if limit <= 0 {
+		return l
+	}
+	return &rateLimitedLogger{Logger: l, limit: limit, now: time.Now}
+}
+
+func (l *rateLimitedLogger) Debugf(format string, v ...interface{}) {
+	l.lock.Lock()
+	now := l.now()
+	if now.Sub(l.window) >= time.Second {
+		if l.dropped > 0 {
+			l.Logger.Debugf("dropped %v debug log lines\n", l.dropped)
+		}
+		l.window = now
+		l.count = 0
+		l.dropped = 0
+	}
+	if l.count >= l.limit {
+		l.dropped++
+		l.lock.Unlock()
+		return
+	}
+	l.count++
+	l.lock.Unlock()
+
+	l.Logger.Debugf(format, v...)
+}
+
+// LevelLogger is a Logger, which reports whether it logs Debug lines at all.
+// Hot paths skip formatting Debug lines for loggers, which don't.
+type LevelLogger interface {
+	Logger
+	DebugEnabled() bool
+}
+
+// debugEnabled reports whether l logs Debug lines. Loggers, which aren't
+// LevelLoggers, are assumed to log them.
+func debugEnabled(l Logger) bool {
+	if ll, ok := l.(LevelLogger); ok {
+		return ll.DebugEnabled()
+	}
+	return true
+}
+
+func (l *rateLimitedLogger) DebugEnabled() bool {
+	return debugEnabled(l.Logger)
+}
+
+// infoLogger drops all Debug lines.
+type infoLogger struct {
+	Logger
+}
+
+// NewInfoLogger wraps l so that only Info lines are logged.
+func NewInfoLogger(l Logger) LevelLogger {
+	return infoLogger{Logger: l}
+}
+
+func (infoLogger) Debugf(format string, v ...interface{}) {}
+
+func (infoLogger) DebugEnabled() bool {
+	return false
+}
@@ -0,0 +1,110 @@
+package rftp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type recordingLogger struct {
+	debug, info []string
+}
+
+func (l *recordingLogger) Debugf(format string, v ...interface{}) {
+	l.debug = append(l.debug, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) Infof(format string, v ...interface{}) {
+	l.info = append(l.info, fmt.Sprintf(format, v...))
+}
+
+func TestRateLimitedLogger(t *testing.T) {
+	rec := &recordingLogger{}
+	now := time.Now()
+	l := NewRateLimitedLogger(rec, 10).(*rateLimitedLogger)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		l.Debugf("packet %v", i)
+		l.Infof("info %v", i)
+	}
+	if len(rec.debug) != 10 {
+		t.Errorf("logged %v debug lines in one second, want 10", len(rec.debug))
+	}
+	if len(rec.info) != 100 {
+		t.Errorf("logged %v info lines, want all 100", len(rec.info))
+	}
+
+	now = now.Add(time.Second)
+	l.Debugf("next second")
+	if len(rec.debug) != 12 {
+		t.Fatalf("logged %v debug lines after one second, want 12", len(rec.debug))
+	}
+	if want := "dropped 90 debug log lines\n"; rec.debug[10] != want {
+		t.Errorf("got %q, want %q", rec.debug[10], want)
+	}
+
+	if l := NewRateLimitedLogger(rec, 0); l != rec {
+		t.Error("limit of 0 should not wrap the logger")
+	}
+}
+
+func TestPayloadLogInterval(t *testing.T) {
+	p := &serverPayload{fileIndex: 1, offset: 2}
+	for _, tc := range []struct {
+		name     string
+		logger   func(Logger) Logger
+		interval int
+		want     int
+	}{
+		{"disabled by default", func(l Logger) Logger { return l }, 0, 0},
+		{"every third", func(l Logger) Logger { return l }, 3, 3},
+		{"info level", func(l Logger) Logger { return NewInfoLogger(l) }, 1, 0},
+		{"rate limited info level", func(l Logger) Logger { return NewRateLimitedLogger(NewInfoLogger(l), 5) }, 1, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := &recordingLogger{}
+			s := &Server{PayloadLogInterval: tc.interval, packetLog: tc.logger(rec)}
+			c := &clientConnection{packetLog: s.packetLog, payloadLogInterval: s.payloadLogInterval()}
+			for i := 0; i < 10; i++ {
+				c.logPayload(p)
+			}
+			if len(rec.debug) != tc.want {
+				t.Errorf("logged %v of 10 payloads, want %v", len(rec.debug), tc.want)
+			}
+			if tc.want == 0 {
+				if allocs := testing.AllocsPerRun(100, func() { c.logPayload(p) }); allocs != 0 {
+					t.Errorf("got %v allocations per payload without logging", allocs)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPayloadLog shows that sending a payload doesn't do any logging
+// work, if the logger doesn't log Debug lines.
+func BenchmarkPayloadLog(b *testing.B) {
+	p := &serverPayload{fileIndex: 1, offset: 2}
+	for name, l := range map[string]Logger{
+		"info":  NewInfoLogger(stdLogger{}),
+		"debug": formattingLogger{},
+	} {
+		b.Run(name, func(b *testing.B) {
+			s := &Server{PayloadLogInterval: 1, packetLog: l}
+			c := &clientConnection{packetLog: l, payloadLogInterval: s.payloadLogInterval()}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c.logPayload(p)
+			}
+		})
+	}
+}
+
+// formattingLogger formats Debug lines and drops them.
+type formattingLogger struct{}
+
+func (formattingLogger) Debugf(format string, v ...interface{}) {
+	_ = fmt.Sprintf(format, v...)
+}
+
+func (formattingLogger) Infof(string, ...interface{}) {}
@@ -19,24 +19,47 @@ type MarkovLossSimulator struct {
 	p         float32
 	q         float32
 	lossState bool
+
+	// rand is the source of the simulation, the global source of math/rand
+	// if nil.
+	rand *rand.Rand
 }
 
 // Return a new loss simulator. p and q between 0 and 1.
 // Caller should consider seeding global randomness source.
 func NewMarkovLossSimulator(p float32, q float32) LossSimulator {
+	return NewSeededMarkovLossSimulator(p, q, nil)
+}
+
+// NewSeededMarkovLossSimulator returns a loss simulator, which draws from src
+// instead of the global randomness source. Simulations with sources of the same
+// seed drop the same packets, which makes them reproducible. src must not be
+// shared with other goroutines.
+func NewSeededMarkovLossSimulator(p float32, q float32, src rand.Source) LossSimulator {
 	if p < 0 || q < 0 || p > 1 || q > 1 {
 		log.Panic("The loss simulation parameters must be between 0 and 1")
 	}
 
-	return &MarkovLossSimulator{
+	l := &MarkovLossSimulator{
 		p:         p,
 		q:         q,
 		lossState: false,
 	}
+	if src != nil {
+		l.rand = rand.New(src)
+	}
+	return l
+}
+
+func (l *MarkovLossSimulator) float32() float32 {
+	if l.rand != nil {
+		return l.rand.Float32()
+	}
+	return rand.Float32()
 }
 
 func (l *MarkovLossSimulator) shouldDrop() bool {
-	x := rand.Float32() // upper bound is exclusive, i.e., never 1; problem?
+	x := l.float32() // upper bound is exclusive, i.e., never 1; problem?
 	if l.lossState {
 		if x >= l.q {
 			l.lossState = false
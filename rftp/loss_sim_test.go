@@ -0,0 +1,39 @@
+package rftp
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func drops(l LossSimulator, n int) []bool {
+	ds := make([]bool, n)
+	for i := range ds {
+		ds[i] = l.shouldDrop()
+	}
+	return ds
+}
+
+func TestSeededLossSimulatorIsDeterministic(t *testing.T) {
+	a := drops(NewSeededMarkovLossSimulator(0.1, 0.5, rand.NewSource(42)), 1000)
+	b := drops(NewSeededMarkovLossSimulator(0.1, 0.5, rand.NewSource(42)), 1000)
+	c := drops(NewSeededMarkovLossSimulator(0.1, 0.5, rand.NewSource(43)), 1000)
+
+	dropped, differs := 0, false
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("simulations with the same seed differ at packet %v", i)
+		}
+		if a[i] {
+			dropped++
+		}
+		if a[i] != c[i] {
+			differs = true
+		}
+	}
+	if dropped == 0 || dropped == len(a) {
+		t.Errorf("dropped %v of %v packets", dropped, len(a))
+	}
+	if !differs {
+		t.Error("simulations with different seeds are equal")
+	}
+}
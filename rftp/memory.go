@@ -0,0 +1,113 @@
+package rftp
+
+import "sync"
+
+// memoryBudget is the payload memory shared by all connections of a server.
+type memoryBudget struct {
+	lock sync.Mutex
+	max  int
+	used int
+	// waiting are the reservations, which are admitted in order as memory is
+	// freed, so that no connection starves.
+	waiting []*reservation
+}
+
+type reservation struct {
+	n        int
+	admitted chan struct{}
+}
+
+func newMemoryBudget(max int) *memoryBudget {
+	return &memoryBudget{max: max}
+}
+
+// reserve blocks until n more bytes fit into the budget and accounts for them.
+// It returns false, if closeChan is closed meanwhile.
+func (b *memoryBudget) reserve(n int, closeChan <-chan struct{}) bool {
+	b.lock.Lock()
+	if len(b.waiting) == 0 && b.fits(n) {
+		b.used += n
+		b.lock.Unlock()
+		return true
+	}
+	r := &reservation{n: n, admitted: make(chan struct{})}
+	b.waiting = append(b.waiting, r)
+	b.lock.Unlock()
+
+	select {
+	case <-r.admitted:
+		return true
+	case <-closeChan:
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for i, w := range b.waiting {
+		if w == r {
+			b.waiting = append(b.waiting[:i], b.waiting[i+1:]...)
+			return false
+		}
+	}
+	// admitted meanwhile
+	b.used -= n
+	b.admit()
+	return false
+}
+
+// fits reports whether n more bytes fit. A single reservation is always
+// admitted, if nothing else is held. b.lock must be held.
+func (b *memoryBudget) fits(n int) bool {
+	return b.used == 0 || b.used+n <= b.max
+}
+
+// admit admits the waiting reservations in order, as long as they fit. b.lock
+// must be held.
+func (b *memoryBudget) admit() {
+	for len(b.waiting) > 0 && b.fits(b.waiting[0].n) {
+		r := b.waiting[0]
+		b.waiting = b.waiting[1:]
+		b.used += r.n
+		close(r.admitted)
+	}
+}
+
+// free returns n bytes to the budget.
+func (b *memoryBudget) free(n int) {
+	if n == 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.used -= n
+	b.admit()
+}
+
+func (b *memoryBudget) inUse() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.used
+}
+
+// releaseMemory returns the memory held by the closed connection to the
+// server's budget, since its payloads are never acknowledged anymore.
+func (c *clientConnection) releaseMemory() {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	if c.budget == nil {
+		return
+	}
+	c.budget.free(c.memory)
+	c.budget = nil
+}
+
+// Memory returns the number of payload bytes all connections queue for
+// sending and cache for retransmissions. It is only tracked, if MaxMemory is
+// set.
+func (s *Server) Memory() int {
+	s.clientMux.Lock()
+	b := s.memory
+	s.clientMux.Unlock()
+	if b == nil {
+		return 0
+	}
+	return b.inUse()
+}
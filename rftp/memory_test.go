@@ -0,0 +1,89 @@
+package rftp
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerMemoryLimit(t *testing.T) {
+	for _, nackOnly := range []bool{false, true} {
+		nackOnly := nackOnly
+		t.Run(fmt.Sprintf("nackOnly=%v", nackOnly), func(t *testing.T) {
+			testServerMemoryLimit(t, nackOnly)
+		})
+	}
+}
+
+func testServerMemoryLimit(t *testing.T, nackOnly bool) {
+	const (
+		limit   = 16 * 1024
+		clients = 8
+	)
+	data := testData(32 * 1024)
+	s := NewServer()
+	s.MaxMemory = limit
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	stop := make(chan struct{})
+	peak := make(chan int)
+	go func() {
+		max := 0
+		for {
+			select {
+			case <-stop:
+				peak <- max
+				return
+			case <-time.After(time.Millisecond):
+			}
+			if m := s.Memory(); m > max {
+				max = m
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := Client{Conn: NewUDPConnection(), NackOnly: nackOnly}
+			rs, err := c.Request(addr, []string{"file"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			got, err := ioutil.ReadAll(rs[0])
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("received %v bytes differing from source: %v", len(got), err)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("transfers didn't complete")
+	}
+	close(stop)
+	if max := <-peak; max > limit {
+		t.Errorf("connections held %v bytes, want at most %v", max, limit)
+	}
+
+	// closed connections return their memory
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Memory() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v bytes held after all transfers completed", s.Memory())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,117 @@
+package rftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+)
+
+// Root returns the root of the binary Merkle tree over the region checksums.
+// Leaves are the newHash of a 0 byte followed by a checksum, inner nodes the
+// newHash of a 1 byte followed by their children, and a node without sibling
+// moves up unchanged. The root is the newHash of a 2 byte followed by the file
+// size, the number of leaves and the tree's top node, so that neither can be
+// forged. A root published by a trusted source along the file authenticates
+// all region checksums received from a server.
+func (r *RegionChecksums) Root(newHash func() hash.Hash) []byte {
+	if len(r.Sums) == 0 {
+		return nil
+	}
+	level := make([][]byte, len(r.Sums))
+	for i, sum := range r.Sums {
+		h := newHash()
+		h.Write([]byte{0})
+		h.Write(sum)
+		level[i] = h.Sum(nil)
+	}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := newHash()
+			h.Write([]byte{1})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	h := newHash()
+	h.Write([]byte{2})
+	var sizes [16]byte
+	binary.BigEndian.PutUint64(sizes[:8], r.Size)
+	binary.BigEndian.PutUint64(sizes[8:], uint64(len(r.Sums)))
+	h.Write(sizes[:])
+	h.Write(level[0])
+	return h.Sum(nil)
+}
+
+// ErrRootMismatch is the error of ChunkChecksums, if the checksums received
+// from the server don't match the trusted root.
+var ErrRootMismatch = errors.New("chunk checksums don't match the root")
+
+// ChunkChecksums asks the server for the checksums of the chunks of the file
+// name, which verify each chunk on arrival, see FileRequest.ChunkSums. If root
+// isn't nil, the checksums are only returned, if their Root by NewHash is root.
+// The server must support FeatureRegions.
+func (c *Client) ChunkChecksums(host, name string, root []byte) (*RegionChecksums, error) {
+	chunkSize := defaultChunkSize
+	if c.ChunkSize > 0 {
+		chunkSize = c.ChunkSize
+	}
+	if chunkSize > maxChunkSize {
+		chunkSize = maxChunkSize
+	}
+	rs, err := c.RegionChecksums(host, name, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	if root != nil && !bytes.Equal(rs.Root(c.newHash), root) {
+		return nil, ErrRootMismatch
+	}
+	return rs, nil
+}
+
+// verifyChunk reports whether the payload p matches the checksum of its chunk,
+// if the file is verified by chunk. Corrupt chunks are dropped and requested
+// again with the next ack instead of failing the file's checksum at its end.
+// Chunks, to which the checksums don't apply, fail the file.
+func (f *FileResponse) verifyChunk(p *serverPayload) (bool, error) {
+	sums := f.chunkSums
+	if sums == nil {
+		return true, nil
+	}
+	if p.offset >= uint64(len(sums.Sums)) {
+		return false, fmt.Errorf("%w: chunk %v of file %v is beyond its %v chunk checksums",
+			ErrChecksum, p.offset, f.index, len(sums.Sums))
+	}
+	length := uint64(sums.RegionSize)
+	if rest := sums.Size - p.offset*length; rest < length {
+		length = rest
+	}
+	if uint64(len(p.data)) != length {
+		// The server chose another chunk size, to which the checksums don't
+		// apply.
+		return false, fmt.Errorf("%w: chunk %v of file %v has %v bytes, its checksum covers %v",
+			ErrChecksum, p.offset, f.index, len(p.data), length)
+	}
+	h := f.chunkHash()
+	h.Write(p.data)
+	if bytes.Equal(h.Sum(nil), sums.Sums[p.offset]) {
+		return true, nil
+	}
+	log.Printf("chunk %v of file %v is corrupt, requesting it again\n", p.offset, f.index)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.outOfOrder[p.offset]; !ok && p.offset >= f.head {
+		delete(f.rerequested, p.offset)
+		f.missing(p.offset)
+	}
+	return false, nil
+}
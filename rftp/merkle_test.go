@@ -0,0 +1,137 @@
+package rftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+// corruptingConn flips a byte of the first payload of the chunk at offset and
+// counts the received payloads per chunk.
+type corruptingConn struct {
+	connection
+	offset uint64
+
+	lock     sync.Mutex
+	received map[uint64]int
+}
+
+func (c *corruptingConn) handle(msgType uint8, h packetHandler) {
+	if msgType != msgServerPayload {
+		c.connection.handle(msgType, h)
+		return
+	}
+	c.connection.handle(msgType, handlerFunc(func(w io.Writer, p *packet) {
+		pl := serverPayload{}
+		if err := pl.UnmarshalBinary(p.data); err == nil {
+			c.lock.Lock()
+			c.received[pl.offset]++
+			first := c.received[pl.offset] == 1
+			c.lock.Unlock()
+			if pl.offset == c.offset && first {
+				data := append([]byte{}, p.data...)
+				data[len(data)-1] ^= 0xff
+				p = &packet{os: p.os, data: data, remoteAddr: p.remoteAddr, ackNum: p.ackNum}
+			}
+		}
+		h.handle(w, p)
+	}))
+}
+
+func TestChunkChecksumsRequestCorruptChunk(t *testing.T) {
+	data := testData(20*1024 + 5)
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	sums, err := (&Client{Conn: NewUDPConnection()}).ChunkChecksums(addr, "file", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sums.Sums) != 21 {
+		t.Fatalf("got %v chunk checksums, want 21", len(sums.Sums))
+	}
+	root := sums.Root(md5.New)
+	if _, err := (&Client{Conn: NewUDPConnection()}).ChunkChecksums(addr, "file", root); err != nil {
+		t.Errorf("checksums don't match their own root: %v", err)
+	}
+	bad := append([]byte{}, root...)
+	bad[0] ^= 0xff
+	if _, err := (&Client{Conn: NewUDPConnection()}).ChunkChecksums(addr, "file", bad); !errors.Is(err, ErrRootMismatch) {
+		t.Errorf("got error %v for a wrong root, want %v", err, ErrRootMismatch)
+	}
+
+	conn := &corruptingConn{connection: NewUDPConnection(), offset: 3, received: make(map[uint64]int)}
+	c := Client{Conn: conn}
+	rs, err := c.RequestFrom(addr, []FileRequest{{Name: "file", ChunkSums: sums}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rs[0])
+	if err != nil || rs[0].Err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("received %v of %v bytes: %v, %v", len(got), len(data), err, rs[0].Err)
+	}
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if n := conn.received[3]; n != 2 {
+		t.Errorf("received corrupt chunk %v times, want 2", n)
+	}
+	for offset, n := range conn.received {
+		if offset != 3 && n != 1 {
+			t.Errorf("received intact chunk %v %v times, want once", offset, n)
+		}
+	}
+}
+
+func TestRootSeparatesLeavesFromNodes(t *testing.T) {
+	leaf := func(b byte) []byte { return bytes.Repeat([]byte{b}, md5.Size) }
+	rs := &RegionChecksums{Size: 2048, RegionSize: 1024, Sums: [][]byte{leaf(1), leaf(2)}}
+	root := rs.Root(md5.New)
+
+	// the inner node over both leaves posing as a single leaf
+	h := md5.New()
+	h.Write([]byte{1})
+	h.Write(leaf(1))
+	h.Write(leaf(2))
+	forged := &RegionChecksums{Size: 1024, RegionSize: 1024, Sums: [][]byte{h.Sum(nil)}}
+	if bytes.Equal(forged.Root(md5.New), root) {
+		t.Error("an inner node has the root of a leaf")
+	}
+	resized := &RegionChecksums{Size: 2000, RegionSize: 1024, Sums: rs.Sums}
+	if bytes.Equal(resized.Root(md5.New), root) {
+		t.Error("checksums of another file size have the same root")
+	}
+}
+
+func TestVerifyChunkFailsInapplicableChecksums(t *testing.T) {
+	data := testData(2*1024 + 5)
+	sums := &RegionChecksums{Size: uint64(len(data)), RegionSize: 1024}
+	for off := 0; off < len(data); off += 1024 {
+		end := off + 1024
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := md5.Sum(data[off:end])
+		sums.Sums = append(sums.Sums, sum[:])
+	}
+
+	for _, p := range []*serverPayload{
+		{offset: 3, data: data[:5]},
+		{offset: 0, data: data[:512]},
+	} {
+		f := newFileResponse("file", 0, nil)
+		f.chunkSums, f.chunkHash = sums, md5.New
+		if ok, err := f.verifyChunk(p); ok || !errors.Is(err, ErrChecksum) {
+			t.Errorf("chunk %v with %v bytes: got %v, %v, want %v", p.offset, len(p.data), ok, err, ErrChecksum)
+		}
+	}
+	f := newFileResponse("file", 0, nil)
+	f.chunkSums, f.chunkHash = sums, md5.New
+	if ok, err := f.verifyChunk(&serverPayload{offset: 2, data: data[2048:]}); !ok || err != nil {
+		t.Errorf("got %v, %v for an intact chunk", ok, err)
+	}
+}
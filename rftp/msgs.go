@@ -17,6 +17,14 @@ const (
 	msgServerPayload
 	msgClientAck
 	msgClose
+	// msgReceipt confirms that the client received and verified a file, see
+	// Client.Receipts.
+	msgReceipt
+	// msgResumeToken carries a resume token issued by the server, see
+	// Client.OnResumeToken.
+	msgResumeToken
+	// msgProbe is a message of a bandwidth probe, see Client.ProbeBandwidth.
+	msgProbe
 )
 
 // status, the server puts to metadata
@@ -27,6 +35,8 @@ const (
 	fileNotExistent
 	fileEmpty
 	accessDenied
+	offsetTooBig
+	readError
 )
 
 func (m MetaDataStatus) String() string {
@@ -41,10 +51,197 @@ func (m MetaDataStatus) String() string {
 		return "3: access denied"
 	case 4:
 		return "4: Offset bigger than filesize"
+	case 5:
+		return "5: error while reading file"
 	}
 	return fmt.Sprintf("unknown error: %v", uint8(m))
 }
 
+// AllMetaDataStatuses returns all statuses defined by the protocol in
+// ascending order, e.g. to map them to messages of a user interface.
+func AllMetaDataStatuses() []MetaDataStatus {
+	ss := make([]MetaDataStatus, 0, readError+1)
+	for s := noErr; s <= readError; s++ {
+		ss = append(ss, s)
+	}
+	return ss
+}
+
+// header option types
+const (
+	// optionEstimate marks a request as dry-run. The server responds with the
+	// total size of the files matched by each requested name, but doesn't
+	// transfer them. In the response to a name matching a single file, it
+	// marks the checksum as the file's checksum cached by the server.
+	optionEstimate uint8 = iota + 1
+
+	// optionFileCount carries the number of files matched by a requested name
+	// as uint32 in the metadata responding to an estimate request.
+	optionFileCount
+
+	// optionReason carries a human readable description of the reason of a
+	// close message.
+	optionReason
+
+	// optionGzip requests gzip compressed transfers. In metadata, it carries
+	// the uncompressed size of the file as uint64.
+	optionGzip
+
+	// optionChunkSize carries a chunk size as uint16. In requests, it is the
+	// size preferred by the client, in metadata the size used by the server.
+	optionChunkSize
+
+	// optionOffset carries the chunk offset as uint64 in metadata, at which the
+	// transfer of the file started, if it doesn't start at chunk 0.
+	optionOffset
+
+	// optionNackOnly requests selective repeat: The client's acks only request
+	// missing chunks and metadata, their cumulative offset is meaningless. The
+	// client confirms the end of the transfer with a close message.
+	optionNackOnly = optionCritical | 7
+
+	// optionConnectionID carries an opaque ID chosen by the client in all of
+	// its messages. The server identifies the connection by the ID instead of
+	// the client's address, so that the connection survives address changes.
+	// Servers, which don't know it, fall back to the address.
+	optionConnectionID uint8 = 8
+
+	// optionCapabilities asks the server for its capabilities in a request
+	// without files. The metadata responding to it carries the encoded
+	// Capabilities.
+	optionCapabilities uint8 = 9
+
+	// optionName carries the canonical name of a file in metadata, if the
+	// server serves the requested name from a file of another name.
+	optionName uint8 = 10
+
+	// optionProfile carries the name of the transfer profile requested by the
+	// client, see Profile.
+	optionProfile uint8 = 11
+
+	// optionMetadataBatch requests batched metadata. In metadata, it marks a
+	// metadataBatch, which carries the metadata of several files.
+	optionMetadataBatch uint8 = 12
+
+	// optionAppMetadata carries opaque application metadata of a file in
+	// metadata, see SetAppMetadata.
+	optionAppMetadata uint8 = 13
+
+	// optionRegions marks a request as dry-run for region checksums and
+	// carries the region size in bytes as uint32. The server responds with
+	// one metadata per region of each file, which carries the checksum of the
+	// region and its index as uint64 in this option.
+	optionRegions uint8 = 14
+
+	// optionLimit carries the number of chunks as uint64, which are at most
+	// transferred of each requested file from its offset. The files end early
+	// as if they were truncated. Streams and compressed files aren't limited.
+	// With FeatureRanges, it carries one limit per file in request order
+	// instead, split across consecutive options of at most 31 limits each.
+	optionLimit = optionCritical | 15
+
+	// optionChecksums carries the ChecksumAlgorithm of each requested file as
+	// one byte per file in request order.
+	optionChecksums = optionCritical | 16
+
+	// optionByHash marks the files of a request, which are requested by
+	// content, with one byte per file in request order, 1 for requested by
+	// hash. Their names are the hex-encoded digests by the algorithm selected
+	// in optionChecksums.
+	optionByHash = optionCritical | 17
+
+	// optionResumeToken asks the server for resume tokens in a request without
+	// a value. With a value, it presents a token to resume the requested files
+	// at its offsets. Tokens longer than an option value are split across
+	// several options, which are concatenated in order.
+	optionResumeToken uint8 = 18
+
+	// optionVersions carries the protocol versions supported by the server,
+	// one byte each, in a close with unsupportedVersion, which rejects a
+	// request of another version.
+	optionVersions uint8 = 19
+)
+
+// connectionIDSize is the size of the connection IDs chosen by clients.
+const connectionIDSize = 8
+
+const (
+	// defaultChunkSize is the size of chunks in bytes, unless the client
+	// requests another size.
+	defaultChunkSize = 1024
+
+	// minChunkSize and maxChunkSize bound the chunk sizes clients may
+	// request. maxChunkSize leaves room for headers in a UDP datagram.
+	minChunkSize = 64
+	maxChunkSize = 65000
+)
+
+func chunkSizeOption(size int) option {
+	value := make([]byte, 2)
+	binary.BigEndian.PutUint16(value, uint16(size))
+	return option{otype: optionChunkSize, value: value}
+}
+
+func offsetOption(offset uint64) option {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, offset)
+	return option{otype: optionOffset, value: value}
+}
+
+// chunkSize returns the chunk size carried by os, if any.
+func chunkSize(os []option) (int, bool) {
+	o, ok := findOption(os, optionChunkSize)
+	if !ok || len(o.value) != 2 {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint16(o.value)), true
+}
+
+// reasonOption describes err in an option of type optionReason. The
+// description is truncated to the maximum option length.
+func reasonOption(err error) option {
+	value := []byte(err.Error())
+	if len(value) > math.MaxUint8 {
+		value = value[:math.MaxUint8]
+	}
+	return option{otype: optionReason, value: value}
+}
+
+// optionCritical is set in the type of options, which peers must not ignore.
+// A peer, which doesn't understand a critical option, closes the connection,
+// while unknown options without it are ignored.
+const optionCritical uint8 = 0x80
+
+// checkOptions returns an error if os contains an option of unknown type.
+// critical reports whether one of the unknown options is critical.
+func checkOptions(os []option) (critical bool, err error) {
+	for _, o := range os {
+		switch o.otype {
+		case optionEstimate, optionFileCount, optionReason, optionGzip, optionChunkSize, optionOffset,
+			optionNackOnly, optionConnectionID, optionCapabilities, optionName, optionProfile,
+			optionMetadataBatch, optionAppMetadata, optionRegions, optionLimit, optionChecksums,
+			optionByHash, optionResumeToken, optionVersions:
+		default:
+			if o.otype&optionCritical != 0 {
+				return true, fmt.Errorf("unknown critical option type %d", o.otype)
+			}
+			if err == nil {
+				err = fmt.Errorf("unknown option type %d", o.otype)
+			}
+		}
+	}
+	return false, err
+}
+
+func findOption(os []option, otype uint8) (option, bool) {
+	for _, o := range os {
+		if o.otype == otype {
+			return o, true
+		}
+	}
+	return option{}, false
+}
+
 type option struct {
 	otype uint8
 	value []byte
@@ -80,6 +277,11 @@ func (o *option) MarshalBinary() (data []byte, err error) {
 	return buf, nil
 }
 
+// defaultMaxOptions is the number of options, which received headers may
+// carry, unless the connection is configured otherwise. It bounds the cost of
+// parsing headers of untrusted datagrams.
+const defaultMaxOptions = 64
+
 type msgHeader struct {
 	version   uint8
 	msgType   uint8
@@ -87,6 +289,10 @@ type msgHeader struct {
 	optionLen uint8
 	options   []option
 
+	// maxOptions is the number of options UnmarshalBinary accepts,
+	// defaultMaxOptions if 0.
+	maxOptions int
+
 	hdrLen int
 }
 
@@ -116,8 +322,27 @@ func (s msgHeader) MarshalBinary() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// AppendBinary appends the header to b.
+func (s msgHeader) AppendBinary(b []byte) []byte {
+	b = append(b, s.version<<4^s.msgType, s.ackNum, s.optionLen)
+	for _, o := range s.options {
+		b = append(b, o.otype, byte(len(o.value)))
+		b = append(b, o.value...)
+	}
+	return b
+}
+
+// size is the length of the marshaled header.
+func (s msgHeader) size() int {
+	n := 3
+	for _, o := range s.options {
+		n += 2 + len(o.value)
+	}
+	return n
+}
+
 func (s *msgHeader) UnmarshalBinary(data []byte) error {
-	if len(data) < 2 {
+	if len(data) < 3 {
 		return fmt.Errorf("MsgHeader too short")
 	}
 	vt := uint8(data[0])
@@ -125,6 +350,24 @@ func (s *msgHeader) UnmarshalBinary(data []byte) error {
 	s.msgType = vt & 0x0F
 	s.ackNum = uint8(data[1])
 	s.optionLen = uint8(data[2])
+	max := s.maxOptions
+	if max <= 0 {
+		max = defaultMaxOptions
+	}
+	if int(s.optionLen) > max {
+		return fmt.Errorf("header carries %d options, at most %d are allowed", s.optionLen, max)
+	}
+	// The claimed options must fit into data before any is allocated.
+	end := 3
+	for i := 0; i < int(s.optionLen); i++ {
+		if end+2 > len(data) {
+			return fmt.Errorf("header claims %d options, but data ends after %d", s.optionLen, i)
+		}
+		end += 2 + int(data[end+1])
+	}
+	if end > len(data) {
+		return fmt.Errorf("options of header exceed data by %d bytes", end-len(data))
+	}
 	if s.optionLen > 0 {
 		s.options = make([]option, s.optionLen)
 	}
@@ -145,6 +388,9 @@ func (s *msgHeader) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
+// clientRequest requests files, which are identified by their index in files
+// in all further messages. A file name, that is requested more than once, is
+// transferred once for each of its indices, independently of the others.
 type clientRequest struct {
 	maxTransmissionRate uint32
 	files               []fileDescriptor
@@ -197,7 +443,13 @@ func (s clientRequest) MarshalBinary() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// fileDescriptorSize is the size of a file descriptor without its name.
+const fileDescriptorSize = 9
+
 func (s *clientRequest) UnmarshalBinary(data []byte) error {
+	if len(data) < 6 {
+		return fmt.Errorf("request truncated: need %d bytes, have %d", 6, len(data))
+	}
 	s.maxTransmissionRate = binary.BigEndian.Uint32(data[:4])
 	numFiles := binary.BigEndian.Uint16(data[4:6])
 
@@ -205,32 +457,69 @@ func (s *clientRequest) UnmarshalBinary(data []byte) error {
 		return nil
 	}
 
-	s.files = make([]fileDescriptor, numFiles)
+	// The number of files is claimed by the peer, the descriptors must fit
+	// into data before they are allocated.
+	if need := 6 + int(numFiles)*fileDescriptorSize; len(data) < need {
+		return fmt.Errorf("request truncated: need at least %d bytes for %d files, have %d",
+			need, numFiles, len(data))
+	}
+	s.files = make([]fileDescriptor, 0, numFiles)
 
 	dataLens := data[6:]
 	for i := uint16(0); i < numFiles; i++ {
+		if len(dataLens) < fileDescriptorSize {
+			return fmt.Errorf("request truncated: need %d bytes for file descriptor %d, have %d",
+				fileDescriptorSize, i, len(dataLens))
+		}
 		f := fileDescriptor{}
 		f.offset = uintOffset(dataLens[:7])
-		pathLen := binary.BigEndian.Uint16(dataLens[7:9])
+		pathLen := int(binary.BigEndian.Uint16(dataLens[7:9]))
+		if len(dataLens) < fileDescriptorSize+pathLen {
+			return fmt.Errorf("request truncated: need %d bytes for the name of file %d, have %d",
+				pathLen, i, len(dataLens)-fileDescriptorSize)
+		}
 		f.fileName = string(dataLens[9 : 9+pathLen])
 		dataLens = dataLens[9+pathLen:]
-		s.files[i] = f
+		s.files = append(s.files, f)
 	}
 
 	return nil
 }
 
+// Formats of the checksum in serverMetaData, stored in the otherwise reserved
+// first byte of the message.
+const (
+	// The checksum is a 16 byte MD5 digest. Empty checksums are padded with
+	// zeros. This is the only format, older implementations understand.
+	checkSumFixed uint8 = iota
+
+	// The checksum is prefixed by its length in one byte.
+	checkSumLengthPrefixed
+)
+
+const md5Size = 16
+
 type serverMetaData struct {
-	ackNum    uint8
 	status    MetaDataStatus
 	fileIndex uint16
 	size      uint64
-	checkSum  [16]byte
+	checkSum  []byte
+
+	// options are sent in the header.
+	options []option
 }
 
 func (s serverMetaData) MarshalBinary() ([]byte, error) {
+	format := checkSumLengthPrefixed
+	if len(s.checkSum) == 0 || len(s.checkSum) == md5Size {
+		format = checkSumFixed
+	}
+	if len(s.checkSum) > math.MaxUint8 {
+		return nil, fmt.Errorf("checksum too long: %d bytes", len(s.checkSum))
+	}
+
 	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.BigEndian, byte(0))
+	err := binary.Write(buf, binary.BigEndian, format)
 	if err != nil {
 		return nil, err
 	}
@@ -246,29 +535,56 @@ func (s serverMetaData) MarshalBinary() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	_, err = buf.Write(s.checkSum[:])
+	if format == checkSumFixed {
+		cs := make([]byte, md5Size)
+		copy(cs, s.checkSum)
+		_, err = buf.Write(cs)
+	} else {
+		buf.WriteByte(uint8(len(s.checkSum)))
+		_, err = buf.Write(s.checkSum)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), err
 }
 
+// metaDataSize is the size of metadata without its checksum.
+const metaDataSize = 12
+
 func (s *serverMetaData) UnmarshalBinary(data []byte) error {
+	if len(data) < metaDataSize {
+		return fmt.Errorf("metadata truncated: need %d bytes, have %d", metaDataSize, len(data))
+	}
+	format := data[0]
 	s.status = MetaDataStatus(data[1])
 	s.fileIndex = binary.BigEndian.Uint16(data[2:4])
-	s.size = binary.BigEndian.Uint64(data[4:12])
-
-	cs := data[12:28]
+	s.size = binary.BigEndian.Uint64(data[4:metaDataSize])
 
-	for i, c := range cs {
-		s.checkSum[i] = c
+	cs := data[metaDataSize:]
+	switch format {
+	case checkSumFixed:
+		if len(cs) < md5Size {
+			return fmt.Errorf("metadata truncated: need %d bytes of checksum, have %d", md5Size, len(cs))
+		}
+		s.checkSum = append([]byte{}, cs[:md5Size]...)
+	case checkSumLengthPrefixed:
+		if len(cs) < 1 {
+			return errors.New("metadata truncated: missing checksum length")
+		}
+		l := int(cs[0])
+		if len(cs) < 1+l {
+			return fmt.Errorf("metadata truncated: need %d bytes of checksum, have %d", l, len(cs)-1)
+		}
+		s.checkSum = append([]byte{}, cs[1:1+l]...)
+	default:
+		return fmt.Errorf("unknown checksum format: %v", format)
 	}
 	return nil
 }
 
 type serverPayload struct {
 	fileIndex uint16
-	ackNumber uint8
 	offset    uint64
 	data      []byte
 }
@@ -278,32 +594,31 @@ func (s *serverPayload) String() string {
 }
 
 func (s serverPayload) MarshalBinary() ([]byte, error) {
-	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.BigEndian, s.fileIndex)
-	if err != nil {
-		return nil, err
-	}
-	sb, err := sevenByteOffset(s.offset)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Write(buf, binary.BigEndian, sb)
-	if err != nil {
-		return nil, err
-	}
+	return s.AppendBinary(make([]byte, 0, payloadHeaderSize+len(s.data))), nil
+}
 
-	_, err = buf.Write(s.data)
-	bs := buf.Bytes()
-	return bs, err
+// AppendBinary appends the payload to b. It doesn't allocate, if b has room
+// for the 9 byte payload header and the data.
+func (s serverPayload) AppendBinary(b []byte) []byte {
+	b = append(b, byte(s.fileIndex>>8), byte(s.fileIndex))
+	b = appendSevenByteOffset(b, s.offset)
+	return append(b, s.data...)
 }
 
+// payloadHeaderSize is the size of the file index and offset preceding the
+// data of a payload.
+const payloadHeaderSize = 9
+
 func (s *serverPayload) UnmarshalBinary(data []byte) error {
+	if len(data) < payloadHeaderSize {
+		return fmt.Errorf("payload truncated: need %d bytes, have %d", payloadHeaderSize, len(data))
+	}
 	s.fileIndex = binary.BigEndian.Uint16(data[0:2])
 
-	s.offset = uintOffset(data[2:9])
+	s.offset = uintOffset(data[2:payloadHeaderSize])
 
-	if len(data) > 9 {
-		s.data = data[9:]
+	if len(data) > payloadHeaderSize {
+		s.data = data[payloadHeaderSize:]
 	}
 	return nil
 }
@@ -341,8 +656,13 @@ const (
 	metaDataMissing
 )
 
+// clientAck acknowledges all files of a request at once. fileIndex and offset
+// are the cumulative ack of the highest file, whose transfer started, while
+// resendEntries may request chunks and metadata of any file. Clients send a
+// single ack per ack interval, regardless of the number of files.
+//
+// Like for all messages, the ack number is only carried by the header.
 type clientAck struct {
-	ackNumber           uint8
 	fileIndex           uint16
 	status              uint8
 	maxTransmissionRate uint32
@@ -357,8 +677,7 @@ func (c *clientAck) String() string {
 		res = append(res, re.String())
 	}
 	return fmt.Sprintf(
-		"{%v %v %v %v %v %v}",
-		c.ackNumber,
+		"{%v %v %v %v %v}",
 		c.fileIndex,
 		c.status,
 		c.maxTransmissionRate,
@@ -369,12 +688,14 @@ func (c *clientAck) String() string {
 
 // make offset BigEndian and cut off the first (most significant) byte
 func sevenByteOffset(offset uint64) ([]byte, error) {
-	offsetBuffer := new(bytes.Buffer)
-	err := binary.Write(offsetBuffer, binary.BigEndian, offset)
-	if err != nil {
-		return nil, err
-	}
-	return offsetBuffer.Bytes()[1:], nil
+	return appendSevenByteOffset(make([]byte, 0, 7), offset), nil
+}
+
+// appendSevenByteOffset appends offset BigEndian without its first (most
+// significant) byte to b.
+func appendSevenByteOffset(b []byte, offset uint64) []byte {
+	return append(b, byte(offset>>48), byte(offset>>40), byte(offset>>32),
+		byte(offset>>24), byte(offset>>16), byte(offset>>8), byte(offset))
 }
 
 // pad 7 byte with another zero byte to make reading easy
@@ -431,6 +752,9 @@ func (c clientAck) MarshalBinary() ([]byte, error) {
 }
 
 func (c *clientAck) UnmarshalBinary(data []byte) error {
+	if len(data) < 14 {
+		return fmt.Errorf("ack too short: %d bytes", len(data))
+	}
 	c.fileIndex = binary.BigEndian.Uint16(data[0:2])
 	c.status = uint8(data[2])
 	c.maxTransmissionRate = binary.BigEndian.Uint32(data[3:7])
@@ -438,7 +762,11 @@ func (c *clientAck) UnmarshalBinary(data []byte) error {
 
 	if len(data) > 14 {
 		reBytes := data[14:]
-		for i := 0; i < len(reBytes)/10; i++ {
+		if len(reBytes)%10 != 0 {
+			return fmt.Errorf("resend entries of %d bytes not a multiple of 10 bytes", len(reBytes))
+		}
+		n := len(reBytes) / 10
+		for i := 0; i < n; i++ {
 			re := &resendEntry{}
 			re.fileIndex = binary.BigEndian.Uint16(reBytes[:2])
 			re.offset = uintOffset(reBytes[2:9])
@@ -461,6 +789,8 @@ const (
 	wrongChecksum
 	donwloadFinished
 	timeout
+	protocolViolation
+	tooManyRetransmissions
 )
 
 func (m CloseConnectionReason) String() string {
@@ -479,10 +809,24 @@ func (m CloseConnectionReason) String() string {
 		return "5: download finished"
 	case 6:
 		return "6: timeout"
+	case 7:
+		return "7: protocol violation"
+	case 8:
+		return "8: too many retransmissions"
 	}
 	return fmt.Sprintf("unknown reason: %v", uint8(m))
 }
 
+// AllCloseReasons returns all close reasons defined by the protocol in
+// ascending order, e.g. to map them to messages of a user interface.
+func AllCloseReasons() []CloseConnectionReason {
+	rs := make([]CloseConnectionReason, 0, tooManyRetransmissions+1)
+	for r := noReason; r <= tooManyRetransmissions; r++ {
+		rs = append(rs, r)
+	}
+	return rs
+}
+
 type closeConnection struct {
 	reason CloseConnectionReason
 }
@@ -497,6 +841,9 @@ func (c closeConnection) MarshalBinary() ([]byte, error) {
 }
 
 func (c *closeConnection) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("close message too short: %d bytes", len(data))
+	}
 	c.reason = CloseConnectionReason(binary.BigEndian.Uint16(data[:2]))
 	return nil
 }
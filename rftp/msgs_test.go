@@ -1,8 +1,11 @@
 package rftp
 
 import (
+	"bytes"
 	"encoding"
+	"math/rand"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -53,6 +56,36 @@ func TestMsgHeaderMarshalling(t *testing.T) {
 	}
 }
 
+func TestMsgHeaderOptionBounds(t *testing.T) {
+	tests := map[string]struct {
+		data       []byte
+		maxOptions int
+	}{
+		// claims 5 options, but carries a single one
+		"missing options": {[]byte{0x10, 0, 5, 8, 2, 1, 2}, 0},
+		// the second option's value ends beyond the data
+		"truncated value": {[]byte{0x10, 0, 2, 8, 0, 9, 200, 1}, 0},
+		"too many":        {[]byte{0x10, 0, 3, 8, 0, 8, 0, 8, 0}, 2},
+		"above default":   {append([]byte{0x10, 0, defaultMaxOptions + 1}, make([]byte, 2*(defaultMaxOptions+1))...), 0},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			h := &msgHeader{maxOptions: tc.maxOptions}
+			if err := h.UnmarshalBinary(tc.data); err == nil {
+				t.Errorf("parsed %+v, want an error", h)
+			}
+			if h.options != nil {
+				t.Errorf("allocated %v options before rejecting the header", len(h.options))
+			}
+		})
+	}
+
+	h := &msgHeader{maxOptions: 3}
+	if err := h.UnmarshalBinary([]byte{0x10, 0, 3, 8, 0, 8, 0, 8, 1, 1}); err != nil || len(h.options) != 3 {
+		t.Errorf("got %v options, %v, want 3 options", len(h.options), err)
+	}
+}
+
 func TestClientRequestMarshalling(t *testing.T) {
 	tests := map[string]clientRequest{
 		"empty": {},
@@ -81,15 +114,49 @@ func TestClientRequestMarshalling(t *testing.T) {
 	}
 }
 
+func TestClientRequestTruncated(t *testing.T) {
+	tests := map[string]clientRequest{
+		"one file": {
+			maxTransmissionRate: 1000,
+			files:               []fileDescriptor{{5, "path1"}},
+		},
+		"three files": {
+			files: []fileDescriptor{{5, "path1"}, {0, ""}, {10, "a longer path"}},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			bs, err := tc.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := (&clientRequest{}).UnmarshalBinary(bs); err != nil {
+				t.Fatalf("failed to parse complete request: %v", err)
+			}
+			for i := 0; i < len(bs); i++ {
+				if err := (&clientRequest{}).UnmarshalBinary(bs[:i]); err == nil {
+					t.Errorf("parsed request truncated to %v of %v bytes", i, len(bs))
+				}
+			}
+		})
+	}
+
+	// a request claiming many files must not allocate for them
+	bs := []byte{0, 0, 0, 0, 0xff, 0xff}
+	if err := (&clientRequest{}).UnmarshalBinary(bs); err == nil {
+		t.Error("parsed request with 65535 missing files")
+	}
+}
+
 func TestFileRequestMarshalling(t *testing.T) {
 	cs := []byte("846e302501dfdab67f93c10f831d7eee")
-	var csa [16]byte
-	copy(csa[:], cs[:16])
 	tests := map[string]serverMetaData{
-		"empty":             {},
-		"zero":              {0, 0, 0, 0, [16]byte{}},
-		"non-zero-uints":    {0, 1, 2, 3, [16]byte{}},
-		"non-zero-checksum": {0, 1, 2, 3, csa},
+		"empty":             {checkSum: make([]byte, 16)},
+		"zero":              {0, 0, 0, make([]byte, 16), nil},
+		"non-zero-uints":    {1, 2, 3, make([]byte, 16), nil},
+		"non-zero-checksum": {1, 2, 3, cs[:16], nil},
+		"32-byte-checksum":  {1, 2, 3, cs, nil},
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -98,6 +165,28 @@ func TestFileRequestMarshalling(t *testing.T) {
 	}
 }
 
+func TestMetaDataChecksumFormats(t *testing.T) {
+	legacy := append([]byte{0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 3}, make([]byte, 16)...)
+	legacy[12] = 0xab
+	md := serverMetaData{}
+	checkErr(t, md.UnmarshalBinary(legacy))
+	if len(md.checkSum) != 16 || md.checkSum[0] != 0xab || md.size != 3 {
+		t.Errorf("failed to parse fixed size checksum: %+v", md)
+	}
+
+	bs, err := serverMetaData{status: fileNotExistent}.MarshalBinary()
+	checkErr(t, err)
+	if len(bs) != len(legacy) || bs[0] != checkSumFixed {
+		t.Errorf("empty checksum not encoded in fixed format: %x", bs)
+	}
+
+	bs, err = serverMetaData{checkSum: make([]byte, 32)}.MarshalBinary()
+	checkErr(t, err)
+	if len(bs) != 12+1+32 || bs[0] != checkSumLengthPrefixed || bs[12] != 32 {
+		t.Errorf("32 byte checksum not length prefixed: %x", bs)
+	}
+}
+
 func TestDataMarshalling(t *testing.T) {
 	tests := map[string]serverPayload{
 		"empty": {},
@@ -105,7 +194,7 @@ func TestDataMarshalling(t *testing.T) {
 			fileIndex: 0,
 			offset:    0,
 		},
-		"non-zero": {0, 0, 0, []byte("some data")},
+		"non-zero": {0, 0, []byte("some data")},
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -115,11 +204,50 @@ func TestDataMarshalling(t *testing.T) {
 	}
 }
 
+func TestPayloadAppendBinary(t *testing.T) {
+	p := serverPayload{fileIndex: 0x0102, offset: 0x030405060708090a, data: []byte("data")}
+	want := append([]byte{1, 2, 4, 5, 6, 7, 8, 9, 10}, "data"...)
+	if got := p.AppendBinary(nil); !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+	if got := p.AppendBinary([]byte{0xff}); !bytes.Equal(got, append([]byte{0xff}, want...)) {
+		t.Errorf("got %x, want %x appended", got, want)
+	}
+
+	os := []option{{otype: optionConnectionID, value: []byte{1, 2, 3}}}
+	header := msgHeader{version: protocolVersion, msgType: msgServerPayload, ackNum: 7, optionLen: 1, options: os}
+	hs, err := header.MarshalBinary()
+	checkErr(t, err)
+	for _, msg := range []encoding.BinaryMarshaler{p, &p} {
+		bs, err := marshalMsg(7, msg, os...)
+		checkErr(t, err)
+		if !bytes.Equal(bs, append(hs, want...)) {
+			t.Errorf("marshalMsg(%T) = %x, want %x", msg, bs, append(hs, want...))
+		}
+	}
+}
+
+// BenchmarkPayloadAppendBinary marshals payloads into a reused buffer, which
+// must not allocate.
+func BenchmarkPayloadAppendBinary(b *testing.B) {
+	p := serverPayload{fileIndex: 1, offset: 1 << 40, data: testData(defaultChunkSize)}
+	buf := make([]byte, 0, 9+len(p.data))
+	if allocs := testing.AllocsPerRun(100, func() { buf = p.AppendBinary(buf[:0]) }); allocs != 0 {
+		b.Fatalf("got %v allocations per payload", allocs)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(p.data)))
+	for i := 0; i < b.N; i++ {
+		buf = p.AppendBinary(buf[:0])
+	}
+}
+
 func TestAcknowledgementMarshalling(t *testing.T) {
 	tests := map[string]clientAck{
-		"no-missing":   {0, 0, 0, false, 0, 0, nil},
-		"resend-entry": {0, 0, 0, false, 0, 0, []*resendEntry{{0, 1, 2}}},
-		"offset-2":     {0, 0, 0, false, 0, 2, []*resendEntry{{0, 1, 2}}},
+		"no-missing":   {0, 0, 0, 0, nil},
+		"resend-entry": {0, 0, 0, 0, []*resendEntry{{0, 1, 2}}},
+		"offset-2":     {0, 0, 0, 2, []*resendEntry{{0, 1, 2}}},
+		"multi-file":   {0, 0, 0, 2, []*resendEntry{{0, 1, 1}, {1, 1, 1}, {2, 0, 0}}},
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
@@ -129,6 +257,50 @@ func TestAcknowledgementMarshalling(t *testing.T) {
 	}
 }
 
+func TestAcknowledgementResendEntryLength(t *testing.T) {
+	bs, err := clientAck{offset: 2, resendEntries: []*resendEntry{{0, 1, 1}, {1, 1, 1}}}.MarshalBinary()
+	checkErr(t, err)
+
+	ack := &clientAck{}
+	if err := ack.UnmarshalBinary(bs); err != nil {
+		t.Errorf("failed to parse complete resend entries: %v", err)
+	}
+	if len(ack.resendEntries) != 2 {
+		t.Errorf("got %v resend entries, want 2", len(ack.resendEntries))
+	}
+	if err := (&clientAck{}).UnmarshalBinary(bs[:len(bs)-1]); err == nil {
+		t.Error("parsed resend entry one byte short without error")
+	}
+}
+
+func TestAllEnumValuesHaveStrings(t *testing.T) {
+	reasons := AllCloseReasons()
+	if len(reasons) != int(tooManyRetransmissions)+1 {
+		t.Errorf("got %v close reasons, want %v", len(reasons), tooManyRetransmissions+1)
+	}
+	for i, r := range reasons {
+		if int(r) != i || strings.HasPrefix(r.String(), "unknown") {
+			t.Errorf("close reason %v at %v: %q", uint16(r), i, r)
+		}
+	}
+	if next := reasons[len(reasons)-1] + 1; !strings.HasPrefix(next.String(), "unknown") {
+		t.Errorf("close reason %q is missing", next)
+	}
+
+	statuses := AllMetaDataStatuses()
+	if len(statuses) != int(readError)+1 {
+		t.Errorf("got %v statuses, want %v", len(statuses), readError+1)
+	}
+	for i, s := range statuses {
+		if int(s) != i || strings.HasPrefix(s.String(), "unknown") {
+			t.Errorf("status %v at %v: %q", uint8(s), i, s)
+		}
+	}
+	if next := statuses[len(statuses)-1] + 1; !strings.HasPrefix(next.String(), "unknown") {
+		t.Errorf("status %q is missing", next)
+	}
+}
+
 func testConversion(t *testing.T, a UnMarshalBinary, b UnMarshalBinary) {
 	binA, err := a.MarshalBinary()
 	checkErr(t, err)
@@ -147,3 +319,92 @@ func testConversion(t *testing.T, a UnMarshalBinary, b UnMarshalBinary) {
 		t.Errorf("%+v != %+v", binA, binB)
 	}
 }
+
+// FuzzUnmarshal feeds arbitrary bytes to all unmarshalers, which must fail
+// with an error instead of panicking.
+func FuzzUnmarshal(f *testing.F) {
+	seeds := []encoding.BinaryMarshaler{
+		&msgHeader{version: 1, msgType: msgServerPayload, optionLen: 1, options: []option{{8, []byte{1, 2}, 4}}, hdrLen: 7},
+		clientRequest{files: []fileDescriptor{{0, "file"}, {3, "other"}}},
+		serverMetaData{fileIndex: 1, size: 10, checkSum: make([]byte, md5Size)},
+		serverMetaData{fileIndex: 1, checkSum: make([]byte, 32)},
+		serverPayload{fileIndex: 1, offset: 2, data: []byte("some data")},
+		clientAck{offset: 2, resendEntries: []*resendEntry{{0, 1, 1}, {1, 1, 1}}},
+		closeConnection{reason: timeout},
+		metadataBatch{entries: [][]byte{{1, 2, 3}, {}}},
+	}
+	for _, s := range seeds {
+		bs, err := s.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(bs)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, u := range unmarshalers() {
+			u.UnmarshalBinary(data)
+		}
+		parseCapabilities(option{otype: optionCapabilities, value: data})
+	})
+}
+
+// unmarshalers returns a new value of every message type.
+func unmarshalers() []encoding.BinaryUnmarshaler {
+	return []encoding.BinaryUnmarshaler{
+		&option{},
+		&msgHeader{},
+		&clientRequest{},
+		&serverMetaData{},
+		&serverPayload{},
+		&clientAck{},
+		&closeConnection{},
+		&metadataBatch{},
+		&clientReceipt{},
+		&resumeTokenMsg{},
+		&probeMsg{},
+	}
+}
+
+// TestUnmarshalShort feeds random short datagrams to all unmarshalers, which
+// must not panic.
+func TestUnmarshalShort(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		data := make([]byte, rnd.Intn(40))
+		rnd.Read(data)
+		for _, u := range unmarshalers() {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("%T panicked on %x: %v", u, data, r)
+					}
+				}()
+				u.UnmarshalBinary(data)
+			}()
+		}
+	}
+}
+
+func TestServerMessagesTruncated(t *testing.T) {
+	for name, tc := range map[string]struct {
+		msg encoding.BinaryMarshaler
+		u   encoding.BinaryUnmarshaler
+	}{
+		"metadata":               {serverMetaData{fileIndex: 1, size: 10, checkSum: make([]byte, md5Size)}, &serverMetaData{}},
+		"metadata long checksum": {serverMetaData{fileIndex: 1, size: 10, checkSum: make([]byte, 32)}, &serverMetaData{}},
+		"payload":                {serverPayload{fileIndex: 1, offset: 2}, &serverPayload{}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			bs, err := tc.msg.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < len(bs); i++ {
+				if err := tc.u.UnmarshalBinary(bs[:i]); err == nil {
+					t.Errorf("parsed message truncated to %v of %v bytes", i, len(bs))
+				}
+			}
+		})
+	}
+}
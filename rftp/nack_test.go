@@ -0,0 +1,112 @@
+package rftp
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// nackDroppingConn drops payloads of offset and the first dropNacks acks
+// requesting it again.
+type nackDroppingConn struct {
+	connection
+	offset       uint64
+	dropPayloads int
+	dropNacks    int
+
+	lock  sync.Mutex
+	nacks int
+}
+
+func (c *nackDroppingConn) handle(msgType uint8, h packetHandler) {
+	if msgType != msgServerPayload {
+		c.connection.handle(msgType, h)
+		return
+	}
+	c.connection.handle(msgType, handlerFunc(func(w io.Writer, p *packet) {
+		pl := serverPayload{}
+		if err := pl.UnmarshalBinary(p.data); err == nil && pl.offset == c.offset {
+			c.lock.Lock()
+			drop := c.dropPayloads != 0
+			if c.dropPayloads > 0 {
+				c.dropPayloads--
+			}
+			c.lock.Unlock()
+			if drop {
+				return
+			}
+		}
+		h.handle(w, p)
+	}))
+}
+
+func (c *nackDroppingConn) sendAck(ackNum uint8, msg encoding.BinaryMarshaler, os ...option) error {
+	if ack, ok := msg.(clientAck); ok {
+		for _, re := range ack.resendEntries {
+			if re.length > 0 && re.offset == c.offset {
+				c.lock.Lock()
+				c.nacks++
+				drop := c.nacks <= c.dropNacks
+				c.lock.Unlock()
+				if drop {
+					return nil
+				}
+			}
+		}
+	}
+	return c.connection.sendAck(ackNum, msg, os...)
+}
+
+func (c *nackDroppingConn) requests() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.nacks
+}
+
+func TestLostNackIsSentAgain(t *testing.T) {
+	data := testData(20 * 1024)
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	conn := &nackDroppingConn{connection: NewUDPConnection(), offset: 3, dropPayloads: 1, dropNacks: 1}
+	// only the nacks request the chunk, not the frontier of the acks
+	c := Client{Conn: conn, NackTimeout: 20 * time.Millisecond, NackOnly: true}
+	rs, err := c.RequestFrom(addr, []FileRequest{{Name: "file"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rs[0])
+	if err != nil || rs[0].Err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("received %v of %v bytes: %v, %v", len(got), len(data), err, rs[0].Err)
+	}
+	if n := conn.requests(); n < 2 {
+		t.Errorf("requested the lost chunk %v times, want it requested again after the lost nack", n)
+	}
+}
+
+func TestMaxNacks(t *testing.T) {
+	data := testData(20 * 1024)
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	conn := &nackDroppingConn{connection: NewUDPConnection(), offset: 3, dropPayloads: -1}
+	c := Client{Conn: conn, NackTimeout: 10 * time.Millisecond, MaxNacks: 3}
+	rs, err := c.RequestFrom(addr, []FileRequest{{Name: "file"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(rs[0])
+	if !errors.Is(rs[0].err(), ErrGaveUp) {
+		t.Errorf("got error %v, want %v", rs[0].err(), ErrGaveUp)
+	}
+	if n := conn.requests(); n != 3 {
+		t.Errorf("requested the lost chunk %v times, want 3", n)
+	}
+}
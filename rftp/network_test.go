@@ -0,0 +1,544 @@
+package rftp
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memNetwork is an in-memory datagram network between memConns. It drops,
+// delays and reorders datagrams as configured. Datagrams are delivered by a
+// virtual clock, which tests advance by advanceUntil, and servers and clients
+// on the network are meant to use the same clock. Whether a datagram is
+// dropped or reordered depends only on the seed, the datagram and how often it
+// was sent before, not on the order of sends, so that a seed determines a run.
+type memNetwork struct {
+	// Loss is the probability of a datagram to be dropped.
+	Loss float64
+	// RTT is the round trip time between any two connections.
+	RTT time.Duration
+	// Reorder is the probability of a datagram to be delayed by another RTT,
+	// so that later datagrams overtake it.
+	Reorder float64
+	// Rate is the rate in bytes per second, at which datagrams reach each
+	// connection. Datagrams queue up behind each other at the bottleneck. 0
+	// means unlimited.
+	Rate int
+
+	clock *virtualClock
+	// pending counts the datagrams delivered, but not handled yet. It's
+	// accessed atomically.
+	pending int64
+
+	lock     sync.Mutex
+	seed     int64
+	conns    map[string]*memConn
+	nextPort int
+	// busy is the time up to which the bottleneck to each address is busy.
+	busy map[string]time.Time
+	// sent counts the sends of each datagram by its hash, if datagrams are
+	// dropped or reordered.
+	sent map[uint64]int
+}
+
+func newMemNetwork(seed int64) *memNetwork {
+	return &memNetwork{
+		clock:    newVirtualClock(),
+		seed:     seed,
+		conns:    make(map[string]*memConn),
+		nextPort: 40000,
+		busy:     make(map[string]time.Time),
+		sent:     make(map[uint64]int),
+	}
+}
+
+// conn returns a new connection on the network, which isn't bound yet.
+func (n *memNetwork) conn() *memConn {
+	return &memConn{network: n, handlers: make(map[uint8]packetHandler)}
+}
+
+// attach binds c to addr or, if addr is nil, to an ephemeral port.
+func (n *memNetwork) attach(c *memConn, addr *net.UDPAddr) (*net.UDPAddr, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if addr == nil {
+		n.nextPort++
+		addr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: n.nextPort}
+	}
+	if _, ok := n.conns[addr.String()]; ok {
+		return nil, fmt.Errorf("address %v in use", addr)
+	}
+	n.conns[addr.String()] = c
+	return addr, nil
+}
+
+func (n *memNetwork) detach(addr *net.UDPAddr) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.conns, addr.String())
+}
+
+// bound reports whether a connection is bound to addr.
+func (n *memNetwork) bound(addr string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	_, ok := n.conns[addr]
+	return ok
+}
+
+// send delivers a copy of bs from src to dst after half the RTT and the time
+// it queues at the bottleneck, unless it's dropped.
+func (n *memNetwork) send(src, dst *net.UDPAddr, bs []byte) {
+	n.lock.Lock()
+	loss, reorder := n.fate(src, dst, bs)
+	if loss < n.Loss {
+		n.lock.Unlock()
+		return
+	}
+	delay := n.RTT / 2
+	if reorder < n.Reorder {
+		delay += n.RTT
+	}
+	if n.Rate > 0 {
+		now := n.clock.Now()
+		start := n.busy[dst.String()]
+		if start.Before(now) {
+			start = now
+		}
+		end := start.Add(time.Duration(len(bs)) * time.Second / time.Duration(n.Rate))
+		n.busy[dst.String()] = end
+		delay += end.Sub(now)
+	}
+	n.lock.Unlock()
+
+	msg := append([]byte{}, bs...)
+	n.clock.afterInline(delay, func() {
+		n.lock.Lock()
+		c, ok := n.conns[dst.String()]
+		n.lock.Unlock()
+		if ok {
+			c.deliver(datagram{src: src, data: msg})
+		}
+	})
+}
+
+// fate returns two numbers in [0, 1), which decide whether bs is dropped and
+// whether it's reordered. n.lock must be held.
+func (n *memNetwork) fate(src, dst *net.UDPAddr, bs []byte) (loss, reorder float64) {
+	if n.Loss == 0 && n.Reorder == 0 {
+		return 1, 1
+	}
+	h := fnv.New64a()
+	binary.Write(h, binary.BigEndian, n.seed)
+	io.WriteString(h, src.String())
+	io.WriteString(h, dst.String())
+	h.Write(bs)
+	key := h.Sum64()
+	// resends of a dropped datagram must not share its fate
+	binary.Write(h, binary.BigEndian, int64(n.sent[key]))
+	n.sent[key]++
+	x := h.Sum64()
+	return unitFloat(splitmix64(x)), unitFloat(splitmix64(x + 1))
+}
+
+// unitFloat maps x to [0, 1).
+func unitFloat(x uint64) float64 {
+	return float64(x>>11) / (1 << 53)
+}
+
+// settleYields is the number of times in a row, that the processor must be
+// yielded without any work on the network, before it's considered settled.
+const settleYields = 10
+
+// settle waits until all delivered datagrams were handled, no timer callbacks
+// are running and the clock stayed unused while the processor was yielded
+// settleYields times in a row, so that the clock doesn't overtake goroutines
+// still reacting to its last advance. Simulations run on a single processor,
+// see simulatedServer, so yielding it lets every ready goroutine run. Only the
+// work of the network and its clock is tracked, goroutines of other tests
+// don't delay it.
+func (n *memNetwork) settle() {
+	for yields := 0; yields < settleYields; {
+		ops := n.clock.activity()
+		runtime.Gosched()
+		if atomic.LoadInt64(&n.pending) > 0 || n.clock.busy() || n.clock.activity() != ops {
+			yields = 0
+			continue
+		}
+		yields++
+	}
+}
+
+// advanceUntil advances the clock of the network until done is closed. Before
+// each advance, it waits for the network to settle.
+func (n *memNetwork) advanceUntil(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		n.settle()
+		n.clock.advance()
+	}
+}
+
+type datagram struct {
+	src  *net.UDPAddr
+	data []byte
+}
+
+// memConn is a connection on a memNetwork. Like a UDP socket, it can be
+// connected again after it was closed.
+type memConn struct {
+	network     *memNetwork
+	handlers    map[uint8]packetHandler
+	violation   violationHandler
+	unsupported violationHandler
+
+	lock   sync.Mutex
+	local  *net.UDPAddr
+	remote *net.UDPAddr
+	inbox  chan datagram
+	done   chan struct{}
+	closed chan struct{}
+}
+
+var _ connection = (*memConn)(nil)
+
+func (c *memConn) addr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.local
+}
+
+func (c *memConn) handle(msgType uint8, h packetHandler) {
+	c.handlers[msgType] = h
+}
+
+func (c *memConn) handleViolation(h violationHandler) {
+	c.violation = h
+}
+
+func (c *memConn) handleUnsupported(h violationHandler) {
+	c.unsupported = h
+}
+
+// bind attaches c to addr or to an ephemeral port with a fresh inbox.
+func (c *memConn) bind(addr *net.UDPAddr) error {
+	local, err := c.network.attach(c, addr)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.local = local
+	c.inbox = make(chan datagram, 1024*1024)
+	c.done = make(chan struct{})
+	c.closed = make(chan struct{})
+	return nil
+}
+
+func (c *memConn) listen(host string) (func(), error) {
+	addr, err := net.ResolveUDPAddr("udp4", host)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.bind(addr); err != nil {
+		return nil, err
+	}
+	return func() { c.cclose(0) }, nil
+}
+
+func (c *memConn) connectTo(host string) error {
+	addr, err := net.ResolveUDPAddr("udp4", host)
+	if err != nil {
+		return err
+	}
+	if err := c.bind(nil); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.remote = addr
+	c.lock.Unlock()
+	return nil
+}
+
+// deliver queues d to be received, unless c is closed or its inbox is full.
+func (c *memConn) deliver(d datagram) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	select {
+	case c.inbox <- d:
+		atomic.AddInt64(&c.network.pending, 1)
+	default:
+	}
+}
+
+func (c *memConn) receive() error {
+	return c.receiveContext(context.Background())
+}
+
+func (c *memConn) receiveContext(ctx context.Context) error {
+	c.lock.Lock()
+	local, inbox, done, closed := c.local, c.inbox, c.done, c.closed
+	c.lock.Unlock()
+
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		close(closed)
+	}()
+	for {
+		var d datagram
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case d = <-inbox:
+		}
+		handle := c.dispatch(local, d)
+		if handle == nil {
+			atomic.AddInt64(&c.network.pending, -1)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer atomic.AddInt64(&c.network.pending, -1)
+			handle()
+		}()
+	}
+}
+
+// dispatch returns the handling of d received on local, nil if d was handled
+// already.
+func (c *memConn) dispatch(local *net.UDPAddr, d datagram) func() {
+	src := d.src
+	rw := responseWriter(func(bs []byte) (int, error) {
+		c.network.send(local, src, bs)
+		return len(bs), nil
+	})
+
+	header := &msgHeader{}
+	if err := header.UnmarshalBinary(d.data); err != nil {
+		if c.violation != nil {
+			c.violation(rw, src, d.data, err)
+		}
+		return nil
+	}
+	if critical, err := checkOptions(header.options); critical {
+		if c.unsupported != nil {
+			c.unsupported(rw, src, d.data, err)
+		}
+		return nil
+	}
+	handler, ok := c.handlers[header.msgType]
+	if !ok {
+		log.Printf("no handler for message type %d\n", header.msgType)
+		return nil
+	}
+	p := &packet{
+		os:         header.options,
+		data:       d.data[header.hdrLen:],
+		remoteAddr: src,
+		ackNum:     header.ackNum,
+		version:    header.version,
+	}
+	return func() { handler.handle(rw, p) }
+}
+
+func (c *memConn) send(msg encoding.BinaryMarshaler, os ...option) error {
+	return c.sendAck(0, msg, os...)
+}
+
+func (c *memConn) sendAck(ackNum uint8, msg encoding.BinaryMarshaler, os ...option) error {
+	bs, err := marshalMsg(ackNum, msg, os...)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	local, remote := c.local, c.remote
+	c.lock.Unlock()
+	if local == nil || remote == nil {
+		return fmt.Errorf("connection not connected")
+	}
+	c.network.send(local, remote, bs)
+	return nil
+}
+
+// cclose unbinds the connection and waits up to timeout for receive to finish
+// handling in-flight packets. Closing a closed connection is a no-op.
+func (c *memConn) cclose(timeout time.Duration) error {
+	c.lock.Lock()
+	local, done, closed := c.local, c.done, c.closed
+	if done == nil {
+		c.lock.Unlock()
+		return nil
+	}
+	select {
+	case <-done:
+		c.lock.Unlock()
+		return nil
+	default:
+	}
+	close(done)
+	// datagrams left in the inbox are never handled
+	for drained := false; !drained; {
+		select {
+		case <-c.inbox:
+			atomic.AddInt64(&c.network.pending, -1)
+		default:
+			drained = true
+		}
+	}
+	c.lock.Unlock()
+
+	c.network.detach(local)
+	select {
+	case <-closed:
+	case <-time.After(timeout):
+	}
+	return nil
+}
+
+// LossSim is ignored, the network simulates loss.
+func (c *memConn) LossSim(LossSimulator) {}
+
+func (c *memConn) BindAddr(string) error { return nil }
+
+func (c *memConn) BindInterface(string) error { return nil }
+
+// simulatedServer serves files by fh on network until the test ends and
+// returns its address.
+func simulatedServer(tb testing.TB, network *memNetwork, fh FileHandler) string {
+	const addr = "10.0.0.1:2020"
+	// a single processor without garbage collection runs the goroutines of
+	// the simulation in the same order each time
+	procs := runtime.GOMAXPROCS(1)
+	gc := debug.SetGCPercent(-1)
+	tb.Cleanup(func() {
+		debug.SetGCPercent(gc)
+		runtime.GOMAXPROCS(procs)
+	})
+	s := NewServer()
+	s.Conn = network.conn()
+	s.clk = network.clock
+	s.SetFileHandler(fh)
+	go s.Listen(addr)
+	for i := 0; !network.bound(addr); i++ {
+		if i == 100 {
+			tb.Fatal("server did not start listening")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	tb.Cleanup(func() {
+		// connections only close, while the clock advances
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			s.Shutdown(ctx)
+		}()
+		network.advanceUntil(done)
+	})
+	return addr
+}
+
+// simulatedClient returns a client on network, which uses its clock.
+func simulatedClient(network *memNetwork) *Client {
+	return &Client{Conn: network.conn(), clk: network.clock}
+}
+
+// simulatedTransfer serves files by fh on network and requests names from a
+// client on the same network. It returns the received content of the files.
+func simulatedTransfer(t *testing.T, network *memNetwork, fh FileHandler, names []string) [][]byte {
+	addr := simulatedServer(t, network, fh)
+	c := simulatedClient(network)
+	var (
+		received [][]byte
+		err      error
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var rs []*FileResponse
+		if rs, err = c.Request(addr, names); err != nil {
+			return
+		}
+		received = make([][]byte, len(rs))
+		for i, r := range rs {
+			if received[i], err = ioutil.ReadAll(r); err != nil {
+				err = fmt.Errorf("reading %v: %w", names[i], err)
+				return
+			}
+			if r.Err != nil {
+				t.Errorf("%v: %v", names[i], r.Err)
+			}
+		}
+	}()
+	network.advanceUntil(done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return received
+}
+
+func TestSimulatedTransferUnderLoss(t *testing.T) {
+	data := testData(100*1024 + 17)
+	network := newMemNetwork(1)
+	network.Loss = 0.1
+	network.RTT = 10 * time.Millisecond
+	network.Reorder = 0.05
+
+	got := simulatedTransfer(t, network, bytesHandler(map[string][]byte{"file": data}), []string{"file"})
+	if !bytes.Equal(got[0], data) {
+		t.Errorf("received %v bytes differing from the %v source bytes", len(got[0]), len(data))
+	}
+}
+
+func TestSimulatedTransferIsDeterministic(t *testing.T) {
+	data := testData(50*1024 + 17)
+	run := func() (time.Duration, map[uint64]int) {
+		network := newMemNetwork(3)
+		network.Loss = 0.1
+		network.RTT = 10 * time.Millisecond
+		network.Reorder = 0.05
+		start := network.clock.Now()
+		simulatedTransfer(t, network, bytesHandler(map[string][]byte{"file": data}), []string{"file"})
+		// the client's close may still be on its way
+		network.settle()
+		network.lock.Lock()
+		defer network.lock.Unlock()
+		return network.clock.Now().Sub(start), network.sent
+	}
+	took, sent := run()
+	again, sentAgain := run()
+	if took != again {
+		t.Errorf("transfers took %v and %v", took, again)
+	}
+	if !reflect.DeepEqual(sent, sentAgain) {
+		t.Errorf("transfers sent %v and %v distinct datagrams", len(sent), len(sentAgain))
+	}
+}
@@ -0,0 +1,223 @@
+package rftp
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// defaultPersistInterval is the default of Server.PersistInterval.
+const defaultPersistInterval = 100 * time.Millisecond
+
+// StateStore persists the state of connections with a connection ID, so that
+// a restarted server resumes their transfers, once the client acknowledges
+// again. Implementations must be safe for concurrent use.
+type StateStore interface {
+	// Save stores the state of the connection id. It is called with the acks
+	// of the client, at most once per Server.PersistInterval.
+	Save(id string, state *ConnectionState) error
+	// Load returns the state of the connection id. It returns false, if there
+	// is none.
+	Load(id string) (*ConnectionState, bool, error)
+	// Delete removes the state of the connection id, once it is closed.
+	Delete(id string) error
+}
+
+// ConnectionState is the state needed to resume the transfer of a connection.
+type ConnectionState struct {
+	Files     []PersistedFile
+	ChunkSize int
+	Gzip      bool
+	NackOnly  bool
+	Profile   Profile
+	// Limits are the numbers of chunks transferred of each file from its
+	// offset, nil means no limit.
+	Limits        []uint64
+	BatchMetadata bool
+}
+
+// PersistedFile is the state of a requested file.
+type PersistedFile struct {
+	// FileRequest holds the name, the checksum algorithm, the digest of files
+	// requested by hash and the chunk, at which the transfer started, if it
+	// started, or else the requested offset.
+	FileRequest
+	// Frontier is the offset of the first chunk, which the client didn't
+	// acknowledge.
+	Frontier uint64
+	// ChunkSize is the chunk size of the file, 0 if its transfer didn't
+	// start.
+	ChunkSize int
+}
+
+// MemoryStateStore keeps states in memory. It survives restarts of servers
+// within a process, e.g. in tests.
+type MemoryStateStore struct {
+	lock   sync.Mutex
+	states map[string]*ConnectionState
+}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{states: make(map[string]*ConnectionState)}
+}
+
+func (m *MemoryStateStore) Save(id string, state *ConnectionState) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.states[id] = state.copy()
+	return nil
+}
+
+func (m *MemoryStateStore) Load(id string) (*ConnectionState, bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	state, ok := m.states[id]
+	if !ok {
+		return nil, false, nil
+	}
+	return state.copy(), true, nil
+}
+
+func (m *MemoryStateStore) Delete(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.states, id)
+	return nil
+}
+
+func (s *ConnectionState) copy() *ConnectionState {
+	c := *s
+	c.Files = append([]PersistedFile{}, s.Files...)
+	if s.Limits != nil {
+		c.Limits = append([]uint64{}, s.Limits...)
+	}
+	return &c
+}
+
+// request returns the request, which resumes the connection.
+func (s *ConnectionState) request() *clientRequest {
+	cr := &clientRequest{files: make([]fileDescriptor, len(s.Files))}
+	for i, f := range s.Files {
+		cr.files[i] = fileDescriptor{f.Offset, f.Name}
+	}
+	return cr
+}
+
+// checksums returns the checksum algorithms of the files.
+func (s *ConnectionState) checksums() []ChecksumAlgorithm {
+	algs := make([]ChecksumAlgorithm, len(s.Files))
+	for i, f := range s.Files {
+		algs[i] = f.Checksum
+	}
+	return algs
+}
+
+// digests returns the digests of the files requested by hash, nil if all were
+// requested by name.
+func (s *ConnectionState) digests() [][]byte {
+	var ds [][]byte
+	for i, f := range s.Files {
+		if f.Hash == nil {
+			continue
+		}
+		if ds == nil {
+			ds = make([][]byte, len(s.Files))
+		}
+		ds[i] = f.Hash
+	}
+	return ds
+}
+
+// fileStart is the start offset and chunk size of a file, whose transfer
+// started.
+type fileStart struct {
+	offset    uint64
+	chunkSize int
+}
+
+// started records the start offset and chunk size of the file at index.
+func (c *clientConnection) started(index uint16, offset uint64, chunkSize int) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if c.state.starts == nil {
+		c.state.starts = make(map[uint16]fileStart)
+	}
+	c.state.starts[index] = fileStart{offset, chunkSize}
+}
+
+// persist saves the state of the connection, if it has a store and the last
+// save is at least persistInterval ago.
+func (c *clientConnection) persist() {
+	if c.store == nil {
+		return
+	}
+	now := c.clock().Now()
+	if !c.persistedAt.IsZero() && now.Sub(c.persistedAt) < c.persistInterval {
+		return
+	}
+	state := c.connectionState()
+	if err := c.store.Save(c.id, state); err != nil {
+		log.Printf("failed to save state of connection %v: %v\n", c.id, err)
+		return
+	}
+	c.persistedAt = now
+}
+
+// connectionState returns the current state of the connection.
+func (c *clientConnection) connectionState() *ConnectionState {
+	state := &ConnectionState{
+		Files:     make([]PersistedFile, len(c.req.files)),
+		ChunkSize: c.chunkSize,
+		Gzip:      c.gzip,
+		NackOnly:  c.nackOnly,
+		Profile:   c.profile,
+
+		Limits:        c.limits,
+		BatchMetadata: c.batchMetadata,
+	}
+	c.stateLock.Lock()
+	for i, f := range c.req.files {
+		index := uint16(i)
+		pf := PersistedFile{
+			FileRequest: FileRequest{
+				Name:     f.fileName,
+				Offset:   f.offset,
+				Checksum: c.checksum(index),
+				Hash:     c.digest(index),
+			},
+			Frontier: c.state.frontier[index],
+		}
+		if start, ok := c.state.starts[index]; ok {
+			pf.Offset = start.offset
+			pf.ChunkSize = start.chunkSize
+		}
+		state.Files[i] = pf
+	}
+	c.stateLock.Unlock()
+	return state
+}
+
+// resumed returns the persisted state of the file at index, if the connection
+// resumes a transfer, which already started the file.
+func (c *clientConnection) resumed(index uint16) (PersistedFile, bool) {
+	if c.resume == nil || int(index) >= len(c.resume.Files) {
+		return PersistedFile{}, false
+	}
+	f := c.resume.Files[index]
+	return f, f.ChunkSize > 0
+}
+
+// acknowledged reports whether the client acknowledged all n chunks of the
+// file at index before the connection was resumed. Its metadata is only
+// cached then, the client may already be done with the file.
+func (c *clientConnection) acknowledged(index uint16, n uint64) bool {
+	f, ok := c.resumed(index)
+	return ok && f.Frontier >= n
+}
+
+// cacheMetadata keeps md for retransmissions without sending it.
+func (c *clientConnection) cacheMetadata(md *serverMetaData) {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	c.metadataCache[md.fileIndex] = md
+}
@@ -0,0 +1,300 @@
+package rftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// stallingReaderAt reads data up to stall and blocks beyond it until ctx is
+// done.
+type stallingReaderAt struct {
+	ctx   context.Context
+	data  []byte
+	stall int64
+}
+
+func (r *stallingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > r.stall {
+		<-r.ctx.Done()
+		return 0, r.ctx.Err()
+	}
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+// stallingHandler serves data, whose reads block beyond stall bytes.
+func stallingHandler(data []byte, stall int64) FileHandler {
+	return func(ctx context.Context, name string) (*io.SectionReader, error) {
+		r := &stallingReaderAt{ctx: ctx, data: data, stall: stall}
+		return io.NewSectionReader(r, 0, int64(len(data))), nil
+	}
+}
+
+// restartServer crashes first, once store holds a frontier of acked chunks of
+// the first file, and starts a server configured by setup with store at addr
+// instead. It returns the summaries of the second server.
+func restartServer(t *testing.T, first *Server, addr string, store *MemoryStateStore, acked, stall uint64, setup func(*Server)) <-chan TransferSummary {
+	deadline := time.Now().Add(2 * time.Second)
+	for frontier := uint64(0); frontier < acked; {
+		if time.Now().After(deadline) {
+			t.Fatalf("persisted frontier %v, want %v", frontier, acked)
+		}
+		time.Sleep(10 * time.Millisecond)
+		store.lock.Lock()
+		for _, state := range store.states {
+			frontier = state.Files[0].Frontier
+		}
+		store.lock.Unlock()
+		if frontier > stall {
+			t.Fatalf("persisted frontier %v beyond the stall at %v", frontier, stall)
+		}
+	}
+
+	// the first server crashes and a second one takes over its address
+	first.Conn.cclose(0)
+	summaries := make(chan TransferSummary, 1)
+	second := NewServer()
+	second.StateStore = store
+	second.OnComplete = func(s TransferSummary) {
+		summaries <- s
+	}
+	setup(second)
+	go second.Listen(addr)
+	t.Cleanup(func() { second.Shutdown(context.Background()) })
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		probe, err := net.ListenUDP("udp4", udpAddr)
+		if err != nil {
+			break
+		}
+		probe.Close()
+		if i == 100 {
+			t.Fatal("second server did not start listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return summaries
+}
+
+// readAsync reads fr completely in the background.
+func readAsync(fr *FileResponse) <-chan []byte {
+	received := make(chan []byte, 1)
+	go func() {
+		got, _ := ioutil.ReadAll(fr)
+		received <- got
+	}()
+	return received
+}
+
+func TestResumeAfterRestart(t *testing.T) {
+	const chunks, stall = 300, 150
+	// The server reads whole blocks, so only the blocks before the stall are
+	// sent.
+	const blockChunks = defaultReadBlockSize / 1024
+	const acked = stall / blockChunks * blockChunks
+	data := testData(chunks * 1024)
+	store := NewMemoryStateStore()
+
+	// the first server stalls in the middle of the file
+	first := NewServer()
+	first.StateStore = store
+	first.SetFileHandler(stallingHandler(data, stall*1024))
+	addr := startServer(t, first)
+
+	c := Client{Conn: NewUDPConnection(), ConnectionID: true}
+	rs, err := c.Request(addr, []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := readAsync(rs[0])
+
+	summaries := restartServer(t, first, addr, store, acked, stall, func(s *Server) {
+		s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	})
+
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, data) || rs[0].Err != nil {
+			t.Fatalf("received %v of %v bytes: %v", len(got), len(data), rs[0].Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("resumed transfer did not complete")
+	}
+	select {
+	case s := <-summaries:
+		if max := uint64(chunks-acked) * 1024; s.Bytes > max {
+			t.Errorf("resumed connection sent %v bytes, want at most %v", s.Bytes, max)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("resumed connection not closed")
+	}
+}
+
+func TestResumeKeepsLimits(t *testing.T) {
+	const chunks, stall = 300, 150
+	const blockChunks = defaultReadBlockSize / 1024
+	const acked = stall / blockChunks * blockChunks
+	// a range, which ends beyond the stall
+	const limit = 200
+	data := testData(chunks * 1024)
+	store := NewMemoryStateStore()
+
+	first := NewServer()
+	first.StateStore = store
+	first.SetFileHandler(stallingHandler(data, stall*1024))
+	addr := startServer(t, first)
+
+	c := Client{Conn: NewUDPConnection(), ConnectionID: true, BatchMetadata: true}
+	c.limits = []uint64{limit}
+	rs, err := c.Request(addr, []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := readAsync(rs[0])
+
+	summaries := restartServer(t, first, addr, store, acked, stall, func(s *Server) {
+		s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	})
+
+	want := data[:limit*1024]
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, want) || rs[0].Err != nil {
+			t.Fatalf("received %v of %v bytes of the range: %v", len(got), len(want), rs[0].Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("resumed transfer did not complete")
+	}
+	select {
+	case s := <-summaries:
+		if max := uint64(limit-acked) * 1024; s.Bytes > max {
+			t.Errorf("resumed connection sent %v bytes, want at most the %v bytes left of the range", s.Bytes, max)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("resumed connection not closed")
+	}
+}
+
+func TestResumeKeepsChecksum(t *testing.T) {
+	const chunks, stall = 300, 150
+	const blockChunks = defaultReadBlockSize / 1024
+	const acked = stall / blockChunks * blockChunks
+	data := testData(chunks * 1024)
+	store := NewMemoryStateStore()
+
+	first := NewServer()
+	first.StateStore = store
+	first.SetFileHandler(stallingHandler(data, stall*1024))
+	addr := startServer(t, first)
+
+	c := Client{Conn: NewUDPConnection(), ConnectionID: true}
+	rs, err := c.RequestFrom(addr, []FileRequest{{Name: "file", Checksum: ChecksumCRC32}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := readAsync(rs[0])
+
+	restartServer(t, first, addr, store, acked, stall, func(s *Server) {
+		s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	})
+
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, data) || rs[0].Err != nil {
+			t.Fatalf("received %v of %v bytes: %v", len(got), len(data), rs[0].Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("resumed transfer did not complete")
+	}
+}
+
+func TestResumeKeepsHash(t *testing.T) {
+	const chunks, stall = 300, 150
+	const blockChunks = defaultReadBlockSize / 1024
+	const acked = stall / blockChunks * blockChunks
+	data := testData(chunks * 1024)
+	sum := sha256.Sum256(data)
+	store := NewMemoryStateStore()
+
+	first := NewServer()
+	first.StateStore = store
+	stalling := stallingHandler(data, stall*1024)
+	first.HashHandler = func(ctx context.Context, _ ChecksumAlgorithm, _ []byte) (*io.SectionReader, error) {
+		return stalling(ctx, "")
+	}
+	addr := startServer(t, first)
+
+	c := Client{Conn: NewUDPConnection(), ConnectionID: true}
+	rs, err := c.RequestFrom(addr, []FileRequest{{Hash: sum[:], Checksum: ChecksumSHA256}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := readAsync(rs[0])
+
+	restartServer(t, first, addr, store, acked, stall, func(s *Server) {
+		s.SetFileHandler(func(_ context.Context, name string) (*io.SectionReader, error) {
+			t.Errorf("opened the digest as file %v", name)
+			return nil, nil
+		})
+		s.HashHandler = func(_ context.Context, _ ChecksumAlgorithm, digest []byte) (*io.SectionReader, error) {
+			if !bytes.Equal(digest, sum[:]) {
+				return nil, nil
+			}
+			return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), nil
+		}
+	})
+
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, data) || rs[0].Err != nil {
+			t.Fatalf("received %v of %v bytes: %v", len(got), len(data), rs[0].Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("resumed transfer did not complete")
+	}
+}
+
+// countingStore counts the saves of states.
+type countingStore struct {
+	*MemoryStateStore
+	saves int
+}
+
+func (s *countingStore) Save(id string, state *ConnectionState) error {
+	s.saves++
+	return s.MemoryStateStore.Save(id, state)
+}
+
+func TestPersistInterval(t *testing.T) {
+	clk := newVirtualClock()
+	store := &countingStore{MemoryStateStore: NewMemoryStateStore()}
+	c := newTestClientConnection(&clientRequest{files: []fileDescriptor{{0, "file"}}}, ioutil.Discard)
+	c.clk = clk
+	c.store, c.id = store, "id"
+	c.persistInterval = time.Second
+
+	c.persist()
+	c.state.frontier[0] = 5
+	c.persist()
+	if store.saves != 1 {
+		t.Fatalf("saved %v times within the interval, want 1", store.saves)
+	}
+	clk.afterInline(time.Second, func() {})
+	clk.advance()
+	c.persist()
+	if store.saves != 2 {
+		t.Fatalf("saved %v times after the interval, want 2", store.saves)
+	}
+	state, _, _ := store.Load("id")
+	if state.Files[0].Frontier != 5 {
+		t.Errorf("persisted frontier %v, want 5", state.Files[0].Frontier)
+	}
+}
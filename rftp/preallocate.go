@@ -0,0 +1,42 @@
+package rftp
+
+import (
+	"io"
+	"os"
+)
+
+// truncater is a writer, whose size can be set, like *os.File.
+type truncater interface {
+	Truncate(size int64) error
+}
+
+// preallocate reserves size bytes in w. Files are allocated on disk where the
+// platform supports it, other writers are truncated to size, if they can be.
+// Writers of neither kind are left alone.
+func preallocate(w io.WriterAt, size int64) error {
+	switch w := w.(type) {
+	case *os.File:
+		return allocateFile(w, size)
+	case teeWriterAt:
+		for _, tw := range w {
+			if err := preallocate(tw, size); err != nil {
+				return err
+			}
+		}
+		return nil
+	case truncater:
+		return w.Truncate(size)
+	}
+	return nil
+}
+
+// announcedSize returns the size of the content read from f, once the metadata
+// announced it.
+func (f *FileResponse) announcedSize() (uint64, bool) {
+	select {
+	case <-f.sized:
+		return f.size, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,20 @@
+package rftp
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocateFile allocates the blocks of the first size bytes of f, so that the
+// disk running full fails now instead of in the middle of the transfer. It
+// falls back to truncating f on file systems without fallocate.
+func allocateFile(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return f.Truncate(size)
+	}
+	if err != nil {
+		return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+	}
+	return nil
+}
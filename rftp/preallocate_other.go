@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package rftp
+
+import "os"
+
+func allocateFile(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
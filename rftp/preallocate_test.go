@@ -0,0 +1,79 @@
+package rftp
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// statWriterAt records the size of f, when it's written to the first time.
+type statWriterAt struct {
+	f     *os.File
+	sizes []int64
+}
+
+func (s *statWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if len(s.sizes) == 0 {
+		fi, err := s.f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		s.sizes = append(s.sizes, fi.Size())
+	}
+	return len(p), nil
+}
+
+func TestDownloadPreallocate(t *testing.T) {
+	data := testData(100*1024 + 100)
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	f, err := ioutil.TempFile("", "rftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// the probe sees the file before the first chunk is written to it
+	probe := &statWriterAt{f: f}
+	c := Client{Conn: NewUDPConnection(), Preallocate: true}
+	res, err := c.Download(context.Background(), addr, []DownloadFile{{FileRequest{Name: "file"}, TeeWriterAt(probe, f)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probe.sizes) == 0 || probe.sizes[0] != int64(len(data)) {
+		t.Errorf("file had sizes %v before the first write, want %v", probe.sizes, len(data))
+	}
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Files[0].Complete || !bytes.Equal(got, data) {
+		t.Errorf("got %+v and %v bytes, want the complete file", res.Files[0], len(got))
+	}
+}
+
+func TestPreallocateWriters(t *testing.T) {
+	w := &truncatingWriterAt{}
+	if err := preallocate(TeeWriterAt(&memWriterAt{}, w), 42); err != nil {
+		t.Fatal(err)
+	}
+	if w.size != 42 {
+		t.Errorf("truncated to %v, want 42", w.size)
+	}
+}
+
+// truncatingWriterAt records the size it was truncated to.
+type truncatingWriterAt struct {
+	memWriterAt
+	size int64
+}
+
+func (w *truncatingWriterAt) Truncate(size int64) error {
+	w.size = size
+	return nil
+}
@@ -0,0 +1,103 @@
+package rftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// checksumCache holds the sizes and checksums of whole files by name. The
+// checksums are computed by the server's hash.
+type checksumCache struct {
+	lock sync.Mutex
+	sums map[string]cachedSum
+}
+
+type cachedSum struct {
+	size int64
+	sum  []byte
+}
+
+func (c *checksumCache) store(name string, size int64, sum []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.sums == nil {
+		c.sums = make(map[string]cachedSum)
+	}
+	c.sums[name] = cachedSum{size: size, sum: append([]byte{}, sum...)}
+}
+
+// load returns the cached checksum of name, if the file still has size
+// bytes. A file of another size changed since it was cached.
+func (c *checksumCache) load(name string, size int64) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s, ok := c.sums[name]
+	if !ok || s.size != size {
+		return nil, false
+	}
+	return s.sum, true
+}
+
+// PreloadError holds the errors of the files, which Preload failed to cache,
+// by name.
+type PreloadError map[string]error
+
+func (e PreloadError) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%v: %v", name, e[name])
+	}
+	return fmt.Sprintf("failed to preload %d files: %v", len(e), strings.Join(msgs, ", "))
+}
+
+// Preload reads the files names and caches their sizes and checksums, which
+// are otherwise cached once a file was transferred completely. Estimate
+// requests of a single cached file carry its checksum without reading the
+// file. Servers, which know their popular files, preload them at startup to
+// save the first requests the hashing. The returned error is a PreloadError,
+// if any file couldn't be cached, e.g. because it doesn't exist.
+//
+// Cached checksums are invalidated once the size of their file changes.
+// Preload files again after changing their content in place.
+func (s *Server) Preload(names ...string) error {
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	errs := PreloadError{}
+	for _, name := range names {
+		r, err := s.fh(ctx, name)
+		if err == nil && r == nil {
+			err = os.ErrNotExist
+		}
+		if err != nil {
+			errs[name] = err
+			continue
+		}
+		if r.Size() == UnknownSize {
+			errs[name] = errors.New("streams have no checksum before they end")
+			continue
+		}
+		h := s.NewHash()
+		if _, err := io.Copy(h, io.NewSectionReader(r, 0, r.Size())); err != nil {
+			errs[name] = err
+			continue
+		}
+		s.sums.store(name, r.Size(), h.Sum(nil))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
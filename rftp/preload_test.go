@@ -0,0 +1,83 @@
+package rftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// readCounter counts the reads of a file, also concurrent ones.
+type readCounter struct {
+	data  []byte
+	reads *int32
+}
+
+func (r readCounter) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddInt32(r.reads, 1)
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+func TestPreload(t *testing.T) {
+	files := map[string][]byte{"a": testData(5*1024 + 10), "b": testData(3000)}
+	var reads int32
+	s := NewServer()
+	s.SetFileHandler(func(_ context.Context, name string) (*io.SectionReader, error) {
+		data, ok := files[name]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return io.NewSectionReader(readCounter{data, &reads}, 0, int64(len(data))), nil
+	})
+
+	err := s.Preload("a", "missing")
+	var perr PreloadError
+	if !errors.As(err, &perr) || len(perr) != 1 || !errors.Is(perr["missing"], os.ErrNotExist) {
+		t.Fatalf("got error %v, want only missing to fail", err)
+	}
+	if atomic.LoadInt32(&reads) == 0 {
+		t.Fatal("preloading didn't read the file")
+	}
+	addr := startServer(t, s)
+
+	atomic.StoreInt32(&reads, 0)
+	c := Client{Conn: NewUDPConnection()}
+	e, err := c.Estimate(addr, []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := md5.Sum(files["a"])
+	if !bytes.Equal(e.Checksums[0], want[:]) || e.Checksums[1] != nil {
+		t.Errorf("got checksums %x, want only the checksum of a %x", e.Checksums, want)
+	}
+	if n := atomic.LoadInt32(&reads); n != 0 {
+		t.Errorf("estimate read files %v times", n)
+	}
+
+	// transfers cache the checksums, too
+	rs, err := c.Request(addr, []string{"b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(rs[0]); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&reads, 0)
+	c2 := Client{Conn: NewUDPConnection()}
+	e, err = c2.Estimate(addr, []string{"b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = md5.Sum(files["b"])
+	if !bytes.Equal(e.Checksums[0], want[:]) {
+		t.Errorf("got checksum %x after the transfer, want %x", e.Checksums[0], want)
+	}
+	if n := atomic.LoadInt32(&reads); n != 0 {
+		t.Errorf("estimate read files %v times", n)
+	}
+}
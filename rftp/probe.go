@@ -0,0 +1,250 @@
+package rftp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+)
+
+// A bandwidth probe estimates the rate of the path from the server to a client
+// by the dispersion of a short burst: The client sends a probe request padded
+// to probeSize bytes, the server answers with probePackets datagrams of the
+// same size back to back, the client echoes each of them right away and the
+// server derives the rate from the time between the first and the last echo.
+// The burst is at most three times the request, so that probes can't be used
+// to amplify traffic towards spoofed addresses.
+const (
+	// probeSize is the size in bytes of probe requests and probe datagrams.
+	probeSize = 1200
+	// probePackets is the number of datagrams the server answers a probe
+	// request with.
+	probePackets = 3
+	// probeTimeout is the time the server waits for echoes, before it
+	// estimates the rate from the echoes received so far.
+	probeTimeout = time.Second
+	// probeRounds is the number of probes of ProbeBandwidth, whose median is
+	// the estimate.
+	probeRounds = 3
+)
+
+// probe message kinds
+const (
+	probeRequest uint8 = iota
+	probePacket
+	probeEcho
+	probeResult
+)
+
+// probeMsg is a message of a bandwidth probe. padding zero bytes pad it to the
+// probe size.
+type probeMsg struct {
+	kind  uint8
+	index uint8
+	// rate is the estimated rate in bytes per second in results, 0 if
+	// unknown.
+	rate    uint64
+	padding int
+}
+
+// probeMsgSize is the size of a probeMsg without padding.
+const probeMsgSize = 10
+
+// probePadding is the padding, which pads a probe message to probeSize bytes
+// including its header without options.
+const probePadding = probeSize - 3 - probeMsgSize
+
+func (m probeMsg) MarshalBinary() ([]byte, error) {
+	bs := make([]byte, probeMsgSize+m.padding)
+	bs[0] = m.kind
+	bs[1] = m.index
+	binary.BigEndian.PutUint64(bs[2:], m.rate)
+	return bs, nil
+}
+
+func (m *probeMsg) UnmarshalBinary(data []byte) error {
+	if len(data) < probeMsgSize {
+		return fmt.Errorf("probe message too short: %d bytes", len(data))
+	}
+	m.kind = data[0]
+	m.index = data[1]
+	m.rate = binary.BigEndian.Uint64(data[2:])
+	m.padding = len(data) - probeMsgSize
+	return nil
+}
+
+// bandwidthProbe is the state of a probe of the server.
+type bandwidthProbe struct {
+	w        io.Writer
+	arrivals [probePackets]time.Time
+	echoes   int
+	timer    timer
+}
+
+// rate returns the rate in bytes per second estimated by the echoes, 0 if it
+// can't be estimated.
+func (pr *bandwidthProbe) rate() uint64 {
+	var first, last time.Time
+	for _, t := range pr.arrivals {
+		if t.IsZero() {
+			continue
+		}
+		if first.IsZero() || t.Before(first) {
+			first = t
+		}
+		if t.After(last) {
+			last = t
+		}
+	}
+	span := last.Sub(first)
+	if pr.echoes < 2 || span <= 0 {
+		return 0
+	}
+	return uint64(float64(pr.echoes-1) * probeSize / span.Seconds())
+}
+
+func (s *Server) handleProbe(w io.Writer, p *packet) {
+	m := probeMsg{}
+	if err := m.UnmarshalBinary(p.data); err != nil {
+		if s.Strict {
+			s.violated(w, p, err)
+			return
+		}
+		s.packetLog.Debugf("dropping malformed probe from %v: %v\n", p.remoteAddr, err)
+		return
+	}
+	key := s.addrKey(p.remoteAddr)
+	switch m.kind {
+	case probeRequest:
+		if m.padding < probePadding {
+			s.packetLog.Debugf("dropping probe request from %v without padding\n", p.remoteAddr)
+			return
+		}
+		s.startProbe(w, key)
+	case probeEcho:
+		s.probeEchoed(key, m.index)
+	default:
+		s.packetLog.Debugf("dropping probe message of kind %d from %v\n", m.kind, p.remoteAddr)
+	}
+}
+
+// startProbe answers the probe request of the client key with the burst,
+// unless a probe of the client is running already.
+func (s *Server) startProbe(w io.Writer, key string) {
+	s.clientMux.Lock()
+	if s.shuttingDown || s.probes[key] != nil {
+		s.clientMux.Unlock()
+		return
+	}
+	if s.probes == nil {
+		s.probes = make(map[string]*bandwidthProbe)
+	}
+	pr := &bandwidthProbe{w: w}
+	pr.timer = s.clock().AfterFunc(probeTimeout, func() { s.finishProbe(key, pr) })
+	s.probes[key] = pr
+	s.clientMux.Unlock()
+
+	for i := 0; i < probePackets; i++ {
+		if err := sendTo(w, probeMsg{kind: probePacket, index: uint8(i), padding: probePadding}); err != nil {
+			s.Logger.Infof("failed to send probe: %v\n", err)
+		}
+	}
+}
+
+// probeEchoed records the echo of the probe datagram index by the client key
+// and finishes the probe, once all datagrams were echoed.
+func (s *Server) probeEchoed(key string, index uint8) {
+	now := s.clock().Now()
+	s.clientMux.Lock()
+	pr := s.probes[key]
+	if pr == nil || int(index) >= probePackets || !pr.arrivals[index].IsZero() {
+		s.clientMux.Unlock()
+		return
+	}
+	pr.arrivals[index] = now
+	pr.echoes++
+	done := pr.echoes == probePackets
+	s.clientMux.Unlock()
+	if done {
+		s.finishProbe(key, pr)
+	}
+}
+
+// finishProbe sends the client key the rate estimated by the probe pr.
+func (s *Server) finishProbe(key string, pr *bandwidthProbe) {
+	s.clientMux.Lock()
+	if s.probes[key] != pr {
+		s.clientMux.Unlock()
+		return
+	}
+	delete(s.probes, key)
+	pr.timer.Stop()
+	rate := pr.rate()
+	s.clientMux.Unlock()
+
+	s.Logger.Infof("estimated %v B/s to %v from %v echoes\n", rate, key, pr.echoes)
+	if err := sendTo(pr.w, probeMsg{kind: probeResult, rate: rate}); err != nil {
+		s.Logger.Infof("failed to send probe result: %v\n", err)
+	}
+}
+
+// ProbeBandwidth asks the server at host to estimate the rate of the path to
+// the client in bytes per second, e.g. to size the parallelism of a large
+// transfer. The server sends a few datagrams back to back and measures the
+// time between their echoes. The estimate is the median of several such
+// probes. The server must support FeatureProbe, others don't respond.
+func (c *Client) ProbeBandwidth(ctx context.Context, host string) (uint64, error) {
+	if err := c.Conn.connectTo(host); err != nil {
+		return 0, err
+	}
+
+	results := make(chan uint64, 1)
+	c.Conn.handle(msgProbe, handlerFunc(func(_ io.Writer, p *packet) {
+		m := probeMsg{}
+		if err := m.UnmarshalBinary(p.data); err != nil {
+			log.Printf("failed to parse probe message: %v\n", err)
+			return
+		}
+		switch m.kind {
+		case probePacket:
+			if err := c.Conn.send(probeMsg{kind: probeEcho, index: m.index}); err != nil {
+				log.Printf("failed to echo probe: %v\n", err)
+			}
+		case probeResult:
+			select {
+			case results <- m.rate:
+			default:
+			}
+		}
+	}))
+	go c.Conn.receive()
+	defer c.Conn.cclose(c.closeTimeout())
+
+	var rates []uint64
+	for round := 0; round < probeRounds; round++ {
+		if err := c.Conn.send(probeMsg{kind: probeRequest, padding: probePadding}); err != nil {
+			return 0, err
+		}
+		timeout := c.clock().NewTimer(2 * probeTimeout)
+		select {
+		case rate := <-results:
+			if rate > 0 {
+				rates = append(rates, rate)
+			}
+		case <-ctx.Done():
+			timeout.Stop()
+			return 0, ctx.Err()
+		case <-timeout.C():
+		}
+		timeout.Stop()
+	}
+	if len(rates) == 0 {
+		return 0, errors.New("server didn't estimate the bandwidth")
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i] < rates[j] })
+	return rates[len(rates)/2], nil
+}
@@ -0,0 +1,110 @@
+package rftp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedLogger records the lines logged by concurrent goroutines.
+type lockedLogger struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (l *lockedLogger) Debugf(format string, v ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lines = append(l.lines, "debug: "+fmt.Sprintf(format, v...))
+}
+
+func (l *lockedLogger) Infof(format string, v ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lines = append(l.lines, "info: "+fmt.Sprintf(format, v...))
+}
+
+// logged reports whether a line starting with prefix was logged.
+func (l *lockedLogger) logged(prefix string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestProbeBandwidth(t *testing.T) {
+	const rate = 100 * 1000
+	network := newMemNetwork(1)
+	network.RTT = 20 * time.Millisecond
+	network.Rate = rate
+	addr := simulatedServer(t, network, nil)
+
+	var (
+		got uint64
+		err error
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		got, err = simulatedClient(network).ProbeBandwidth(context.Background(), addr)
+	}()
+	network.advanceUntil(done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got < rate*3/4 || got > rate*5/4 {
+		t.Errorf("estimated %v B/s, want %v B/s within 25%%", got, rate)
+	}
+}
+
+func TestProbeBurstIsBounded(t *testing.T) {
+	logger := &lockedLogger{}
+	s := NewServer()
+	s.Logger = logger
+	addr := startServer(t, s)
+	conn := dialServer(t, addr)
+	defer conn.Close()
+
+	// unpadded requests aren't answered
+	if err := sendTo(conn, probeMsg{kind: probeRequest}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2*probeSize)
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := conn.Read(buf); err == nil {
+		t.Fatalf("unpadded probe request answered with %v bytes", n)
+	}
+
+	if err := sendTo(conn, probeMsg{kind: probeRequest, padding: probePadding}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < probePackets; i++ {
+		m := probeMsg{}
+		if err := m.UnmarshalBinary(readMsg(t, conn, msgProbe)); err != nil {
+			t.Fatal(err)
+		}
+		if m.kind != probePacket || probeMsgSize+m.padding+3 > probeSize {
+			t.Errorf("got probe message of kind %v with %v bytes padding", m.kind, m.padding)
+		}
+	}
+	// without echoes, nothing but the result follows the burst
+	m := probeMsg{}
+	if err := m.UnmarshalBinary(readMsg(t, conn, msgProbe)); err != nil {
+		t.Fatal(err)
+	}
+	if m.kind != probeResult || m.rate != 0 {
+		t.Errorf("got probe message of kind %v with rate %v, want result without rate", m.kind, m.rate)
+	}
+	for _, prefix := range []string{"debug: dropping probe request", "info: estimated 0 B/s"} {
+		if !logger.logged(prefix) {
+			t.Errorf("no line %q... logged by the server's logger", prefix)
+		}
+	}
+}
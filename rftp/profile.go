@@ -0,0 +1,72 @@
+package rftp
+
+import "log"
+
+// Profile is a named set of congestion control and priority settings, which a
+// client requests for its transfer instead of tuning the server.
+type Profile string
+
+const (
+	// ProfileInteractive starts fast and completes files first, for transfers
+	// a user waits for.
+	ProfileInteractive Profile = "interactive"
+	// ProfileBulk ramps up to the capacity of the path. It is the default.
+	ProfileBulk Profile = "bulk"
+	// ProfileBackground ramps up slowly and caps its rate, so that it leaves
+	// room to other transfers.
+	ProfileBackground Profile = "background"
+)
+
+// profileSettings are the server settings a profile maps to.
+type profileSettings struct {
+	// initialRate and maxRate bound the congestion rate in packets per
+	// second, maxRate 0 means no limit.
+	initialRate uint32
+	maxRate     uint32
+	// increaseDivisor slows the growth of the rate, it grows by
+	// rate/increaseDivisor with each ack without losses.
+	increaseDivisor uint32
+	// completeFirst overrides the server's ResendPriority with
+	// ResendNearestCompletion.
+	completeFirst bool
+}
+
+var profiles = map[Profile]profileSettings{
+	ProfileInteractive: {initialRate: 2000, increaseDivisor: 2, completeFirst: true},
+	ProfileBulk:        {initialRate: 1000, increaseDivisor: 2},
+	ProfileBackground:  {initialRate: 100, maxRate: 2000, increaseDivisor: 8},
+}
+
+func profileOption(p Profile) option {
+	return option{otype: optionProfile, value: []byte(p)}
+}
+
+// profile returns the profile requested by os. Unknown profiles fall back to
+// ProfileBulk.
+func profile(os []option) Profile {
+	o, ok := findOption(os, optionProfile)
+	if !ok {
+		return ProfileBulk
+	}
+	p := Profile(o.value)
+	if _, ok := profiles[p]; !ok {
+		log.Printf("unknown profile %q, using %q\n", p, ProfileBulk)
+		return ProfileBulk
+	}
+	return p
+}
+
+// profileSettings returns the settings of the connection's profile,
+// ProfileBulk, if it has none.
+func (c *clientConnection) profileSettings() profileSettings {
+	if s, ok := profiles[c.profile]; ok {
+		return s
+	}
+	return profiles[ProfileBulk]
+}
+
+// rateControl returns the congestion controller of a connection with the
+// settings s.
+func (s profileSettings) rateControl() *aimd {
+	return &aimd{congRate: s.initialRate, maxRate: s.maxRate, increaseDivisor: s.increaseDivisor}
+}
@@ -0,0 +1,69 @@
+package rftp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBackgroundProfileYields(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(2000 * 1024)}))
+	addr := startServer(t, s)
+
+	// the transfers compete for the server, each acknowledges the same
+	// chunks without losses
+	request := func(p Profile) *net.UDPConn {
+		conn := dialServer(t, addr)
+		req := clientRequest{files: []fileDescriptor{{0, "file"}}}
+		if err := sendTo(conn, req, profileOption(p)); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	conns := map[Profile]*net.UDPConn{
+		ProfileBackground: request(ProfileBackground),
+		ProfileBulk:       request(ProfileBulk),
+		"unknown":         request("unknown"),
+	}
+	for p, conn := range conns {
+		defer conn.Close()
+		readMsg(t, conn, msgServerPayload)
+		if _, ok := s.TransferState(conn.LocalAddr()); !ok {
+			t.Fatalf("no connection for the %v transfer", p)
+		}
+	}
+	for ackNum := uint8(1); ackNum <= 10; ackNum++ {
+		for _, conn := range conns {
+			if err := sendAckTo(conn, ackNum, clientAck{fileIndex: 0, offset: uint64(ackNum)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rate := func(p Profile) uint32 {
+		deadline := time.Now().Add(time.Second)
+		for {
+			ts, ok := s.TransferState(conns[p].LocalAddr())
+			if ok && ts.Files[0].Frontier == 10 {
+				return ts.Rate
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("acks of the %v transfer not handled", p)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	background, bulk := rate(ProfileBackground), rate(ProfileBulk)
+	if background > profiles[ProfileBackground].maxRate {
+		t.Errorf("background rate %v exceeds its maximum", background)
+	}
+	if background*10 > bulk {
+		t.Errorf("background rate %v not well below bulk rate %v", background, bulk)
+	}
+	// unknown profiles fall back to bulk
+	if unknown := rate("unknown"); background*10 > unknown {
+		t.Errorf("unknown profile got rate %v, want about the bulk rate %v", unknown, bulk)
+	}
+}
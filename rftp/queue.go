@@ -3,12 +3,14 @@ package rftp
 import (
 	"container/heap"
 	"fmt"
+	"math"
+	"sort"
 	"strings"
 )
 
 type chunkQueue struct {
 	items     []*serverPayload
-	max       uint64 // filesize
+	max       uint64 // number of chunks of the file, 0 if unknown
 	fileIndex uint16
 }
 
@@ -58,6 +60,61 @@ func (c *chunkQueue) Pop() interface{} {
 	return item
 }
 
+// Frontier returns the offset below which all chunks have been received, given
+// that all chunks below head have been received before.
+func (c chunkQueue) Frontier(head uint64) uint64 {
+	offsets := make([]uint64, len(c.items))
+	for i, item := range c.items {
+		offsets[i] = item.offset
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	for _, o := range offsets {
+		if o > head {
+			break
+		}
+		if o == head {
+			head++
+		}
+	}
+	return head
+}
+
+// Gaps returns resend entries for the chunks from head on, which are missing in
+// the queue. If the number of chunks of the file is known, the chunks after the
+// last queued chunk are missing as well.
+func (c chunkQueue) Gaps(head uint64) []*resendEntry {
+	offsets := make([]uint64, len(c.items))
+	for i, item := range c.items {
+		offsets[i] = item.offset
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	gaps := []*resendEntry{}
+	missing := func(from, to uint64) {
+		for from < to {
+			length := to - from
+			if length > math.MaxUint8 {
+				length = math.MaxUint8
+			}
+			gaps = append(gaps, &resendEntry{
+				fileIndex: c.fileIndex,
+				offset:    from,
+				length:    uint8(length),
+			})
+			from += length
+		}
+	}
+	for _, o := range offsets {
+		if o < head {
+			continue
+		}
+		missing(head, o)
+		head = o + 1
+	}
+	missing(head, c.max)
+	return gaps
+}
+
 func (c *chunkQueue) Top() uint64 {
 	if c.Len() <= 0 {
 		return 0
@@ -2,6 +2,7 @@ package rftp
 
 import (
 	"container/heap"
+	"reflect"
 	"testing"
 )
 
@@ -48,3 +49,80 @@ func TestChunkQueue(t *testing.T) {
 		}
 	}
 }
+
+func TestChunkQueueFrontier(t *testing.T) {
+	q := newChunkQueue(0)
+	for _, o := range []uint64{7, 4, 3, 5, 3} {
+		heap.Push(q, &serverPayload{offset: o})
+	}
+	tests := []struct {
+		head uint64
+		want uint64
+	}{
+		{0, 0},
+		{2, 2},
+		{3, 6},
+		{4, 6},
+		{7, 8},
+		{9, 9},
+	}
+	for _, tc := range tests {
+		if got := q.Frontier(tc.head); got != tc.want {
+			t.Errorf("Frontier(%v) = %v, want %v", tc.head, got, tc.want)
+		}
+	}
+}
+
+func TestChunkQueueGaps(t *testing.T) {
+	tests := map[string]struct {
+		queued []uint64
+		max    uint64
+		head   uint64
+		want   []resendEntry
+	}{
+		"last-chunk-missing": {
+			max:  7,
+			head: 6,
+			want: []resendEntry{{0, 6, 1}},
+		},
+		"size-unknown": {
+			queued: []uint64{5},
+			head:   4,
+			want:   []resendEntry{{0, 4, 1}},
+		},
+		"gap-and-tail": {
+			queued: []uint64{5},
+			max:    7,
+			head:   4,
+			want:   []resendEntry{{0, 4, 1}, {0, 6, 1}},
+		},
+		"long-tail": {
+			queued: []uint64{2},
+			max:    300,
+			head:   0,
+			want:   []resendEntry{{0, 0, 2}, {0, 3, 255}, {0, 258, 42}},
+		},
+		"complete": {
+			max:  7,
+			head: 7,
+			want: []resendEntry{},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			q := newChunkQueue(0)
+			q.max = tc.max
+			for _, o := range tc.queued {
+				heap.Push(q, &serverPayload{offset: o})
+			}
+			gaps := q.Gaps(tc.head)
+			got := make([]resendEntry, len(gaps))
+			for i, g := range gaps {
+				got[i] = *g
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got gaps %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+package rftp
+
+// validateRange checks the range of a file of size bytes, which starts at
+// chunk offset and spans limit chunks of chunkSize bytes, a limit of 0 meaning
+// up to the end of the file. It returns the range in bytes clamped to the end
+// of the file and noErr, or offsetTooBig, if the offset is beyond the 56 bit
+// offsets of the protocol or beyond the end of the file. An offset right at the
+// end yields an empty range. chunkSize must not be 0.
+func validateRange(offset, limit, chunkSize, size uint64) (start, length uint64, status MetaDataStatus) {
+	// offset*chunkSize may overflow, offset > size/chunkSize doesn't and is
+	// equivalent to offset*chunkSize > size.
+	if offset > maxFileOffset || offset > size/chunkSize {
+		return 0, 0, offsetTooBig
+	}
+	start = offset * chunkSize
+	length = size - start
+	if limit > 0 && limit <= length/chunkSize {
+		length = limit * chunkSize
+	}
+	return start, length, noErr
+}
@@ -0,0 +1,41 @@
+package rftp
+
+import (
+	"math"
+	"testing"
+)
+
+func TestValidateRange(t *testing.T) {
+	for _, tc := range []struct {
+		name                  string
+		offset, limit, chunk  uint64
+		size                  uint64
+		wantStart, wantLength uint64
+		wantStatus            MetaDataStatus
+	}{
+		{"whole file", 0, 0, 1024, 5000, 0, 5000, noErr},
+		{"empty file", 0, 0, 1024, 0, 0, 0, noErr},
+		{"offset in file", 2, 0, 1024, 5000, 2048, 2952, noErr},
+		{"offset at last partial chunk", 4, 0, 1024, 5000, 4096, 904, noErr},
+		{"offset at end of file", 5, 0, 1000, 5000, 5000, 0, noErr},
+		{"offset beyond end", 5, 0, 1024, 5000, 0, 0, offsetTooBig},
+		{"offset beyond empty file", 1, 0, 1024, 0, 0, 0, offsetTooBig},
+		{"limit", 1, 2, 1024, 5000, 1024, 2048, noErr},
+		{"limit up to end", 1, 3, 1000, 5000, 1000, 3000, noErr},
+		{"limit beyond end", 1, 4, 1024, 5000, 1024, 3976, noErr},
+		{"limit of partial chunk", 4, 1, 1024, 5000, 4096, 904, noErr},
+		{"max offset", maxFileOffset, 0, 1, maxFileOffset + 10, maxFileOffset, 10, noErr},
+		{"offset beyond 56 bits", maxFileOffset + 1, 0, 1, math.MaxUint64, 0, 0, offsetTooBig},
+		{"overflowing start", maxFileOffset, 0, 1 << 16, math.MaxUint64, 0, 0, offsetTooBig},
+		{"overflowing start of small file", 1 << 55, 0, 1 << 10, 1 << 20, 0, 0, offsetTooBig},
+		{"overflowing limit", 0, math.MaxUint64, 1 << 10, 5000, 0, 5000, noErr},
+		{"largest file", 0, 0, 1024, math.MaxUint64, 0, math.MaxUint64, noErr},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			start, length, status := validateRange(tc.offset, tc.limit, tc.chunk, tc.size)
+			if status != tc.wantStatus || start != tc.wantStart || length != tc.wantLength {
+				t.Errorf("got %v+%v, %v, want %v+%v, %v", start, length, status, tc.wantStart, tc.wantLength, tc.wantStatus)
+			}
+		})
+	}
+}
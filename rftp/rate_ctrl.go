@@ -18,8 +18,9 @@ type RateControl interface {
 	// Element added each time the awaitAvailable rate changes.
 	awaitAvailable() <-chan struct{}
 
-	// Must be called with a newly received client acknowledgment.
-	onAck(*clientAck)
+	// Must be called with a newly received client acknowledgment and the ack
+	// number of its header.
+	onAck(ackNum uint8, ack *clientAck)
 
 	// Must be called once for each packet that is sent on a connection.
 	onSend()
@@ -30,16 +31,40 @@ const (
 	// at the client. Minimal time needed: 1 RTT. Give it a bit of room to account
 	// for the processing delay etc.
 	aimdDecreaseCoolOffPeriod = 6 // unit in number of ACKs. 6 acks = 1.5 RTTs
+
+	// aimdMinRate is the lowest congestion rate. Repeated loss halves the
+	// rate, and below 2 packets per second the multiplicative increase never
+	// raises it again, which stalls the connection for good.
+	aimdMinRate = 10
+
+	// pacingSlack is how early a paced packet may be sent. Timers are too
+	// coarse to space packets at high rates exactly, so packets due within
+	// the slack are sent together.
+	pacingSlack = time.Millisecond
 )
 
 type aimd struct {
-	congRate              uint32
+	congRate uint32
+	// maxRate caps congRate, if set. The rate grows by
+	// congRate/increaseDivisor, congRate/2 if unset.
+	maxRate         uint32
+	increaseDivisor uint32
+	// ceiling caps the rate, if set and not 0. It's accessed atomically, so
+	// that it can be changed while the connection is running.
+	ceiling               *uint32
 	flowRate              uint32
 	sent                  uint32
 	lastAck               uint8
 	decreaseCoolOffPeriod uint8
 
-	resetTicker         *time.Ticker
+	// nextSend is the earliest time of the next packet, so that packets are
+	// spaced evenly at the current rate instead of sent in bursts.
+	nextSend  time.Time
+	paceTimer timer
+	// clk is the source of time, the real clock if nil.
+	clk clock
+
+	resetTicker         ticker
 	closedTicker        chan struct{}
 	availableChan       chan struct{}
 	notifyAvailableLock sync.Mutex
@@ -48,7 +73,7 @@ type aimd struct {
 var _ RateControl = (*aimd)(nil)
 
 func (c *aimd) start() {
-	c.resetTicker = time.NewTicker(1 * time.Second)
+	c.resetTicker = orRealClock(c.clk).NewTicker(1 * time.Second)
 	c.closedTicker = make(chan struct{}, 1)
 	c.availableChan = make(chan struct{}, 1)
 	c.notifyAvailableLock = sync.Mutex{}
@@ -58,7 +83,7 @@ func (c *aimd) start() {
 			atomic.StoreUint32(&c.sent, 0)
 			c.notifyAvailable()
 			select {
-			case <-c.resetTicker.C:
+			case <-c.resetTicker.C():
 			case <-c.closedTicker:
 				return
 			}
@@ -68,6 +93,9 @@ func (c *aimd) start() {
 
 func (c *aimd) stop() {
 	c.resetTicker.Stop() // does not close resetTicker.C
+	if c.paceTimer != nil {
+		c.paceTimer.Stop()
+	}
 	c.closedTicker <- struct{}{}
 }
 
@@ -90,21 +118,49 @@ func (c *aimd) notifyAvailable() {
 func (c *aimd) isAvailable() bool {
 	sent := atomic.LoadUint32(&c.sent)
 	//log.Printf("isAvailable: sent: %v, c.congRate: %v, c.flowRate: %v\n", sent, c.congRate, c.flowRate)
-	if c.flowRate > 0 {
-		return sent < c.congRate && sent < c.flowRate
+	if sent >= c.rate() {
+		return false
+	}
+	if wait := c.nextSend.Sub(orRealClock(c.clk).Now()); wait > pacingSlack {
+		c.pace(wait)
+		return false
+	}
+	return true
+}
+
+// rate returns the number of packets per second allowed by congestion and
+// flow control.
+func (c *aimd) rate() uint32 {
+	rate := c.congRate
+	if c.flowRate > 0 && c.flowRate < rate {
+		rate = c.flowRate
+	}
+	if c.ceiling != nil {
+		if ceiling := atomic.LoadUint32(c.ceiling); ceiling > 0 && ceiling < rate {
+			rate = ceiling
+		}
 	}
-	return sent < c.congRate
+	return rate
 }
 
-func (c *aimd) onAck(ack *clientAck) {
-	if ack.ackNumber < c.lastAck {
+// pace notifies awaitAvailable after d, when the next packet is due.
+func (c *aimd) pace(d time.Duration) {
+	if c.paceTimer == nil {
+		c.paceTimer = orRealClock(c.clk).AfterFunc(d, c.notifyAvailable)
+		return
+	}
+	c.paceTimer.Reset(d)
+}
+
+func (c *aimd) onAck(ackNum uint8, ack *clientAck) {
+	if ackNum < c.lastAck {
 		// Should we make sure that out-of-order ACKs are handled earlier?
-		c.lastAck = ack.ackNumber
+		c.lastAck = ackNum
 		return
 	}
 
 	if c.decreaseCoolOffPeriod > 0 {
-		diff := ack.ackNumber - c.lastAck
+		diff := ackNum - c.lastAck
 		if diff > c.decreaseCoolOffPeriod {
 			c.decreaseCoolOffPeriod = 0
 		} else {
@@ -115,16 +171,26 @@ func (c *aimd) onAck(ack *clientAck) {
 	c.flowRate = ack.maxTransmissionRate
 
 	if len(ack.resendEntries) < 10 {
+		divisor := c.increaseDivisor
+		if divisor == 0 {
+			divisor = 2
+		}
 		// prevent overflow
 		if c.congRate < 1073741824 {
-			c.congRate += c.congRate / 2
+			c.congRate += c.congRate / divisor
+		}
+		if c.maxRate > 0 && c.congRate > c.maxRate {
+			c.congRate = c.maxRate
 		}
 	} else if c.decreaseCoolOffPeriod == 0 {
 		c.congRate /= 2
+		if c.congRate < aimdMinRate {
+			c.congRate = aimdMinRate
+		}
 		c.decreaseCoolOffPeriod = aimdDecreaseCoolOffPeriod
 	}
 
-	c.lastAck = ack.ackNumber
+	c.lastAck = ackNum
 	if c.isAvailable() {
 		c.notifyAvailable()
 	}
@@ -132,4 +198,14 @@ func (c *aimd) onAck(ack *clientAck) {
 
 func (c *aimd) onSend() {
 	atomic.AddUint32(&c.sent, 1)
+	rate := c.rate()
+	if rate == 0 {
+		return
+	}
+	// idle time gives no credit for a burst
+	now := orRealClock(c.clk).Now()
+	if c.nextSend.Before(now) {
+		c.nextSend = now
+	}
+	c.nextSend = c.nextSend.Add(time.Second / time.Duration(rate))
 }
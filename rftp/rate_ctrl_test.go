@@ -0,0 +1,69 @@
+package rftp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacing(t *testing.T) {
+	const (
+		rate  = 200
+		n     = 20
+		ideal = time.Second / rate
+	)
+	clk := newVirtualClock()
+	c := &aimd{congRate: rate, clk: clk}
+	c.start()
+	defer c.stop()
+
+	// send as fast as the rate control allows
+	sends := make([]time.Time, 0, n)
+	for len(sends) < n {
+		if !c.isAvailable() {
+			clk.advance()
+			select {
+			case <-c.awaitAvailable():
+			case <-time.After(time.Second):
+				t.Fatalf("rate control blocked after %v packets", len(sends))
+			}
+			continue
+		}
+		c.onSend()
+		sends = append(sends, clk.Now())
+	}
+
+	for i := 1; i < n; i++ {
+		if gap := sends[i].Sub(sends[i-1]); gap < ideal/2 {
+			t.Errorf("packet %v sent %v after the previous one, want about %v", i, gap, ideal)
+		}
+	}
+	want := (n - 1) * ideal
+	if total := sends[n-1].Sub(sends[0]); total < want*8/10 || total > want*2 {
+		t.Errorf("sent %v packets in %v, want about %v", n, total, want)
+	}
+}
+
+func TestAIMDRecoversFromRepeatedLoss(t *testing.T) {
+	c := &aimd{congRate: 100}
+	c.start()
+	defer c.stop()
+
+	// each ack reports heavy loss after the cool off period
+	lossy := &clientAck{resendEntries: make([]*resendEntry, 10)}
+	ackNum := uint8(0)
+	for i := 0; i < 20; i++ {
+		ackNum += aimdDecreaseCoolOffPeriod + 1
+		c.onAck(ackNum, lossy)
+	}
+	if c.congRate != aimdMinRate {
+		t.Fatalf("rate %v after repeated loss, want the minimum %v", c.congRate, aimdMinRate)
+	}
+
+	for i := 0; i < 5; i++ {
+		ackNum++
+		c.onAck(ackNum, &clientAck{})
+	}
+	if c.congRate <= aimdMinRate {
+		t.Errorf("rate %v didn't increase after the loss ended", c.congRate)
+	}
+}
@@ -0,0 +1,57 @@
+package rftp
+
+import "time"
+
+// rateBuckets is the number of rateWindow intervals, over which a rateMeter
+// measures.
+const rateBuckets = 10
+
+// rateMeter measures a rate in bytes per second over a sliding window of the
+// last rateBuckets intervals. Adding is O(1) amortized and doesn't allocate.
+type rateMeter struct {
+	buckets [rateBuckets]uint64
+	start   time.Time
+	// last is the number of the interval of the last sample since start.
+	last int64
+}
+
+func (m *rateMeter) add(now time.Time, n uint64) {
+	if m.start.IsZero() {
+		m.start = now
+	}
+	m.advance(now)
+	m.buckets[m.last%rateBuckets] += n
+}
+
+// advance clears the buckets of the intervals passed since the last sample.
+func (m *rateMeter) advance(now time.Time) {
+	i := int64(now.Sub(m.start) / rateWindow)
+	for j := m.last + 1; j <= i && j <= m.last+rateBuckets; j++ {
+		m.buckets[j%rateBuckets] = 0
+	}
+	if i > m.last {
+		m.last = i
+	}
+}
+
+// rate returns the rate over the window up to now. Early rates are measured
+// over the age of the meter, but at least over one interval.
+func (m *rateMeter) rate(now time.Time) uint64 {
+	if m.start.IsZero() {
+		return 0
+	}
+	m.advance(now)
+	sum := uint64(0)
+	for _, b := range m.buckets {
+		sum += b
+	}
+	age := now.Sub(m.start)
+	window := (rateBuckets-1)*rateWindow + age%rateWindow
+	if age < window {
+		window = age
+	}
+	if window < rateWindow {
+		window = rateWindow
+	}
+	return uint64(float64(sum) / window.Seconds())
+}
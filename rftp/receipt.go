@@ -0,0 +1,130 @@
+package rftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+)
+
+// clientReceipt confirms that the client received the file fileIndex
+// completely and verified it against checksum.
+type clientReceipt struct {
+	fileIndex uint16
+	checksum  []byte
+}
+
+func (r clientReceipt) MarshalBinary() ([]byte, error) {
+	bs := make([]byte, 2, 2+len(r.checksum))
+	binary.BigEndian.PutUint16(bs, r.fileIndex)
+	return append(bs, r.checksum...), nil
+}
+
+func (r *clientReceipt) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("receipt too short: %d bytes", len(data))
+	}
+	r.fileIndex = binary.BigEndian.Uint16(data)
+	r.checksum = append([]byte{}, data[2:]...)
+	return nil
+}
+
+// Receipt confirms that a client received a file completely and verified it,
+// see Client.Receipts.
+type Receipt struct {
+	Addr net.Addr
+	File uint16
+	Name string
+	// Checksum is the checksum the client verified the file against.
+	Checksum []byte
+	// Match is set, if Checksum is the checksum the server sent for the file.
+	Match bool
+}
+
+func (r Receipt) String() string {
+	return fmt.Sprintf("receipt from %v for file %v (%v): checksum %x, match %v",
+		r.Addr, r.File, r.Name, r.Checksum, r.Match)
+}
+
+// recordChecksum keeps the checksum sent in the metadata of file to check
+// receipts against it.
+func (c *clientConnection) recordChecksum(file uint16, sum []byte) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if c.state.checksums == nil {
+		c.state.checksums = make(map[uint16][]byte)
+	}
+	c.state.checksums[file] = sum
+}
+
+// receipt returns the Receipt of r.
+func (c *clientConnection) receipt(r clientReceipt) Receipt {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	receipt := Receipt{Addr: c.peer.address(), File: r.fileIndex, Checksum: r.checksum}
+	if int(r.fileIndex) < len(c.req.files) {
+		receipt.Name = c.req.files[r.fileIndex].fileName
+	}
+	if sum, ok := c.state.checksums[r.fileIndex]; ok {
+		receipt.Match = bytes.Equal(sum, r.checksum)
+	}
+	return receipt
+}
+
+// keepForReceipts keeps the closed connection c for the close timeout. Clients
+// send the close right after the last receipt, both may be handled in any
+// order. clientMux must be held.
+func (s *Server) keepForReceipts(key string, c *clientConnection) {
+	if s.closed == nil {
+		s.closed = make(map[string]*clientConnection)
+	}
+	s.closed[key] = c
+	s.clock().AfterFunc(s.closeTimeout(), func() {
+		s.clientMux.Lock()
+		defer s.clientMux.Unlock()
+		if s.closed[key] == c {
+			delete(s.closed, key)
+		}
+	})
+}
+
+func (s *Server) handleReceipt(w io.Writer, p *packet) {
+	r := clientReceipt{}
+	if err := r.UnmarshalBinary(p.data); err != nil {
+		if s.Strict {
+			s.violated(w, p, err)
+			return
+		}
+		log.Printf("dropping malformed receipt from %v: %v\n", p.remoteAddr, err)
+		return
+	}
+	key := s.connKey(p)
+	s.clientMux.Lock()
+	c, ok := s.clients[key]
+	if !ok {
+		c, ok = s.closed[key]
+	}
+	s.clientMux.Unlock()
+	if !ok {
+		log.Printf("dropping receipt from %v without connection\n", p.remoteAddr)
+		return
+	}
+	receipt := c.receipt(r)
+	s.Logger.Infof("%v\n", receipt)
+	if s.OnReceipt != nil {
+		s.OnReceipt(receipt)
+	}
+}
+
+// sendReceipt confirms the verified file index to the server, if its
+// verification succeeded, and finishes the file.
+func (c *Client) sendReceipt(index uint16, sum []byte, err error) {
+	if err == nil {
+		if err := c.Conn.send(clientReceipt{fileIndex: index, checksum: sum}, c.withID()...); err != nil {
+			log.Printf("failed to send receipt: %v\n", err)
+		}
+	}
+	c.done <- index
+}
@@ -0,0 +1,61 @@
+package rftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestReceipts(t *testing.T) {
+	files := map[string][]byte{"a": testData(3*1024 + 7), "b": testData(100)}
+	receipts := make(chan Receipt, len(files))
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(files))
+	s.OnReceipt = func(r Receipt) { receipts <- r }
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection(), Receipts: true}
+	rs, err := c.RequestFrom(addr, []FileRequest{{Name: "a"}, {Name: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"a", "b"} {
+		got, err := ioutil.ReadAll(rs[i])
+		if err != nil || rs[i].Err != nil || !bytes.Equal(got, files[name]) {
+			t.Fatalf("file %v: received %v bytes: %v, %v", name, len(got), err, rs[i].Err)
+		}
+		select {
+		case r := <-receipts:
+			sum := md5.Sum(files[name])
+			if r.File != uint16(i) || r.Name != name || !bytes.Equal(r.Checksum, sum[:]) || !r.Match {
+				t.Errorf("got %v, want file %v (%v) with checksum %x", r, i, name, sum)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no receipt for file %v", name)
+		}
+	}
+}
+
+func TestNoReceiptsByDefault(t *testing.T) {
+	receipts := make(chan Receipt, 1)
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"a": testData(100)}))
+	s.OnReceipt = func(r Receipt) { receipts <- r }
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	rs, err := c.RequestFrom(addr, []FileRequest{{Name: "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(rs[0]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-receipts:
+		t.Errorf("got %v without Client.Receipts", r)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
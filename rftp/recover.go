@@ -0,0 +1,177 @@
+package rftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// limitsPerOption is the number of limits carried by a single option.
+const limitsPerOption = 31
+
+// maxRanges is the number of ranges Recover fetches in a single request, whose
+// limits fit into the options of a header.
+const maxRanges = 32 * limitsPerOption
+
+// limitOptions returns the options carrying limits, a single limit of all
+// files or one limit per file.
+func limitOptions(limits []uint64) []option {
+	var os []option
+	for len(limits) > 0 {
+		n := len(limits)
+		if n > limitsPerOption {
+			n = limitsPerOption
+		}
+		value := make([]byte, 8*n)
+		for i, l := range limits[:n] {
+			binary.BigEndian.PutUint64(value[8*i:], l)
+		}
+		os = append(os, option{otype: optionLimit, value: value})
+		limits = limits[n:]
+	}
+	return os
+}
+
+// limits returns the number of chunks requested by os of each of files, nil
+// if unlimited. A limit of 0 doesn't limit its file.
+func limits(os []option, files int) ([]uint64, error) {
+	var value []byte
+	for _, o := range os {
+		if o.otype == optionLimit {
+			value = append(value, o.value...)
+		}
+	}
+	if value == nil {
+		return nil, nil
+	}
+	if len(value)%8 != 0 || (len(value) != 8 && len(value) != 8*files) {
+		return nil, fmt.Errorf("got %d bytes of limits for %d files", len(value), files)
+	}
+	ls := make([]uint64, files)
+	for i := range ls {
+		if len(value) == 8 {
+			ls[i] = binary.BigEndian.Uint64(value)
+		} else {
+			ls[i] = binary.BigEndian.Uint64(value[8*i:])
+		}
+	}
+	return ls, nil
+}
+
+// ChunkRange is a range of Count chunks starting at chunk Offset.
+type ChunkRange struct {
+	Offset uint64
+	Count  uint64
+}
+
+// Recover completes the partial local copy f of the file name on a new
+// connection, e.g. after the client crashed during a download, and fetches
+// only its missing ranges in a single request. missing are the ranges, which
+// the client tracked as missing. If it is nil, f is compared with the server's
+// region checksums instead, see Repair, and the regions, which don't match,
+// are missing. Recover returns the ranges it fetched. Chunks are ChunkSize
+// bytes long. The server must support FeatureRanges, and FeatureRegions to
+// compare the regions.
+func (c *Client) Recover(host, name string, f ReadWriterAt, missing []ChunkRange) ([]ChunkRange, error) {
+	chunkSize := c.fixedChunkSize()
+	if missing == nil {
+		var err error
+		if missing, err = c.missingRegions(host, name, f, chunkSize); err != nil {
+			return nil, err
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	if len(missing) > maxRanges {
+		return nil, fmt.Errorf("%v missing ranges exceed the %v ranges of a request", len(missing), maxRanges)
+	}
+
+	reqs := make([]FileRequest, len(missing))
+	c.limits = make([]uint64, len(missing))
+	defer func() { c.limits = nil }()
+	for i, r := range missing {
+		if r.Count == 0 {
+			return nil, errors.New("empty missing range")
+		}
+		reqs[i] = FileRequest{Name: name, Offset: r.Offset}
+		c.limits[i] = r.Count
+	}
+	responses, err := c.RequestFrom(host, reqs)
+	if err != nil {
+		return nil, err
+	}
+	for i, fr := range responses {
+		off := int64(missing[i].Offset) * int64(chunkSize)
+		if err := writeRange(fr, f, off, missing[i].Offset); err != nil {
+			c.closeConnection()
+			return nil, fmt.Errorf("failed to fetch chunks %v+%v: %w", missing[i].Offset, missing[i].Count, err)
+		}
+	}
+	return missing, nil
+}
+
+// missingRegions returns the ranges of the regions of f, which don't match the
+// server's region checksums of the file name. Adjacent regions form a single
+// range.
+func (c *Client) missingRegions(host, name string, f ReadWriterAt, chunkSize int) ([]ChunkRange, error) {
+	regionSize := c.RegionSize
+	if regionSize <= 0 {
+		regionSize = defaultRegionSize
+	}
+	if regionSize%chunkSize != 0 {
+		return nil, fmt.Errorf("region size %v is no multiple of the chunk size %v", regionSize, chunkSize)
+	}
+	rs, err := c.RegionChecksums(host, name, regionSize)
+	if err != nil {
+		return nil, err
+	}
+
+	regionChunks := uint64(regionSize / chunkSize)
+	chunks := (rs.Size + uint64(chunkSize) - 1) / uint64(chunkSize)
+	missing := []ChunkRange{}
+	for i, sum := range rs.Sums {
+		if c.regionMatches(f, rs, i, sum) {
+			continue
+		}
+		r := ChunkRange{Offset: uint64(i) * regionChunks, Count: regionChunks}
+		if end := r.Offset + r.Count; end > chunks {
+			r.Count = chunks - r.Offset
+		}
+		if n := len(missing); n > 0 && missing[n-1].Offset+missing[n-1].Count == r.Offset {
+			missing[n-1].Count += r.Count
+			continue
+		}
+		missing = append(missing, r)
+	}
+	return missing, nil
+}
+
+// fixedChunkSize returns the chunk size of requests, whose chunks the client
+// counts itself, e.g. to request ranges or regions.
+func (c *Client) fixedChunkSize() int {
+	if c.ChunkSize > 0 {
+		return c.ChunkSize
+	}
+	return defaultChunkSize
+}
+
+// writeRange writes the chunks received by fr to f at off, once they were
+// received completely and verified. The transfer must start at the requested
+// chunk offset.
+func writeRange(fr *FileResponse, f io.WriterAt, off int64, offset uint64) error {
+	data, err := ioutil.ReadAll(fr)
+	if err != nil {
+		return err
+	}
+	if err := fr.err(); err != nil {
+		return err
+	}
+	if fr.Offset() != offset {
+		return fmt.Errorf("transfer started at chunk %v instead of %v", fr.Offset(), offset)
+	}
+	_, err = f.WriteAt(data, off)
+	return err
+}
@@ -0,0 +1,114 @@
+package rftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecoverFetchesOnlyMissingRanges(t *testing.T) {
+	data := testData(20*1024 + 100)
+
+	// the holes of a partial copy, which the client tracked
+	tracked := []ChunkRange{{2, 2}, {7, 1}, {18, 3}}
+	holey := append([]byte{}, data...)
+	for _, r := range tracked {
+		end := (r.Offset + r.Count) * 1024
+		if end > uint64(len(holey)) {
+			end = uint64(len(holey))
+		}
+		for i := r.Offset * 1024; i < end; i++ {
+			holey[i] = 0
+		}
+	}
+	path := writeTempFile(t, holey)
+	defer os.Remove(path)
+	local, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	summaries := make(chan TransferSummary, 1)
+	s := NewServer()
+	s.OnComplete = func(sum TransferSummary) { summaries <- sum }
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	fetched, err := c.Recover(addr, "file", local, tracked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fetched, tracked) {
+		t.Errorf("fetched %v, want %v", fetched, tracked)
+	}
+	if got, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("local copy not recovered: %v", err)
+	}
+	select {
+	case sum := <-summaries:
+		if want := uint64(5*1024 + 100); sum.Bytes != want {
+			t.Errorf("server sent %v bytes, want only the %v missing bytes", sum.Bytes, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no transfer completed")
+	}
+}
+
+func TestRecoverComparesRegions(t *testing.T) {
+	const regionSize = 4 * 1024
+	data := testData(5*regionSize + 100)
+	summaries := make(chan TransferSummary, 1)
+	s := NewServer()
+	s.OnComplete = func(sum TransferSummary) { summaries <- sum }
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	// a copy, which is corrupted in its first region and ends in its third
+	local := &memWriterAt{data: append([]byte{}, data[:2*regionSize+10]...)}
+	local.data[100] ^= 0xff
+
+	c := Client{Conn: NewUDPConnection(), RegionSize: regionSize}
+	fetched, err := c.Recover(addr, "file", local, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []ChunkRange{{0, 4}, {8, 13}}; !reflect.DeepEqual(fetched, want) {
+		t.Errorf("fetched %v, want %v", fetched, want)
+	}
+	if !bytes.Equal(local.data, data) {
+		t.Error("local copy not recovered")
+	}
+	select {
+	case sum := <-summaries:
+		if want := uint64(4*regionSize + 100); sum.Bytes != want {
+			t.Errorf("server sent %v bytes, want only the %v missing bytes", sum.Bytes, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no transfer completed")
+	}
+}
+
+func TestLimitOptions(t *testing.T) {
+	ls := make([]uint64, 40)
+	for i := range ls {
+		ls[i] = uint64(i)
+	}
+	os := limitOptions(ls)
+	if len(os) != 2 {
+		t.Fatalf("got %v options, want 2", len(os))
+	}
+	if got, err := limits(os, len(ls)); err != nil || !reflect.DeepEqual(got, ls) {
+		t.Errorf("got %v, %v, want %v", got, err, ls)
+	}
+	if got, err := limits(limitOptions([]uint64{5}), 3); err != nil || !reflect.DeepEqual(got, []uint64{5, 5, 5}) {
+		t.Errorf("got %v, %v for a single limit, want it for all files", got, err)
+	}
+	if _, err := limits(limitOptions([]uint64{1, 2}), 3); err == nil {
+		t.Error("accepted 2 limits for 3 files")
+	}
+}
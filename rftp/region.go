@@ -0,0 +1,292 @@
+package rftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"time"
+)
+
+// defaultRegionSize is the size of the regions compared by Repair, unless
+// Client.RegionSize is set.
+const defaultRegionSize = 1 << 20
+
+// maxRegions is the number of region checksums the server sends in response
+// to a single request.
+const maxRegions = 1 << 14
+
+func regionsOption(size uint32) option {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, size)
+	return option{otype: optionRegions, value: value}
+}
+
+func regionIndexOption(index uint64) option {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, index)
+	return option{otype: optionRegions, value: value}
+}
+
+// regionChecksums responds to the region request p with the checksums of the
+// regions of the requested files, one metadata per region. Requests for
+// regions smaller than a chunk or more than maxRegions are rejected, smaller
+// regions would cost a hash and a packet per few bytes.
+func (s *Server) regionChecksums(w io.Writer, p *packet, cr *clientRequest, o option) {
+	if len(o.value) != 4 || binary.BigEndian.Uint32(o.value) < uint32(s.chunkSize(p.os)) {
+		s.rejectRequest(w, p, fmt.Errorf("invalid region size %x", o.value))
+		return
+	}
+	size := int64(binary.BigEndian.Uint32(o.value))
+	mds := make([]serverMetaData, len(cr.files))
+	readers := make([]*io.SectionReader, len(cr.files))
+	regions := int64(0)
+	for i, f := range cr.files {
+		mds[i].fileIndex = uint16(i)
+		r, err := s.fh(s.ctx, f.fileName)
+		if err != nil || r == nil {
+			mds[i].status = fileNotExistent
+		} else if r.Size() == UnknownSize {
+			// streams can't be read again
+			mds[i].status = readError
+		} else if r.Size() == 0 {
+			mds[i].status = fileEmpty
+		}
+		if mds[i].status != noErr {
+			regions++
+			continue
+		}
+		readers[i] = r
+		regions += (r.Size() + size - 1) / size
+	}
+	if regions > maxRegions {
+		s.rejectRequest(w, p, fmt.Errorf("request for %v regions exceeds the limit of %v", regions, maxRegions))
+		return
+	}
+
+	for i, f := range cr.files {
+		md, r := mds[i], readers[i]
+		if md.status != noErr {
+			if err := sendTo(w, md); err != nil {
+				s.Logger.Infof("failed to send region checksum: %v\n", err)
+			}
+			continue
+		}
+
+		md.size = uint64(r.Size())
+		for index := int64(0); index*size < r.Size(); index++ {
+			h := s.NewHash()
+			if _, err := io.Copy(h, io.NewSectionReader(r, index*size, size)); err != nil {
+				s.Logger.Infof("failed to read region %v of %v: %v\n", index, f.fileName, err)
+				md.status = readError
+				if err := sendTo(w, md); err != nil {
+					s.Logger.Infof("failed to send region checksum: %v\n", err)
+				}
+				break
+			}
+			md.checkSum = h.Sum(nil)
+			if err := sendTo(w, md, regionIndexOption(uint64(index))); err != nil {
+				s.Logger.Infof("failed to send region checksum: %v\n", err)
+			}
+		}
+	}
+}
+
+// RegionChecksums are the checksums of the regions of a file.
+type RegionChecksums struct {
+	// Size is the size of the file in bytes.
+	Size uint64
+	// RegionSize is the size of all regions but the last in bytes.
+	RegionSize int
+	Sums       [][]byte
+}
+
+// RegionChecksums asks the server for the checksums of the regions of
+// regionSize bytes of the file name, without transferring it. Servers reject
+// regions smaller than ChunkSize and requests for more than 16384 regions.
+func (c *Client) RegionChecksums(host, name string, regionSize int) (*RegionChecksums, error) {
+	if regionSize < minChunkSize || int64(regionSize) > math.MaxUint32 {
+		return nil, fmt.Errorf("invalid region size %v", regionSize)
+	}
+	if err := c.Conn.connectTo(host); err != nil {
+		return nil, err
+	}
+
+	type region struct {
+		md    serverMetaData
+		index uint64
+	}
+	regions := make(chan region, 1024)
+	c.Conn.handle(msgServerMetadata, handlerFunc(func(_ io.Writer, p *packet) {
+		md := serverMetaData{}
+		if err := md.UnmarshalBinary(p.data); err != nil {
+			log.Printf("failed to parse region checksum: %v\n", err)
+			return
+		}
+		r := region{md: md}
+		if o, ok := findOption(p.os, optionRegions); ok && len(o.value) == 8 {
+			r.index = binary.BigEndian.Uint64(o.value)
+		} else if md.status == noErr {
+			log.Println("dropped region checksum without index")
+			return
+		}
+		regions <- r
+	}))
+	closed := make(chan string, 1)
+	c.Conn.handle(msgClose, handlerFunc(func(_ io.Writer, p *packet) {
+		cl := closeConnection{}
+		if err := cl.UnmarshalBinary(p.data); err != nil {
+			log.Printf("dropping malformed close from %v: %v\n", p.remoteAddr, err)
+			return
+		}
+		reason := cl.reason.String()
+		if o, ok := findOption(p.os, optionReason); ok {
+			reason += ": " + string(o.value)
+		}
+		select {
+		case closed <- reason:
+		default:
+		}
+	}))
+	go c.Conn.receive()
+	defer c.Conn.cclose(c.closeTimeout())
+
+	rs := &RegionChecksums{RegionSize: regionSize}
+	received := 0
+	for try := 1; try <= 3; try++ {
+		err := c.Conn.send(clientRequest{files: []fileDescriptor{{0, name}}}, regionsOption(uint32(regionSize)),
+			chunkSizeOption(c.fixedChunkSize()))
+		if err != nil {
+			return nil, err
+		}
+		timeout := c.clock().NewTimer(time.Duration(math.Pow(2, float64(try))) * time.Second)
+	wait:
+		for rs.Sums == nil || received < len(rs.Sums) {
+			select {
+			case r := <-regions:
+				if r.md.status != noErr {
+					timeout.Stop()
+					return nil, fmt.Errorf("server returned error for %v: status %v", name, r.md.status)
+				}
+				if rs.Sums == nil {
+					rs.Size = r.md.size
+					rs.Sums = make([][]byte, (r.md.size+uint64(regionSize)-1)/uint64(regionSize))
+				}
+				if r.index < uint64(len(rs.Sums)) && rs.Sums[r.index] == nil {
+					rs.Sums[r.index] = r.md.checkSum
+					received++
+				}
+			case reason := <-closed:
+				timeout.Stop()
+				return nil, fmt.Errorf("server rejected region request for %v: %v", name, reason)
+			case <-timeout.C():
+				break wait
+			}
+		}
+		timeout.Stop()
+		if rs.Sums != nil && received == len(rs.Sums) {
+			return rs, nil
+		}
+	}
+	return nil, fmt.Errorf("region checksum request timed out %v times, aborting", 3)
+}
+
+// ReadWriterAt is the local copy of a file, which Repair verifies and
+// repairs, e.g. an *os.File.
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// RepairResult describes the regions of a repaired file.
+type RepairResult struct {
+	// Size is the size of the file on the server. Local copies, which are
+	// longer, must be truncated to it.
+	Size    uint64
+	Regions int
+	// Refetched are the indexes of the regions, which didn't match the
+	// server's checksums and were fetched again.
+	Refetched []int
+}
+
+// Repair compares the local copy f of the file name with the server's region
+// checksums, see RegionChecksums, and only fetches the regions again, which
+// don't match, in requests of up to 992 regions each. Regions are RegionSize
+// bytes long. This is more precise than downloading the whole file again after
+// a checksum mismatch. The server must support FeatureRegions.
+func (c *Client) Repair(host, name string, f ReadWriterAt) (*RepairResult, error) {
+	regionSize := c.RegionSize
+	if regionSize <= 0 {
+		regionSize = defaultRegionSize
+	}
+	chunkSize := c.fixedChunkSize()
+	if regionSize%chunkSize != 0 {
+		return nil, fmt.Errorf("region size %v is no multiple of the chunk size %v", regionSize, chunkSize)
+	}
+
+	rs, err := c.RegionChecksums(host, name, regionSize)
+	if err != nil {
+		return nil, err
+	}
+	result := &RepairResult{Size: rs.Size, Regions: len(rs.Sums)}
+	for i, sum := range rs.Sums {
+		if !c.regionMatches(f, rs, i, sum) {
+			result.Refetched = append(result.Refetched, i)
+		}
+	}
+	if len(result.Refetched) == 0 {
+		return result, nil
+	}
+
+	c.limits = []uint64{uint64(regionSize / chunkSize)}
+	defer func() { c.limits = nil }()
+	for batch := result.Refetched; len(batch) > 0; {
+		n := len(batch)
+		if n > maxRanges {
+			n = maxRanges
+		}
+		if err := c.fetchRegions(host, name, f, batch[:n], regionSize, chunkSize); err != nil {
+			return nil, err
+		}
+		batch = batch[n:]
+	}
+	return result, nil
+}
+
+// fetchRegions fetches the regions of the file name in a single request and
+// writes them to f.
+func (c *Client) fetchRegions(host, name string, f io.WriterAt, regions []int, regionSize, chunkSize int) error {
+	reqs := make([]FileRequest, len(regions))
+	for i, region := range regions {
+		reqs[i] = FileRequest{Name: name, Offset: uint64(region * regionSize / chunkSize)}
+	}
+	responses, err := c.RequestFrom(host, reqs)
+	if err != nil {
+		return err
+	}
+	for i, fr := range responses {
+		off := int64(regions[i]) * int64(regionSize)
+		if err := writeRange(fr, f, off, reqs[i].Offset); err != nil {
+			c.closeConnection()
+			return fmt.Errorf("failed to fetch region %v: %w", regions[i], err)
+		}
+	}
+	return nil
+}
+
+// regionMatches reports whether the region index of f matches sum.
+func (c *Client) regionMatches(f io.ReaderAt, rs *RegionChecksums, index int, sum []byte) bool {
+	off := int64(index) * int64(rs.RegionSize)
+	length := int64(rs.RegionSize)
+	if rest := int64(rs.Size) - off; rest < length {
+		length = rest
+	}
+	h := c.newHash()
+	n, err := io.Copy(h, io.NewSectionReader(f, off, length))
+	if err != nil || n != length {
+		return false
+	}
+	return bytes.Equal(h.Sum(nil), sum)
+}
@@ -0,0 +1,70 @@
+package rftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestRepairRefetchesCorruptedRegion(t *testing.T) {
+	const regionSize = 4 * 1024
+	data := testData(4*regionSize + 100)
+	summaries := make(chan TransferSummary, 1)
+	s := NewServer()
+	s.OnComplete = func(sum TransferSummary) { summaries <- sum }
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	local := &memWriterAt{data: append([]byte{}, data...)}
+	local.data[2*regionSize+10] ^= 0xff
+
+	c := Client{Conn: NewUDPConnection(), RegionSize: regionSize}
+	result, err := c.Repair(addr, "file", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Regions != 5 || !reflect.DeepEqual(result.Refetched, []int{2}) {
+		t.Errorf("refetched regions %v of %v, want [2] of 5", result.Refetched, result.Regions)
+	}
+	if !bytes.Equal(local.data, data) {
+		t.Error("local copy not repaired")
+	}
+	if sum := <-summaries; sum.Bytes != regionSize {
+		t.Errorf("server sent %v bytes, want only the region of %v bytes", sum.Bytes, regionSize)
+	}
+}
+
+func TestRegionRequestLimits(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(func(context.Context, string) (*io.SectionReader, error) {
+		// never read, the requests are rejected before
+		return io.NewSectionReader(bytes.NewReader(nil), 0, (maxRegions+1)*defaultChunkSize), nil
+	})
+	addr := startServer(t, s)
+
+	for _, size := range []uint32{1, defaultChunkSize - 1, defaultChunkSize} {
+		conn := dialServer(t, addr)
+		defer conn.Close()
+		if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}, regionsOption(size)); err != nil {
+			t.Fatal(err)
+		}
+		cl := &closeConnection{}
+		if err := cl.UnmarshalBinary(readMsg(t, conn, msgClose)); err != nil {
+			t.Fatal(err)
+		}
+		if cl.reason != unknownRequest {
+			t.Errorf("region size %v: got close reason %v, want %v", size, cl.reason, unknownRequest)
+		}
+	}
+
+	c := Client{Conn: NewUDPConnection()}
+	if _, err := c.RegionChecksums(addr, "file", defaultChunkSize); err == nil {
+		t.Error("request for too many regions succeeded")
+	}
+	c = Client{Conn: NewUDPConnection(), ChunkSize: 2 * defaultChunkSize}
+	if _, err := c.RegionChecksums(addr, "file", defaultChunkSize); err == nil {
+		t.Error("request for regions smaller than a chunk succeeded")
+	}
+}
@@ -0,0 +1,145 @@
+package rftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+)
+
+// errChunkUnavailable is the error of a resend, whose chunk was evicted from
+// the cache and can't be read from its file again, e.g. because the file was
+// truncated. The client could never complete the file.
+var errChunkUnavailable = errors.New("chunk unavailable from cache and file")
+
+// chunkSource is the reader of a file, from which evicted chunks are read
+// again. Streams have none.
+type chunkSource struct {
+	r         io.ReaderAt
+	size      int64
+	chunkSize int
+	// compressed is set, if r compresses the file again for each read.
+	compressed bool
+}
+
+// keepSource keeps sr of the file at index to read its evicted chunks again.
+func (c *clientConnection) keepSource(index uint16, sr *io.SectionReader, chunkSize int) {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	if c.sources == nil {
+		c.sources = make(map[uint16]chunkSource)
+	}
+	c.sources[index] = chunkSource{r: sr, size: sr.Size(), chunkSize: chunkSize}
+}
+
+// keepCompressed keeps sr of the file at index, which is sent compressed, to
+// compress it again for reads of its evicted chunks. The size of the
+// compressed stream is set once it was read, see sizeCompressed.
+func (c *clientConnection) keepCompressed(index uint16, sr *io.SectionReader, chunkSize int) {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	if c.sources == nil {
+		c.sources = make(map[uint16]chunkSource)
+	}
+	c.sources[index] = chunkSource{r: recompressor{sr}, size: UnknownSize, chunkSize: chunkSize, compressed: true}
+}
+
+// sizeCompressed sets the size of the compressed stream of the file at index.
+func (c *clientConnection) sizeCompressed(index uint16, size int64) {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	if src, ok := c.sources[index]; ok && src.compressed {
+		src.size = size
+		c.sources[index] = src
+	}
+}
+
+// recompressor reads the compressed stream of a file by compressing the file
+// again, which yields the same stream. Each read compresses the file from its
+// start, so it only serves the rare reads of evicted chunks.
+type recompressor struct {
+	sr *io.SectionReader
+}
+
+func (z recompressor) ReadAt(p []byte, off int64) (int, error) {
+	r, stop := compress(io.NewSectionReader(z.sr, 0, z.sr.Size()))
+	defer stop()
+	if _, err := io.CopyN(ioutil.Discard, r, off); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(r, p)
+}
+
+// cachesPayloads reports whether the sent payloads of file are cached for
+// resends, see ResendSource. In NACK-only mode, they are never acknowledged,
+// so they aren't cached, if they can be read again. Compressed payloads are
+// always cached, because reading them again compresses the whole file.
+func (c *clientConnection) cachesPayloads(file uint16) bool {
+	if c.resendSource != ResendFromFile && !c.nackOnly {
+		return true
+	}
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	src, ok := c.sources[file]
+	return !ok || src.compressed
+}
+
+// rereadable reports whether the chunk of file at offset, which isn't cached,
+// is read from the file to resend it. That's the case, if it was dropped from
+// the cache after an ack or, if payloads of file aren't cached, sent before.
+func (c *clientConnection) rereadable(file uint16, offset uint64) bool {
+	c.cacheLock.Lock()
+	evicted := offset < c.evicted[file]
+	c.cacheLock.Unlock()
+	if evicted || c.cachesPayloads(file) {
+		return evicted
+	}
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return offset < c.state.sent[file]
+}
+
+// reread reads the evicted chunk of file at offset from the file again. It
+// fails with errChunkUnavailable, if the chunk can't be read completely.
+func (c *clientConnection) reread(file uint16, offset uint64) (*serverPayload, error) {
+	c.cacheLock.Lock()
+	src, ok := c.sources[file]
+	c.cacheLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: file %v can't be read again", errChunkUnavailable, file)
+	}
+
+	start := int64(offset) * int64(src.chunkSize)
+	length := src.size - start
+	if length > int64(src.chunkSize) {
+		length = int64(src.chunkSize)
+	}
+	if length <= 0 {
+		return nil, fmt.Errorf("%w: chunk %v of file %v is beyond its end", errChunkUnavailable, offset, file)
+	}
+	buf := make([]byte, length)
+	n, err := readChunk(src.r, buf, start)
+	if n < len(buf) {
+		return nil, fmt.Errorf("%w: read %v of %v bytes of chunk %v of file %v: %v",
+			errChunkUnavailable, n, length, offset, file, err)
+	}
+	c.stateLock.Lock()
+	c.state.rereads++
+	c.stateLock.Unlock()
+	return &serverPayload{fileIndex: file, offset: offset, data: buf}, nil
+}
+
+// unavailable closes the connection, because a chunk requested by the client
+// can't be resent.
+func (c *clientConnection) unavailable(err error) {
+	c.stateLock.Lock()
+	c.state.unavailable++
+	c.stateLock.Unlock()
+
+	log.Println(err)
+	if err := sendTo(c.socket, closeConnection{reason: applicationClosed}, reasonOption(err)); err != nil {
+		log.Printf("failed to send close: %v\n", err)
+	}
+	c.closeWith(applicationClosed)
+}
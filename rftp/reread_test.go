@@ -0,0 +1,223 @@
+package rftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// evictThenRequest transfers the file at path by a request with options opts,
+// acknowledges its first 10 chunks, so that they are evicted, calls modify and
+// requests chunk 2 again.
+func evictThenRequest(t *testing.T, s *Server, path string, modify func(), opts ...option) *net.UDPConn {
+	s.SetFileHandler(func(_ context.Context, _ string) (*io.SectionReader, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return io.NewSectionReader(f, 0, info.Size()), nil
+	})
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}, opts...); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, conn, msgServerMetadata)
+	if err := sendAckTo(conn, 1, clientAck{fileIndex: 0, offset: 10}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if ts, ok := s.TransferState(conn.LocalAddr()); ok && ts.Files[0].Frontier == 10 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ack not handled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	modify()
+	if err := sendAckTo(conn, 2, clientAck{
+		fileIndex:     0,
+		offset:        10,
+		resendEntries: []*resendEntry{{0, 2, 1}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func writeTempFile(t *testing.T, data []byte) string {
+	f, err := ioutil.TempFile("", "rftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestEvictedChunkIsReread(t *testing.T) {
+	data := testData(20 * 1024)
+	path := writeTempFile(t, data)
+	defer os.Remove(path)
+
+	conn := evictThenRequest(t, NewServer(), path, func() {})
+	defer conn.Close()
+	for {
+		p := serverPayload{}
+		if err := p.UnmarshalBinary(readMsg(t, conn, msgServerPayload)); err != nil {
+			t.Fatal(err)
+		}
+		if p.offset == 2 {
+			if !bytes.Equal(p.data, data[2*1024:3*1024]) {
+				t.Error("resent chunk differs from the file")
+			}
+			return
+		}
+	}
+}
+
+func TestEvictedCompressedChunkIsReread(t *testing.T) {
+	// compressing random data enlarges it, so the stream has more than the
+	// 10 acknowledged chunks
+	data := make([]byte, 20*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	path := writeTempFile(t, data)
+	defer os.Remove(path)
+	r, stop := compress(bytes.NewReader(data))
+	defer stop()
+	compressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := evictThenRequest(t, NewServer(), path, func() {}, option{otype: optionGzip})
+	defer conn.Close()
+	for {
+		p := serverPayload{}
+		if err := p.UnmarshalBinary(readMsg(t, conn, msgServerPayload)); err != nil {
+			t.Fatal(err)
+		}
+		if p.offset == 2 {
+			if !bytes.Equal(p.data, compressed[2*1024:3*1024]) {
+				t.Error("resent chunk differs from the compressed stream")
+			}
+			return
+		}
+	}
+}
+
+func TestTruncatedFileClosesConnection(t *testing.T) {
+	path := writeTempFile(t, testData(20*1024))
+	defer os.Remove(path)
+
+	summaries := make(chan TransferSummary, 1)
+	s := NewServer()
+	s.OnComplete = func(summary TransferSummary) {
+		summaries <- summary
+	}
+	conn := evictThenRequest(t, s, path, func() {
+		if err := os.Truncate(path, 1024); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer conn.Close()
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("no close received: %v", err)
+		}
+		h := &msgHeader{}
+		if err := h.UnmarshalBinary(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if h.msgType != msgClose {
+			continue
+		}
+		if o, ok := findOption(h.options, optionReason); !ok ||
+			!strings.Contains(string(o.value), errChunkUnavailable.Error()) {
+			t.Errorf("close doesn't report the unavailable chunk: %q", o.value)
+		}
+		break
+	}
+
+	select {
+	case summary := <-summaries:
+		if summary.Unavailable != 1 {
+			t.Errorf("got %v unavailable chunks, want 1", summary.Unavailable)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no summary reported")
+	}
+}
+
+func TestResendSource(t *testing.T) {
+	data := testData(20 * 1024)
+	for _, tc := range []struct {
+		source  ResendSource
+		rereads int
+	}{
+		{ResendFromCache, 0},
+		{ResendFromFile, 1},
+	} {
+		s := NewServer()
+		s.ResendSource = tc.source
+		s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+		addr := startServer(t, s)
+
+		conn := dialServer(t, addr)
+		defer conn.Close()
+		if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+			t.Fatal(err)
+		}
+		readMsg(t, conn, msgServerMetadata)
+		// nothing is acknowledged, so chunk 2 is cached unless read again
+		if err := sendAckTo(conn, 1, clientAck{
+			fileIndex:     0,
+			resendEntries: []*resendEntry{{0, 2, 1}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			p := serverPayload{}
+			if err := p.UnmarshalBinary(readMsg(t, conn, msgServerPayload)); err != nil {
+				t.Fatal(err)
+			}
+			if p.offset == 2 {
+				if !bytes.Equal(p.data, data[2*1024:3*1024]) {
+					t.Errorf("%v: resent chunk differs from the file", tc.source)
+				}
+				break
+			}
+		}
+		ts, ok := s.TransferState(conn.LocalAddr())
+		if !ok {
+			t.Fatalf("%v: connection closed", tc.source)
+		}
+		if ts.Rereads != tc.rereads {
+			t.Errorf("%v: got %v rereads, want %v", tc.source, ts.Rereads, tc.rereads)
+		}
+		if tc.source == ResendFromFile && ts.Memory != 0 {
+			t.Errorf("%v: holds %v bytes of payloads", tc.source, ts.Memory)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package rftp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ResendOutcome is the decision on a chunk requested by an ack.
+type ResendOutcome uint8
+
+const (
+	// ResentFromCache is a chunk resent from the cache.
+	ResentFromCache ResendOutcome = iota
+	// ResentFromFile is a chunk read from its file again and resent, because
+	// it was evicted from the cache after an ack or never cached, see
+	// ResendSource.
+	ResentFromFile
+	// SkippedNotSent is a chunk, which wasn't sent yet.
+	SkippedNotSent
+	// SkippedUnavailable is a chunk, which was neither cached nor readable
+	// from its file. The connection is closed.
+	SkippedUnavailable
+	// SkippedRetransmissions is a chunk, which was resent
+	// Server.MaxRetransmissions times already. The connection is closed.
+	SkippedRetransmissions
+	// SkippedClosed is a chunk requested after the connection was closed.
+	SkippedClosed
+	// SkippedNotScheduled is a requested chunk, which the RetransmitScheduler
+	// didn't resend, e.g. because it was queued already or beyond the ack's
+	// budget.
+	SkippedNotScheduled
+	// SkippedAcknowledged is a chunk, which the client acknowledged already,
+	// e.g. by an ack newer than the one requesting it.
+	SkippedAcknowledged
+)
+
+func (o ResendOutcome) String() string {
+	switch o {
+	case ResentFromCache:
+		return "cached"
+	case ResentFromFile:
+		return "reread"
+	case SkippedNotSent:
+		return "not sent"
+	case SkippedUnavailable:
+		return "unavailable"
+	case SkippedRetransmissions:
+		return "retransmissions exceeded"
+	case SkippedClosed:
+		return "closed"
+	case SkippedNotScheduled:
+		return "not scheduled"
+	case SkippedAcknowledged:
+		return "acknowledged"
+	}
+	return fmt.Sprintf("unknown outcome %d", uint8(o))
+}
+
+// ChunkDecision is the outcome of a chunk requested by an ack.
+type ChunkDecision struct {
+	File    uint16
+	Offset  uint64
+	Outcome ResendOutcome
+}
+
+// ResendTrace records the decisions on the resends of a single ack. Each
+// trace is logged as the only argument of a Debug line of the server's Logger,
+// so that loggers inspecting their arguments receive it structured.
+type ResendTrace struct {
+	// Ack is the ack with its resends in the order they were serviced in.
+	Ack AckEvent
+	// Chunks are the decisions in the order they were made. Chunks, which the
+	// scheduler didn't resend, are appended last.
+	Chunks []ChunkDecision
+	// Metadata are the files, whose metadata was resent.
+	Metadata []uint16
+}
+
+// Outcomes returns the chunks of t with outcome o.
+func (t *ResendTrace) Outcomes(o ResendOutcome) []ChunkDecision {
+	ds := []ChunkDecision{}
+	for _, d := range t.Chunks {
+		if d.Outcome == o {
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
+
+// String formats t as key=value pairs, chunks as file:offset.
+func (t *ResendTrace) String() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "resend file=%v offset=%v requested=[", t.Ack.File, t.Ack.Offset)
+	for i, re := range t.Ack.Resends {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		fmt.Fprintf(b, "%v:%v+%v", re.File, re.Offset, re.Length)
+	}
+	b.WriteString("]")
+	for o := ResentFromCache; o <= SkippedAcknowledged; o++ {
+		ds := t.Outcomes(o)
+		if len(ds) == 0 {
+			continue
+		}
+		fmt.Fprintf(b, " %v=[", strings.ReplaceAll(o.String(), " ", "_"))
+		for i, d := range ds {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			fmt.Fprintf(b, "%v:%v", d.File, d.Offset)
+		}
+		b.WriteString("]")
+	}
+	if len(t.Metadata) > 0 {
+		fmt.Fprintf(b, " metadata=%v", t.Metadata)
+	}
+	return b.String()
+}
+
+// begin starts tracing the decisions on the resends of ack.
+func (r *resender) begin(ack AckEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.trace = &ResendTrace{Ack: ack}
+}
+
+// decide records the outcome of the chunk of file at offset, if an ack is
+// traced, and reports whether it was resent.
+func (r *resender) decide(file uint16, offset uint64, o ResendOutcome) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.trace != nil {
+		r.trace.Chunks = append(r.trace.Chunks, ChunkDecision{File: file, Offset: offset, Outcome: o})
+	}
+	return o == ResentFromCache || o == ResentFromFile
+}
+
+// end finishes the trace of the current ack. Requested chunks without
+// decision weren't resent by the scheduler.
+func (r *resender) end() *ResendTrace {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	t := r.trace
+	r.trace = nil
+	decided := map[uint16]map[uint64]struct{}{}
+	for _, d := range t.Chunks {
+		if _, ok := decided[d.File]; !ok {
+			decided[d.File] = map[uint64]struct{}{}
+		}
+		decided[d.File][d.Offset] = struct{}{}
+	}
+	for _, re := range t.Ack.Resends {
+		for i := uint64(0); i < uint64(re.Length); i++ {
+			offset := re.Offset + i
+			if _, ok := decided[re.File]; !ok {
+				decided[re.File] = map[uint64]struct{}{}
+			}
+			if _, ok := decided[re.File][offset]; !ok {
+				decided[re.File][offset] = struct{}{}
+				t.Chunks = append(t.Chunks, ChunkDecision{File: re.File, Offset: offset, Outcome: SkippedNotScheduled})
+			}
+		}
+	}
+	return t
+}
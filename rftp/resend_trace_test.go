@@ -0,0 +1,146 @@
+package rftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// traceLogger passes the resend traces logged by a server to traces.
+type traceLogger struct {
+	traces chan *ResendTrace
+}
+
+func (l traceLogger) Debugf(format string, v ...interface{}) {
+	if len(v) != 1 {
+		return
+	}
+	if t, ok := v[0].(*ResendTrace); ok {
+		select {
+		case l.traces <- t:
+		default:
+		}
+	}
+}
+
+func (l traceLogger) Infof(string, ...interface{}) {}
+
+func TestResendTrace(t *testing.T) {
+	data := testData(20 * 1024)
+	logger := traceLogger{traces: make(chan *ResendTrace, 16)}
+	s := NewServer()
+	s.Logger = logger
+	s.ResendSource = ResendFromFile
+	s.MaxResendsPerAck = 4
+	s.SetFileHandler(func(_ context.Context, name string) (*io.SectionReader, error) {
+		if name == "stream" {
+			// streams can't be read again and are always cached
+			return NewStreamReader(bytes.NewReader(data[:5*1024])), nil
+		}
+		return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), nil
+	})
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}, {0, "stream"}}}); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, conn, msgServerMetadata)
+	readMsg(t, conn, msgServerMetadata)
+	if err := sendAckTo(conn, 1, clientAck{
+		fileIndex: 0,
+		resendEntries: []*resendEntry{
+			{0, 2, 1},
+			{1, 3, 1},
+			{1, 500, 1},
+			{0, 0, 0},
+			// beyond the budget of 4 ranges
+			{0, 600, 1},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var trace *ResendTrace
+	for trace == nil {
+		select {
+		case tr := <-logger.traces:
+			if len(tr.Ack.Resends) == 5 {
+				trace = tr
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no trace of the ack logged")
+		}
+	}
+	want := []ChunkDecision{
+		{0, 2, ResentFromFile},
+		{1, 3, ResentFromCache},
+		{1, 500, SkippedNotSent},
+		{0, 600, SkippedNotScheduled},
+	}
+	if !reflect.DeepEqual(trace.Chunks, want) {
+		t.Errorf("got decisions %v, want %v", trace.Chunks, want)
+	}
+	if !reflect.DeepEqual(trace.Metadata, []uint16{0}) {
+		t.Errorf("got metadata resent of files %v, want [0]", trace.Metadata)
+	}
+	if got, want := trace.String(), "resend file=0 offset=0 requested=[0:0+0 0:2+1 1:3+1 1:500+1 0:600+1]"+
+		" cached=[1:3] reread=[0:2] not_sent=[1:500] not_scheduled=[0:600] metadata=[0]"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestResendTraceSkipsAcknowledged(t *testing.T) {
+	logger := traceLogger{traces: make(chan *ResendTrace, 16)}
+	s := NewServer()
+	s.Logger = logger
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(20 * 1024)}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, conn, msgServerMetadata)
+	if err := sendAckTo(conn, 2, clientAck{fileIndex: 0, offset: 10}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if ts, ok := s.TransferState(conn.LocalAddr()); ok && ts.Files[0].Frontier == 10 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ack not handled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// an older ack, which arrives late, requests an acknowledged chunk
+	if err := sendAckTo(conn, 1, clientAck{fileIndex: 0, offset: 2, resendEntries: []*resendEntry{{0, 2, 1}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		select {
+		case tr := <-logger.traces:
+			if len(tr.Ack.Resends) != 1 {
+				continue
+			}
+			want := []ChunkDecision{{0, 2, SkippedAcknowledged}}
+			if !reflect.DeepEqual(tr.Chunks, want) {
+				t.Errorf("got decisions %v, want %v", tr.Chunks, want)
+			}
+			if got, want := tr.String(), "resend file=0 offset=2 requested=[0:2+1] acknowledged=[0:2]"; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			return
+		case <-time.After(2 * time.Second):
+			t.Fatal("no trace of the ack logged")
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package rftp
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// RetransmitScheduler decides which chunks are resent and when. The server
+// creates one scheduler per connection and calls its methods from a single
+// goroutine, so implementations need no locking unless they resend from other
+// goroutines, e.g. timers.
+type RetransmitScheduler interface {
+	// OnAck is called with every ack of the client. r resends cached chunks
+	// and metadata, it may be kept to resend later.
+	OnAck(ack AckEvent, r Resender)
+
+	// OnResent is called after a chunk queued by Resender.Resend was sent.
+	OnResent(file uint16, offset uint64)
+}
+
+// Resender gives a RetransmitScheduler access to the cache of a connection.
+// Its methods are safe for concurrent use.
+type Resender interface {
+	// Resend queues the chunk of file at offset to be resent and reports
+	// whether it was. It fails, if the chunk wasn't sent yet, a newer ack
+	// acknowledged it or the connection is closed. Chunks evicted from the
+	// cache after an ack or never cached, see Server.ResendSource, are read
+	// from the file again. If that fails, the connection is closed. A chunk
+	// resent more than Server.MaxRetransmissions times closes the connection.
+	Resend(file uint16, offset uint64) bool
+
+	// ResendMetadata queues the metadata of file to be resent and reports
+	// whether it was. It fails, if the metadata wasn't sent yet.
+	ResendMetadata(file uint16) bool
+}
+
+// AckEvent is an ack received from a client.
+type AckEvent struct {
+	// All chunks of File before Offset were received. Both are 0 for clients
+	// in NACK-only mode.
+	File   uint16
+	Offset uint64
+	// MetadataMissing is set, if the client lacks the metadata of File.
+	MetadataMissing bool
+	// NackOnly is set, if the client requested selective repeat.
+	NackOnly bool
+
+	// Resends are the ranges the client requested, ordered according to
+	// Server.ResendPriority.
+	Resends []ResendRange
+	// Budget is the number of ranges serviced per ack, see
+	// Server.MaxResendsPerAck. 0 means no limit.
+	Budget int
+}
+
+// ResendRange is a range of chunks requested by a client. A range of length 0
+// requests only the metadata of File, its Offset is ignored.
+type ResendRange struct {
+	File   uint16
+	Offset uint64
+	Length uint8
+}
+
+// newAckEvent converts ack, whose resend entries must already be ordered. The
+// ack's maximum transmission rate only limits the rate, not the resends.
+func newAckEvent(ack *clientAck, nackOnly bool, budget int) AckEvent {
+	e := AckEvent{
+		File:            ack.fileIndex,
+		Offset:          ack.offset,
+		MetadataMissing: ack.status == metaDataMissing,
+		NackOnly:        nackOnly,
+		Resends:         make([]ResendRange, len(ack.resendEntries)),
+		Budget:          budget,
+	}
+	for i, re := range ack.resendEntries {
+		e.Resends[i] = ResendRange{File: re.fileIndex, Offset: re.offset, Length: re.length}
+	}
+	return e
+}
+
+// defaultScheduler immediately resends all requested chunks from the cache.
+// Chunks queued but not sent yet aren't queued again. Without requested
+// chunks, the chunk at the acknowledged offset is resent.
+type defaultScheduler struct {
+	scheduled map[uint16]map[uint64]struct{}
+}
+
+func newDefaultScheduler() RetransmitScheduler {
+	return &defaultScheduler{scheduled: map[uint16]map[uint64]struct{}{}}
+}
+
+func (s *defaultScheduler) OnResent(file uint16, offset uint64) {
+	delete(s.scheduled[file], offset)
+}
+
+func (s *defaultScheduler) OnAck(ack AckEvent, r Resender) {
+	// use a map to avoid duplicates in metadata resend entries
+	metadata := map[uint16]struct{}{}
+	if ack.MetadataMissing {
+		metadata[ack.File] = struct{}{}
+	}
+
+	if len(ack.Resends) <= 0 && !ack.NackOnly {
+		r.Resend(ack.File, ack.Offset)
+	}
+	for i, re := range ack.Resends {
+		if ack.Budget > 0 && i >= ack.Budget {
+			break
+		}
+		if re.Length == 0 {
+			// metadata only, the payload cache is left alone
+			metadata[re.File] = struct{}{}
+			continue
+		}
+		if _, exists := s.scheduled[re.File]; !exists {
+			s.scheduled[re.File] = make(map[uint64]struct{})
+		}
+		if _, ok := s.scheduled[re.File][re.Offset]; ok {
+			continue
+		}
+		s.scheduled[re.File][re.Offset] = struct{}{}
+
+		for i := uint64(0); i < uint64(re.Length); i++ {
+			if !r.Resend(re.File, re.Offset+i) {
+				// the connection's trace of the ack tells why
+				break
+			}
+		}
+	}
+
+	for k := range metadata {
+		r.ResendMetadata(k)
+	}
+}
+
+// resender implements Resender for a connection.
+type resender struct {
+	c *clientConnection
+
+	lock sync.Mutex
+	// retransmissions counts the resends per chunk, if the number is limited.
+	// Chunks are dropped, once they are acknowledged.
+	retransmissions map[uint16]map[uint64]int
+	// trace records the decisions on the resends of the current ack.
+	trace *ResendTrace
+}
+
+func (r *resender) Resend(file uint16, offset uint64) bool {
+	c := r.c
+	if c.cleaner.closed() {
+		return r.decide(file, offset, SkippedClosed)
+	}
+	if c.ackedChunk(file, offset) {
+		return r.decide(file, offset, SkippedAcknowledged)
+	}
+	outcome := ResentFromCache
+	p, ok := c.getFromCache(file, offset)
+	if !ok {
+		if !c.rereadable(file, offset) {
+			return r.decide(file, offset, SkippedNotSent)
+		}
+		var err error
+		if p, err = c.reread(file, offset); err != nil {
+			c.unavailable(err)
+			return r.decide(file, offset, SkippedUnavailable)
+		}
+		outcome = ResentFromFile
+	}
+	if c.maxRetransmissions > 0 {
+		r.lock.Lock()
+		if _, ok := r.retransmissions[file]; !ok {
+			r.retransmissions[file] = make(map[uint64]int)
+		}
+		r.retransmissions[file][offset]++
+		exceeded := r.retransmissions[file][offset] > c.maxRetransmissions
+		r.lock.Unlock()
+		if exceeded {
+			c.giveUp(p)
+			return r.decide(file, offset, SkippedRetransmissions)
+		}
+	}
+	c.resend <- p
+	return r.decide(file, offset, outcome)
+}
+
+// ackedChunk reports whether the newest ack of the client acknowledged the
+// chunk of file at offset, so that older acks requesting it are outdated.
+// Like the frontier, the acknowledged chunks end at the first missing one.
+func (c *clientConnection) ackedChunk(file uint16, offset uint64) bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	ack := c.state.newest
+	if ack == nil || file > ack.fileIndex || file == ack.fileIndex && offset >= ack.offset {
+		return false
+	}
+	for _, re := range ack.resendEntries {
+		if re.fileIndex == file && re.offset <= offset {
+			return false
+		}
+	}
+	return true
+}
+
+// forget drops the retransmission counts of the chunks below the frontiers,
+// which the client acknowledged.
+func (r *resender) forget() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for file, counts := range r.retransmissions {
+		r.c.stateLock.Lock()
+		frontier := r.c.state.frontier[file]
+		r.c.stateLock.Unlock()
+		for offset := range counts {
+			if offset < frontier {
+				delete(counts, offset)
+			}
+		}
+		if len(counts) == 0 {
+			delete(r.retransmissions, file)
+		}
+	}
+}
+
+func (r *resender) ResendMetadata(file uint16) bool {
+	m, ok := r.c.getMetadata(file)
+	if ok {
+		r.c.metadata <- m
+		r.lock.Lock()
+		if r.trace != nil {
+			r.trace.Metadata = append(r.trace.Metadata, file)
+		}
+		r.lock.Unlock()
+	}
+	return ok
+}
+
+// rescheduler passes the acks of the connection and the sent resends to its
+// scheduler.
+func (c *clientConnection) rescheduler() {
+	closeChan := c.cleaner.subscribe()
+	r := &resender{c: c, retransmissions: map[uint16]map[uint64]int{}}
+	for {
+		select {
+		case <-closeChan:
+			return
+		case p := <-c.resendDone:
+			c.scheduler.OnResent(p.fileIndex, p.offset)
+		case ack := <-c.reschedule:
+			r.forget()
+			sort.Sort(&ack.resendEntries)
+			c.prioritizeResends(ack.resendEntries)
+			e := newAckEvent(ack, c.nackOnly, c.maxResends)
+			r.begin(e)
+			c.scheduler.OnAck(e, r)
+			c.packetLog.Debugf("%v\n", r.end())
+		}
+	}
+}
+
+// giveUp closes the connection, because p exceeded the maximum number of
+// retransmissions. Otherwise, a chunk that never reaches the client would be
+// resent forever.
+func (c *clientConnection) giveUp(p *serverPayload) {
+	err := fmt.Errorf("chunk %v of file %v exceeded %v retransmissions",
+		p.offset, p.fileIndex, c.maxRetransmissions)
+	log.Println(err)
+	if err := sendTo(c.socket, closeConnection{reason: tooManyRetransmissions}, reasonOption(err)); err != nil {
+		log.Printf("failed to send close: %v\n", err)
+	}
+	c.closeWith(tooManyRetransmissions)
+}
@@ -0,0 +1,113 @@
+package rftp
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// delayedScheduler resends requested chunks after a delay.
+type delayedScheduler struct {
+	delay time.Duration
+}
+
+func (s delayedScheduler) OnAck(ack AckEvent, r Resender) {
+	for _, re := range ack.Resends {
+		re := re
+		time.AfterFunc(s.delay, func() {
+			for i := uint64(0); i < uint64(re.Length); i++ {
+				r.Resend(re.File, re.Offset+i)
+			}
+		})
+	}
+}
+
+func (s delayedScheduler) OnResent(uint16, uint64) {}
+
+func TestCustomRetransmitScheduler(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	s := NewServer()
+	s.NewRetransmitScheduler = func() RetransmitScheduler {
+		return delayedScheduler{delay: delay}
+	}
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10 * 1024)}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+	// the metadata follows the last payload
+	readMsg(t, conn, msgServerMetadata)
+
+	requested := time.Now()
+	if err := sendAckTo(conn, 1, clientAck{
+		fileIndex:     0,
+		offset:        2,
+		resendEntries: []*resendEntry{{0, 2, 1}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	p := serverPayload{}
+	if err := p.UnmarshalBinary(readMsg(t, conn, msgServerPayload)); err != nil {
+		t.Fatal(err)
+	}
+	if p.offset != 2 {
+		t.Errorf("got offset %v, want 2", p.offset)
+	}
+	if elapsed := time.Since(requested); elapsed < delay {
+		t.Errorf("chunk resent after %v, want at least %v", elapsed, delay)
+	}
+}
+
+func TestRetransmissionCountsOfAckedChunksAreDropped(t *testing.T) {
+	c := newTestClientConnection(&clientRequest{files: []fileDescriptor{{0, "a"}, {0, "b"}}}, ioutil.Discard)
+	r := &resender{c: c, retransmissions: map[uint16]map[uint64]int{
+		0: {1: 2, 3: 1},
+		1: {0: 1, 7: 3},
+	}}
+	c.state.frontier[0] = 4
+	c.state.frontier[1] = 5
+
+	r.forget()
+	if _, ok := r.retransmissions[0]; ok {
+		t.Errorf("counts of acknowledged file kept: %v", r.retransmissions[0])
+	}
+	if counts := r.retransmissions[1]; len(counts) != 1 || counts[7] != 3 {
+		t.Errorf("got counts %v of file 1, want map[7:3]", counts)
+	}
+}
+
+func TestMetadataOnlyResend(t *testing.T) {
+	c := &clientConnection{
+		resend:        make(chan *serverPayload, 10),
+		resendDone:    make(chan *serverPayload, 10),
+		reschedule:    make(chan *clientAck, 1),
+		metadata:      make(chan *serverMetaData, 10),
+		cleaner:       cleaner{cb: func() {}},
+		packetLog:     stdLogger{},
+		chunks:        map[uint16]uint64{0: 10},
+		payloadCache:  make(map[uint16]map[uint64]*serverPayload),
+		scheduler:     newDefaultScheduler(),
+		metadataCache: map[uint16]*serverMetaData{0: {fileIndex: 0}},
+	}
+	c.saveToCache(&serverPayload{fileIndex: 0, offset: 5})
+	go c.rescheduler()
+	defer c.cleaner.close()
+
+	c.reschedule <- &clientAck{resendEntries: resendEntryList{{0, 5, 0}}}
+	select {
+	case md := <-c.metadata:
+		if md.fileIndex != 0 {
+			t.Errorf("resent metadata of file %v, want file 0", md.fileIndex)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for metadata")
+	}
+	select {
+	case p := <-c.resend:
+		t.Errorf("resent payload of file %v at %v for a metadata request", p.fileIndex, p.offset)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
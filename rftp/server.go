@@ -1,60 +1,503 @@
 package rftp
 
 import (
+	"compress/gzip"
+	"context"
 	"crypto/md5"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"log"
+	"math"
 	"net"
+	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type FileHandler func(name string) (*io.SectionReader, error)
+// FileHandler opens the file requested by name. ctx is canceled once the
+// connection, which requested the file, is closed, or once an estimate read the
+// file's size, so that handlers can close their files then. Files of unknown size can be
+// returned by NewStreamReader. Errors wrapping os.ErrPermission are reported to
+// the client as access denied, other names without a reader as not existent.
+type FileHandler func(ctx context.Context, name string) (*io.SectionReader, error)
+
+// UnknownSize is the size of section readers returned by NewStreamReader. The
+// server reads them until io.EOF and reports the number of bytes read as size.
+const UnknownSize int64 = math.MaxInt64
+
+// NewStreamReader returns a section reader of size UnknownSize, which reads
+// from r. It only supports reads at contiguous, increasing offsets, as done by
+// the server. Since all payloads but the last one of a file fill their chunk,
+// a slow r delays chunks until they are full instead of splitting them. Choose
+// a smaller chunk size to bound the latency of trickling streams.
+func NewStreamReader(r io.Reader) *io.SectionReader {
+	return io.NewSectionReader(&streamReaderAt{r: r}, 0, UnknownSize)
+}
+
+type streamReaderAt struct {
+	r    io.Reader
+	off  int64
+	lock sync.Mutex
+}
+
+func (s *streamReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if off != s.off {
+		return 0, fmt.Errorf("non-sequential read at offset %d, expected %d", off, s.off)
+	}
+	n, err := io.ReadFull(s.r, p)
+	s.off += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+const (
+	// defaultRTT is assumed as long as no RTT was measured.
+	defaultRTT = 100 * time.Millisecond
+
+	// metadataRetransmissions is the number of times metadata is resent
+	// proactively, if it is the only message sent for a file.
+	metadataRetransmissions = 3
+
+	// unackedRTTs is the number of RTTs a client may leave sent messages
+	// unacknowledged before the connection is closed.
+	unackedRTTs = 30
+)
+
+// FileRequest describes a file requested by a client.
+type FileRequest struct {
+	Name string
+	// Offset is the chunk at which the transfer starts.
+	Offset uint64
+	// Checksum is the algorithm, by which the file is verified. It allows to
+	// verify large files by a fast and small critical files by a strong hash
+	// in the same request. Servers must support FeatureChecksums, unless all
+	// files use ChecksumDefault.
+	Checksum ChecksumAlgorithm
+	// Hash requests the file by content instead of by name. The server's
+	// HashHandler opens the content, whose checksum by Checksum is Hash, and
+	// the client fails the file with ErrChecksum, unless the received content
+	// has this checksum. Name is ignored, files requested by hash are
+	// transferred from their start. Servers must support FeatureByHash.
+	Hash []byte
+	// ChunkSums are the checksums of the chunks of the file, see
+	// Client.ChunkChecksums. Each chunk is verified on arrival and corrupt
+	// ones are requested again right away. They require a transfer from
+	// offset 0 without Client.Gzip. Chunks, to which they don't apply, fail
+	// the file.
+	ChunkSums *RegionChecksums
+}
+
+// ResendPriority decides which files' resend entries are serviced first, when
+// an ack requests more resends than its budget allows.
+type ResendPriority uint8
+
+const (
+	// ResendByOffset services resend entries in order of their offsets,
+	// regardless of the file they belong to.
+	ResendByOffset ResendPriority = iota
+
+	// ResendNearestCompletion services the resend entries of the file with the
+	// fewest chunks left after its first missing chunk first, so that nearly
+	// finished files don't starve behind large ones.
+	ResendNearestCompletion
+)
+
+// ResendSource decides where the chunks resent on a connection are taken from.
+type ResendSource uint8
+
+const (
+	// ResendFromCache keeps sent payloads in memory until the client
+	// acknowledges them and resends them from there. Resends don't touch the
+	// disk, but a connection holds its unacknowledged window of payloads, see
+	// MaxConnectionMemory. Payloads evicted after an ack are read again.
+	ResendFromCache ResendSource = iota
+
+	// ResendFromFile doesn't keep the payloads of files of known size and
+	// reads resent chunks from their file again. Connections hold almost no
+	// memory, but each resend costs a read, which delays it on slow disks.
+	// Payloads of streams and compressed files are always cached.
+	ResendFromFile
+)
+
+// maxNameSize is the maximum size of a canonical name in bytes. It's carried
+// in a single option.
+const maxNameSize = math.MaxUint8
 
 type fileReader struct {
-	index  uint16
+	index uint16
+	// name is the canonical name of the file, if the requested name was
+	// rewritten.
+	name string
+	// appMetadata is the application metadata set by the FileHandler.
+	appMetadata []byte
+	// offset is the chunk at which the transfer starts, sr starts there.
 	offset uint64
 	sr     *io.SectionReader
 	hasher hash.Hash
+	// status is set, if the file can't be transferred, although it exists.
+	status MetaDataStatus
+	// cacheAs is the name, under which the checksum is cached once the file
+	// was read. It's empty, if the transfer doesn't cover the whole file or
+	// doesn't use the server's hash.
+	cacheAs string
+}
+
+// ackPacket is a received ack with the ack number of its header.
+type ackPacket struct {
+	*clientAck
+	ackNum uint8
+}
+
+// response is a message produced by getResponse. Payloads and metadata share
+// one queue, so that the metadata carrying a file's checksum is never sent
+// before the file's last payload.
+type response struct {
+	payload  *serverPayload
+	metadata *serverMetaData
 }
 
 type clientConnection struct {
 	rtt           time.Duration
 	req           *clientRequest
-	payload       chan *serverPayload
+	responses     chan response
 	resend        chan *serverPayload
 	metadata      chan *serverMetaData
-	ack           chan *clientAck
+	ack           chan ackPacket
 	reschedule    chan *clientAck
 	resendDone    chan *serverPayload
 	rescheduledAt map[uint64]time.Time
 	cclose        chan *closeConnection
 	socket        io.Writer
+	peer          *peer
 
+	// ctx is canceled by the cleaner when the connection closes.
+	ctx     context.Context
 	cleaner cleaner
 
-	metadataCache    map[uint16]*serverMetaData
-	payloadCache     map[uint16]map[uint64]*serverPayload
-	payloadCacheLock sync.Mutex
+	resendPriority ResendPriority
+	resendSource   ResendSource
+	// profile is the transfer profile requested by the client.
+	profile Profile
+	// batchMetadata sends the metadata of several files in one datagram.
+	batchMetadata bool
+	scheduler     RetransmitScheduler
+	// chunks is guarded by stateLock, getResponse updates it, when the chunk
+	// size of a file adapts.
+	chunks map[uint16]uint64
+
+	// maxRetransmissions limits how often a chunk is resent, 0 means no limit.
+	maxRetransmissions int
+	// maxResends limits the resend entries serviced per ack, 0 means no
+	// limit.
+	maxResends int
+
+	// gzip is set, if the client requested gzip compressed transfers.
+	gzip bool
+
+	// gso batches payloads into segmented writes, see Server.GSO.
+	gso bool
+
+	// nackOnly is set, if the client requested selective repeat. Its acks
+	// don't acknowledge chunks cumulatively, so chunks are only resent on
+	// request. Chunks of files, which can be read again, aren't cached but
+	// read again then.
+	nackOnly bool
+
+	// chunkSize is the size of the chunks sent on this connection. If
+	// chunkSizer is set, it's only the initial size.
+	chunkSize  int
+	chunkSizer *chunkSizer
+
+	// checkpoint resolves the requested offsets, if set.
+	checkpoint func(ctx context.Context, name string, offset uint64) (uint64, error)
+	// rewrite resolves the requested names, if set.
+	rewrite func(ctx context.Context, name string) (string, error)
+
+	// store persists the state of the connection with ID id, if set. resume
+	// is the persisted state, if the connection resumes a transfer.
+	store  StateStore
+	id     string
+	resume *ConnectionState
+	// persistInterval is the minimum time between two saves, persistedAt
+	// the time of the last one. Only the writeResponse goroutine accesses
+	// persistedAt after the connection started.
+	persistInterval time.Duration
+	persistedAt     time.Time
+	// tokens issues resume tokens, if the client asked for them.
+	tokens *tokenIssuer
+
+	newHash func() hash.Hash
+	// checksums are the checksum algorithms of the requested files.
+	checksums []ChecksumAlgorithm
+	// digests are the digests of the files requested by hash, nil for files
+	// requested by name.
+	digests [][]byte
+	// hashHandler opens the files requested by hash, if set.
+	hashHandler HashHandler
+	// sums caches the checksums of files read completely.
+	sums *checksumCache
+
+	// ceiling caps the rate in packets per second, see Server.SetRate. It's
+	// accessed atomically, 0 means no cap.
+	ceiling uint32
+
+	// packetLog logs per packet events, which may be rate limited.
+	packetLog Logger
+
+	// clk is the source of time, the real clock if nil.
+	clk clock
+
+	// payloadLogInterval logs every nth payload sent, if it's not 0, see
+	// Server.PayloadLogInterval.
+	payloadLogInterval uint64
+	payloadsSent       uint64
+	// goroutines counts the goroutines of the connection.
+	goroutines *goroutineTracker
+
+	// cacheLock guards metadataCache, payloadCache, pendingMetadata, evicted,
+	// sources, memory and budget.
+	metadataCache   map[uint16]*serverMetaData
+	payloadCache    map[uint16]map[uint64]*serverPayload
+	pendingMetadata map[uint16]struct{}
+	cacheLock       sync.Mutex
+
+	// evicted holds per file the offset below which acknowledged payloads were
+	// dropped from the cache.
+	evicted map[uint16]uint64
+	// sources holds the readers of files, whose evicted payloads can be read
+	// again.
+	sources map[uint16]chunkSource
+	// memory is the number of payload bytes queued or cached. Reading files
+	// pauses while it exceeds maxMemory, if set, and resumes once memFreed
+	// signals that acknowledged payloads were evicted.
+	memory    int
+	maxMemory int
+	memFreed  chan struct{}
+	// budget is the memory shared with all connections of the server, nil if
+	// unlimited. The connection's memory is accounted for in both.
+	budget *memoryBudget
+
+	// maxFiles limits the files in transfer, 0 means no limit. fileDone
+	// signals that a file left the transfer.
+	maxFiles int
+	fileDone chan struct{}
+
+	// readBlockSize is the size of reads from files of known size.
+	readBlockSize int
+
+	// verifyOffsets closes the connection before sending a payload beyond
+	// the chunks of its file.
+	verifyOffsets bool
+
+	// limits are the numbers of chunks transferred of each file from its
+	// offset, nil or 0 mean no limit.
+	limits []uint64
+
+	// stateLock guards state.
+	state     transferState
+	stateLock sync.Mutex
+}
+
+// transferState is tracked for TransferState snapshots.
+type transferState struct {
+	// frontier and sent hold per file the first chunk not acknowledged and
+	// the first chunk not sent.
+	frontier        map[uint16]uint64
+	sent            map[uint16]uint64
+	retransmissions int
+	// lengths holds per file the payload lengths of the chunks sent, but not
+	// acknowledged yet.
+	lengths map[uint16]map[uint64]int
+	// unavailable counts resends, whose chunks were neither cached nor
+	// readable from the file.
+	unavailable int
+	// rereads counts resends, whose chunks were read from the file again.
+	rereads int
+	// checksums holds the checksums sent in the metadata of the files.
+	checksums map[uint16][]byte
+	rate      uint32
+
+	// newest is the ack with the highest number, newestNum its number.
+	// Resends requested by older acks are checked against it.
+	newest    *clientAck
+	newestNum uint8
+
+	// start, bytes and the following fields are reported in the summary.
+	start      time.Time
+	bytes      uint64
+	chunksSent int
+	// sentAt holds the send times of chunks, which weren't acknowledged or
+	// resent yet, to sample the RTT.
+	sentAt      map[uint16]map[uint64]time.Time
+	rtts        rttStats
+	window      time.Time
+	windowBytes uint64
+	peakBytes   uint64
+	reason      CloseConnectionReason
+	reasonSet   bool
+
+	// active holds the files in transfer, emitted the number of chunks of
+	// files, which were read completely.
+	active  map[uint16]struct{}
+	emitted map[uint16]uint64
+
+	// starts holds the files, whose transfer started, to persist them.
+	starts map[uint16]fileStart
+}
+
+// TransferState is a snapshot of the state of a connection's transfer.
+type TransferState struct {
+	Files []FileState
+	// InFlight is the number of bytes sent, but not acknowledged yet.
+	InFlight uint64
+	// Retransmissions is the number of resent chunks.
+	Retransmissions int
+	// Unavailable is the number of requested chunks, which were neither
+	// cached nor readable from their file. The connection is closed then.
+	Unavailable int
+	// Rereads is the number of resent chunks, which were read from their file
+	// again instead of the cache, see Server.ResendSource.
+	Rereads int
+	// Rate is the current congestion rate in packets per second.
+	Rate uint32
+	// Memory is the number of payload bytes queued for sending or cached for
+	// retransmissions.
+	Memory int
+	// ActiveFiles is the number of files in transfer, i.e., files which were
+	// opened, but not acknowledged completely yet.
+	ActiveFiles int
+}
+
+// FileState is the state of a single file of a transfer.
+type FileState struct {
+	Name string
+	// Frontier is the offset of the first chunk, which is not acknowledged
+	// by the client.
+	Frontier uint64
+	// Chunks is the number of chunks of the file, 0 if unknown.
+	Chunks uint64
 }
 
 func (c *clientConnection) writeResponse() {
 	log.Println("start writing response packets")
 	lastAck := uint8(0)
-	rateControl := &aimd{congRate: 1000}
+	rateControl := c.profileSettings().rateControl()
+	rateControl.ceiling = &c.ceiling
+	rateControl.clk = c.clk
 	rateControl.start()
 	defer rateControl.stop()
 
-	handleAck := func(ack *clientAck) {
-		lastAck = ack.ackNumber
-		rateControl.onAck(ack)
-		c.reschedule <- ack
+	// unacked fires once sent messages went unacknowledged for too long, nil
+	// while nothing is outstanding. The cleaner's timeout alone would not catch
+	// a half-open client, as long as there is data left to send.
+	var unacked <-chan time.Time
+	onSend := func() {
+		rateControl.onSend()
+		if unacked == nil {
+			unacked = c.clock().NewTimer(c.ackTimeout()).C()
+		}
+	}
+
+	handleAck := func(ack ackPacket) {
+		unacked = nil
+		lastAck = ack.ackNum
+		rateControl.onAck(ack.ackNum, ack.clientAck)
+		c.recordAck(ack.clientAck, ack.ackNum, rateControl.congRate)
+		c.finishAcked(ack.clientAck)
+		c.persist()
+		c.issueResumeToken()
+		c.evictAcked(ack.clientAck)
+		c.ackMetadata(ack.clientAck)
+		c.reschedule <- ack.clientAck
 		c.cleaner.refresh(5 * time.Second) // TODO: replace by 500 + RTT * 3 or something
 	}
 
+	// verify closes the connection, if p violates the offsets in verification
+	// mode.
+	verify := func(p *serverPayload) bool {
+		if !c.verifyOffsets {
+			return true
+		}
+		if err := c.verifyOffset(p); err != nil {
+			c.offsetViolation(err)
+			return false
+		}
+		return true
+	}
+
+	resend := func(pl *serverPayload) error {
+		if !verify(pl) {
+			return nil
+		}
+		err := sendAckTo(c.socket, lastAck, pl)
+		onSend()
+		c.recordResend(pl)
+		c.resendDone <- pl
+		return err
+	}
+
+	// gso collects the payloads admitted at once into a single write, if
+	// segmentation offload is enabled.
+	var gso *gsoBatch
+	if c.gso {
+		gso = newGSOBatch(c.socket)
+	}
+
+	sendPayload := func(p *serverPayload) error {
+		c.logPayload(p)
+		cached := c.cachesPayloads(p.fileIndex)
+		if cached {
+			c.saveToCache(p)
+		}
+		var err error
+		if gso != nil {
+			err = gso.add(lastAck, p)
+		} else {
+			err = sendAckTo(c.socket, lastAck, p)
+		}
+		c.recordSent(p)
+		if !cached {
+			c.freeMemory(len(p.data))
+		}
+		onSend()
+		return err
+	}
+
+	batcher := &metadataBatcher{c: c}
+
+	handleResponse := func(r response) error {
+		if r.metadata != nil && gso != nil {
+			// the metadata follows the payloads of its file
+			if err := gso.flush(); err != nil {
+				log.Println(err)
+			}
+		}
+		if r.metadata != nil && c.batchMetadata {
+			sent, err := batcher.add(r.metadata, lastAck)
+			if sent {
+				onSend()
+			}
+			return err
+		} else if r.metadata != nil {
+			err := c.sendMetadata(r.metadata, lastAck)
+			onSend()
+			return err
+		} else if !verify(r.payload) {
+			// the connection is closed
+			return nil
+		}
+		return sendPayload(r.payload)
+	}
+
 	closeChan := c.cleaner.subscribe()
 
 	for !c.cleaner.closed() {
@@ -63,10 +506,7 @@ func (c *clientConnection) writeResponse() {
 		if rateControl.isAvailable() {
 			select {
 			case pl := <-c.resend:
-				pl.ackNumber = lastAck
-				err = sendTo(c.socket, *pl)
-				rateControl.onSend()
-				c.resendDone <- pl
+				err = resend(pl)
 				continue
 
 			case ack := <-c.ack:
@@ -76,27 +516,44 @@ func (c *clientConnection) writeResponse() {
 			}
 			select {
 			case md := <-c.metadata:
-				log.Printf(
-					"sending metadata for file %v: status: %v, size: %v, checksum: %x\n",
-					md.fileIndex,
-					md.status,
-					md.size,
-					md.checkSum,
-				)
-				md.ackNum = lastAck
-				c.metadataCache[md.fileIndex] = md
-				err = sendTo(c.socket, *md)
-				rateControl.onSend()
-
-			case pl := <-c.payload:
-				pl.ackNumber = lastAck
-				c.saveToCache(pl)
-				err = sendTo(c.socket, *pl)
-				rateControl.onSend()
+				err = c.sendMetadata(md, lastAck)
+				onSend()
+
+			case pl := <-c.resend:
+				err = resend(pl)
+
+			case r := <-c.responses:
+				err = handleResponse(r)
+				if gso == nil {
+					break
+				}
+				// payloads admitted right away join the segmented write
+			fill:
+				for r.payload != nil && gso.open() && rateControl.isAvailable() && !c.cleaner.closed() {
+					select {
+					case r = <-c.responses:
+						if rerr := handleResponse(r); rerr != nil {
+							log.Println(rerr)
+						}
+					default:
+						break fill
+					}
+				}
+				if ferr := gso.flush(); ferr != nil {
+					err = ferr
+				}
 
 			case ack := <-c.ack:
 				handleAck(ack)
 
+			case <-batcher.flush:
+				err = batcher.send(lastAck)
+				onSend()
+
+			case <-unacked:
+				c.timeout()
+				return
+
 			case <-closeChan:
 				return
 			}
@@ -106,6 +563,9 @@ func (c *clientConnection) writeResponse() {
 				continue
 			case ack := <-c.ack:
 				handleAck(ack)
+			case <-unacked:
+				c.timeout()
+				return
 			case <-closeChan:
 				return
 			}
@@ -117,102 +577,397 @@ func (c *clientConnection) writeResponse() {
 	}
 }
 
-// TODO: Drop cached payloads. That's not trivial, because we don't have
-// explicit acks per file, so we have to calculate it, to avoid keeping all
-// files in the cache.
-func (c *clientConnection) saveToCache(p *serverPayload) {
-	c.payloadCacheLock.Lock()
-	defer c.payloadCacheLock.Unlock()
-	_, ok := c.payloadCache[p.fileIndex]
-	if !ok {
-		c.payloadCache[p.fileIndex] = make(map[uint64]*serverPayload)
+// clock returns the source of time of the connection.
+func (c *clientConnection) clock() clock {
+	return orRealClock(c.clk)
+}
+
+// ackTimeout is the time a client may leave sent messages unacknowledged.
+func (c *clientConnection) ackTimeout() time.Duration {
+	rtt := c.rtt
+	if rtt <= 0 {
+		rtt = defaultRTT
 	}
+	return unackedRTTs * rtt
+}
 
-	c.payloadCache[p.fileIndex][p.offset] = p
+// timeout closes the connection to a client, which stopped acknowledging
+// messages.
+func (c *clientConnection) timeout() {
+	log.Printf("no ack from %v within %v, closing connection\n", c.peer.address(), c.ackTimeout())
+	c.closeWith(timeout)
+	if err := sendTo(c.socket, closeConnection{reason: timeout}); err != nil {
+		log.Printf("failed to send close: %v\n", err)
+	}
 }
 
-func (c *clientConnection) getFromCache(file uint16, offset uint64) (*serverPayload, bool) {
-	c.payloadCacheLock.Lock()
-	defer c.payloadCacheLock.Unlock()
+// limitDuration closes the connection with timeout, if it is still open after
+// d, no matter whether the client keeps acknowledging.
+func (c *clientConnection) limitDuration(d time.Duration) {
+	closeChan := c.cleaner.subscribe()
+	deadline := c.clock().NewTimer(d)
+	defer deadline.Stop()
+	select {
+	case <-closeChan:
+		return
+	case <-deadline.C():
+	}
+	err := fmt.Errorf("transfer exceeded the maximum duration of %v", d)
+	log.Printf("closing connection to %v: %v\n", c.peer.address(), err)
+	c.closeWith(timeout)
+	if err := sendTo(c.socket, closeConnection{reason: timeout}, reasonOption(err)); err != nil {
+		log.Printf("failed to send close: %v\n", err)
+	}
+}
 
-	if c, ok := c.payloadCache[file]; ok {
-		if p, ok := c[offset]; ok {
-			return p, true
+func (c *clientConnection) recordSent(p *serverPayload) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if p.offset+1 > c.state.sent[p.fileIndex] {
+		c.state.sent[p.fileIndex] = p.offset + 1
+	}
+	if p.offset >= c.state.frontier[p.fileIndex] {
+		if c.state.lengths == nil {
+			c.state.lengths = make(map[uint16]map[uint64]int)
+		}
+		if _, ok := c.state.lengths[p.fileIndex]; !ok {
+			c.state.lengths[p.fileIndex] = make(map[uint64]int)
+		}
+		c.state.lengths[p.fileIndex][p.offset] = len(p.data)
+	}
+	now := c.clock().Now()
+	c.state.chunksSent++
+	c.state.bytes += uint64(len(p.data))
+	c.state.countRate(now, uint64(len(p.data)))
+	if c.state.sentAt == nil {
+		c.state.sentAt = make(map[uint16]map[uint64]time.Time)
+	}
+	if _, ok := c.state.sentAt[p.fileIndex]; !ok {
+		c.state.sentAt[p.fileIndex] = make(map[uint64]time.Time)
+	}
+	c.state.sentAt[p.fileIndex][p.offset] = now
+}
+
+func (c *clientConnection) recordResend(p *serverPayload) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.state.retransmissions++
+	// the ack of a resent chunk can't be matched to one of its sends
+	delete(c.state.sentAt[p.fileIndex], p.offset)
+}
+
+// recordAck advances the frontiers of the files as reported by ack. Files
+// before the ack's file are acknowledged up to their first resend entry or
+// else as far as they were sent.
+func (c *clientConnection) recordAck(ack *clientAck, ackNum uint8, rate uint32) {
+	missing := map[uint16]uint64{}
+	for _, re := range ack.resendEntries {
+		if o, ok := missing[re.fileIndex]; !ok || re.offset < o {
+			missing[re.fileIndex] = re.offset
+		}
+	}
+
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.state.rate = rate
+	if c.state.newest == nil || ackNewer(ackNum, c.state.newestNum) {
+		c.state.newest = ack
+		c.state.newestNum = ackNum
+	}
+	if ack.offset > 0 {
+		last := ack.offset - 1
+		if sent, ok := c.state.sentAt[ack.fileIndex][last]; ok {
+			c.state.rtts.add(c.clock().Now().Sub(sent))
+			delete(c.state.sentAt[ack.fileIndex], last)
+		}
+	}
+	for f := uint16(0); int(f) < len(c.req.files) && f <= ack.fileIndex; f++ {
+		frontier := c.state.sent[f]
+		if f == ack.fileIndex {
+			frontier = ack.offset
+		}
+		if o, ok := missing[f]; ok && o < frontier {
+			frontier = o
+		}
+		if frontier > c.state.frontier[f] {
+			for o := c.state.frontier[f]; o < frontier; o++ {
+				delete(c.state.lengths[f], o)
+			}
+			c.state.frontier[f] = frontier
 		}
 	}
-	return nil, false
 }
 
-func (c *clientConnection) rescheduler() {
+// transferState returns a consistent snapshot of the connection's state.
+func (c *clientConnection) transferState() *TransferState {
+	c.cacheLock.Lock()
+	memory := c.memory
+	c.cacheLock.Unlock()
+
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	ts := &TransferState{
+		Files:           make([]FileState, len(c.req.files)),
+		Retransmissions: c.state.retransmissions,
+		Unavailable:     c.state.unavailable,
+		Rereads:         c.state.rereads,
+		Rate:            c.state.rate,
+		Memory:          memory,
+		ActiveFiles:     len(c.state.active),
+	}
+	for i, f := range c.req.files {
+		index := uint16(i)
+		ts.Files[i] = FileState{
+			Name:     f.fileName,
+			Frontier: c.state.frontier[index],
+			Chunks:   c.chunks[index],
+		}
+		for _, n := range c.state.lengths[index] {
+			ts.InFlight += uint64(n)
+		}
+	}
+	return ts
+}
+
+// logPayload logs every payloadLogInterval-th payload sent. Only the
+// writeResponse goroutine calls it.
+func (c *clientConnection) logPayload(p *serverPayload) {
+	if c.payloadLogInterval == 0 {
+		return
+	}
+	c.payloadsSent++
+	if c.payloadsSent%c.payloadLogInterval == 0 {
+		c.packetLog.Debugf("sending payload for file %v at offset %v\n", p.fileIndex, p.offset)
+	}
+}
+
+func (c *clientConnection) sendMetadata(md *serverMetaData, lastAck uint8) error {
+	log.Printf(
+		"sending metadata for file %v: status: %v, size: %v, checksum: %x\n",
+		md.fileIndex,
+		md.status,
+		md.size,
+		md.checkSum,
+	)
+	c.cacheLock.Lock()
+	c.metadataCache[md.fileIndex] = md
+	c.cacheLock.Unlock()
+	return sendAckTo(c.socket, lastAck, *md, md.options...)
+}
+
+func (c *clientConnection) getMetadata(file uint16) (*serverMetaData, bool) {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	m, ok := c.metadataCache[file]
+	return m, ok
+}
+
+// ackMetadata marks the pending metadata as received, which the ack doesn't
+// request to be resent.
+func (c *clientConnection) ackMetadata(ack *clientAck) {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	if len(c.pendingMetadata) == 0 {
+		return
+	}
+	requested := map[uint16]struct{}{}
+	if ack.status == metaDataMissing {
+		requested[ack.fileIndex] = struct{}{}
+	}
+	for _, re := range ack.resendEntries {
+		if re.length == 0 {
+			requested[re.fileIndex] = struct{}{}
+		}
+	}
+	for file := range c.pendingMetadata {
+		if _, ok := requested[file]; !ok {
+			delete(c.pendingMetadata, file)
+		}
+	}
+}
+
+// retransmitMetadata resends the metadata of a file, which is the only message
+// sent for the file, once per RTT until the client acknowledges it or
+// metadataRetransmissions is reached. Otherwise, a single lost packet would
+// stall the client until it times out.
+func (c *clientConnection) retransmitMetadata(file uint16) {
 	closeChan := c.cleaner.subscribe()
-	resendScheduled := map[uint16]map[uint64]struct{}{}
+	interval := c.rtt
+	if interval <= 0 {
+		interval = defaultRTT
+	}
+	ticker := c.clock().NewTicker(interval)
+	defer ticker.Stop()
 
-	for {
+	for i := 0; i < metadataRetransmissions; i++ {
 		select {
 		case <-closeChan:
 			return
-		case p := <-c.resendDone:
-			log.Printf("delete rescheduled entry: file %v at offset %v\n", p.fileIndex, p.offset)
-			delete(resendScheduled[p.fileIndex], p.offset)
-		case ack := <-c.reschedule:
-			// use a map to avoid duplicates in metadata resend entries
-			metadata := map[uint16]struct{}{}
-			if ack.status == metaDataMissing {
-				metadata[ack.fileIndex] = struct{}{}
+		case <-ticker.C():
+		}
+
+		c.cacheLock.Lock()
+		_, pending := c.pendingMetadata[file]
+		c.cacheLock.Unlock()
+		if !pending {
+			return
+		}
+		if m, ok := c.getMetadata(file); ok {
+			log.Printf("retransmitting metadata for file %v\n", file)
+			select {
+			case c.metadata <- m:
+			case <-closeChan:
+				return
 			}
+		}
+	}
+}
+
+// saveToCache keeps p for retransmissions until the client acknowledges it.
+// Payloads of files before the acknowledged file are never dropped, because
+// acks don't tell exactly which of their chunks are missing.
+func (c *clientConnection) saveToCache(p *serverPayload) {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	_, ok := c.payloadCache[p.fileIndex]
+	if !ok {
+		c.payloadCache[p.fileIndex] = make(map[uint64]*serverPayload)
+	}
 
-			sort.Sort(&ack.resendEntries)
+	c.payloadCache[p.fileIndex][p.offset] = p
+}
 
-			if len(ack.resendEntries) <= 0 {
-				if p, ok := c.getFromCache(ack.fileIndex, ack.offset); ok {
-					c.resend <- p
-				}
-			}
-			for i, re := range ack.resendEntries {
-				if ack.maxTransmissionRate > 0 && uint32(i) > ack.maxTransmissionRate {
-					break
-				}
-				if re.length == 0 {
-					metadata[re.fileIndex] = struct{}{}
-				}
-				if _, exists := resendScheduled[re.fileIndex]; !exists {
-					resendScheduled[re.fileIndex] = make(map[uint64]struct{})
-				}
-				if _, ok := resendScheduled[re.fileIndex][re.offset]; !ok {
-					resendScheduled[re.fileIndex][re.offset] = struct{}{}
+// reserve blocks until n more payload bytes fit into the connection's memory
+// limit and accounts for them. A single payload is always admitted, if nothing
+// else is held. It returns false, if the connection was closed meanwhile.
+func (c *clientConnection) reserve(n int, closeChan <-chan struct{}) bool {
+	var budget *memoryBudget
+	for {
+		c.cacheLock.Lock()
+		fits := c.maxMemory <= 0 || c.memory == 0 || c.memory+n <= c.maxMemory
+		budget = c.budget
+		c.cacheLock.Unlock()
+		if fits {
+			break
+		}
 
-					if p, ok := c.getFromCache(re.fileIndex, re.offset); ok {
-						if re.length == 0 {
-							c.resend <- p
-							log.Printf("rescheduled: file %v at %v\n", re.fileIndex, re.offset)
-						}
+		select {
+		case <-c.memFreed:
+		case <-closeChan:
+			return false
+		}
+	}
+	// Only the reading goroutine reserves, the connection's memory can only
+	// have shrunk meanwhile.
+	if budget != nil && !budget.reserve(n, closeChan) {
+		return false
+	}
 
-						for i := uint64(0); i < uint64(re.length); i++ {
-							if p, ok := c.getFromCache(re.fileIndex, re.offset+i); ok {
-								c.resend <- p
-								log.Printf("rescheduled: file %v at %v\n", re.fileIndex, re.offset+i)
-							} else {
-								log.Printf("didn't find resend entry in cache: %v\n", re.offset+i)
-								break
-								// TODO:
-								// re-read from sectionReader, this isn't trivial either
-								// because we may have to avoid concurrent reads on the files
-							}
-						}
-					}
-				} else {
-					log.Printf("skipped rescheduling for: file %v at %v\n", re.fileIndex, re.offset)
-				}
-			}
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	c.memory += n
+	if budget != nil && c.budget == nil {
+		// the connection was closed and released its memory meanwhile
+		budget.free(n)
+	}
+	return true
+}
 
-			// resend metadata
-			for k := range metadata {
-				if m, ok := c.metadataCache[k]; ok {
-					c.metadata <- m
-				}
-			}
+// memoryLimited reports whether the connection's memory is limited.
+func (c *clientConnection) memoryLimited() bool {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	return c.maxMemory > 0 || c.budget != nil
+}
+
+// evictAcked drops the cached payloads of the acknowledged file below the
+// ack's offset and its first resend entry and frees their memory.
+func (c *clientConnection) evictAcked(ack *clientAck) {
+	offset := ack.offset
+	for _, re := range ack.resendEntries {
+		if re.fileIndex == ack.fileIndex && re.offset < offset {
+			offset = re.offset
+		}
+	}
+
+	c.cacheLock.Lock()
+	from := c.evicted[ack.fileIndex]
+	cache := c.payloadCache[ack.fileIndex]
+	// all payloads sent above from are cached
+	if max := from + uint64(len(cache)); offset > max {
+		offset = max
+	}
+	freed := 0
+	for o := from; o < offset; o++ {
+		if p, ok := cache[o]; ok {
+			freed += len(p.data)
+			delete(cache, o)
+		}
+	}
+	if offset > from {
+		c.evicted[ack.fileIndex] = offset
+	}
+	c.cacheLock.Unlock()
+	c.freeMemory(freed)
+}
+
+// freeMemory frees n payload bytes of the connection's memory.
+func (c *clientConnection) freeMemory(n int) {
+	if n == 0 {
+		return
+	}
+	c.cacheLock.Lock()
+	c.memory -= n
+	if c.budget != nil {
+		c.budget.free(n)
+	}
+	c.cacheLock.Unlock()
+
+	select {
+	case c.memFreed <- struct{}{}:
+	default:
+	}
+}
+
+func (c *clientConnection) getFromCache(file uint16, offset uint64) (*serverPayload, bool) {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+
+	if c, ok := c.payloadCache[file]; ok {
+		if p, ok := c[offset]; ok {
+			return p, true
 		}
 	}
+	return nil, false
+}
+
+// prioritizeResends stably reorders entries, which must already be sorted by
+// offset, according to the connection's ResendPriority.
+func (c *clientConnection) prioritizeResends(entries resendEntryList) {
+	if c.resendPriority != ResendNearestCompletion {
+		return
+	}
+	remaining := map[uint16]uint64{}
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	for _, re := range entries {
+		if _, ok := remaining[re.fileIndex]; ok {
+			continue
+		}
+		// entries are sorted, so this is the first missing chunk of the file
+		if chunks := c.chunks[re.fileIndex]; chunks > re.offset {
+			remaining[re.fileIndex] = chunks - re.offset
+		} else {
+			remaining[re.fileIndex] = 0
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		ri, rj := remaining[entries[i].fileIndex], remaining[entries[j].fileIndex]
+		if ri != rj {
+			return ri < rj
+		}
+		return entries[i].fileIndex < entries[j].fileIndex
+	})
 }
 
 func (c *clientConnection) getResponse(fh FileHandler) {
@@ -220,91 +975,454 @@ func (c *clientConnection) getResponse(fh FileHandler) {
 		// TODO Send error file not available
 	}
 
-	c.payload = make(chan *serverPayload, 1024*1024)
+	c.responses = make(chan response, 1024*1024)
 	c.resend = make(chan *serverPayload, 1024*1024)
 	c.metadata = make(chan *serverMetaData, len(c.req.files))
 	c.reschedule = make(chan *clientAck, 1024)
 	c.resendDone = make(chan *serverPayload, 1024*1024)
+	c.memFreed = make(chan struct{}, 1)
+	c.fileDone = make(chan struct{}, 1)
 
-	go c.writeResponse()
-	go c.rescheduler()
+	c.stateLock.Lock()
+	c.chunks = make(map[uint16]uint64)
+	c.stateLock.Unlock()
 
-	srs := []fileReader{}
-	for i, fr := range c.req.files {
-		r, err := fh(fr.fileName)
-		if err != nil {
-			// TODO
-			// send err metadata
-		}
-		sr := fileReader{
-			index:  uint16(i),
-			sr:     r,
-			hasher: md5.New(),
-		}
-		srs = append(srs, sr)
+	c.goFunc("writeResponse", c.writeResponse)
+	c.goFunc("rescheduler", c.rescheduler)
 
-		// Copy pre offset bytes to hasher
-		n, err := io.CopyN(sr.hasher, sr.sr, int64(fr.offset*1024))
-		if err != nil || n != int64(fr.offset) {
-			// TODO
-			// report read error
+	closeChan := c.cleaner.subscribe()
+	emit := func(r response) bool {
+		select {
+		case c.responses <- r:
+			return true
+		case <-closeChan:
+			return false
 		}
 	}
+	// closeSrc stops the compression of the file being sent, if any.
+	closeSrc := func() {}
+	defer func() { closeSrc() }()
 
-	closeChan := c.cleaner.subscribe()
-
-	for _, fr := range srs {
-		if c.cleaner.closed() {
+files:
+	for i, fd := range c.req.files {
+		if c.cleaner.closed() || !c.startFile(uint16(i), closeChan) {
 			return
 		}
-
-		if fr.sr == nil {
-			c.metadata <- &serverMetaData{fileIndex: fr.index, status: fileNotExistent}
+		fr := c.openFile(fh, uint16(i), fd)
+
+		if fr.status != noErr || fr.sr == nil || fr.sr.Size() == 0 {
+			md := &serverMetaData{fileIndex: fr.index, status: fr.status}
+			if fr.sr == nil && fr.status == noErr {
+				md.status = fileNotExistent
+			} else if fr.status == noErr {
+				md.status = fileEmpty
+			}
+			md.options = fr.options()
+			if c.acknowledged(fr.index, 0) {
+				c.cacheMetadata(md)
+				c.finishFile(fr.index)
+				continue
+			}
+			c.started(fr.index, fr.offset, c.chunkSize)
+			c.cacheLock.Lock()
+			c.pendingMetadata[fr.index] = struct{}{}
+			c.cacheLock.Unlock()
+			if !emit(response{metadata: md}) {
+				return
+			}
+			index := fr.index
+			c.goFunc("retransmitMetadata", func() { c.retransmitMetadata(index) })
+			// without payloads, there's nothing to keep the slot for
+			c.finishFile(fr.index)
 			continue
 		}
-		if fr.sr.Size() == 0 {
-			c.metadata <- &serverMetaData{fileIndex: fr.index, status: fileEmpty}
-			continue
+
+		// In gzip mode, the compressed stream is sent from its start and the
+		// deflater hashes the original file.
+		src := fr.sr
+		var d *deflater
+		if c.gzip {
+			d = &deflater{hasher: c.hash(fr.index)}
+			src, closeSrc = d.compress(io.NewSectionReader(fr.sr, 0, fr.sr.Size()))
+		}
+
+		chunkSize := c.nextChunkSize()
+		// Chunks acknowledged before the connection was resumed are only
+		// hashed.
+		skip := uint64(0)
+		if f, ok := c.resumed(fr.index); ok {
+			chunkSize = f.ChunkSize
+			skip = f.Frontier
+		}
+		c.started(fr.index, fr.offset, chunkSize)
+		if chunkSize != c.chunkSize && fr.sr.Size() != UnknownSize && d == nil {
+			c.stateLock.Lock()
+			c.chunks[fr.index] = uint64((fr.sr.Size() + int64(chunkSize) - 1) / int64(chunkSize))
+			c.stateLock.Unlock()
+		}
+		// Streams are read a chunk at a time, so that chunks don't wait for a
+		// whole block.
+		var r io.ReaderAt = src
+		if fr.sr.Size() != UnknownSize && d == nil {
+			r = c.readBlocks(src, chunkSize)
+			c.keepSource(fr.index, src, chunkSize)
+		} else if fr.sr.Size() != UnknownSize {
+			c.keepCompressed(fr.index, fr.sr, chunkSize)
+		} else if c.nackOnly && c.memoryLimited() {
+			// The payloads would be cached until the connection closes.
+			c.unavailable(fmt.Errorf("%w: file %v can't be read again, which NACK-only transfers need with limited memory",
+				errChunkUnavailable, fr.index))
+			return
 		}
 
 		done := false
 		off := int64(0)
+		size := uint64(0)
 		for !done {
-			buf := make([]byte, 1024)
-			n, err := fr.sr.ReadAt(buf, 1024*off)
+			buf := make([]byte, chunkSize)
+			n, err := readChunk(r, buf, int64(chunkSize)*off)
 			if err == io.EOF {
 				done = true
+			} else if err != nil {
+				// Don't ship bytes of a failed read, the client could never verify
+				// the file anyway.
+				log.Printf("error, on reading file %v: %v\n", fr.index, err)
+				closeSrc()
+				if !emit(response{metadata: &serverMetaData{fileIndex: fr.index, status: readError}}) {
+					return
+				}
+				c.finishFile(fr.index)
+				continue files
 			}
-			if err != nil {
-				log.Printf("error, on reading file: %v\n", err)
+			if n == 0 {
+				// The previous chunk ended exactly at the end of the file.
+				break
 			}
-			_, err = fr.hasher.Write(buf[:n])
-			if err != nil {
-				log.Printf("failed to write to hash: %v\n", err)
+			if d == nil {
+				_, err = fr.hasher.Write(buf[:n])
+				if err != nil {
+					log.Printf("failed to write to hash: %v\n", err)
+				}
 			}
+			size += uint64(n)
 			p := &serverPayload{
 				fileIndex: fr.index,
 				data:      buf[:n],
 				offset:    uint64(off),
 			}
 			off++
-			select {
-			case c.payload <- p:
-			case <-closeChan:
+			if p.offset < skip {
+				continue
+			}
+			if !c.reserve(len(p.data), closeChan) || !emit(response{payload: p}) {
 				return
 			}
 		}
+		closeSrc()
+
+		m := &serverMetaData{fileIndex: fr.index, size: size}
+		m.checkSum = fr.hasher.Sum(nil)
+		if fr.cacheAs != "" && int64(size) == fr.sr.Size() {
+			c.sums.store(fr.cacheAs, int64(size), m.checkSum)
+		}
+		m.options = []option{chunkSizeOption(chunkSize)}
+		if fr.offset > 0 {
+			m.options = append(m.options, offsetOption(fr.offset))
+		}
+		m.options = append(m.options, fr.options()...)
+		if d != nil {
+			m.checkSum = d.hasher.Sum(nil)
+			m.options = append(m.options, d.sizeOption())
+			c.sizeCompressed(fr.index, int64(size))
+		}
+		c.recordChecksum(fr.index, m.checkSum)
+		c.emitted(fr.index, uint64(off))
+		if c.acknowledged(fr.index, uint64(off)) {
+			c.cacheMetadata(m)
+			c.finishFile(fr.index)
+			continue
+		}
+		if !emit(response{metadata: m}) {
+			return
+		}
+	}
+}
+
+// options returns the options, which describe the file in its metadata.
+func (fr *fileReader) options() []option {
+	os := []option{}
+	if fr.name != "" {
+		os = append(os, option{otype: optionName, value: []byte(fr.name)})
+	}
+	if fr.appMetadata != nil {
+		os = append(os, option{otype: optionAppMetadata, value: fr.appMetadata})
+	}
+	return os
+}
+
+// checksum returns the checksum algorithm of the file index.
+func (c *clientConnection) checksum(index uint16) ChecksumAlgorithm {
+	if int(index) < len(c.checksums) {
+		return c.checksums[index]
+	}
+	return ChecksumDefault
+}
+
+// digest returns the requested digest of the file index, if it's requested by
+// hash.
+func (c *clientConnection) digest(index uint16) []byte {
+	if int(index) < len(c.digests) {
+		return c.digests[index]
+	}
+	return nil
+}
+
+// hash returns a new hash of the checksum algorithm of the file index.
+func (c *clientConnection) hash(index uint16) hash.Hash {
+	// checked when the request was parsed
+	if h, err := c.checksum(index).hash(c.newHash); err == nil {
+		return h
+	}
+	return c.newHash()
+}
+
+// openFile opens the file requested by fd and resolves its name and offset.
+func (c *clientConnection) openFile(fh FileHandler, index uint16, fd fileDescriptor) fileReader {
+	fr := fileReader{
+		index:  index,
+		hasher: c.hash(index),
+	}
+	digest := c.digest(index)
+	if c.rewrite != nil && digest == nil {
+		name, err := c.rewrite(c.ctx, fd.fileName)
+		if err == nil && len(name) > maxNameSize {
+			err = fmt.Errorf("name too long: %d bytes", len(name))
+		}
+		if err != nil {
+			log.Printf("failed to rewrite %v: %v\n", fd.fileName, err)
+		} else if name != fd.fileName {
+			fr.name = name
+			fd.fileName = name
+		}
+	}
+	ctx, am := withAppMetadata(c.ctx)
+	var r *io.SectionReader
+	var err error
+	if digest == nil {
+		r, err = fh(ctx, fd.fileName)
+	} else if c.hashHandler != nil {
+		r, err = c.hashHandler(ctx, c.checksum(index), digest)
+	}
+	fr.appMetadata = am.value
+	if errors.Is(err, os.ErrPermission) {
+		fr.status = accessDenied
+		r = nil
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("failed to open file %v: %v\n", index, err)
+	}
+	fr.sr = r
+	// Streams can only be read from their start and compressed streams
+	// always start at 0.
+	if r != nil && r.Size() != UnknownSize && !c.gzip {
+		if f, ok := c.resumed(index); ok {
+			fr.offset = f.Offset
+		} else if digest == nil {
+			fr.offset = c.resolveOffset(fd)
+		}
+		var limit uint64
+		if c.limits != nil {
+			limit = c.limits[index]
+		}
+		start, length, status := validateRange(fr.offset, limit, uint64(c.chunkSize), uint64(r.Size()))
+		if status != noErr {
+			fr.status = status
+		} else {
+			fr.sr = io.NewSectionReader(r, int64(start), int64(length))
+		}
+	}
+	if fr.status == noErr && r != nil && r.Size() != UnknownSize && !c.gzip &&
+		fr.sr.Size() == r.Size() && c.sums != nil && c.checksum(index) == ChecksumDefault &&
+		digest == nil {
+		fr.cacheAs = fd.fileName
+	}
+	// The chunks of compressed files are counted once they were read.
+	if fr.status == noErr && fr.sr != nil && fr.sr.Size() != UnknownSize && !c.gzip {
+		c.stateLock.Lock()
+		c.chunks[index] = uint64((fr.sr.Size() + int64(c.chunkSize) - 1) / int64(c.chunkSize))
+		c.stateLock.Unlock()
+	}
+	return fr
+}
+
+// readChunk fills buf from r at off. Contrary to the contract of io.ReaderAt,
+// some implementations return short reads without an error, which must not end
+// a chunk early.
+func readChunk(r io.ReaderAt, buf []byte, off int64) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.ReadAt(buf[n:], off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrNoProgress
+		}
+	}
+	return n, nil
+}
+
+// resolveOffset returns the chunk at which the transfer of the requested file
+// starts. Payload offsets and the size and checksum in the file's metadata are
+// relative to it.
+func (c *clientConnection) resolveOffset(fr fileDescriptor) uint64 {
+	if c.checkpoint == nil {
+		return fr.offset
+	}
+	offset, err := c.checkpoint(c.ctx, fr.fileName, fr.offset)
+	if err != nil {
+		log.Printf("failed to resolve offset %v of %v: %v\n", fr.offset, fr.fileName, err)
+		return fr.offset
+	}
+	return offset
+}
+
+// deflater compresses files in gzip mode. It hashes and counts the original
+// bytes, which are reported in the file's metadata.
+type deflater struct {
+	hasher hash.Hash
+	size   uint64
+}
+
+func (d *deflater) Write(p []byte) (int, error) {
+	d.size += uint64(len(p))
+	return d.hasher.Write(p)
+}
+
+// compress returns a stream of the gzip compressed content of r, whose
+// original bytes d hashes and counts. The returned function stops the
+// compression.
+func (d *deflater) compress(r io.Reader) (*io.SectionReader, func()) {
+	return compress(io.TeeReader(r, d))
+}
 
-		m := &serverMetaData{fileIndex: fr.index, size: uint64(fr.sr.Size())}
-		copy(m.checkSum[:], fr.hasher.Sum(nil)[:16])
-		c.metadata <- m
+// compress returns a stream of the gzip compressed content of r. The returned
+// function stops the compression.
+func compress(r io.Reader) (*io.SectionReader, func()) {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, r)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	return NewStreamReader(pr), func() {
+		pr.Close()
 	}
 }
 
+// sizeOption returns the original size as option of type optionGzip. It must
+// only be called after the compressed stream was read until io.EOF.
+func (d *deflater) sizeOption() option {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, d.size)
+	return option{otype: optionGzip, value: value}
+}
+
 func key(ip *net.UDPAddr) string {
 	return fmt.Sprintf("%v:%v", ip.IP, ip.Port)
 }
 
+// connectionID returns the connection ID of p in hex, if any. IDs of another
+// size than connectionIDSize are ignored.
+func connectionID(p *packet) string {
+	if o, ok := findOption(p.os, optionConnectionID); ok && len(o.value) == connectionIDSize {
+		return fmt.Sprintf("%x", o.value)
+	}
+	return ""
+}
+
+// connKey returns the key of the connection p belongs to: The connection ID
+// chosen by the client, if any, or else the key of the client's address.
+func (s *Server) connKey(p *packet) string {
+	if id := connectionID(p); id != "" {
+		return "id:" + id
+	}
+	return s.addrKey(p.remoteAddr)
+}
+
+// addrKey returns the key of connections from addr without a connection ID.
+func (s *Server) addrKey(addr *net.UDPAddr) string {
+	if s.ConnectionKey != nil {
+		return s.ConnectionKey(addr)
+	}
+	return key(addr)
+}
+
+// peer is the address of a client and the writer sending to it. Both change,
+// if a client with a connection ID migrates to another address. Only acks
+// newer than any received before move the connection, so that replayed
+// packets don't redirect it. Repeated requests move it, until the first ack
+// arrived.
+type peer struct {
+	lock sync.Mutex
+	w    io.Writer
+	addr *net.UDPAddr
+	// ackNum is the number of the newest ack received, 0 if none.
+	ackNum uint8
+}
+
+func (p *peer) Write(b []byte) (int, error) {
+	p.lock.Lock()
+	w := p.w
+	p.lock.Unlock()
+	return w.Write(b)
+}
+
+// address returns the current address of the client. Connections created by
+// tests have no peer.
+func (p *peer) address() *net.UDPAddr {
+	if p == nil {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.addr
+}
+
+// migrate directs further messages to addr via w and reports whether the
+// address changed. ackNum is the number of the ack received from addr, 0 for
+// requests. The connection only moves, if the ack is newer than the acks
+// received before.
+func (p *peer) migrate(w io.Writer, addr *net.UDPAddr, ackNum uint8) bool {
+	if p == nil || addr == nil {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	newer := ackNewer(ackNum, p.ackNum)
+	if newer && ackNum != 0 {
+		p.ackNum = ackNum
+	}
+	if !newer || p.addr != nil && key(p.addr) == key(addr) {
+		return false
+	}
+	p.w = w
+	p.addr = addr
+	return true
+}
+
+// ackNewer reports whether the ack number a is newer than b, 0 being older
+// than any ack. Ack numbers wrap around and skip 0.
+func ackNewer(a, b uint8) bool {
+	if b == 0 {
+		return true
+	}
+	return a != 0 && int8(a-b) > 0
+}
+
 type cleaner struct {
 	closeLock   sync.RWMutex
 	subs        []chan struct{}
@@ -312,14 +1430,19 @@ type cleaner struct {
 
 	timeoutLock sync.Mutex
 	deadline    time.Time
+	// clk is the source of time, the real clock if nil.
+	clk clock
 
 	cb func()
+	// done is called after cb without locks held, so that it may call back
+	// into the server, e.g. to close other connections.
+	done func()
 }
 
 func (c *cleaner) close() {
 	c.closeLock.Lock()
-	defer c.closeLock.Unlock()
 	if c.closedState {
+		c.closeLock.Unlock()
 		return
 	}
 	c.closedState = true
@@ -328,6 +1451,10 @@ func (c *cleaner) close() {
 		close(sub)
 	}
 	c.cb()
+	c.closeLock.Unlock()
+	if c.done != nil {
+		c.done()
+	}
 }
 
 func (c *cleaner) closed() bool {
@@ -339,16 +1466,17 @@ func (c *cleaner) closed() bool {
 func (c *cleaner) refresh(d time.Duration) {
 	c.timeoutLock.Lock()
 	defer c.timeoutLock.Unlock()
-	c.deadline = time.Now().Add(d)
+	c.deadline = orRealClock(c.clk).Now().Add(d)
 }
 
 func (c *cleaner) checkTimeout() {
 	c.timeoutLock.Lock()
 	defer c.timeoutLock.Unlock()
-	if time.Now().After(c.deadline) {
+	clock := orRealClock(c.clk)
+	if now := clock.Now(); !now.Before(c.deadline) {
 		c.close()
 	} else if !c.closed() {
-		time.AfterFunc(time.Until(c.deadline), c.checkTimeout)
+		clock.AfterFunc(c.deadline.Sub(now), c.checkTimeout)
 	}
 }
 
@@ -368,13 +1496,223 @@ type Server struct {
 	Conn connection
 	fh   FileHandler
 
+	// ctx lives as long as Listen, connection contexts are derived from it.
+	ctx context.Context
+
+	// ChunkSize is the chunk size in bytes of requests, which don't ask for
+	// one, e.g. larger on low loss LANs or smaller on paths with a small MTU.
+	// The metadata of each file tells the client the chunk size. Defaults to
+	// 1024 bytes.
+	ChunkSize int
+
+	// MaxChunkSize is the largest chunk size in bytes, which clients may
+	// request. Larger requests are reduced to it. Defaults to ChunkSize.
+	MaxChunkSize int
+
+	// MaxRetransmissions is the number of times a chunk is resent before the
+	// connection is closed. 0 means no limit.
+	MaxRetransmissions int
+
+	// MaxResendsPerAck is the number of resend entries of an ack, which are
+	// serviced, in the order of ResendPriority. The maximum transmission rate
+	// of acks only limits the rate. 0 means no limit.
+	MaxResendsPerAck int
+
+	// MaxTransferDuration is the time after which a connection is closed with
+	// reason timeout, even if the client keeps acknowledging. It keeps slow
+	// clients from holding resources forever. 0 means no limit.
+	MaxTransferDuration time.Duration
+
+	// NewRetransmitScheduler returns the scheduler, which decides the resends
+	// of a new connection. If nil, all chunks requested by an ack are resent
+	// immediately.
+	NewRetransmitScheduler func() RetransmitScheduler
+
+	// AdaptiveChunkSize makes the chunk size of connections adapt to the
+	// observed loss, starting at the requested or default size. If nil, the
+	// chunk size is fixed.
+	AdaptiveChunkSize *AdaptiveChunkSize
+
+	// MaxConnectionMemory is the number of payload bytes a connection may
+	// queue for sending and cache for retransmissions. Reading files pauses at
+	// the limit until the client acknowledges chunks. 0 means no limit.
+	MaxConnectionMemory int
+
+	// MaxMemory is the number of payload bytes all connections together may
+	// queue for sending and cache for retransmissions. Reading files pauses
+	// across connections at the limit until clients acknowledge chunks, see
+	// Memory. 0 means no limit.
+	MaxMemory int
+
+	// MaxConcurrentFiles is the number of files a connection transfers at
+	// once. Further files of a request are opened once the client
+	// acknowledged all chunks of a file in transfer. 0 means no limit.
+	// Files aren't acknowledged in NACK-only mode, so NACK-only requests for
+	// more files are rejected.
+	MaxConcurrentFiles int
+
+	// ReadBlockSize is the size in bytes of reads from files of known size,
+	// from which chunks are sliced. Fewer, larger reads save syscalls with
+	// small chunks. Defaults to 64 KiB, chunks at least as large are read
+	// directly.
+	ReadBlockSize int
+
+	// GSO makes the server write the payloads, which rate control admits at
+	// once, with a single syscall, which the kernel splits into datagrams by
+	// UDP generic segmentation offload. It's only supported on Linux. If a
+	// segmented write fails, the connection falls back to writing payloads one
+	// by one.
+	GSO bool
+
+	// ResendSource decides whether resent chunks are taken from the cache or
+	// read from their file again. Defaults to ResendFromCache.
+	ResendSource ResendSource
+
+	// VerifyOffsets makes connections check that no payload lies beyond the
+	// chunks of its file and close with protocolViolation otherwise. Meant
+	// for tests and staging.
+	VerifyOffsets bool
+
+	// ResendPriority decides which files are served first when an ack requests
+	// more resends than it allows. Defaults to ResendByOffset.
+	ResendPriority ResendPriority
+
+	// NewHash returns the hash used to compute the checksums of served files.
+	// Its digest may be at most 255 bytes long. Defaults to MD5.
+	NewHash func() hash.Hash
+
+	// Checkpoint maps the chunk offset requested for the file name to the
+	// chunk the transfer actually starts at, e.g. the last keyframe before it.
+	// The resolved offset is reported to the client in the file's metadata. If
+	// nil or on error, transfers start at the requested offset.
+	Checkpoint func(ctx context.Context, name string, offset uint64) (uint64, error)
+
+	// Rewrite maps a requested name to the name of the file, which is served
+	// instead, e.g. "latest" to a versioned file. The file handler and
+	// Checkpoint receive the rewritten name, the client receives it as the
+	// file's canonical name. If nil, on error or if the name is longer than
+	// 255 bytes, names aren't rewritten.
+	Rewrite func(ctx context.Context, name string) (string, error)
+
+	// HashHandler opens the files requested by hash, see FileRequest.Hash.
+	// Rewrite and Checkpoint don't apply to them. If nil, the files requested
+	// by hash don't exist.
+	HashHandler HashHandler
+
+	// ResumeTokenKey signs the resume tokens issued to clients, which ask for
+	// them, see Client.OnResumeToken. Tokens carry the state of a transfer
+	// and resume it in a later connection, even after the client or the
+	// server restarted, as long as the key stays the same. If nil, no tokens
+	// are issued and requests presenting one are rejected.
+	ResumeTokenKey []byte
+
+	// ResumeTokenTTL is the time after which issued tokens expire. Defaults
+	// to 24 hours.
+	ResumeTokenTTL time.Duration
+
+	// ResumeTokenInterval is the minimum time between two tokens of a
+	// connection. Defaults to one second.
+	ResumeTokenInterval time.Duration
+
+	// StateStore persists the state of connections with a connection ID. If
+	// set, a restarted server resumes their transfers without resending
+	// acknowledged chunks, once the client acknowledges again.
+	StateStore StateStore
+	// PersistInterval is the minimum time between two saves of the state of a
+	// connection. Chunks acknowledged since the last save are resent after a
+	// restart. Defaults to 100 ms.
+	PersistInterval time.Duration
+
+	// Glob returns the names of all files matching pattern. It expands the
+	// names of estimate requests. If nil, names are not expanded.
+	Glob func(pattern string) ([]string, error)
+
+	// ConnectionKey maps the address of a client to the key of its
+	// connection. Packets from addresses with the same key belong to the same
+	// connection, which follows the client to the address it was last seen
+	// at, e.g. if a NAT rebinds its port. Packets with a connection ID are
+	// keyed by it instead. Defaults to the client's IP and port.
+	ConnectionKey func(addr *net.UDPAddr) string
+
+	// OnRequest is called with every new request before the transfer starts.
+	// If it returns an error, the connection is closed without transferring
+	// any file.
+	OnRequest func(addr net.Addr, files []FileRequest) error
+
+	// OnComplete is called with the summary of every transfer once its
+	// connection is closed. The summary is also logged at Info level.
+	OnComplete func(TransferSummary)
+
+	// OnReceipt is called with the receipts of clients, which confirm that
+	// they received and verified a file, see Client.Receipts. Receipts are
+	// also logged at Info level.
+	OnReceipt func(Receipt)
+
+	// Logger receives the summaries, receipts and per packet Debug lines of
+	// the server and the events of probes, region checksums and resume
+	// tokens. Defaults to the standard logger of package log, which receives
+	// the server's other log output.
+	Logger Logger
+
+	// PacketLogLimit is the maximum number of per packet Debug lines logged
+	// per second. 0 means unlimited.
+	PacketLogLimit int
+
+	// PayloadLogInterval makes the server log every nth payload sent at Debug
+	// level. 0, the default, disables logging payloads, since a line per
+	// payload slows down the transfer. Payloads aren't logged either, if the
+	// Logger is a LevelLogger without Debug enabled.
+	PayloadLogInterval int
+
+	// Strict makes the server close connections with any packet that violates
+	// the protocol instead of dropping it. Meant for debugging.
+	Strict bool
+
+	// IgnoreMisdirected makes the server drop messages, which only servers
+	// send, instead of closing the connection with unknownRequest. The server
+	// receives them, if it's misconfigured to talk to itself or to another
+	// server.
+	IgnoreMisdirected bool
+
+	// CloseTimeout is the time Shutdown waits for in-flight packets to be
+	// handled after closing the socket. Defaults to one second.
+	CloseTimeout time.Duration
+
+	// SupportedVersions are the protocol versions of the requests, which the
+	// server accepts. Requests of other versions are closed with
+	// unsupportedVersion and the supported versions, so that clients
+	// downgrade, see Client.Version. Defaults to the version of this package.
+	SupportedVersions []uint8
+
+	packetLog Logger
+
 	clients   map[string]*clientConnection
 	clientMux sync.Mutex
+	// closed keeps closed connections for receipts, which race their close.
+	closed       map[string]*clientConnection
+	shuttingDown bool
+	// probes are the running bandwidth probes by client address.
+	probes map[string]*bandwidthProbe
+	// memory is the budget of MaxMemory, created with the first connection.
+	memory *memoryBudget
+	// goroutines counts the goroutines of all connections.
+	goroutines goroutineTracker
+	// sums caches the checksums of whole files, see Preload.
+	sums checksumCache
+	// clk is the source of time, the real clock if nil.
+	clk clock
+}
+
+// clock returns the source of time of the server.
+func (s *Server) clock() clock {
+	return orRealClock(s.clk)
 }
 
 func NewServer() *Server {
 	s := &Server{
 		Conn:    NewUDPConnection(),
+		NewHash: md5.New,
+		Logger:  stdLogger{},
 		clients: make(map[string]*clientConnection),
 	}
 
@@ -386,9 +1724,33 @@ func (s *Server) Addr() net.Addr {
 }
 
 func (s *Server) Listen(host string) error {
+	return s.ListenContext(context.Background(), host)
+}
+
+// ListenContext works like Listen, but stops listening and returns nil once
+// ctx is done. Connections, which are still open then, are closed. Shutdown
+// lets them finish first.
+func (s *Server) ListenContext(ctx context.Context, host string) error {
 	s.Conn.handle(msgClientRequest, handlerFunc(s.handleRequest))
 	s.Conn.handle(msgClientAck, handlerFunc(s.handleACK))
 	s.Conn.handle(msgClose, handlerFunc(s.handleClose))
+	s.Conn.handle(msgReceipt, handlerFunc(s.handleReceipt))
+	s.Conn.handle(msgProbe, handlerFunc(s.handleProbe))
+	if !s.IgnoreMisdirected {
+		s.Conn.handle(msgServerMetadata, s.misdirected(msgServerMetadata))
+		s.Conn.handle(msgServerPayload, s.misdirected(msgServerPayload))
+		s.Conn.handle(msgResumeToken, s.misdirected(msgResumeToken))
+	}
+	s.Conn.handleUnsupported(s.unsupported)
+	if s.Strict {
+		s.Conn.handleViolation(s.violation)
+	}
+
+	sctx, cancelCtx := context.WithCancel(ctx)
+	defer cancelCtx()
+	s.ctx = sctx
+	s.packetLog = NewRateLimitedLogger(s.Logger, s.PacketLogLimit)
+	s.goroutines.logger = s.Logger
 
 	cancel, err := s.Conn.listen(host)
 	if err != nil {
@@ -397,13 +1759,219 @@ func (s *Server) Listen(host string) error {
 	defer cancel()
 
 	log.Printf("running server on addr '%v'\n", s.Conn.addr())
-	return s.Conn.receive()
+	if err := s.Conn.receiveContext(ctx); err != nil || ctx.Err() == nil {
+		return err
+	}
+	s.closeConnections()
+	return nil
+}
+
+// supportedVersions returns the protocol versions of the requests, which s
+// accepts.
+func (s *Server) supportedVersions() []uint8 {
+	if len(s.SupportedVersions) == 0 {
+		return []uint8{protocolVersion}
+	}
+	return s.SupportedVersions
+}
+
+func (s *Server) supportsVersion(version uint8) bool {
+	for _, v := range s.supportedVersions() {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// baseChunkSize returns the chunk size of requests without a chunk size.
+func (s *Server) baseChunkSize() int {
+	switch size := s.ChunkSize; {
+	case size <= 0:
+		return defaultChunkSize
+	case size < minChunkSize:
+		return minChunkSize
+	case size > maxChunkSize:
+		return maxChunkSize
+	default:
+		return size
+	}
+}
+
+// chunkSize returns the chunk size for a request with the options os.
+func (s *Server) chunkSize(os []option) int {
+	size, ok := chunkSize(os)
+	if !ok {
+		return s.baseChunkSize()
+	}
+	if max := s.chunkSizeLimit(); size > max {
+		size = max
+	}
+	if size < minChunkSize {
+		size = minChunkSize
+	}
+	return size
+}
+
+// chunkSizeLimit returns the largest chunk size clients may request.
+func (s *Server) chunkSizeLimit() int {
+	max := s.MaxChunkSize
+	if max <= 0 {
+		max = s.baseChunkSize()
+	}
+	if max > maxChunkSize {
+		max = maxChunkSize
+	}
+	return max
+}
+
+// payloadLogInterval returns the interval of payloads logged, 0 if they aren't
+// logged at all.
+func (s *Server) payloadLogInterval() uint64 {
+	if s.PayloadLogInterval <= 0 || !debugEnabled(s.packetLog) {
+		return 0
+	}
+	return uint64(s.PayloadLogInterval)
+}
+
+func (s *Server) closeTimeout() time.Duration {
+	if s.CloseTimeout > 0 {
+		return s.CloseTimeout
+	}
+	return defaultCloseTimeout
+}
+
+func (s *Server) persistInterval() time.Duration {
+	if s.PersistInterval > 0 {
+		return s.PersistInterval
+	}
+	return defaultPersistInterval
 }
 
 func (s *Server) SetFileHandler(fh FileHandler) {
 	s.fh = fh
 }
 
+// closeConnections closes all open connections with reason applicationClosed.
+func (s *Server) closeConnections() {
+	s.clientMux.Lock()
+	clients := make([]*clientConnection, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.clientMux.Unlock()
+	for _, c := range clients {
+		c.closeWith(applicationClosed)
+		if err := sendTo(c.socket, closeConnection{reason: applicationClosed}); err != nil {
+			log.Printf("failed to send close: %v\n", err)
+		}
+	}
+}
+
+// Shutdown gracefully stops the server. New requests are rejected with a close
+// message while open connections may finish their transfers until ctx is done.
+// Connections that are still open then are closed and the server stops
+// listening.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.clientMux.Lock()
+	s.shuttingDown = true
+	s.clientMux.Unlock()
+
+	for {
+		s.clientMux.Lock()
+		clients := make([]*clientConnection, 0, len(s.clients))
+		for _, c := range s.clients {
+			clients = append(clients, c)
+		}
+		s.clientMux.Unlock()
+
+		if len(clients) == 0 {
+			return s.Conn.cclose(s.closeTimeout())
+		}
+
+		// wait for the connections one by one
+		select {
+		case <-ctx.Done():
+			s.closeConnections()
+			if err := s.Conn.cclose(s.closeTimeout()); err != nil {
+				return err
+			}
+			return ctx.Err()
+		case <-clients[0].cleaner.subscribe():
+		}
+	}
+}
+
+// Connections returns the addresses of all open connections.
+func (s *Server) Connections() []net.Addr {
+	s.clientMux.Lock()
+	defer s.clientMux.Unlock()
+	addrs := make([]net.Addr, 0, len(s.clients))
+	for _, c := range s.clients {
+		addrs = append(addrs, c.peer.address())
+	}
+	return addrs
+}
+
+// TransferState returns a snapshot of the state of the transfer to addr. It
+// returns false, if there is no connection to addr.
+func (s *Server) TransferState(addr net.Addr) (*TransferState, bool) {
+	c, ok := s.connection(addr)
+	if !ok {
+		return nil, false
+	}
+	return c.transferState(), true
+}
+
+// CloseConnection cancels the transfer to addr. The client is told reason.
+func (s *Server) CloseConnection(addr net.Addr, reason string) error {
+	c, ok := s.connection(addr)
+	if !ok {
+		return fmt.Errorf("no connection to %v", addr)
+	}
+	c.closeWith(applicationClosed)
+	return sendTo(c.socket, closeConnection{reason: applicationClosed}, reasonOption(errors.New(reason)))
+}
+
+// SetRate caps the rate of the running transfer to addr at bytesPerSec, e.g.
+// to yield bandwidth to a transfer of higher priority without canceling it.
+// The cap is converted to packets of the connection's chunk size and applies
+// from the next packet on. Congestion control still applies below it. 0
+// removes the cap.
+func (s *Server) SetRate(addr net.Addr, bytesPerSec uint32) error {
+	c, ok := s.connection(addr)
+	if !ok {
+		return fmt.Errorf("no connection to %v", addr)
+	}
+	packets := bytesPerSec / uint32(c.chunkSize)
+	if bytesPerSec > 0 && packets == 0 {
+		packets = 1
+	}
+	atomic.StoreUint32(&c.ceiling, packets)
+	return nil
+}
+
+// connection returns the connection to addr. Connections with an ID are
+// found at the address they were last seen at. If several clients share addr,
+// any of them is returned.
+func (s *Server) connection(addr net.Addr) (*clientConnection, bool) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil, false
+	}
+	s.clientMux.Lock()
+	defer s.clientMux.Unlock()
+	if c, ok := s.clients[s.addrKey(ua)]; ok {
+		return c, true
+	}
+	for _, c := range s.clients {
+		if a := c.peer.address(); a != nil && key(a) == key(ua) {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
 type unreliableWriter struct {
 	breakTime  time.Time
 	returnTime time.Time
@@ -437,67 +2005,557 @@ func (s *Server) handleRequest(w io.Writer, p *packet) {
 	//w = getUnreliableWriter(w, x, y)
 
 	log.Printf("handling cr from %v: %v\n", p.remoteAddr, p)
+	if !s.supportsVersion(p.version) {
+		// The request may not even parse in a version the server doesn't
+		// know, so it's rejected before anything else.
+		err := fmt.Errorf("unsupported protocol version %d", p.version)
+		log.Printf("rejecting request from %v: %v\n", p.remoteAddr, err)
+		if err := sendTo(w, closeConnection{reason: unsupportedVersion}, reasonOption(err),
+			option{otype: optionVersions, value: s.supportedVersions()}); err != nil {
+			log.Printf("failed to send close: %v\n", err)
+		}
+		return
+	}
 	cr := &clientRequest{}
 	err := cr.UnmarshalBinary(p.data)
 	if err != nil {
-		// TODO: Close connection?
-		log.Println("failed to parse data")
+		if s.Strict {
+			s.violated(w, p, err)
+			return
+		}
+		// Without a parsed request, there's nothing to transfer. The client
+		// learns so right away instead of timing out.
+		log.Printf("failed to parse request from %v: %v\n", p.remoteAddr, err)
+		if err := sendTo(w, closeConnection{reason: unknownRequest}, reasonOption(err)); err != nil {
+			log.Printf("failed to send close: %v\n", err)
+		}
+		return
+	}
+
+	if _, ok := findOption(p.os, optionCapabilities); ok {
+		if err := sendTo(w, serverMetaData{}, s.capabilities().option()); err != nil {
+			log.Printf("failed to send capabilities: %v\n", err)
+		}
+		return
+	}
+	if len(cr.files) == 0 {
+		// A request for no files would open a connection, which never sends
+		// anything, so the client would only notice after timing out.
+		s.rejectRequest(w, p, errors.New("request without files"))
+		return
+	}
+	algs, err := checksums(p.os, len(cr.files))
+	if err != nil {
+		s.rejectRequest(w, p, err)
+		return
+	}
+	ds, err := digests(p.os, cr.files)
+	if err != nil {
+		s.rejectRequest(w, p, err)
+		return
+	}
+	ls, err := limits(p.os, len(cr.files))
+	if err != nil {
+		s.rejectRequest(w, p, err)
+		return
+	}
+	if _, ok := findOption(p.os, optionNackOnly); ok {
+		if err := s.checkNackOnlyFiles(len(cr.files)); err != nil {
+			s.rejectRequest(w, p, err)
+			return
+		}
+	}
+
+	key := s.connKey(p)
+	s.clientMux.Lock()
+	_, exists := s.clients[key]
+	s.clientMux.Unlock()
+	chunkSize := s.chunkSize(p.os)
+	// issuer is the connection, which issued the presented resume token. It's
+	// only closed, once this request replaced it.
+	var issuer string
+	if !exists {
+		size, from, ok, err := s.resumeFromToken(cr, p.os)
+		if err != nil {
+			log.Printf("rejecting request from %v: %v\n", p.remoteAddr, err)
+			s.reject(w, s.connKey(p), unknownRequest, err)
+			return
+		}
+		if ok {
+			chunkSize = size
+			issuer = from
+		}
+	}
+	if !exists && s.OnRequest != nil {
+		files := make([]FileRequest, len(cr.files))
+		for i, f := range cr.files {
+			files[i] = FileRequest{Name: f.fileName, Offset: f.offset, Checksum: algs[i]}
+			if ds != nil {
+				files[i].Hash = ds[i]
+			}
+		}
+		if err := s.OnRequest(p.remoteAddr, files); err != nil {
+			log.Printf("request from %v rejected: %v\n", p.remoteAddr, err)
+			if err := sendTo(w, closeConnection{reason: applicationClosed}, reasonOption(err)); err != nil {
+				log.Printf("failed to send close: %v\n", err)
+			}
+			return
+		}
+	}
+
+	if _, ok := findOption(p.os, optionEstimate); ok {
+		s.estimate(w, cr)
+		return
+	}
+	if o, ok := findOption(p.os, optionRegions); ok {
+		s.regionChecksums(w, p, cr, o)
+		return
 	}
 
-	key := key(p.remoteAddr)
+	_, compressed := findOption(p.os, optionGzip)
+	_, nackOnly := findOption(p.os, optionNackOnly)
+	_, batched := findOption(p.os, optionMetadataBatch)
+
+	replaced := false
+	defer func() {
+		// after clientMux was released, which supersede takes
+		if replaced {
+			s.supersede(issuer, key)
+		}
+	}()
 	s.clientMux.Lock()
 	defer s.clientMux.Unlock()
-	if _, ok := s.clients[key]; !ok {
-		c := &clientConnection{
-			ack:    make(chan *clientAck, 1024),
-			cclose: make(chan *closeConnection),
-			socket: w,
-			req:    cr,
-
-			cleaner: cleaner{cb: func() {
+	if s.shuttingDown {
+		// Checked under clientMux, so a connection is either drained by Shutdown
+		// or never created.
+		log.Printf("rejecting request from %v during shutdown\n", p.remoteAddr)
+		if err := sendTo(w, closeConnection{reason: applicationClosed}); err != nil {
+			log.Printf("failed to send close: %v\n", err)
+		}
+		return
+	}
+	conn, ok := s.clients[key]
+	if !ok {
+		params := connParams{
+			chunkSize: chunkSize,
+			gzip:      compressed,
+			nackOnly:  nackOnly,
+			profile:   profile(p.os),
+			limits:    ls,
+			checksums: algs,
+			digests:   ds,
+
+			batchMetadata: batched,
+		}
+		params.tokens = s.newTokenIssuer(cr, p.os, params)
+		s.newConnection(w, p, key, cr, params)
+		replaced = true
+	} else if connectionID(p) != "" {
+		// The client repeated its request, because no response arrived yet.
+		// Load balancers and NATs may have mapped it to another port
+		// meanwhile, so responses follow the request like they follow acks.
+		if old := conn.peer.address(); conn.peer.migrate(w, p.remoteAddr, 0) {
+			log.Printf("connection migrated from %v to %v\n", old, p.remoteAddr)
+		}
+		replaced = true
+	} else {
+		// TODO: send close, because duplicate connection request
+	}
+}
+
+// connParams are the parameters of a new connection.
+type connParams struct {
+	chunkSize      int
+	gzip, nackOnly bool
+	profile        Profile
+	batchMetadata  bool
+	// limits are the numbers of chunks transferred of each file, nil or 0
+	// mean no limit.
+	limits []uint64
+	// resume is the persisted state of the connection, if it is resumed.
+	resume *ConnectionState
+	// checksums are the checksum algorithms of the requested files. Without
+	// them, all files use the server's hash.
+	checksums []ChecksumAlgorithm
+	// digests are the digests of the files requested by hash, nil for files
+	// requested by name.
+	digests [][]byte
+	// tokens issues resume tokens, if the client asked for them.
+	tokens *tokenIssuer
+}
+
+// newConnection creates the connection key to the sender of p, which
+// requested cr, and starts its transfer. clientMux must be held.
+func (s *Server) newConnection(w io.Writer, p *packet, key string, cr *clientRequest, params connParams) *clientConnection {
+	maxMemory, maxFiles := s.MaxConnectionMemory, s.MaxConcurrentFiles
+	var budget *memoryBudget
+	if s.MaxMemory > 0 {
+		if s.memory == nil {
+			s.memory = newMemoryBudget(s.MaxMemory)
+		}
+		budget = s.memory
+	}
+	var store StateStore
+	id := connectionID(p)
+	if id != "" {
+		store = s.StateStore
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	var sizer *chunkSizer
+	if s.AdaptiveChunkSize != nil {
+		sizer = newChunkSizer(s.AdaptiveChunkSize, params.chunkSize, s.chunkSizeLimit())
+		sizer.now = s.clock().Now
+	}
+	resendPriority := s.ResendPriority
+	if profiles[params.profile].completeFirst {
+		resendPriority = ResendNearestCompletion
+	}
+
+	pr := &peer{w: w, addr: p.remoteAddr}
+	var c *clientConnection
+	// summary is built by the cleaner, while the connection is removed, and
+	// passed to OnComplete afterwards.
+	var summary TransferSummary
+	c = &clientConnection{
+		ack:    make(chan ackPacket, 1024),
+		cclose: make(chan *closeConnection),
+		socket: pr,
+		peer:   pr,
+		req:    cr,
+
+		ctx: ctx,
+		clk: s.clk,
+		cleaner: cleaner{
+			clk: s.clk,
+			cb: func() {
+				cancel()
+				c.releaseMemory()
 				log.Printf("Trying to close Conn: %v. Current number of connections: %v\n", key, len(s.clients))
 				s.clientMux.Lock()
 				defer s.clientMux.Unlock()
 				delete(s.clients, key)
+				s.keepForReceipts(key, c)
 				log.Printf("Conn %v closed. Current number of connections: %v\n", key, len(s.clients))
-			}},
+				if store != nil {
+					if err := store.Delete(id); err != nil {
+						log.Printf("failed to delete state of connection %v: %v\n", id, err)
+					}
+				}
+				summary = c.summary()
+			},
+			done: func() { s.complete(summary) },
+		},
+
+		resendPriority:     resendPriority,
+		resendSource:       s.ResendSource,
+		profile:            params.profile,
+		batchMetadata:      params.batchMetadata,
+		scheduler:          s.newRetransmitScheduler(),
+		maxRetransmissions: s.MaxRetransmissions,
+		maxResends:         s.MaxResendsPerAck,
+		gzip:               params.gzip,
+		nackOnly:           params.nackOnly,
+		maxMemory:          maxMemory,
+		budget:             budget,
+		maxFiles:           maxFiles,
+		readBlockSize:      s.ReadBlockSize,
+		gso:                s.GSO,
+		verifyOffsets:      s.VerifyOffsets,
+		limits:             params.limits,
+		chunkSize:          params.chunkSize,
+		chunkSizer:         sizer,
+		checkpoint:         s.Checkpoint,
+		rewrite:            s.Rewrite,
+		store:              store,
+		id:                 id,
+		persistInterval:    s.persistInterval(),
+		resume:             params.resume,
+		tokens:             params.tokens,
+		newHash:            s.NewHash,
+		checksums:          params.checksums,
+		digests:            params.digests,
+		hashHandler:        s.HashHandler,
+		sums:               &s.sums,
+		packetLog:          s.packetLog,
+		payloadLogInterval: s.payloadLogInterval(),
+		goroutines:         &s.goroutines,
+
+		payloadCache:    make(map[uint16]map[uint64]*serverPayload),
+		metadataCache:   make(map[uint16]*serverMetaData),
+		pendingMetadata: make(map[uint16]struct{}),
+		evicted:         make(map[uint16]uint64),
+
+		state: transferState{
+			frontier: make(map[uint16]uint64),
+			sent:     make(map[uint16]uint64),
+			start:    s.clock().Now(),
+			active:   make(map[uint16]struct{}),
+			emitted:  make(map[uint16]uint64),
+		},
+	}
+	if params.resume != nil {
+		for i, f := range params.resume.Files {
+			index := uint16(i)
+			c.state.frontier[index] = f.Frontier
+			c.state.sent[index] = f.Frontier
+			c.evicted[index] = f.Frontier
+		}
+	}
+	s.clients[key] = c
+	c.persist()
+	c.goFunc("getResponse", func() { c.getResponse(s.fh) })
+	if s.MaxTransferDuration > 0 {
+		c.goFunc("limitDuration", func() { c.limitDuration(s.MaxTransferDuration) })
+	}
+	c.cleaner.refresh(5 * time.Second)
+	c.cleaner.checkTimeout()
+	return c
+}
+
+// resumeConnection recreates the connection key to the sender of p from its
+// persisted state, if there is any. clientMux must be held.
+func (s *Server) resumeConnection(w io.Writer, p *packet, key string) (*clientConnection, bool) {
+	id := connectionID(p)
+	if s.StateStore == nil || id == "" || s.shuttingDown {
+		return nil, false
+	}
+	state, ok, err := s.StateStore.Load(id)
+	if err != nil {
+		log.Printf("failed to load state of connection %v: %v\n", id, err)
+	}
+	if !ok || err != nil {
+		return nil, false
+	}
+	if state.NackOnly {
+		if err := s.checkNackOnlyFiles(len(state.Files)); err != nil {
+			log.Printf("not resuming connection %v: %v\n", id, err)
+			return nil, false
+		}
+	}
+	log.Printf("resuming connection %v from %v\n", id, p.remoteAddr)
+	c := s.newConnection(w, p, key, state.request(), connParams{
+		chunkSize: state.ChunkSize,
+		gzip:      state.Gzip,
+		nackOnly:  state.NackOnly,
+		profile:   state.Profile,
+		limits:    state.Limits,
+		resume:    state,
+		checksums: state.checksums(),
+		digests:   state.digests(),
+
+		batchMetadata: state.BatchMetadata,
+	})
+	return c, true
+}
+
+// checkNackOnlyFiles returns an error, if a NACK-only request for n files
+// exceeds MaxConcurrentFiles. Its files are never acknowledged, so further
+// files would never be opened.
+func (s *Server) checkNackOnlyFiles(n int) error {
+	if s.MaxConcurrentFiles > 0 && n > s.MaxConcurrentFiles {
+		return fmt.Errorf("NACK-only request for %v files exceeds the limit of %v concurrent files",
+			n, s.MaxConcurrentFiles)
+	}
+	return nil
+}
+
+func (s *Server) newRetransmitScheduler() RetransmitScheduler {
+	if s.NewRetransmitScheduler != nil {
+		return s.NewRetransmitScheduler()
+	}
+	return newDefaultScheduler()
+}
 
-			payloadCache:  make(map[uint16]map[uint64]*serverPayload),
-			metadataCache: make(map[uint16]*serverMetaData),
+// estimate responds to a dry-run request with one metadata per requested name,
+// which carries the total size and the number of files matched by the name.
+// No connection is created.
+func (s *Server) estimate(w io.Writer, cr *clientRequest) {
+	for i, f := range cr.files {
+		names := []string{f.fileName}
+		if s.Glob != nil {
+			matches, err := s.Glob(f.fileName)
+			if err != nil {
+				log.Printf("failed to expand %v: %v\n", f.fileName, err)
+			}
+			names = matches
+		}
+
+		md := serverMetaData{fileIndex: uint16(i)}
+		count := uint32(0)
+		var sum []byte
+		for _, name := range names {
+			ctx, cancel := context.WithCancel(s.ctx)
+			r, err := s.fh(ctx, name)
+			if err != nil || r == nil {
+				cancel()
+				continue
+			}
+			md.size += uint64(r.Size())
+			count++
+			sum, _ = s.sums.load(name, r.Size())
+			// lets the handler close the file
+			cancel()
+		}
+		if count == 0 {
+			md.status = fileNotExistent
+		}
+
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint32(value, count)
+		opts := []option{{otype: optionFileCount, value: value}}
+		if count == 1 && sum != nil {
+			md.checkSum = sum
+			opts = append(opts, option{otype: optionEstimate})
+		}
+		if err := sendTo(w, md, opts...); err != nil {
+			log.Printf("failed to send estimate: %v\n", err)
 		}
-		s.clients[key] = c
-		go c.getResponse(s.fh)
-		c.cleaner.refresh(5 * time.Second)
-		c.cleaner.checkTimeout()
-	} else {
-		// TODO: send close, because duplicate connection request
 	}
 }
 
-func (s *Server) handleACK(_ io.Writer, p *packet) {
+func (s *Server) handleACK(w io.Writer, p *packet) {
 	ack := &clientAck{}
 	err := ack.UnmarshalBinary(p.data)
 	if err != nil {
-		// TODO: Close connection?
-		log.Println("failed to parse ack")
+		if s.Strict {
+			s.violated(w, p, err)
+			return
+		}
+		// The next ack supersedes a malformed one.
+		log.Printf("dropping malformed ack from %v: %v\n", p.remoteAddr, err)
+		return
 	}
-	ack.ackNumber = p.ackNum
-	key := key(p.remoteAddr)
+	key := s.connKey(p)
 	s.clientMux.Lock()
 	defer s.clientMux.Unlock()
-	if conn, ok := s.clients[key]; ok {
-		conn.ack <- ack
+	conn, ok := s.clients[key]
+	if !ok {
+		conn, ok = s.resumeConnection(w, p, key)
+	}
+	if ok {
+		if old := conn.peer.address(); conn.peer.migrate(w, p.remoteAddr, p.ackNum) {
+			log.Printf("connection migrated from %v to %v\n", old, p.remoteAddr)
+		}
+		conn.ack <- ackPacket{clientAck: ack, ackNum: p.ackNum}
 	}
 }
 
-func (s *Server) handleClose(_ io.Writer, p *packet) {
+func (s *Server) handleClose(w io.Writer, p *packet) {
 	cl := closeConnection{}
 	err := cl.UnmarshalBinary(p.data)
 	if err != nil {
-		// TODO What now?
-		log.Println("failed to parse close")
+		if s.Strict {
+			s.violated(w, p, err)
+			return
+		}
+		// The connection times out, if the client really closed it.
+		log.Printf("dropping malformed close from %v: %v\n", p.remoteAddr, err)
+		return
+	}
+
+	// A live connection takes precedence over a closed one of the same key,
+	// e.g. of a client, which reconnected right after its last transfer.
+	key := s.connKey(p)
+	s.clientMux.Lock()
+	c, ok := s.clients[key]
+	_, closed := s.closed[key]
+	s.clientMux.Unlock()
+	if !ok && closed {
+		// Both ends closed at the same time, the server's reason stands.
+		log.Printf("connection to %v closed already, ignoring its close: %s\n", p.remoteAddr, cl.reason)
+		return
+	}
+	if !ok {
+		log.Printf("dropping close from %v without connection: %s\n", p.remoteAddr, cl.reason)
+		return
+	}
+	if o, ok := findOption(p.os, optionReason); ok {
+		log.Printf("connection closed: %s: %s\n", cl.reason.String(), o.value)
+	} else {
+		log.Printf("connection closed: %s\n", cl.reason.String())
+	}
+	c.closeWith(cl.reason)
+}
+
+// complete reports the summary of a closed connection.
+func (s *Server) complete(summary TransferSummary) {
+	s.Logger.Infof("transfer finished: %v\n", summary)
+	if s.OnComplete != nil {
+		s.OnComplete(summary)
+	}
+}
+
+// violation closes the connection to addr in strict mode after it sent a
+// packet that violates the protocol.
+func (s *Server) violation(w io.Writer, addr *net.UDPAddr, packet []byte, err error) {
+	log.Printf("protocol violation by %v: %v, packet: %x\n", addr, err, packet)
+	s.reject(w, s.datagramKey(addr, packet), protocolViolation, err)
+}
+
+// violated closes the connection, which sent p, after the body of p violated
+// the protocol.
+func (s *Server) violated(w io.Writer, p *packet, err error) {
+	log.Printf("protocol violation by %v: %v, packet: %x\n", p.remoteAddr, err, p.data)
+	s.reject(w, s.connKey(p), protocolViolation, err)
+}
+
+// unsupported closes the connection to addr after it sent a critical option,
+// which the server doesn't understand.
+func (s *Server) unsupported(w io.Writer, addr *net.UDPAddr, packet []byte, err error) {
+	log.Printf("unsupported packet from %v: %v, packet: %x\n", addr, err, packet)
+	s.reject(w, s.datagramKey(addr, packet), unsupportedVersion, err)
+}
+
+// datagramKey returns the key of the connection, which sent datagram from addr.
+// Without a parsable header, it's the key of connections from addr without ID.
+func (s *Server) datagramKey(addr *net.UDPAddr, datagram []byte) string {
+	h := &msgHeader{}
+	if err := h.UnmarshalBinary(datagram); err != nil {
+		return s.addrKey(addr)
+	}
+	return s.connKey(&packet{os: h.options, remoteAddr: addr})
+}
+
+// misdirected returns a handler, which closes the connection after receiving
+// a message of msgType, which only servers send. The peer is a server or the
+// server itself.
+func (s *Server) misdirected(msgType uint8) handlerFunc {
+	return func(w io.Writer, p *packet) {
+		err := fmt.Errorf("received server message type %d from %v, is the peer a server?",
+			msgType, p.remoteAddr)
+		log.Println(err)
+		s.reject(w, s.connKey(p), unknownRequest, err)
+	}
+}
+
+// rejectRequest rejects the invalid request p with unknownRequest, unless its
+// connection is already open. A malformed duplicate or retransmission of a
+// request is dropped then, so that it doesn't close a healthy transfer.
+func (s *Server) rejectRequest(w io.Writer, p *packet, err error) {
+	key := s.connKey(p)
+	s.clientMux.Lock()
+	_, exists := s.clients[key]
+	s.clientMux.Unlock()
+	if exists {
+		log.Printf("dropping invalid request from %v of an open connection: %v\n", p.remoteAddr, err)
+		return
 	}
+	log.Printf("rejecting request from %v: %v\n", p.remoteAddr, err)
+	s.reject(w, key, unknownRequest, err)
+}
 
-	log.Printf("connection closed: %s\n", cl.reason.String())
-	// TODO: clean up state
+// reject tells the sender of a packet why it was rejected and closes the
+// connection with key, if any. Other connections sharing the sender's address
+// stay open.
+func (s *Server) reject(w io.Writer, key string, reason CloseConnectionReason, err error) {
+	s.clientMux.Lock()
+	c, ok := s.clients[key]
+	s.clientMux.Unlock()
+	if ok {
+		c.closeWith(reason)
+	}
+	if err := sendTo(w, closeConnection{reason: reason}, reasonOption(err)); err != nil {
+		log.Printf("failed to send close: %v\n", err)
+	}
 }
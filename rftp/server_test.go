@@ -0,0 +1,2305 @@
+package rftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startServer runs s on a free loopback port and returns the address once the
+// server's socket is bound.
+func startServer(t testing.TB, s *Server) string {
+	addr, _ := startServerContext(t, s, context.Background())
+	return addr
+}
+
+// startServerContext works like startServer, but listens with ctx. The
+// returned channel receives the result of ListenContext.
+func startServerContext(t testing.TB, s *Server, ctx context.Context) (string, <-chan error) {
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := probe.LocalAddr().(*net.UDPAddr)
+	probe.Close()
+
+	listening := make(chan error, 1)
+	go func() {
+		listening <- s.ListenContext(ctx, addr.String())
+	}()
+
+	// As long as we can bind the port ourselves, the server isn't listening yet.
+	for i := 0; i < 100; i++ {
+		probe, err := net.ListenUDP("udp4", addr)
+		if err != nil {
+			return addr.String(), listening
+		}
+		probe.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server did not start listening on %v", addr)
+	return "", nil
+}
+
+// dialServer opens a raw UDP socket to addr to send hand-crafted messages.
+func dialServer(t *testing.T, addr string) *net.UDPConn {
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp4", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readMsg reads from conn until a message of type msgType arrives and returns
+// its body. Messages of other types are skipped.
+func readMsg(t *testing.T, conn *net.UDPConn, msgType uint8) []byte {
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("no message of type %v received: %v", msgType, err)
+		}
+		h := &msgHeader{}
+		if err := h.UnmarshalBinary(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if h.msgType == msgType {
+			return buf[h.hdrLen:n]
+		}
+	}
+}
+
+// captureWriter decodes everything written to it and delivers the messages in
+// order to the returned channel.
+func captureWriter() (io.Writer, chan interface{}) {
+	msgs := make(chan interface{}, 1024)
+	return responseWriter(func(bs []byte) (int, error) {
+		h := &msgHeader{}
+		if err := h.UnmarshalBinary(bs); err != nil {
+			return 0, err
+		}
+		body := append([]byte{}, bs[h.hdrLen:]...)
+		var msg encoding.BinaryUnmarshaler
+		switch h.msgType {
+		case msgServerMetadata:
+			msg = &serverMetaData{}
+		case msgServerPayload:
+			msg = &serverPayload{}
+		case msgClose:
+			msg = &closeConnection{}
+		default:
+			return 0, fmt.Errorf("unexpected message type %v", h.msgType)
+		}
+		if err := msg.UnmarshalBinary(body); err != nil {
+			return 0, err
+		}
+		msgs <- msg
+		return len(bs), nil
+	}), msgs
+}
+
+// newTestClientConnection returns a connection as created by the server for
+// the request, which writes its responses to w.
+func newTestClientConnection(req *clientRequest, w io.Writer) *clientConnection {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &clientConnection{
+		ack:             make(chan ackPacket, 1024),
+		chunkSize:       defaultChunkSize,
+		cclose:          make(chan *closeConnection),
+		socket:          w,
+		req:             req,
+		ctx:             ctx,
+		cleaner:         cleaner{cb: cancel},
+		newHash:         md5.New,
+		packetLog:       stdLogger{},
+		scheduler:       newDefaultScheduler(),
+		payloadCache:    make(map[uint16]map[uint64]*serverPayload),
+		metadataCache:   make(map[uint16]*serverMetaData),
+		pendingMetadata: make(map[uint16]struct{}),
+		evicted:         make(map[uint16]uint64),
+		state: transferState{
+			frontier: make(map[uint16]uint64),
+			sent:     make(map[uint16]uint64),
+			active:   make(map[uint16]struct{}),
+			emitted:  make(map[uint16]uint64),
+		},
+	}
+}
+
+func bytesHandler(files map[string][]byte) FileHandler {
+	return func(_ context.Context, name string) (*io.SectionReader, error) {
+		data, ok := files[name]
+		if !ok {
+			return nil, errors.New("file not found")
+		}
+		return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), nil
+	}
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+// failingReaderAt returns an error for every read that reaches failAt.
+type failingReaderAt struct {
+	data   []byte
+	failAt int64
+}
+
+func (r *failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > r.failAt {
+		return 0, errors.New("disk on fire")
+	}
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+func TestReadErrorStopsTransfer(t *testing.T) {
+	data := testData(10 * 1024)
+	s := NewServer()
+	s.SetFileHandler(func(_ context.Context, name string) (*io.SectionReader, error) {
+		r := &failingReaderAt{data: data, failAt: 4 * 1024}
+		return io.NewSectionReader(r, 0, int64(len(data))), nil
+	})
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	rs, err := c.Request(addr, []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(rs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) > 4*1024 {
+		t.Errorf("received %v bytes, but only %v were readable", len(got), 4*1024)
+	}
+	if rs[0].Err == nil || !strings.Contains(rs[0].Err.Error(), readError.String()) {
+		t.Errorf("expected read error status, got: %v", rs[0].Err)
+	}
+}
+
+func TestResendPriority(t *testing.T) {
+	tests := map[string]struct {
+		priority ResendPriority
+		want     []resendEntry
+	}{
+		"by-offset": {
+			priority: ResendByOffset,
+			want:     []resendEntry{{0, 10, 1}, {0, 11, 1}},
+		},
+		"nearest-completion": {
+			priority: ResendNearestCompletion,
+			want:     []resendEntry{{1, 50, 1}, {1, 51, 1}},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := &clientConnection{
+				resend:         make(chan *serverPayload, 10),
+				resendDone:     make(chan *serverPayload, 10),
+				reschedule:     make(chan *clientAck, 1),
+				metadata:       make(chan *serverMetaData, 10),
+				cleaner:        cleaner{cb: func() {}},
+				packetLog:      stdLogger{},
+				resendPriority: tc.priority,
+				chunks:         map[uint16]uint64{0: 1000, 1: 52},
+				payloadCache:   make(map[uint16]map[uint64]*serverPayload),
+				scheduler:      newDefaultScheduler(),
+				metadataCache:  make(map[uint16]*serverMetaData),
+				maxResends:     2,
+			}
+			for _, re := range []resendEntry{{0, 10, 1}, {0, 11, 1}, {1, 50, 1}, {1, 51, 1}} {
+				c.saveToCache(&serverPayload{fileIndex: re.fileIndex, offset: re.offset})
+			}
+			go c.rescheduler()
+			defer c.cleaner.close()
+
+			// the budget allows servicing two entries, regardless of the rate
+			c.reschedule <- &clientAck{
+				maxTransmissionRate: 1,
+				resendEntries: resendEntryList{
+					{0, 10, 1}, {1, 51, 1}, {0, 11, 1}, {1, 50, 1},
+				},
+			}
+
+			for _, want := range tc.want {
+				select {
+				case p := <-c.resend:
+					if p.fileIndex != want.fileIndex || p.offset != want.offset {
+						t.Errorf("resent file %v at %v, want file %v at %v",
+							p.fileIndex, p.offset, want.fileIndex, want.offset)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("timeout waiting for resend")
+				}
+			}
+			select {
+			case p := <-c.resend:
+				t.Errorf("unexpected resend beyond budget: %v", p)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestResendsIndependentOfRate(t *testing.T) {
+	for _, rate := range []uint32{0, 1, 1000} {
+		t.Run(fmt.Sprint(rate), func(t *testing.T) {
+			c := &clientConnection{
+				resend:        make(chan *serverPayload, 10),
+				resendDone:    make(chan *serverPayload, 10),
+				reschedule:    make(chan *clientAck, 1),
+				metadata:      make(chan *serverMetaData, 10),
+				cleaner:       cleaner{cb: func() {}},
+				packetLog:     stdLogger{},
+				chunks:        map[uint16]uint64{0: 1000},
+				payloadCache:  make(map[uint16]map[uint64]*serverPayload),
+				scheduler:     newDefaultScheduler(),
+				metadataCache: make(map[uint16]*serverMetaData),
+			}
+			entries := resendEntryList{{0, 10, 1}, {0, 11, 1}, {0, 12, 1}, {0, 13, 1}}
+			for _, re := range entries {
+				c.saveToCache(&serverPayload{fileIndex: re.fileIndex, offset: re.offset})
+			}
+			go c.rescheduler()
+			defer c.cleaner.close()
+
+			c.reschedule <- &clientAck{maxTransmissionRate: rate, resendEntries: entries}
+			for range entries {
+				select {
+				case <-c.resend:
+				case <-time.After(time.Second):
+					t.Fatal("not all entries resent")
+				}
+			}
+		})
+	}
+}
+
+func TestListenContextCancel(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10)}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr, listening := startServerContext(t, s, ctx)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, conn, msgServerMetadata)
+
+	cancel()
+	select {
+	case err := <-listening:
+		if err != nil {
+			t.Fatalf("ListenContext returned %v, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ListenContext didn't return after its context was canceled")
+	}
+	cl := closeConnection{}
+	if err := cl.UnmarshalBinary(readMsg(t, conn, msgClose)); err != nil {
+		t.Fatal(err)
+	}
+	if cl.reason != applicationClosed {
+		t.Errorf("close reason %v, want %v", cl.reason, applicationClosed)
+	}
+}
+
+func TestRequestDuringShutdownIsRejected(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10)}))
+	addr := startServer(t, s)
+
+	// an open connection keeps the server draining
+	draining := dialServer(t, addr)
+	defer draining.Close()
+	if err := sendTo(draining, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, draining, msgServerMetadata)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(ctx)
+	}()
+	for started := false; !started; {
+		s.clientMux.Lock()
+		started = s.shuttingDown
+		s.clientMux.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	late := dialServer(t, addr)
+	defer late.Close()
+	if err := sendTo(late, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+	cl := closeConnection{}
+	if err := cl.UnmarshalBinary(readMsg(t, late, msgClose)); err != nil {
+		t.Fatal(err)
+	}
+	if cl.reason != applicationClosed {
+		t.Errorf("got close reason %v, want %v", cl.reason, applicationClosed)
+	}
+
+	if err := <-shutdown; err != context.DeadlineExceeded {
+		t.Errorf("shutdown returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	cl = closeConnection{}
+	if err := cl.UnmarshalBinary(readMsg(t, draining, msgClose)); err != nil {
+		t.Fatal(err)
+	}
+	if cl.reason != applicationClosed {
+		t.Errorf("got close reason %v for open connection, want %v", cl.reason, applicationClosed)
+	}
+}
+
+func TestShutdownWaitsForConnections(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10)}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, conn, msgServerMetadata)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned %v with an open connection", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := sendTo(conn, closeConnection{reason: applicationClosed}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("shutdown returned %v, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown didn't return after the last connection closed")
+	}
+}
+
+func TestMetadataFollowsLastPayload(t *testing.T) {
+	files := map[string][]byte{
+		"a": testData(5*1024 + 3),
+		"b": testData(3*1024 + 10),
+		"c": testData(1),
+	}
+	req := &clientRequest{files: []fileDescriptor{{0, "a"}, {0, "b"}, {0, "c"}}}
+
+	for i := 0; i < 20; i++ {
+		w, msgs := captureWriter()
+		c := newTestClientConnection(req, w)
+		go c.getResponse(bytesHandler(files))
+
+		sent := map[uint16]uint64{}
+		for done := 0; done < len(req.files); {
+			select {
+			case msg := <-msgs:
+				switch m := msg.(type) {
+				case *serverPayload:
+					sent[m.fileIndex]++
+				case *serverMetaData:
+					want := (m.size + 1023) / 1024
+					if sent[m.fileIndex] != want {
+						t.Fatalf("metadata of file %v sent after %v of %v payloads",
+							m.fileIndex, sent[m.fileIndex], want)
+					}
+					done++
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("timeout waiting for response")
+			}
+		}
+		c.cleaner.close()
+	}
+}
+
+func TestFileHandlerObservesCancellation(t *testing.T) {
+	data := testData(100 * 1024)
+	ctxs := make(chan context.Context, 1)
+	s := NewServer()
+	s.SetFileHandler(func(ctx context.Context, name string) (*io.SectionReader, error) {
+		ctxs <- ctx
+		return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), nil
+	})
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, conn, msgServerPayload)
+	ctx := <-ctxs
+	if ctx.Err() != nil {
+		t.Fatalf("context canceled during transfer: %v", ctx.Err())
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Shutdown(canceled)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("file handler context not canceled after connection was closed")
+	}
+}
+
+func TestChecksumAlgorithms(t *testing.T) {
+	data := testData(3*1024 + 100)
+	tests := map[string]struct {
+		server, client func() hash.Hash
+		wantErr        bool
+	}{
+		"md5":      {md5.New, nil, false},
+		"sha256":   {sha256.New, sha256.New, false},
+		"mismatch": {sha256.New, md5.New, true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := NewServer()
+			s.NewHash = tc.server
+			s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+			addr := startServer(t, s)
+
+			c := Client{Conn: NewUDPConnection(), NewHash: tc.client}
+			rs, err := c.Request(addr, []string{"file"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(rs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("received data differs from source")
+			}
+			if (rs[0].Err != nil) != tc.wantErr {
+				t.Errorf("got err %v, want error: %v", rs[0].Err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestDuplicateFileNames(t *testing.T) {
+	files := map[string][]byte{
+		"a": testData(3*1024 + 1),
+		"b": bytes.Repeat([]byte{0xff}, 2*1024+7),
+	}
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(files))
+	addr := startServer(t, s)
+
+	names := []string{"a", "b", "a"}
+	c := Client{Conn: NewUDPConnection()}
+	rs, err := c.Request(addr, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range rs {
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Name != names[i] || r.Err != nil {
+			t.Errorf("file %v: got name %v, err %v", i, r.Name, r.Err)
+		}
+		if !bytes.Equal(got, files[names[i]]) {
+			t.Errorf("file %v: received data differs from %v", i, names[i])
+		}
+	}
+}
+
+func TestMetadataRetransmission(t *testing.T) {
+	w, msgs := captureWriter()
+	dropped := false
+	lossy := responseWriter(func(bs []byte) (int, error) {
+		h := &msgHeader{}
+		if err := h.UnmarshalBinary(bs); err == nil && h.msgType == msgServerMetadata && !dropped {
+			dropped = true
+			return len(bs), nil
+		}
+		return w.Write(bs)
+	})
+	c := newTestClientConnection(&clientRequest{files: []fileDescriptor{{0, "missing"}}}, lossy)
+	go c.getResponse(bytesHandler(nil))
+	defer c.cleaner.close()
+
+	select {
+	case msg := <-msgs:
+		md, ok := msg.(*serverMetaData)
+		if !ok || md.status != fileNotExistent {
+			t.Fatalf("got %v, want metadata with status %v", msg, fileNotExistent)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lost metadata was not retransmitted")
+	}
+
+	// the ack doesn't request the metadata, so it was received
+	c.ack <- ackPacket{clientAck: &clientAck{}, ackNum: 1}
+	select {
+	case msg := <-msgs:
+		t.Errorf("unexpected message after metadata was acknowledged: %v", msg)
+	case <-time.After(metadataRetransmissions * defaultRTT):
+	}
+}
+
+func TestOnRequestRejects(t *testing.T) {
+	requested := make(chan []FileRequest, 1)
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10)}))
+	s.OnRequest = func(addr net.Addr, files []FileRequest) error {
+		requested <- files
+		return errors.New("quota exceeded")
+	}
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &msgHeader{}
+	if err := h.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if h.msgType != msgClose {
+		t.Fatalf("got message type %v, want close", h.msgType)
+	}
+	if o, ok := findOption(h.options, optionReason); !ok || string(o.value) != "quota exceeded" {
+		t.Errorf("close doesn't carry the rejection: %q", o.value)
+	}
+	if files := <-requested; len(files) != 1 || files[0].Name != "file" {
+		t.Errorf("hook called with %v", files)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(buf); err == nil {
+		t.Errorf("received %v bytes after rejection", n)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	files := map[string][]byte{
+		"a.txt": testData(10),
+		"b.txt": testData(2000),
+		"c.bin": testData(5),
+	}
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(files))
+	s.Glob = func(pattern string) ([]string, error) {
+		var names []string
+		for name := range files {
+			if ok, err := path.Match(pattern, name); err != nil {
+				return nil, err
+			} else if ok {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	e, err := c.Estimate(addr, []string{"*.txt", "c.bin", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Files != 3 || e.Size != 2015 {
+		t.Errorf("got %v files with %v bytes, want 3 files with 2015 bytes", e.Files, e.Size)
+	}
+}
+
+func TestEstimateReleasesFiles(t *testing.T) {
+	var lock sync.Mutex
+	var opened []context.Context
+	fh := bytesHandler(map[string][]byte{"a": testData(10), "b": testData(20)})
+	s := NewServer()
+	s.SetFileHandler(func(ctx context.Context, name string) (*io.SectionReader, error) {
+		lock.Lock()
+		opened = append(opened, ctx)
+		lock.Unlock()
+		return fh(ctx, name)
+	})
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	if _, err := c.Estimate(addr, []string{"a", "b", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(opened) != 3 {
+		t.Fatalf("handler called %v times, want 3", len(opened))
+	}
+	for i, ctx := range opened {
+		if ctx.Err() == nil {
+			t.Errorf("context of file %v not canceled after the estimate", i)
+		}
+	}
+}
+
+func TestStrictModeClosesOnViolation(t *testing.T) {
+	tests := map[string][]byte{
+		"truncated header": {msgClientRequest | 1<<4, 0, 1},
+		"unknown option":   {msgClientRequest | 1<<4, 0, 1, 100, 0},
+		"unknown type":     {0xF | 1<<4, 0, 0},
+		"truncated ack":    {msgClientAck | 1<<4, 0, 0, 1},
+	}
+	for name, msg := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := NewServer()
+			s.Strict = true
+			s.SetFileHandler(bytesHandler(nil))
+			addr := startServer(t, s)
+
+			conn := dialServer(t, addr)
+			defer conn.Close()
+			if _, err := conn.Write(msg); err != nil {
+				t.Fatal(err)
+			}
+
+			buf := make([]byte, 2048)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := &msgHeader{}
+			if err := h.UnmarshalBinary(buf[:n]); err != nil {
+				t.Fatal(err)
+			}
+			if h.msgType != msgClose {
+				t.Fatalf("got message type %v, want close", h.msgType)
+			}
+			cl := closeConnection{}
+			if err := cl.UnmarshalBinary(buf[h.hdrLen:n]); err != nil {
+				t.Fatal(err)
+			}
+			if cl.reason != protocolViolation {
+				t.Errorf("got reason %v, want %v", cl.reason, protocolViolation)
+			}
+			if o, ok := findOption(h.options, optionReason); !ok || len(o.value) == 0 {
+				t.Error("close message does not describe the violation")
+			}
+		})
+	}
+}
+
+func TestLenientModeDropsViolation(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(nil))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if _, err := conn.Write([]byte{0xF | 1<<4, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(buf); err == nil {
+		t.Errorf("received %v bytes in response to malformed packet", n)
+	}
+}
+
+func TestUnknownSizeStream(t *testing.T) {
+	data := testData(5*1024 + 100)
+	s := NewServer()
+	s.SetFileHandler(func(_ context.Context, name string) (*io.SectionReader, error) {
+		r, w := io.Pipe()
+		go func() {
+			// write in pieces not aligned to chunks to get short reads
+			for p := data; len(p) > 0; {
+				n := 700
+				if n > len(p) {
+					n = len(p)
+				}
+				w.Write(p[:n])
+				p = p[n:]
+			}
+			w.Close()
+		}()
+		return NewStreamReader(r), nil
+	})
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	rs, err := c.Request(addr, []string{"stream"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("received %v bytes differing from source", len(got))
+	}
+	if rs[0].Err != nil {
+		t.Error(rs[0].Err)
+	}
+	if rs[0].Size() != uint64(len(data)) {
+		t.Errorf("got size %v, want %v", rs[0].Size(), len(data))
+	}
+}
+
+func TestRetransmissionLimit(t *testing.T) {
+	s := NewServer()
+	s.MaxRetransmissions = 3
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(3 * 1024)}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// offset 1 never arrives, so the client keeps requesting it
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				sendTo(conn, clientAck{
+					status:        metaDataReceived,
+					resendEntries: []*resendEntry{{0, 1, 1}},
+				})
+			}
+		}
+	}()
+
+	sent := 0
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("connection not closed: %v", err)
+		}
+		h := &msgHeader{}
+		if err := h.UnmarshalBinary(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if h.msgType == msgServerPayload {
+			p := serverPayload{}
+			if err := p.UnmarshalBinary(buf[h.hdrLen:n]); err != nil {
+				t.Fatal(err)
+			}
+			if p.offset == 1 {
+				sent++
+			}
+		}
+		if h.msgType == msgClose {
+			cl := closeConnection{}
+			if err := cl.UnmarshalBinary(buf[h.hdrLen:n]); err != nil {
+				t.Fatal(err)
+			}
+			if cl.reason != tooManyRetransmissions {
+				t.Errorf("got close reason %v, want %v", cl.reason, tooManyRetransmissions)
+			}
+			break
+		}
+	}
+	if sent != 1+s.MaxRetransmissions {
+		t.Errorf("chunk was sent %v times, want %v", sent, 1+s.MaxRetransmissions)
+	}
+}
+
+func TestGzipStream(t *testing.T) {
+	data := bytes.Repeat([]byte("highly compressible text, "), 4000)
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection(), Gzip: true}
+	rs, err := c.Request(addr, []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("received %v bytes differing from source", len(got))
+	}
+	if rs[0].Err != nil {
+		t.Error(rs[0].Err)
+	}
+	if rs[0].Size() != uint64(len(data)) {
+		t.Errorf("got size %v, want %v", rs[0].Size(), len(data))
+	}
+	// the frontier counts the chunks on the wire
+	frontier := rs[0].Frontier()
+	uncompressed := uint64(len(data)+1023) / 1024
+	if frontier == 0 || frontier*20 > uncompressed {
+		t.Errorf("sent %v chunks, want less than 1/20 of the %v uncompressed chunks", frontier, uncompressed)
+	}
+}
+
+// countingReader is an endless source, which counts the reads.
+type countingReader struct {
+	reads int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	atomic.AddInt64(&r.reads, 1)
+	rand.Read(p)
+	return len(p), nil
+}
+
+func TestCompressStops(t *testing.T) {
+	src := &countingReader{}
+	d := &deflater{hasher: md5.New()}
+	sr, closeSrc := d.compress(src)
+	if _, err := sr.ReadAt(make([]byte, 1024), 0); err != nil {
+		t.Fatal(err)
+	}
+	closeSrc()
+
+	// the compression must stop reading the source after it was closed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reads := atomic.LoadInt64(&src.reads)
+		time.Sleep(50 * time.Millisecond)
+		if atomic.LoadInt64(&src.reads) == reads {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("compression still reads its source after it was closed")
+		}
+	}
+}
+
+func TestTransferState(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10*1024 - 100)}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+	// the metadata follows the last payload, so all chunks are in flight
+	readMsg(t, conn, msgServerMetadata)
+	if err := sendAckTo(conn, 1, clientAck{fileIndex: 0, offset: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	addrs := s.Connections()
+	if len(addrs) != 1 || addrs[0].String() != conn.LocalAddr().String() {
+		t.Fatalf("got connections %v, want %v", addrs, conn.LocalAddr())
+	}
+
+	var ts *TransferState
+	deadline := time.Now().Add(time.Second)
+	for {
+		var ok bool
+		ts, ok = s.TransferState(conn.LocalAddr())
+		if !ok {
+			t.Fatal("no state for open connection")
+		}
+		if ts.Files[0].Frontier == 4 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	want := FileState{Name: "file", Frontier: 4, Chunks: 10}
+	if ts.Files[0] != want {
+		t.Errorf("got file state %+v, want %+v", ts.Files[0], want)
+	}
+	// the last chunk is 100 bytes short
+	if ts.InFlight != 6*1024-100 {
+		t.Errorf("got %v bytes in flight, want %v", ts.InFlight, 6*1024-100)
+	}
+	if ts.Rate == 0 {
+		t.Error("rate not reported")
+	}
+
+	if err := s.CloseConnection(conn.LocalAddr(), "maintenance"); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, conn, msgClose)
+	if _, ok := s.TransferState(conn.LocalAddr()); ok {
+		t.Error("state reported for closed connection")
+	}
+}
+
+func TestPerRequestChunkSize(t *testing.T) {
+	data := testData(20*1024 + 123)
+	s := NewServer()
+	s.MaxChunkSize = 4096
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	tests := map[string]struct {
+		requested int
+		chunks    uint64
+	}{
+		"small":   {512, 41},
+		"clamped": {8192, 6},
+	}
+	var wg sync.WaitGroup
+	for name, tc := range tests {
+		name, tc := name, tc
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := Client{Conn: NewUDPConnection(), ChunkSize: tc.requested}
+			rs, err := c.Request(addr, []string{"file"})
+			if err != nil {
+				t.Errorf("%v: %v", name, err)
+				return
+			}
+			got, err := ioutil.ReadAll(rs[0])
+			if err != nil {
+				t.Errorf("%v: %v", name, err)
+				return
+			}
+			if !bytes.Equal(got, data) || rs[0].Err != nil {
+				t.Errorf("%v: transfer failed: %v", name, rs[0].Err)
+			}
+			if f := rs[0].Frontier(); f != tc.chunks {
+				t.Errorf("%v: received %v chunks, want %v", name, f, tc.chunks)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestServerChunkSize(t *testing.T) {
+	data := testData(20*1024 + 123)
+	for _, tc := range []struct {
+		size   int
+		chunks uint64
+	}{
+		{512, 41},
+		{4096, 6},
+	} {
+		t.Run(fmt.Sprint(tc.size), func(t *testing.T) {
+			s := NewServer()
+			s.ChunkSize = tc.size
+			s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+			addr := startServer(t, s)
+
+			c := Client{Conn: NewUDPConnection()}
+			rs, err := c.Request(addr, []string{"file"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(rs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) || rs[0].Err != nil {
+				t.Errorf("received %v of %v bytes: %v", len(got), len(data), rs[0].Err)
+			}
+			if f := rs[0].Frontier(); f != tc.chunks {
+				t.Errorf("received %v chunks, want %v", f, tc.chunks)
+			}
+		})
+	}
+}
+
+func TestClientNeverAcks(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(100*1024 + 1)}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(unackedRTTs*defaultRTT + 2*time.Second))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("connection not closed: %v", err)
+		}
+		h := &msgHeader{}
+		if err := h.UnmarshalBinary(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if h.msgType != msgClose {
+			continue
+		}
+		cl := closeConnection{}
+		if err := cl.UnmarshalBinary(buf[h.hdrLen:n]); err != nil {
+			t.Fatal(err)
+		}
+		if cl.reason != timeout {
+			t.Errorf("got close reason %v, want %v", cl.reason, timeout)
+		}
+		break
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(s.Connections()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection not reaped: %v", s.Connections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTransferSummary(t *testing.T) {
+	summaries := make(chan TransferSummary, 1)
+	s := NewServer()
+	s.OnComplete = func(summary TransferSummary) {
+		summaries <- summary
+	}
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10 * 1024)}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// chunks 2 and 5 are lost, the metadata follows the last payload
+	readMsg(t, conn, msgServerMetadata)
+	if err := sendAckTo(conn, 1, clientAck{
+		fileIndex:     0,
+		offset:        2,
+		resendEntries: []*resendEntry{{0, 2, 1}, {0, 5, 1}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		readMsg(t, conn, msgServerPayload)
+	}
+	if err := sendAckTo(conn, 2, clientAck{fileIndex: 0, offset: 10}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		ts, ok := s.TransferState(conn.LocalAddr())
+		if !ok || ts.Files[0].Frontier == 10 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("final ack not handled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := sendTo(conn, closeConnection{reason: donwloadFinished}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case summary := <-summaries:
+		if summary.Bytes != 10*1024 {
+			t.Errorf("got %v bytes, want %v", summary.Bytes, 10*1024)
+		}
+		if summary.Retransmissions != 2 {
+			t.Errorf("got %v retransmissions, want 2", summary.Retransmissions)
+		}
+		if summary.Reason != donwloadFinished {
+			t.Errorf("got reason %v, want %v", summary.Reason, donwloadFinished)
+		}
+		if summary.RTT.Samples != 2 {
+			t.Errorf("got %v RTT samples, want 2", summary.RTT.Samples)
+		}
+		if summary.PeakRate < summary.AverageRate {
+			t.Errorf("peak rate %v below average rate %v", summary.PeakRate, summary.AverageRate)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no summary reported")
+	}
+}
+
+func TestOnCompleteCallsServer(t *testing.T) {
+	data := testData(100 * 1024)
+	s := NewServer()
+	s.SetFileHandler(func(ctx context.Context, name string) (*io.SectionReader, error) {
+		if name == "stalled" {
+			r := &stallingReaderAt{ctx: ctx, data: data, stall: 1024}
+			return io.NewSectionReader(r, 0, int64(len(data))), nil
+		}
+		return io.NewSectionReader(bytes.NewReader(data[:1024]), 0, 1024), nil
+	})
+	// the callback closes all other connections, once a transfer finishes
+	completed := make(chan struct{}, 2)
+	s.OnComplete = func(summary TransferSummary) {
+		for _, addr := range s.Connections() {
+			s.TransferState(addr)
+			s.CloseConnection(addr, "closed by callback")
+		}
+		completed <- struct{}{}
+	}
+	addr := startServer(t, s)
+
+	stalled := Client{Conn: NewUDPConnection()}
+	if _, err := stalled.Request(addr, []string{"stalled"}); err != nil {
+		t.Fatal(err)
+	}
+	c := Client{Conn: NewUDPConnection()}
+	rs, err := c.Request(addr, []string{"small"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(rs[0])
+
+	select {
+	case <-completed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnComplete didn't return")
+	}
+	deadline := time.After(2 * time.Second)
+	for {
+		if reason, byServer := stalled.CloseReason(); reason == applicationClosed && byServer {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("stalled connection not closed by the callback")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestCheckpointOffset(t *testing.T) {
+	data := testData(10*1024 + 100)
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	// checkpoints are every 4 chunks
+	s.Checkpoint = func(_ context.Context, name string, offset uint64) (uint64, error) {
+		return offset - offset%4, nil
+	}
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	rs, err := c.RequestFrom(addr, []FileRequest{{Name: "file", Offset: 6}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs[0].Err != nil {
+		t.Fatal(rs[0].Err)
+	}
+	if rs[0].Offset() != 4 {
+		t.Errorf("transfer started at chunk %v, want 4", rs[0].Offset())
+	}
+	if !bytes.Equal(got, data[4*1024:]) {
+		t.Errorf("received %v bytes differing from source after the checkpoint", len(got))
+	}
+}
+
+func TestUnsupportedVersionRejected(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10)}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	err := sendTo(conn, versioned{2, clientRequest{files: []fileDescriptor{{0, "file"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &msgHeader{}
+	if err := h.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	cl := closeConnection{}
+	if err := cl.UnmarshalBinary(buf[h.hdrLen:n]); h.msgType != msgClose || err != nil {
+		t.Fatalf("got message type %v (%v), want a close", h.msgType, err)
+	}
+	if cl.reason != unsupportedVersion {
+		t.Errorf("got close reason %v, want %v", cl.reason, unsupportedVersion)
+	}
+	if o, ok := findOption(h.options, optionVersions); !ok || !bytes.Equal(o.value, []byte{protocolVersion}) {
+		t.Errorf("got supported versions %v, want [%v]", o.value, protocolVersion)
+	}
+	if n := len(s.Connections()); n != 0 {
+		t.Errorf("got %v connections, want none", n)
+	}
+}
+
+func TestUnknownOptionCriticality(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10)}))
+	addr := startServer(t, s)
+	req := clientRequest{files: []fileDescriptor{{0, "file"}}}
+
+	t.Run("optional", func(t *testing.T) {
+		conn := dialServer(t, addr)
+		defer conn.Close()
+		if err := sendTo(conn, req, option{otype: 0x7F, value: []byte{1}}); err != nil {
+			t.Fatal(err)
+		}
+		readMsg(t, conn, msgServerMetadata)
+	})
+
+	t.Run("critical", func(t *testing.T) {
+		conn := dialServer(t, addr)
+		defer conn.Close()
+		if err := sendTo(conn, req, option{otype: optionCritical | 0x7F, value: []byte{1}}); err != nil {
+			t.Fatal(err)
+		}
+		cl := closeConnection{}
+		if err := cl.UnmarshalBinary(readMsg(t, conn, msgClose)); err != nil {
+			t.Fatal(err)
+		}
+		if cl.reason != unsupportedVersion {
+			t.Errorf("got close reason %v, want %v", cl.reason, unsupportedVersion)
+		}
+		if n := len(s.Connections()); n != 1 {
+			t.Errorf("got %v connections, want only the one of the optional request", n)
+		}
+	})
+}
+
+func TestConnectionMemoryLimit(t *testing.T) {
+	const limit = 8 * 1024
+	s := NewServer()
+	s.MaxConnectionMemory = limit
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(100 * 1024)}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client acknowledges every fourth chunk with a delay
+	received := uint64(0)
+	for ackNum := uint8(1); received < 100; ackNum++ {
+		for i := 0; i < 4 && received < 100; i++ {
+			readMsg(t, conn, msgServerPayload)
+			received++
+		}
+		if ts, ok := s.TransferState(conn.LocalAddr()); !ok {
+			t.Fatal("no state for open connection")
+		} else if ts.Memory > limit {
+			t.Fatalf("connection holds %v bytes, want at most %v", ts.Memory, limit)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if err := sendAckTo(conn, ackNum, clientAck{fileIndex: 0, offset: received}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readMsg(t, conn, msgServerMetadata)
+}
+
+func TestNackOnlyConnectionMemoryLimit(t *testing.T) {
+	const limit = 8 * 1024
+	data := testData(100 * 1024)
+	s := NewServer()
+	s.MaxConnectionMemory = limit
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}, option{otype: optionNackOnly}); err != nil {
+		t.Fatal(err)
+	}
+
+	// NACK-only acks acknowledge nothing, the transfer must not stall at the
+	// limit
+	for received, ackNum := 0, uint8(1); received < 100; received++ {
+		readMsg(t, conn, msgServerPayload)
+		if received%4 != 3 {
+			continue
+		}
+		if ts, ok := s.TransferState(conn.LocalAddr()); !ok {
+			t.Fatal("no state for open connection")
+		} else if ts.Memory > limit {
+			t.Fatalf("connection holds %v bytes, want at most %v", ts.Memory, limit)
+		}
+		if err := sendAckTo(conn, ackNum, clientAck{}); err != nil {
+			t.Fatal(err)
+		}
+		ackNum++
+	}
+
+	// requested chunks are read from the file again
+	nack := clientAck{resendEntries: []*resendEntry{{fileIndex: 0, offset: 10, length: 1}}}
+	if err := sendAckTo(conn, 200, nack); err != nil {
+		t.Fatal(err)
+	}
+	p := &serverPayload{}
+	if err := p.UnmarshalBinary(readMsg(t, conn, msgServerPayload)); err != nil {
+		t.Fatal(err)
+	}
+	if p.offset != 10 || !bytes.Equal(p.data, data[10*1024:11*1024]) {
+		t.Errorf("resent chunk %v with %v bytes, want chunk 10", p.offset, len(p.data))
+	}
+}
+
+func TestNackOnlyStreamWithLimitedMemory(t *testing.T) {
+	for _, limit := range []string{"MaxConnectionMemory", "MaxMemory"} {
+		limit := limit
+		t.Run(limit, func(t *testing.T) {
+			s := NewServer()
+			if limit == "MaxMemory" {
+				s.MaxMemory = 8 * 1024
+			} else {
+				s.MaxConnectionMemory = 8 * 1024
+			}
+			testNackOnlyStreamWithLimitedMemory(t, s)
+		})
+	}
+}
+
+func testNackOnlyStreamWithLimitedMemory(t *testing.T, s *Server) {
+	s.SetFileHandler(func(context.Context, string) (*io.SectionReader, error) {
+		return io.NewSectionReader(bytes.NewReader(testData(4096)), 0, UnknownSize), nil
+	})
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "stream"}}}, option{otype: optionNackOnly}); err != nil {
+		t.Fatal(err)
+	}
+	cl := &closeConnection{}
+	if err := cl.UnmarshalBinary(readMsg(t, conn, msgClose)); err != nil {
+		t.Fatal(err)
+	}
+	if cl.reason != applicationClosed {
+		t.Errorf("got close reason %v, want %v", cl.reason, applicationClosed)
+	}
+}
+
+func TestChecksumCoversExactBytes(t *testing.T) {
+	for _, size := range []int{3 * 1024, 3*1024 + 5} {
+		t.Run(fmt.Sprintf("size=%v", size), func(t *testing.T) {
+			data := testData(size)
+			req := &clientRequest{files: []fileDescriptor{{0, "file"}}}
+			w, msgs := captureWriter()
+			c := newTestClientConnection(req, w)
+			defer c.cleaner.close()
+			go c.getResponse(bytesHandler(map[string][]byte{"file": data}))
+
+			received := []byte{}
+			payloads := 0
+			for {
+				select {
+				case msg := <-msgs:
+					switch m := msg.(type) {
+					case *serverPayload:
+						if len(m.data) == 0 {
+							t.Errorf("empty payload at offset %v", m.offset)
+						}
+						payloads++
+						received = append(received, m.data...)
+						continue
+					case *serverMetaData:
+						if want := (size + 1023) / 1024; payloads != want {
+							t.Errorf("sent %v payloads, want %v", payloads, want)
+						}
+						if !bytes.Equal(received, data) {
+							t.Errorf("sent %v bytes differing from file", len(received))
+						}
+						if sum := md5.Sum(data); !bytes.Equal(m.checkSum, sum[:]) {
+							t.Errorf("got checksum %x, want %x", m.checkSum, sum)
+						}
+						if m.size != uint64(size) {
+							t.Errorf("got size %v, want %v", m.size, size)
+						}
+						return
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatal("timeout waiting for response")
+				}
+			}
+		})
+	}
+}
+
+func TestNackOnlyUnderLoss(t *testing.T) {
+	data := testData(50*1024 + 17)
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"a": data, "b": data[:3000]}))
+	addr := startServer(t, s)
+
+	conn := NewUDPConnection()
+	conn.LossSim(NewSeededMarkovLossSimulator(0.3, 0.5, rand.NewSource(1)))
+	c := Client{Conn: conn, NackOnly: true}
+	rs, err := c.Request(addr, []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range [][]byte{data, data[:3000]} {
+		got, err := ioutil.ReadAll(rs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) || rs[i].Err != nil {
+			t.Errorf("file %v: received %v of %v bytes: %v", i, len(got), len(want), rs[i].Err)
+		}
+	}
+
+	// the client confirms the end of the transfer
+	deadline := time.Now().Add(2 * time.Second)
+	for len(s.Connections()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection not closed after the transfer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// shortReaderAt returns at most max bytes per read without an error.
+type shortReaderAt struct {
+	data []byte
+	max  int
+}
+
+func (r *shortReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) > r.max {
+		p = p[:r.max]
+	}
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+func TestShortReadsFillChunks(t *testing.T) {
+	data := testData(5*1024 + 100)
+	req := &clientRequest{files: []fileDescriptor{{0, "file"}}}
+	w, msgs := captureWriter()
+	c := newTestClientConnection(req, w)
+	defer c.cleaner.close()
+	go c.getResponse(func(context.Context, string) (*io.SectionReader, error) {
+		return io.NewSectionReader(&shortReaderAt{data: data, max: 300}, 0, int64(len(data))), nil
+	})
+
+	received := []byte{}
+	for {
+		select {
+		case msg := <-msgs:
+			switch m := msg.(type) {
+			case *serverPayload:
+				if m.offset != uint64(len(received)/1024) {
+					t.Fatalf("payload at offset %v after %v bytes", m.offset, len(received))
+				}
+				if m.offset < 5 && len(m.data) != 1024 {
+					t.Errorf("payload at offset %v has %v bytes, want 1024", m.offset, len(m.data))
+				}
+				received = append(received, m.data...)
+			case *serverMetaData:
+				if !bytes.Equal(received, data) {
+					t.Errorf("sent %v bytes differing from file", len(received))
+				}
+				if sum := md5.Sum(data); !bytes.Equal(m.checkSum, sum[:]) {
+					t.Errorf("got checksum %x, want %x", m.checkSum, sum)
+				}
+				return
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for response")
+		}
+	}
+}
+
+func TestConnectionIDMigration(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10 * 1024)}))
+	addr := startServer(t, s)
+
+	id := option{otype: optionConnectionID, value: []byte("12345678")}
+	before := dialServer(t, addr)
+	defer before.Close()
+	if err := sendTo(before, clientRequest{files: []fileDescriptor{{0, "file"}}}, id); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, before, msgServerPayload)
+
+	// the NAT maps the client to a new port
+	after := dialServer(t, addr)
+	defer after.Close()
+	if err := sendAckTo(after, 1, clientAck{fileIndex: 0, offset: 4}, id); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		addrs := s.Connections()
+		if len(addrs) != 1 {
+			t.Fatalf("got connections %v, want 1", addrs)
+		}
+		if addrs[0].String() == after.LocalAddr().String() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection stayed at %v, want %v", addrs[0], after.LocalAddr())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := s.CloseConnection(after.LocalAddr(), "maintenance"); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, after, msgClose)
+}
+
+func TestConnectionIDVaryingSourcePorts(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(20 * 1024)}))
+	addr := startServer(t, s)
+
+	// a load balancer maps each packet of the client to another port
+	ports := make([]*net.UDPConn, 3)
+	for i := range ports {
+		ports[i] = dialServer(t, addr)
+		defer ports[i].Close()
+	}
+	waitForPort := func(conn *net.UDPConn) {
+		deadline := time.Now().Add(time.Second)
+		for {
+			addrs := s.Connections()
+			if len(addrs) != 1 {
+				t.Fatalf("got connections %v, want 1", addrs)
+			}
+			if addrs[0].String() == conn.LocalAddr().String() {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("connection stayed at %v, want %v", addrs[0], conn.LocalAddr())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	id := option{otype: optionConnectionID, value: []byte("12345678")}
+	req := clientRequest{files: []fileDescriptor{{0, "file"}}}
+	if err := sendTo(ports[0], req, id); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, ports[0], msgServerPayload)
+
+	// the repeated request is answered at its port
+	if err := sendTo(ports[1], req, id); err != nil {
+		t.Fatal(err)
+	}
+	waitForPort(ports[1])
+
+	if err := sendAckTo(ports[2], 1, clientAck{
+		fileIndex:     0,
+		offset:        2,
+		resendEntries: []*resendEntry{{0, 2, 1}},
+	}, id); err != nil {
+		t.Fatal(err)
+	}
+	waitForPort(ports[2])
+	for {
+		p := serverPayload{}
+		if err := p.UnmarshalBinary(readMsg(t, ports[2], msgServerPayload)); err != nil {
+			t.Fatal(err)
+		}
+		if p.offset == 2 {
+			break
+		}
+	}
+}
+
+func TestConnectionIDMigrationNeedsNewerAck(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(100 * 1024)}))
+	addr := startServer(t, s)
+	connectedTo := func(conn *net.UDPConn) bool {
+		addrs := s.Connections()
+		return len(addrs) == 1 && addrs[0].String() == conn.LocalAddr().String()
+	}
+
+	id := option{otype: optionConnectionID, value: []byte("12345678")}
+	client := dialServer(t, addr)
+	defer client.Close()
+	if err := sendTo(client, clientRequest{files: []fileDescriptor{{0, "file"}}}, id); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, client, msgServerPayload)
+	if err := sendAckTo(client, 5, clientAck{fileIndex: 0, offset: 1}, id); err != nil {
+		t.Fatal(err)
+	}
+
+	// replayed acks and requests don't move the connection
+	attacker := dialServer(t, addr)
+	defer attacker.Close()
+	if err := sendTo(attacker, clientRequest{files: []fileDescriptor{{0, "file"}}}, id); err != nil {
+		t.Fatal(err)
+	}
+	for _, ackNum := range []uint8{5, 4} {
+		if err := sendAckTo(attacker, ackNum, clientAck{fileIndex: 0, offset: 1}, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !connectedTo(client) {
+		t.Fatalf("connection moved to %v by replayed packets", s.Connections())
+	}
+
+	// a newer ack does
+	moved := dialServer(t, addr)
+	defer moved.Close()
+	if err := sendAckTo(moved, 6, clientAck{fileIndex: 0, offset: 2}, id); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !connectedTo(moved) {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection stayed at %v, want %v", s.Connections(), moved.LocalAddr())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectionIDOfWrongSize(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10 * 1024)}))
+	addr := startServer(t, s)
+
+	// IDs of the wrong size are ignored, so the connections are told apart by
+	// their addresses
+	id := option{otype: optionConnectionID, value: []byte("1234")}
+	for i := 0; i < 2; i++ {
+		conn := dialServer(t, addr)
+		defer conn.Close()
+		if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}, id); err != nil {
+			t.Fatal(err)
+		}
+		readMsg(t, conn, msgServerPayload)
+	}
+	if addrs := s.Connections(); len(addrs) != 2 {
+		t.Errorf("got connections %v, want 2", addrs)
+	}
+}
+
+func TestConnectionIDSharedAddress(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10 * 1024)}))
+	addr := startServer(t, s)
+
+	// two clients behind the same address
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	a := option{otype: optionConnectionID, value: []byte("aaaaaaaa")}
+	b := option{otype: optionConnectionID, value: []byte("bbbbbbbb")}
+	for _, id := range []option{a, b} {
+		if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForConnections := func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for len(s.Connections()) != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("got %v connections, want %v", len(s.Connections()), n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForConnections(2)
+
+	if err := sendTo(conn, closeConnection{reason: donwloadFinished}, a); err != nil {
+		t.Fatal(err)
+	}
+	waitForConnections(1)
+}
+
+func TestConnectionIDFromRand(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(4 * 1024)}))
+	addr := startServer(t, s)
+
+	// clients with the same seed choose the same ID
+	ids := make([][]byte, 2)
+	for i := range ids {
+		c := Client{Conn: NewUDPConnection(), ConnectionID: true, Rand: rand.New(rand.NewSource(1))}
+		rs, err := c.Request(addr, []string{"file"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(rs[0]); err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = c.id
+	}
+	want := make([]byte, connectionIDSize)
+	rand.New(rand.NewSource(1)).Read(want)
+	for i, id := range ids {
+		if !bytes.Equal(id, want) {
+			t.Errorf("client %v chose ID %x, want %x", i, id, want)
+		}
+	}
+}
+
+func TestRejectKeepsSharedAddress(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10 * 1024)}))
+	addr := startServer(t, s)
+
+	// a client with an ID and one without behind the same address
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	id := option{otype: optionConnectionID, value: []byte("aaaaaaaa")}
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}, id); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, conn, msgServerPayload)
+
+	if err := sendTo(conn, clientRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, conn, msgClose)
+	time.Sleep(50 * time.Millisecond)
+	if addrs := s.Connections(); len(addrs) != 1 {
+		t.Errorf("got connections %v, want the one with ID", addrs)
+	}
+}
+
+func TestMaxConcurrentFiles(t *testing.T) {
+	const limit = 2
+	files := map[string][]byte{}
+	names := []string{}
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprintf("file%v", i)
+		files[name] = testData(3000 + i)
+		names = append(names, name)
+	}
+
+	s := NewServer()
+	var lock sync.Mutex
+	opened := []string{}
+	active := 0
+	handler := bytesHandler(files)
+	s.SetFileHandler(func(ctx context.Context, name string) (*io.SectionReader, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		opened = append(opened, name)
+		for _, addr := range s.Connections() {
+			if ts, ok := s.TransferState(addr); ok && ts.ActiveFiles > active {
+				active = ts.ActiveFiles
+			}
+		}
+		return handler(ctx, name)
+	})
+	s.MaxConcurrentFiles = limit
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	rs, err := c.Request(addr, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range rs {
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, files[names[i]]) || r.Err != nil {
+			t.Errorf("file %v: received %v of %v bytes: %v", i, len(got), len(files[names[i]]), r.Err)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if active > limit {
+		t.Errorf("%v files in transfer, want at most %v", active, limit)
+	}
+	if strings.Join(opened, ",") != strings.Join(names, ",") {
+		t.Errorf("opened files %v, want %v", opened, names)
+	}
+}
+
+func TestMaxConcurrentFilesNackOnly(t *testing.T) {
+	s := NewServer()
+	s.MaxConcurrentFiles = 2
+	var lock sync.Mutex
+	opened := 0
+	handler := bytesHandler(map[string][]byte{"a": testData(3000), "b": testData(3001), "c": testData(3002)})
+	s.SetFileHandler(func(ctx context.Context, name string) (*io.SectionReader, error) {
+		lock.Lock()
+		opened++
+		lock.Unlock()
+		return handler(ctx, name)
+	})
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	req := clientRequest{files: []fileDescriptor{{0, "a"}, {0, "b"}, {0, "c"}}}
+	if err := sendTo(conn, req, option{otype: optionNackOnly}); err != nil {
+		t.Fatal(err)
+	}
+	cl := &closeConnection{}
+	if err := cl.UnmarshalBinary(readMsg(t, conn, msgClose)); err != nil {
+		t.Fatal(err)
+	}
+	if cl.reason != unknownRequest {
+		t.Errorf("got close reason %v, want %v", cl.reason, unknownRequest)
+	}
+	lock.Lock()
+	if opened != 0 {
+		t.Errorf("opened %v files of a rejected request", opened)
+	}
+	lock.Unlock()
+
+	// requests within the limit are transferred
+	c := Client{Conn: NewUDPConnection(), NackOnly: true}
+	rs, err := c.Request(addr, []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range rs {
+		if got, err := ioutil.ReadAll(r); err != nil || len(got) != 3000+i {
+			t.Errorf("file %v: received %v bytes: %v", i, len(got), err)
+		}
+	}
+}
+
+func TestRewriteName(t *testing.T) {
+	data := testData(5*1024 + 7)
+	s := NewServer()
+	s.Rewrite = func(_ context.Context, name string) (string, error) {
+		if name == "latest" {
+			return "v1.2.3.bin", nil
+		}
+		return name, nil
+	}
+	s.SetFileHandler(bytesHandler(map[string][]byte{"v1.2.3.bin": data, "v1.0.0.bin": data[:10]}))
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	rs, err := c.Request(addr, []string{"latest", "v1.0.0.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range [][]byte{data, data[:10]} {
+		got, err := ioutil.ReadAll(rs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) || rs[i].Err != nil {
+			t.Errorf("file %v: received %v of %v bytes: %v", i, len(got), len(want), rs[i].Err)
+		}
+	}
+	if rs[0].Name != "latest" || rs[0].CanonicalName() != "v1.2.3.bin" {
+		t.Errorf("got name %q and canonical name %q, want %q and %q",
+			rs[0].Name, rs[0].CanonicalName(), "latest", "v1.2.3.bin")
+	}
+	if name := rs[1].CanonicalName(); name != "v1.0.0.bin" {
+		t.Errorf("got canonical name %q of a file, which wasn't rewritten", name)
+	}
+}
+
+func TestRewriteNameTooLong(t *testing.T) {
+	data := testData(1024)
+	s := NewServer()
+	s.Rewrite = func(_ context.Context, name string) (string, error) {
+		return strings.Repeat("a", maxNameSize+1), nil
+	}
+	s.SetFileHandler(bytesHandler(map[string][]byte{"latest": data}))
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	rs, err := c.Request(addr, []string{"latest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rs[0])
+	if err != nil || !bytes.Equal(got, data) || rs[0].Err != nil {
+		t.Fatalf("received %v of %v bytes: %v, %v", len(got), len(data), err, rs[0].Err)
+	}
+	if name := rs[0].CanonicalName(); name != "latest" {
+		t.Errorf("got canonical name of %v bytes, want the requested name", len(name))
+	}
+}
+
+func TestMaxTransferDuration(t *testing.T) {
+	const limit = 300 * time.Millisecond
+	s := NewServer()
+	s.MaxTransferDuration = limit
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(1000 * 1024)}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	start := time.Now()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client keeps acknowledging a chunk at a time
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for ackNum := uint8(1); ; ackNum++ {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				sendAckTo(conn, ackNum, clientAck{fileIndex: 0, offset: uint64(ackNum)})
+			}
+		}
+	}()
+
+	cl := closeConnection{}
+	if err := cl.UnmarshalBinary(readMsg(t, conn, msgClose)); err != nil {
+		t.Fatal(err)
+	}
+	if cl.reason != timeout {
+		t.Errorf("got close reason %v, want %v", cl.reason, timeout)
+	}
+	if elapsed := time.Since(start); elapsed < limit || elapsed > 3*limit {
+		t.Errorf("connection closed after %v, want %v", elapsed, limit)
+	}
+}
+
+func TestMisdirectedMessageClosesConnection(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10)}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, conn, msgServerMetadata)
+
+	// a server pointed at this one would send its payload
+	if err := sendTo(conn, serverPayload{fileIndex: 0, offset: 0, data: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	cl := closeConnection{}
+	if err := cl.UnmarshalBinary(readMsg(t, conn, msgClose)); err != nil {
+		t.Fatal(err)
+	}
+	if cl.reason != unknownRequest {
+		t.Errorf("got close reason %v, want %v", cl.reason, unknownRequest)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(s.Connections()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(s.Connections()); n != 0 {
+		t.Errorf("got %v connections after the misdirected message, want 0", n)
+	}
+}
+
+func TestEmptyRequestRejected(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10)}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	cl := closeConnection{}
+	if err := cl.UnmarshalBinary(readMsg(t, conn, msgClose)); err != nil {
+		t.Fatal(err)
+	}
+	if cl.reason != unknownRequest {
+		t.Errorf("got close reason %v, want %v", cl.reason, unknownRequest)
+	}
+	if n := len(s.Connections()); n != 0 {
+		t.Errorf("got %v connections after an empty request, want 0", n)
+	}
+}
+
+func TestInvalidRequestKeepsConnection(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10 * 1024)}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, conn, msgServerPayload)
+
+	// a retransmitted request, which lost its files or carries a bad option
+	if err := sendTo(conn, clientRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	bad := option{otype: optionChecksums, value: []byte{1, 2}}
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}, bad); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(s.Connections()); n != 1 {
+		t.Errorf("got %v connections after invalid requests, want the open one", n)
+	}
+	readMsg(t, conn, msgServerMetadata)
+}
+
+func TestConnectionKeyIgnoringPort(t *testing.T) {
+	s := NewServer()
+	s.ConnectionKey = func(addr *net.UDPAddr) string { return addr.IP.String() }
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(4 * 1024)}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, conn, msgServerMetadata)
+
+	// the client continues from another port, e.g. after a NAT rebinding
+	rebound := dialServer(t, addr)
+	defer rebound.Close()
+	ack := clientAck{
+		fileIndex:     0,
+		offset:        0,
+		resendEntries: []*resendEntry{{fileIndex: 0, offset: 0, length: 1}},
+	}
+	if err := sendAckTo(rebound, 1, ack); err != nil {
+		t.Fatal(err)
+	}
+	pl := serverPayload{}
+	if err := pl.UnmarshalBinary(readMsg(t, rebound, msgServerPayload)); err != nil {
+		t.Fatal(err)
+	}
+	if pl.offset != 0 {
+		t.Errorf("got chunk %v at the new port, want 0", pl.offset)
+	}
+
+	addrs := s.Connections()
+	if len(addrs) != 1 || addrs[0].String() != rebound.LocalAddr().String() {
+		t.Errorf("got connections %v, want %v", addrs, rebound.LocalAddr())
+	}
+}
+
+func TestMalformedRequestCreatesNoConnection(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10)}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	// announces a file descriptor, which is missing
+	if _, err := conn.Write([]byte{msgClientRequest | 1<<4, 0, 0, 0, 0, 0, 0, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	cl := closeConnection{}
+	if err := cl.UnmarshalBinary(readMsg(t, conn, msgClose)); err != nil {
+		t.Fatal(err)
+	}
+	if cl.reason != unknownRequest {
+		t.Errorf("got close reason %v, want %v", cl.reason, unknownRequest)
+	}
+	if n := len(s.Connections()); n != 0 {
+		t.Errorf("got %v connections after a malformed request, want 0", n)
+	}
+}
+
+func TestMalformedAckAndCloseDropped(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": testData(10 * 1024)}))
+	addr := startServer(t, s)
+
+	conn := dialServer(t, addr)
+	defer conn.Close()
+	if err := sendTo(conn, clientRequest{files: []fileDescriptor{{0, "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+	readMsg(t, conn, msgServerMetadata)
+
+	// an ack of 4 chunks followed by a partial resend entry
+	ack, err := marshalMsg(1, clientAck{fileIndex: 0, offset: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(append(ack, 0, 0, 0, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	// a close without reason
+	if _, err := conn.Write([]byte{msgClose | 1<<4, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ts, ok := s.TransferState(conn.LocalAddr())
+	if !ok {
+		t.Fatal("malformed close closed the connection")
+	}
+	if f := ts.Files[0].Frontier; f != 0 {
+		t.Errorf("malformed ack moved the frontier to %v", f)
+	}
+}
+
+// trickleReader returns at most max bytes per read after a short delay, like
+// a slow stream.
+type trickleReader struct {
+	r   io.Reader
+	max int
+}
+
+func (r *trickleReader) Read(p []byte) (int, error) {
+	time.Sleep(100 * time.Microsecond)
+	if len(p) > r.max {
+		p = p[:r.max]
+	}
+	return r.r.Read(p)
+}
+
+func TestTrickleStreamFillsChunks(t *testing.T) {
+	data := testData(3*1024 + 10)
+	req := &clientRequest{files: []fileDescriptor{{0, "file"}}}
+	w, msgs := captureWriter()
+	c := newTestClientConnection(req, w)
+	defer c.cleaner.close()
+	go c.getResponse(func(context.Context, string) (*io.SectionReader, error) {
+		return NewStreamReader(&trickleReader{r: bytes.NewReader(data), max: 100}), nil
+	})
+
+	payloads := []*serverPayload{}
+	for {
+		select {
+		case msg := <-msgs:
+			switch m := msg.(type) {
+			case *serverPayload:
+				payloads = append(payloads, m)
+			case *serverMetaData:
+				if len(payloads) != 4 {
+					t.Fatalf("got %v payloads, want 4", len(payloads))
+				}
+				for i, p := range payloads[:3] {
+					if len(p.data) != 1024 {
+						t.Errorf("payload %v has %v bytes, want 1024", i, len(p.data))
+					}
+				}
+				if n := len(payloads[3].data); n != 10 {
+					t.Errorf("last payload has %v bytes, want 10", n)
+				}
+				if m.size != uint64(len(data)) {
+					t.Errorf("got size %v, want %v", m.size, len(data))
+				}
+				return
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for response")
+		}
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	s := NewServer()
+	s.SetFileHandler(SyntheticFileHandler(1 << 30))
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	rs, err := c.Request(addr, []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received int64
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := rs[0].Read(buf)
+			atomic.AddInt64(&received, int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+	// rate returns the bytes received per second during d.
+	rate := func(d time.Duration) int64 {
+		start := atomic.LoadInt64(&received)
+		time.Sleep(d)
+		return (atomic.LoadInt64(&received) - start) * int64(time.Second) / int64(d)
+	}
+
+	full := rate(500 * time.Millisecond)
+	conns := s.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("got %v connections, want 1", len(conns))
+	}
+	const limit = 8 * 1024
+	if err := s.SetRate(conns[0], limit); err != nil {
+		t.Fatal(err)
+	}
+	// packets in flight and buffered at the client arrive at the old rate
+	time.Sleep(200 * time.Millisecond)
+	capped := rate(time.Second)
+	if full < 4*limit {
+		t.Fatalf("transferred %v B/s at full rate, want more than %v B/s", full, 4*limit)
+	}
+	if capped > limit*3/2 {
+		t.Errorf("transferred %v B/s after capping at %v B/s, %v B/s before", capped, limit, full)
+	}
+	if err := s.SetRate(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, limit); err == nil {
+		t.Error("capped the rate of an unknown connection")
+	}
+}
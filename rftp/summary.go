@@ -0,0 +1,137 @@
+package rftp
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// rateWindow is the interval over which the peak rate of a transfer is
+// measured.
+const rateWindow = 100 * time.Millisecond
+
+// TransferSummary describes a transfer after its connection was closed.
+type TransferSummary struct {
+	Addr net.Addr
+	// Bytes is the number of payload bytes sent, not counting retransmissions.
+	Bytes uint64
+	// Retransmissions is the number of resent chunks.
+	Retransmissions int
+	// Unavailable is the number of requested chunks, which were neither
+	// cached nor readable from their file.
+	Unavailable int
+	Duration    time.Duration
+	// AverageRate and PeakRate are in bytes per second. The peak is measured
+	// over intervals of 100ms.
+	AverageRate uint64
+	PeakRate    uint64
+	RTT         RTTStats
+	// Reason is the reason the connection was closed for.
+	Reason CloseConnectionReason
+}
+
+// RTTStats summarizes the RTT samples of a transfer. A sample is the time
+// between sending a chunk and receiving the first ack, which covers it.
+// Retransmitted chunks are not sampled.
+type RTTStats struct {
+	Samples int
+	Min     time.Duration
+	Mean    time.Duration
+	Max     time.Duration
+}
+
+// String formats s as a single line of key=value pairs.
+func (s TransferSummary) String() string {
+	return fmt.Sprintf(
+		"addr=%v bytes=%v retransmissions=%v unavailable=%v duration=%v avg_rate=%v peak_rate=%v rtt_samples=%v rtt_min=%v rtt_mean=%v rtt_max=%v reason=%q",
+		s.Addr,
+		s.Bytes,
+		s.Retransmissions,
+		s.Unavailable,
+		s.Duration,
+		s.AverageRate,
+		s.PeakRate,
+		s.RTT.Samples,
+		s.RTT.Min,
+		s.RTT.Mean,
+		s.RTT.Max,
+		s.Reason,
+	)
+}
+
+// rttStats accumulates RTT samples.
+type rttStats struct {
+	n        int
+	min, max time.Duration
+	sum      time.Duration
+}
+
+func (r *rttStats) add(rtt time.Duration) {
+	if r.n == 0 || rtt < r.min {
+		r.min = rtt
+	}
+	if rtt > r.max {
+		r.max = rtt
+	}
+	r.sum += rtt
+	r.n++
+}
+
+func (r *rttStats) stats() RTTStats {
+	s := RTTStats{Samples: r.n, Min: r.min, Max: r.max}
+	if r.n > 0 {
+		s.Mean = r.sum / time.Duration(r.n)
+	}
+	return s
+}
+
+// countRate adds n bytes sent at now to the current rate window.
+func (s *transferState) countRate(now time.Time, n uint64) {
+	if now.Sub(s.window) >= rateWindow {
+		s.window = now
+		s.windowBytes = 0
+	}
+	s.windowBytes += n
+	if s.windowBytes > s.peakBytes {
+		s.peakBytes = s.windowBytes
+	}
+}
+
+// closeWith closes the connection for reason. Only the reason of the first
+// call is reported in the summary.
+func (c *clientConnection) closeWith(reason CloseConnectionReason) {
+	c.stateLock.Lock()
+	if !c.state.reasonSet {
+		c.state.reason = reason
+		c.state.reasonSet = true
+	}
+	c.stateLock.Unlock()
+	c.cleaner.close()
+}
+
+// summary returns the summary of the connection's transfer up to now.
+// Connections, which were closed without a reason, timed out.
+func (c *clientConnection) summary() TransferSummary {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	s := TransferSummary{
+		Addr:            c.peer.address(),
+		Bytes:           c.state.bytes,
+		Retransmissions: c.state.retransmissions,
+		Unavailable:     c.state.unavailable,
+		Duration:        c.clock().Now().Sub(c.state.start),
+		RTT:             c.state.rtts.stats(),
+		Reason:          timeout,
+	}
+	if c.state.reasonSet {
+		s.Reason = c.state.reason
+	}
+	if s.Duration > 0 {
+		s.AverageRate = uint64(float64(s.Bytes) / s.Duration.Seconds())
+	}
+	s.PeakRate = c.state.peakBytes * uint64(time.Second/rateWindow)
+	if s.PeakRate < s.AverageRate {
+		s.PeakRate = s.AverageRate
+	}
+	return s
+}
@@ -0,0 +1,44 @@
+package rftp
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+)
+
+// SyntheticFileHandler serves every requested name as a file of size bytes
+// with the content of NewSyntheticReader. It never touches the disk, which
+// makes it useful to benchmark transfers of arbitrary size.
+func SyntheticFileHandler(size int64) FileHandler {
+	return func(context.Context, string) (*io.SectionReader, error) {
+		return NewSyntheticReader(size), nil
+	}
+}
+
+// NewSyntheticReader returns a reader of size deterministic pseudo-random
+// bytes. The content is computed on the fly, so clients can verify received
+// synthetic files by comparing them to a reader of the same size.
+func NewSyntheticReader(size int64) *io.SectionReader {
+	return io.NewSectionReader(syntheticReaderAt{}, 0, size)
+}
+
+// syntheticReaderAt derives each block of 8 bytes from its index.
+type syntheticReaderAt struct{}
+
+func (syntheticReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	var block [8]byte
+	for n := 0; n < len(p); {
+		o := off + int64(n)
+		binary.LittleEndian.PutUint64(block[:], splitmix64(uint64(o/8)))
+		n += copy(p[n:], block[o%8:])
+	}
+	return len(p), nil
+}
+
+// splitmix64 returns the x-th value of the SplitMix64 generator.
+func splitmix64(x uint64) uint64 {
+	z := x*0x9e3779b97f4a7c15 + 0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
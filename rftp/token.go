@@ -0,0 +1,372 @@
+package rftp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"time"
+)
+
+// Resume tokens carry the state of a transfer from one connection to the next,
+// so that clients resume it without tracking what they received, e.g. after a
+// restart. The server issues them to clients, which ask for them, see
+// Client.OnResumeToken, and signs them with Server.ResumeTokenKey. A token is
+// opaque to clients and encoded as
+//
+//	version     uint8
+//	expires     uint64, unix seconds
+//	chunk size  uint16
+//	ID length   uint8
+//	ID          the connection ID of the issuing connection, may be empty
+//	files       8 bytes, digest of the requested names
+//	file count  uint16
+//	offsets     uint64 per file, the chunk offset to resume the file at
+//	MAC         32 bytes, HMAC-SHA256 of all preceding bytes
+const (
+	resumeTokenVersion = 1
+
+	// resumeTokenMACSize is the size of the HMAC-SHA256 ending a token.
+	resumeTokenMACSize = sha256.Size
+	// resumeTokenFilesSize is the size of the digest of the requested names.
+	resumeTokenFilesSize = 8
+
+	// defaultResumeTokenTTL and defaultResumeTokenInterval are the defaults of
+	// Server.ResumeTokenTTL and Server.ResumeTokenInterval.
+	defaultResumeTokenTTL      = 24 * time.Hour
+	defaultResumeTokenInterval = time.Second
+)
+
+var (
+	errInvalidToken = errors.New("invalid resume token")
+	errExpiredToken = fmt.Errorf("%w: expired", errInvalidToken)
+)
+
+// resumeToken is the decoded state carried by a resume token.
+type resumeToken struct {
+	expires   time.Time
+	chunkSize int
+	// id is the connection ID of the issuing connection, if it had one.
+	id string
+	// files is the digest of the requested names, see namesDigest.
+	files []byte
+	// offsets are the chunk offsets to resume the requested files at.
+	offsets []uint64
+}
+
+// namesDigest returns the digest identifying the requested names in tokens.
+func namesDigest(names []string) []byte {
+	h := sha256.New()
+	for _, name := range names {
+		var l [2]byte
+		binary.BigEndian.PutUint16(l[:], uint16(len(name)))
+		h.Write(l[:])
+		h.Write([]byte(name))
+	}
+	return h.Sum(nil)[:resumeTokenFilesSize]
+}
+
+// seal encodes t and signs it with key.
+func (t *resumeToken) seal(key []byte) []byte {
+	b := make([]byte, 0, 14+len(t.id)+resumeTokenFilesSize+2+8*len(t.offsets)+resumeTokenMACSize)
+	b = append(b, resumeTokenVersion)
+	b = appendUint64(b, uint64(t.expires.Unix()))
+	b = append(b, byte(t.chunkSize>>8), byte(t.chunkSize))
+	b = append(b, byte(len(t.id)))
+	b = append(b, t.id...)
+	b = append(b, t.files...)
+	b = append(b, byte(len(t.offsets)>>8), byte(len(t.offsets)))
+	for _, o := range t.offsets {
+		b = appendUint64(b, o)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return mac.Sum(b)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var bs [8]byte
+	binary.BigEndian.PutUint64(bs[:], v)
+	return append(b, bs[:]...)
+}
+
+// openResumeToken verifies token with key and decodes it. It returns an error
+// wrapping errInvalidToken, if the token was tampered with, isn't signed with
+// key or expired before now.
+func openResumeToken(key, token []byte, now time.Time) (*resumeToken, error) {
+	if len(token) < resumeTokenMACSize {
+		return nil, fmt.Errorf("%w: %d bytes", errInvalidToken, len(token))
+	}
+	data, sum := token[:len(token)-resumeTokenMACSize], token[len(token)-resumeTokenMACSize:]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return nil, fmt.Errorf("%w: signature mismatch", errInvalidToken)
+	}
+
+	// The signature is valid, so the token is well formed, unless the key
+	// signed tokens of another version.
+	if len(data) < 12 || data[0] != resumeTokenVersion {
+		return nil, fmt.Errorf("%w: unknown version", errInvalidToken)
+	}
+	t := &resumeToken{}
+	t.expires = time.Unix(int64(binary.BigEndian.Uint64(data[1:9])), 0)
+	t.chunkSize = int(binary.BigEndian.Uint16(data[9:11]))
+	idLen := int(data[11])
+	data = data[12:]
+	if len(data) < idLen+resumeTokenFilesSize+2 {
+		return nil, fmt.Errorf("%w: truncated", errInvalidToken)
+	}
+	t.id = string(data[:idLen])
+	data = data[idLen:]
+	t.files = append([]byte{}, data[:resumeTokenFilesSize]...)
+	count := int(binary.BigEndian.Uint16(data[resumeTokenFilesSize:]))
+	data = data[resumeTokenFilesSize+2:]
+	if len(data) != 8*count {
+		return nil, fmt.Errorf("%w: truncated", errInvalidToken)
+	}
+	t.offsets = make([]uint64, count)
+	for i := range t.offsets {
+		t.offsets[i] = binary.BigEndian.Uint64(data[8*i:])
+	}
+
+	if now.After(t.expires) {
+		return nil, fmt.Errorf("%w at %v", errExpiredToken, t.expires)
+	}
+	return t, nil
+}
+
+// apply sets the offsets of the files of cr to the ones of the token. It
+// returns an error, if cr doesn't request the files the token was issued for.
+func (t *resumeToken) apply(cr *clientRequest) error {
+	names := make([]string, len(cr.files))
+	for i, f := range cr.files {
+		names[i] = f.fileName
+	}
+	if len(names) != len(t.offsets) || !bytes.Equal(namesDigest(names), t.files) {
+		return fmt.Errorf("%w: issued for other files", errInvalidToken)
+	}
+	for i, o := range t.offsets {
+		cr.files[i].offset = o
+	}
+	return nil
+}
+
+// resumeTokenOptions returns the options presenting token in a request. Tokens
+// longer than an option value are split across several options. An empty
+// token asks the server for tokens.
+func resumeTokenOptions(token []byte) []option {
+	os := []option{{otype: optionResumeToken}}
+	if len(token) > 0 {
+		os = os[:0]
+	}
+	for len(token) > 0 {
+		n := len(token)
+		if n > math.MaxUint8 {
+			n = math.MaxUint8
+		}
+		os = append(os, option{otype: optionResumeToken, value: token[:n]})
+		token = token[n:]
+	}
+	return os
+}
+
+// resumeTokenFrom returns the token presented by os and whether os carry
+// resumeToken options at all.
+func resumeTokenFrom(os []option) (token []byte, ok bool) {
+	for _, o := range os {
+		if o.otype == optionResumeToken {
+			token = append(token, o.value...)
+			ok = true
+		}
+	}
+	return token, ok
+}
+
+// resumeTokenMsg carries a resume token issued by the server.
+type resumeTokenMsg struct {
+	token []byte
+}
+
+func (m resumeTokenMsg) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, m.token...), nil
+}
+
+func (m *resumeTokenMsg) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("empty resume token")
+	}
+	m.token = append([]byte{}, data...)
+	return nil
+}
+
+// tokenIssuer issues resume tokens to the client of a connection, which asked
+// for them.
+type tokenIssuer struct {
+	key           []byte
+	ttl, interval time.Duration
+
+	// last is the time the last token was issued at, offsets are the offsets
+	// it carried. Only accessed by writeResponse.
+	last    time.Time
+	offsets []uint64
+}
+
+// newTokenIssuer returns the issuer of the connection requesting cr with os,
+// or nil, if the client didn't ask for tokens or the transfer can't be resumed
+// by one.
+func (s *Server) newTokenIssuer(cr *clientRequest, os []option, params connParams) *tokenIssuer {
+	if _, ok := resumeTokenFrom(os); !ok || s.ResumeTokenKey == nil {
+		return nil
+	}
+	// Offsets don't apply to compressed files and files requested by hash,
+	// acks of selective repeat don't acknowledge chunks and adaptive chunk
+	// sizes don't translate to chunk offsets of a single size.
+	if params.gzip || params.nackOnly || params.digests != nil || s.AdaptiveChunkSize != nil ||
+		len(cr.files) > math.MaxUint16 {
+		s.Logger.Infof("not issuing resume tokens, transfer can't be resumed by one\n")
+		return nil
+	}
+	t := &tokenIssuer{key: s.ResumeTokenKey, ttl: s.ResumeTokenTTL, interval: s.ResumeTokenInterval}
+	if t.ttl <= 0 {
+		t.ttl = defaultResumeTokenTTL
+	}
+	if t.interval <= 0 {
+		t.interval = defaultResumeTokenInterval
+	}
+	return t
+}
+
+// issueResumeToken sends the client a token of the connection's state, if it
+// asked for tokens, the interval since the last one passed and the client
+// acknowledged chunks since.
+func (c *clientConnection) issueResumeToken() {
+	t := c.tokens
+	if t == nil || c.clock().Now().Sub(t.last) < t.interval {
+		return
+	}
+	state := c.connectionState()
+	names := make([]string, len(state.Files))
+	offsets := make([]uint64, len(state.Files))
+	for i, f := range state.Files {
+		names[i] = f.Name
+		offsets[i] = f.Offset + f.Frontier
+	}
+	if uint64sEqual(offsets, t.offsets) {
+		return
+	}
+	// IDs are chosen by clients and may be too long for a token.
+	id := c.id
+	if len(id) > math.MaxUint8 {
+		id = ""
+	}
+	now := c.clock().Now()
+	token := (&resumeToken{
+		expires:   now.Add(t.ttl),
+		chunkSize: c.chunkSize,
+		id:        id,
+		files:     namesDigest(names),
+		offsets:   offsets,
+	}).seal(t.key)
+	t.last, t.offsets = now, offsets
+	if err := sendTo(c.socket, resumeTokenMsg{token: token}); err != nil {
+		c.packetLog.Debugf("failed to send resume token: %v\n", err)
+	}
+}
+
+func uint64sEqual(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// resumeFromToken applies the token presented by os to cr. It returns the
+// chunk size of the token and the key of the connection, which issued it, if
+// it had a connection ID. It returns ok false, if os present no token.
+func (s *Server) resumeFromToken(cr *clientRequest, os []option) (chunkSize int, issuer string, ok bool, err error) {
+	token, _ := resumeTokenFrom(os)
+	if len(token) == 0 {
+		return 0, "", false, nil
+	}
+	if s.ResumeTokenKey == nil {
+		return 0, "", true, errors.New("resume tokens aren't accepted")
+	}
+	t, err := openResumeToken(s.ResumeTokenKey, token, s.clock().Now())
+	if err != nil {
+		return 0, "", true, err
+	}
+	if t.chunkSize < minChunkSize || t.chunkSize > maxChunkSize {
+		return 0, "", true, fmt.Errorf("%w: chunk size %d", errInvalidToken, t.chunkSize)
+	}
+	if err := t.apply(cr); err != nil {
+		return 0, "", true, err
+	}
+	if t.id != "" {
+		issuer = "id:" + t.id
+	}
+	return t.chunkSize, issuer, true, nil
+}
+
+// handleResumeToken passes the tokens of the server to OnResumeToken.
+func (c *Client) handleResumeToken(w io.Writer, p *packet) {
+	m := resumeTokenMsg{}
+	if err := m.UnmarshalBinary(p.data); err != nil {
+		if c.Strict {
+			c.violation(w, p.remoteAddr, p.data, err)
+			return
+		}
+		log.Printf("dropping malformed resume token: %v\n", err)
+		return
+	}
+	if c.OnResumeToken != nil {
+		c.OnResumeToken(m.token)
+	}
+}
+
+// ResumeWithToken requests files like RequestFrom, but resumes them at the
+// offsets carried by token, which the server issued for the same files, see
+// OnResumeToken. The offsets of files are ignored. The server closes the
+// connection with unknownRequest, if it doesn't accept the token, e.g. since
+// it expired. Files, which were complete, resume at their end and transfer
+// no data, streams start over. A connection of the client, which issued the
+// token, is closed by the server, if it's still open and has a connection ID.
+func (c *Client) ResumeWithToken(host string, files []FileRequest, token []byte) ([]*FileResponse, error) {
+	if len(token) == 0 {
+		return nil, errors.New("empty resume token")
+	}
+	c.token = token
+	defer func() { c.token = nil }()
+	return c.RequestFrom(host, files)
+}
+
+// supersede closes the connection issuer, which issued the token presented by
+// the connection key, if it's still open. The client resumed its transfer
+// elsewhere, e.g. after a restart.
+func (s *Server) supersede(issuer, key string) {
+	if issuer == "" || issuer == key {
+		return
+	}
+	s.clientMux.Lock()
+	c, ok := s.clients[issuer]
+	s.clientMux.Unlock()
+	if !ok {
+		return
+	}
+	s.Logger.Infof("connection %v superseded by resumed connection %v\n", issuer, key)
+	c.closeWith(applicationClosed)
+	if err := sendTo(c.socket, closeConnection{reason: applicationClosed},
+		reasonOption(errors.New("superseded by resumed connection"))); err != nil {
+		s.Logger.Infof("failed to send close: %v\n", err)
+	}
+}
@@ -0,0 +1,271 @@
+package rftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResumeWithToken(t *testing.T) {
+	// the stall is aligned to the server's read blocks of 64 chunks
+	const chunks, acked = 300, 128
+	data := testData(chunks * 1024)
+	key := []byte("secret")
+
+	// the first session stalls in the middle of the file
+	var opened int32
+	s := NewServer()
+	s.ResumeTokenKey = key
+	s.ResumeTokenInterval = 10 * time.Millisecond
+	s.SetFileHandler(func(ctx context.Context, name string) (*io.SectionReader, error) {
+		var r io.ReaderAt = bytes.NewReader(data)
+		if atomic.AddInt32(&opened, 1) == 1 {
+			r = &stallingReaderAt{ctx: ctx, data: data, stall: acked * 1024}
+		}
+		return io.NewSectionReader(r, 0, int64(len(data))), nil
+	})
+	addr := startServer(t, s)
+
+	tokens := make(chan []byte, 1024)
+	first := Client{Conn: NewUDPConnection(), ConnectionID: true}
+	first.OnResumeToken = func(token []byte) { tokens <- token }
+	rs, err := first.Request(addr, []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ioutil.ReadAll(rs[0])
+
+	var token []byte
+	deadline := time.After(2 * time.Second)
+	for token == nil {
+		select {
+		case tk := <-tokens:
+			rt, err := openResumeToken(key, tk, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rt.offsets[0] == acked {
+				token = tk
+			}
+		case <-deadline:
+			t.Fatalf("no token at chunk %v", acked)
+		}
+	}
+
+	// the second session starts from scratch, only with the token
+	second := Client{Conn: NewUDPConnection()}
+	rs, err = second.ResumeWithToken(addr, []FileRequest{{Name: "file"}}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rs[0])
+	if err != nil || rs[0].Err != nil {
+		t.Fatalf("resumed transfer failed: %v, %v", err, rs[0].Err)
+	}
+	if !bytes.Equal(got, data[acked*1024:]) || rs[0].Offset() != acked {
+		t.Fatalf("received %v bytes at offset %v, want %v bytes at %v",
+			len(got), rs[0].Offset(), len(data[acked*1024:]), acked)
+	}
+
+	// the server closed the first session, which the second one superseded
+	for {
+		if reason, byServer := first.CloseReason(); reason == applicationClosed && byServer {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("superseded connection not closed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// pausingReaderAt serves data up to stall, and the rest once gate is closed.
+type pausingReaderAt struct {
+	data  []byte
+	stall int64
+	gate  chan struct{}
+}
+
+func (r *pausingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > r.stall {
+		<-r.gate
+	}
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+func TestRejectedResumeKeepsIssuer(t *testing.T) {
+	const chunks, stall = 300, 150
+	data := testData(chunks * 1024)
+	key := []byte("secret")
+	gate := make(chan struct{})
+
+	var rejecting int32
+	s := NewServer()
+	s.ResumeTokenKey = key
+	s.ResumeTokenInterval = 10 * time.Millisecond
+	s.OnRequest = func(addr net.Addr, files []FileRequest) error {
+		if atomic.LoadInt32(&rejecting) == 1 {
+			return errors.New("rejected")
+		}
+		return nil
+	}
+	s.SetFileHandler(func(ctx context.Context, name string) (*io.SectionReader, error) {
+		r := &pausingReaderAt{data: data, stall: stall * 1024, gate: gate}
+		return io.NewSectionReader(r, 0, int64(len(data))), nil
+	})
+	addr := startServer(t, s)
+
+	tokens := make(chan []byte, 1024)
+	first := Client{Conn: NewUDPConnection(), ConnectionID: true}
+	first.OnResumeToken = func(token []byte) { tokens <- token }
+	rs, err := first.Request(addr, []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Conn.cclose(0)
+	received := make(chan []byte, 1)
+	go func() {
+		got, _ := ioutil.ReadAll(rs[0])
+		received <- got
+	}()
+	var token []byte
+	select {
+	case token = <-tokens:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no token issued")
+	}
+
+	// the application rejects the resumed request, so nothing replaces the
+	// first transfer
+	atomic.StoreInt32(&rejecting, 1)
+	second := Client{Conn: NewUDPConnection()}
+	resumed, err := second.ResumeWithToken(addr, []FileRequest{{Name: "file"}}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Conn.cclose(0)
+	failed := make(chan error, 1)
+	go func() {
+		if _, err := ioutil.ReadAll(resumed[0]); err != nil {
+			failed <- err
+			return
+		}
+		failed <- resumed[0].err()
+	}()
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Fatal("reading the rejected resumed file succeeded")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("reading the rejected resumed file did not end")
+	}
+	if reason, byServer := second.CloseReason(); reason != applicationClosed || !byServer {
+		t.Fatalf("resumed request closed with %v, by server %v, want %v by server", reason, byServer, applicationClosed)
+	}
+
+	close(gate)
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, data) || rs[0].err() != nil {
+			t.Fatalf("issuer received %v of %v bytes: %v", len(got), len(data), rs[0].err())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("issuer's transfer did not complete")
+	}
+}
+
+func TestResumeWithInvalidToken(t *testing.T) {
+	key := []byte("secret")
+	s := NewServer()
+	s.ResumeTokenKey = key
+	s.SetFileHandler(bytesHandler(map[string][]byte{"a": testData(4096), "b": testData(4096)}))
+	addr := startServer(t, s)
+
+	valid := (&resumeToken{
+		expires:   time.Now().Add(time.Hour),
+		chunkSize: 1024,
+		files:     namesDigest([]string{"a"}),
+		offsets:   []uint64{2},
+	}).seal(key)
+	tampered := append([]byte{}, valid...)
+	tampered[len(tampered)-resumeTokenMACSize-1] = 1
+
+	for name, tc := range map[string]struct {
+		file  string
+		token []byte
+	}{
+		"tampered":    {"a", tampered},
+		"other files": {"b", valid},
+		"other key":   {"a", (&resumeToken{chunkSize: 1024, files: namesDigest([]string{"a"}), offsets: []uint64{2}}).seal([]byte("other"))},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := Client{Conn: NewUDPConnection()}
+			rs, err := c.ResumeWithToken(addr, []FileRequest{{Name: tc.file}}, tc.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(rs[0])
+			if reason, byServer := c.CloseReason(); reason != unknownRequest || !byServer {
+				t.Errorf("closed with %v, by server %v, want %v by server", reason, byServer, unknownRequest)
+			}
+		})
+	}
+}
+
+func TestOpenResumeToken(t *testing.T) {
+	key := []byte("secret")
+	now := time.Unix(1000, 0)
+	want := &resumeToken{
+		expires:   now.Add(time.Hour),
+		chunkSize: 512,
+		id:        "0123456789abcdef",
+		files:     namesDigest([]string{"a", "b"}),
+		offsets:   []uint64{3, 1 << 40},
+	}
+	token := want.seal(key)
+
+	got, err := openResumeToken(key, token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.expires.Equal(want.expires) || got.chunkSize != want.chunkSize || got.id != want.id ||
+		!bytes.Equal(got.files, want.files) || !uint64sEqual(got.offsets, want.offsets) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if _, err := openResumeToken(key, token, now.Add(2*time.Hour)); !errors.Is(err, errExpiredToken) {
+		t.Errorf("got %v for expired token, want %v", err, errExpiredToken)
+	}
+	for i := range token {
+		tampered := append([]byte{}, token...)
+		tampered[i] ^= 1
+		if _, err := openResumeToken(key, tampered, now); !errors.Is(err, errInvalidToken) {
+			t.Fatalf("got %v with byte %v flipped, want %v", err, i, errInvalidToken)
+		}
+	}
+	if _, err := openResumeToken(key, token[:len(token)-1], now); !errors.Is(err, errInvalidToken) {
+		t.Errorf("got %v for truncated token, want %v", err, errInvalidToken)
+	}
+}
+
+func TestResumeTokenOptions(t *testing.T) {
+	token := testData(600)
+	os := resumeTokenOptions(token)
+	if len(os) != 3 {
+		t.Fatalf("got %v options, want 3", len(os))
+	}
+	if got, ok := resumeTokenFrom(os); !ok || !bytes.Equal(got, token) {
+		t.Errorf("got %x, want %x", got, token)
+	}
+	if got, ok := resumeTokenFrom(resumeTokenOptions(nil)); !ok || len(got) != 0 {
+		t.Errorf("got %x, %v for a token request, want none, true", got, ok)
+	}
+}
@@ -0,0 +1,111 @@
+package rftp
+
+import (
+	"hash"
+	"runtime"
+)
+
+// treeLeafSize is the size in bytes of the leaves of ChecksumTreeMD5.
+const treeLeafSize = 1 << 20
+
+// treeHash hashes consecutive leaves of leafSize bytes each in its own
+// goroutine and combines them, once the sum is requested: The sum is the hash
+// of the concatenated leaf digests, the last leaf may be shorter. A file
+// without content has no leaves, its sum is the hash of nothing. Write only
+// blocks, while all workers are busy, so that hashing large files keeps up
+// with reading them on multicore machines.
+type treeHash struct {
+	newHash  func() hash.Hash
+	leafSize int
+	// workers bounds the leaves hashed at once, and thereby the memory held
+	// by pending leaves.
+	workers chan struct{}
+
+	// buf holds the bytes of the current leaf.
+	buf    []byte
+	leaves []*treeLeaf
+}
+
+// treeLeaf is the digest of a leaf, which is ready once done is closed.
+type treeLeaf struct {
+	done chan struct{}
+	sum  []byte
+}
+
+var _ hash.Hash = (*treeHash)(nil)
+
+// newTreeHash returns a tree hash over leaves of leafSize bytes hashed by
+// newHash, which hashes up to GOMAXPROCS leaves in parallel.
+func newTreeHash(newHash func() hash.Hash, leafSize int) *treeHash {
+	return &treeHash{
+		newHash:  newHash,
+		leafSize: leafSize,
+		workers:  make(chan struct{}, runtime.GOMAXPROCS(0)),
+	}
+}
+
+func (t *treeHash) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if t.buf == nil {
+			t.buf = make([]byte, 0, t.leafSize)
+		}
+		free := t.leafSize - len(t.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		t.buf = append(t.buf, p[:free]...)
+		p = p[free:]
+		if len(t.buf) == t.leafSize {
+			t.hashLeaf(t.buf)
+			t.buf = nil
+		}
+	}
+	return n, nil
+}
+
+// hashLeaf hashes the full leaf b in a new goroutine, once a worker is free.
+func (t *treeHash) hashLeaf(b []byte) {
+	l := &treeLeaf{done: make(chan struct{})}
+	t.leaves = append(t.leaves, l)
+	t.workers <- struct{}{}
+	go func() {
+		defer func() { <-t.workers }()
+		h := t.newHash()
+		h.Write(b)
+		l.sum = h.Sum(nil)
+		close(l.done)
+	}()
+}
+
+// Sum appends the root to b. It waits for the pending leaves and leaves the
+// state unchanged, like all hashes.
+func (t *treeHash) Sum(b []byte) []byte {
+	root := t.newHash()
+	for _, l := range t.leaves {
+		<-l.done
+		root.Write(l.sum)
+	}
+	if len(t.buf) > 0 {
+		h := t.newHash()
+		h.Write(t.buf)
+		root.Write(h.Sum(nil))
+	}
+	return root.Sum(b)
+}
+
+func (t *treeHash) Reset() {
+	for _, l := range t.leaves {
+		<-l.done
+	}
+	t.buf = nil
+	t.leaves = nil
+}
+
+func (t *treeHash) Size() int {
+	return t.newHash().Size()
+}
+
+func (t *treeHash) BlockSize() int {
+	return t.newHash().BlockSize()
+}
@@ -0,0 +1,97 @@
+package rftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"hash"
+	"io/ioutil"
+	"testing"
+)
+
+// treeSum computes the tree hash of data serially.
+func treeSum(data []byte, leafSize int) []byte {
+	root := md5.New()
+	for len(data) > 0 {
+		n := leafSize
+		if n > len(data) {
+			n = len(data)
+		}
+		leaf := md5.Sum(data[:n])
+		root.Write(leaf[:])
+		data = data[n:]
+	}
+	return root.Sum(nil)
+}
+
+func TestTreeHash(t *testing.T) {
+	const leafSize = 1000
+	for _, size := range []int{0, 1, leafSize - 1, leafSize, 2*leafSize + 500, 20 * leafSize} {
+		data := testData(size)
+		want := treeSum(data, leafSize)
+		for _, write := range []int{1, 7, leafSize, 3 * leafSize} {
+			h := newTreeHash(md5.New, leafSize)
+			for rest := data; len(rest) > 0; {
+				n := write
+				if n > len(rest) {
+					n = len(rest)
+				}
+				h.Write(rest[:n])
+				rest = rest[n:]
+			}
+			if got := h.Sum(nil); !bytes.Equal(got, want) {
+				t.Errorf("%v bytes written by %v: got %x, want %x", size, write, got, want)
+			}
+			if got := h.Sum([]byte{1}); !bytes.Equal(got[1:], want) {
+				t.Errorf("%v bytes: second sum %x, want %x", size, got[1:], want)
+			}
+			h.Reset()
+			if got, empty := h.Sum(nil), treeSum(nil, leafSize); !bytes.Equal(got, empty) {
+				t.Errorf("%v bytes: got %x after reset, want %x", size, got, empty)
+			}
+		}
+	}
+}
+
+func TestTreeHashTransfer(t *testing.T) {
+	data := testData(50*1024 + 3)
+	s := NewServer()
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	rs, err := c.RequestFrom(addr, []FileRequest{{Name: "file", Checksum: ChecksumTreeMD5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rs[0])
+	if err != nil || rs[0].Err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("received %v of %v bytes: %v, %v", len(got), len(data), err, rs[0].Err)
+	}
+	if want := treeSum(data, treeLeafSize); !bytes.Equal(rs[0].checksum, want) {
+		t.Errorf("got checksum %x, want %x", rs[0].checksum, want)
+	}
+}
+
+// BenchmarkChecksum compares the wall time of hashing a large file in chunks
+// by flat MD5 and by the MD5 tree hash.
+func BenchmarkChecksum(b *testing.B) {
+	data := testData(64 << 20)
+	for _, bc := range []struct {
+		name    string
+		newHash func() hash.Hash
+	}{
+		{"md5", md5.New},
+		{"md5-tree", func() hash.Hash { return newTreeHash(md5.New, treeLeafSize) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				h := bc.newHash()
+				for off := 0; off < len(data); off += defaultChunkSize {
+					h.Write(data[off : off+defaultChunkSize])
+				}
+				h.Sum(nil)
+			}
+		})
+	}
+}
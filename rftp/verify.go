@@ -0,0 +1,59 @@
+package rftp
+
+import (
+	"fmt"
+	"log"
+)
+
+// verifyOffset returns an error, if p lies beyond the chunks of its file. The
+// number of chunks of compressed files is only known once they were read.
+func (c *clientConnection) verifyOffset(p *serverPayload) error {
+	c.stateLock.Lock()
+	chunks := c.chunks[p.fileIndex]
+	c.stateLock.Unlock()
+	if chunks == 0 || p.offset < chunks {
+		return nil
+	}
+	return fmt.Errorf("payload of file %v at offset %v beyond its %v chunks", p.fileIndex, p.offset, chunks)
+}
+
+// offsetViolation closes the connection in verification mode after the server
+// was about to send a payload beyond its file.
+func (c *clientConnection) offsetViolation(err error) {
+	log.Printf("offset verification failed: %v\n", err)
+	if err := sendTo(c.socket, closeConnection{reason: protocolViolation}, reasonOption(err)); err != nil {
+		log.Printf("failed to send close: %v\n", err)
+	}
+	c.closeWith(protocolViolation)
+}
+
+// verifyOffset returns an error, if the server sent a payload at offset
+// beyond the chunks requested or announced by the file's metadata. Offsets
+// received before the metadata are checked again, once it arrives, see
+// verifyEarly.
+func (f *FileResponse) verifyOffset(offset uint64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.limit > 0 && offset >= f.limit {
+		return fmt.Errorf("payload of file %v at offset %v beyond the %v chunks requested", f.index, offset, f.limit)
+	}
+	if !f.metadata {
+		if offset >= f.early {
+			f.early = offset + 1
+		}
+		return nil
+	}
+	if offset < f.chunks {
+		return nil
+	}
+	return fmt.Errorf("payload of file %v at offset %v beyond its %v chunks", f.index, offset, f.chunks)
+}
+
+// verifyEarly returns an error, if payloads received before the metadata lie
+// beyond the chunks it announces. f.lock must be held.
+func (f *FileResponse) verifyEarly() error {
+	if f.early <= f.chunks {
+		return nil
+	}
+	return fmt.Errorf("payload of file %v at offset %v beyond its %v chunks", f.index, f.early-1, f.chunks)
+}
@@ -0,0 +1,79 @@
+package rftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestVerifyOffsetsCompressed(t *testing.T) {
+	// compressing random data enlarges it, so there are more chunks on the
+	// wire than chunks of the original file
+	data := make([]byte, 20*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	s := NewServer()
+	s.VerifyOffsets = true
+	s.SetFileHandler(bytesHandler(map[string][]byte{"file": data}))
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection(), Gzip: true, VerifyOffsets: true}
+	rs, err := c.Request(addr, []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) || rs[0].Err != nil {
+		t.Errorf("received %v bytes differing from source: %v", len(got), rs[0].Err)
+	}
+}
+
+func TestFileResponseVerifyOffset(t *testing.T) {
+	f := newFileResponse("file", 0, nil)
+	if err := f.verifyOffset(100); err != nil {
+		t.Errorf("rejected offset before the metadata arrived: %v", err)
+	}
+	f.metadata = true
+	f.chunks = 10
+	if err := f.verifyOffset(9); err != nil {
+		t.Error(err)
+	}
+	if err := f.verifyOffset(10); err == nil {
+		t.Error("accepted offset beyond the file's chunks")
+	}
+
+	limited := newFileResponse("file", 0, nil)
+	limited.limit = 5
+	if err := limited.verifyOffset(5); err == nil {
+		t.Error("accepted offset beyond the requested chunks before the metadata arrived")
+	}
+}
+
+func TestFileResponseVerifyEarlyOffsets(t *testing.T) {
+	violations := make(chan error, 1)
+	f := newFileResponse("file", 0, md5.New())
+	f.onViolation = func(err error) { violations <- err }
+	done := make(chan uint16, 1)
+	go f.write(done)
+	go ioutil.ReadAll(f)
+
+	// the payload arrives before the metadata, which announces 10 chunks
+	if err := f.verifyOffset(20); err != nil {
+		t.Fatalf("rejected offset before the metadata arrived: %v", err)
+	}
+	f.mc <- &serverMetaData{size: 10 * 1024}
+	select {
+	case <-violations:
+	case <-time.After(time.Second):
+		t.Fatal("offset beyond the announced chunks not reported")
+	}
+	<-done
+	if f.err() == nil {
+		t.Error("file didn't fail")
+	}
+}
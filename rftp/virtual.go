@@ -0,0 +1,48 @@
+package rftp
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// Generator returns the length bytes of a virtual file, which start at offset.
+// It may return fewer bytes, the rest is requested again, but not none
+// without an error.
+type Generator func(offset int64, length int) ([]byte, error)
+
+// VirtualFile is a file, whose content is computed on demand, e.g. a report.
+type VirtualFile struct {
+	// Size is the declared length of the file in bytes. Offsets passed to
+	// Generate stay within it.
+	Size     int64
+	Generate Generator
+}
+
+// NewVirtualReader returns a reader of the content of f.
+func NewVirtualReader(f VirtualFile) *io.SectionReader {
+	return io.NewSectionReader(generatorReaderAt(f.Generate), 0, f.Size)
+}
+
+// VirtualFileHandler serves the virtual files by their names. Other names are
+// passed to next, if it isn't nil.
+func VirtualFileHandler(files map[string]VirtualFile, next FileHandler) FileHandler {
+	return func(ctx context.Context, name string) (*io.SectionReader, error) {
+		if f, ok := files[name]; ok {
+			return NewVirtualReader(f), nil
+		}
+		if next != nil {
+			return next(ctx, name)
+		}
+		return nil, os.ErrNotExist
+	}
+}
+
+// generatorReaderAt reads from a generator. Reads are bounded by the section
+// reader wrapping it.
+type generatorReaderAt Generator
+
+func (g generatorReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	bs, err := g(off, len(p))
+	return copy(p, bs), err
+}
@@ -0,0 +1,52 @@
+package rftp
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestVirtualFile(t *testing.T) {
+	const size = 10*1024 + 123
+	content := func(off int64) byte {
+		return byte(off*7 + off/1000)
+	}
+	report := VirtualFile{
+		Size: size,
+		// renders at most 700 bytes per call
+		Generate: func(offset int64, length int) ([]byte, error) {
+			if length > 700 {
+				length = 700
+			}
+			bs := make([]byte, length)
+			for i := range bs {
+				bs[i] = content(offset + int64(i))
+			}
+			return bs, nil
+		},
+	}
+	s := NewServer()
+	s.SetFileHandler(VirtualFileHandler(map[string]VirtualFile{"report": report},
+		bytesHandler(map[string][]byte{"static": testData(100)})))
+	addr := startServer(t, s)
+
+	c := Client{Conn: NewUDPConnection()}
+	rs, err := c.Request(addr, []string{"report", "static"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != size || rs[0].Err != nil {
+		t.Fatalf("received %v of %v bytes: %v", len(got), size, rs[0].Err)
+	}
+	for i, b := range got {
+		if b != content(int64(i)) {
+			t.Fatalf("byte %v is %v, want %v", i, b, content(int64(i)))
+		}
+	}
+	if static, err := ioutil.ReadAll(rs[1]); err != nil || len(static) != 100 {
+		t.Errorf("received %v bytes of the static file: %v", len(static), err)
+	}
+}